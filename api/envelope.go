@@ -0,0 +1,126 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EnvelopeVersion is the current version of Envelope
+// Version 0 is the bare RequestMessage, published by the earlier frontends.
+const EnvelopeVersion = 1
+
+// Envelope is the queue message, published by the frontend and received by the engine
+type Envelope struct {
+	// Version is the schema version (EnvelopeVersion)
+	Version int `json:"v"`
+	// ID is the unique ID of the message
+	ID string `json:"id"`
+	// ReceivedAt is the time, when the frontend received the request
+	ReceivedAt time.Time `json:"received_at"`
+	// Client is the authenticated client (API key), empty if unknown
+	Client string `json:"client,omitempty"`
+	// RemoteAddr is the remote IP of the request
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	// TraceParent is the W3C trace context (traceparent header) of the request
+	TraceParent string `json:"traceparent,omitempty"`
+	// Attempt is the number of processing attempts, starting from 1
+	Attempt int `json:"attempt"`
+	// IdempotencyKey is the Idempotency-Key header or the ID of the payload, empty if not set
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Identity is the verified end-user identity, nil if not verified
+	Identity *Identity `json:"identity,omitempty"`
+	// Payload is the request of the client
+	Payload RequestMessage `json:"payload"`
+}
+
+// RequestKey returns the idempotency key, or the message ID, if the client did not set it
+func (envelope *Envelope) RequestKey() string {
+	if envelope.IdempotencyKey != "" {
+		return envelope.IdempotencyKey
+	}
+
+	return envelope.ID
+}
+
+// legacyKeyPrefix is the prefix of the idempotency keys of the version 0 messages without ID
+const legacyKeyPrefix = "v0-sha256:"
+
+// legacyRequestMessage is the version 0 message
+type legacyRequestMessage struct {
+	RequestMessage
+	Identity *Identity `json:"identity,omitempty"`
+}
+
+// NewEnvelope makes an envelope with a new ID
+func NewEnvelope(payload RequestMessage, receivedAt time.Time) (Envelope, error) {
+	id, err := NewMessageID()
+	if err != nil {
+		return Envelope{}, err
+	}
+
+	return Envelope{
+		Version:    EnvelopeVersion,
+		ID:         id,
+		ReceivedAt: receivedAt.UTC(),
+		Attempt:    1,
+		Payload:    payload,
+	}, nil
+}
+
+// NewMessageID returns a random UUID (version 4)
+func NewMessageID() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
+
+// ParseEnvelope parses a queue message of the current or an earlier version
+// A version 0 message is wrapped into an envelope without ID. If it has no ID, its idempotency key is derived
+// from its content, so the engines, which receive the same message, detect it as the same request.
+func ParseEnvelope(data []byte) (Envelope, error) {
+	header := struct {
+		Version int `json:"v"`
+	}{}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return Envelope{}, err
+	}
+
+	switch header.Version {
+	case 0:
+		legacy := legacyRequestMessage{}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return Envelope{}, err
+		}
+
+		idempotencyKey := legacy.ID
+		if idempotencyKey == "" {
+			hash := sha256.Sum256(data)
+			idempotencyKey = legacyKeyPrefix + hex.EncodeToString(hash[:])
+		}
+
+		return Envelope{
+			Attempt: 1, IdempotencyKey: idempotencyKey, Identity: legacy.Identity, Payload: legacy.RequestMessage,
+		}, nil
+	case EnvelopeVersion:
+		envelope := Envelope{}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return Envelope{}, err
+		}
+		if envelope.Attempt < 1 {
+			envelope.Attempt = 1
+		}
+
+		return envelope, nil
+	default:
+		return Envelope{}, fmt.Errorf("unsupported message version %d", header.Version)
+	}
+}
@@ -7,12 +7,26 @@ import (
 
 // RequestMessage is the incoming message
 type RequestMessage struct {
+	// ID is the optional idempotency key of the client, retries must have the same ID
+	ID   string `json:"id,omitempty"`
 	From string `json:"from"`
 	Text string `json:"text"`
 }
 
+// Identity is the end-user identity, verified by the frontend
+type Identity struct {
+	// Subject is the verified user (sub claim)
+	Subject string `json:"sub"`
+	Issuer  string `json:"iss,omitempty"`
+	// Method is the verification method (jwt)
+	Method     string    `json:"method"`
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
 // ResponseMessage is the outgoing message
 type ResponseMessage struct {
+	// ID is the unique ID of the response, the client acknowledges the response by it
+	ID   string `json:"id,omitempty"`
 	To   string `json:"to"`
 	Text string `json:"text"`
 }
@@ -22,3 +36,20 @@ type ResponseWithDelay struct {
 	Response ResponseMessage
 	Delay    time.Duration
 }
+
+// DeliveryStatus is the delivery status of a response message
+type DeliveryStatus struct {
+	// ID is the ID of the response (ResponseMessage.ID)
+	ID string `json:"id"`
+	// RequestID is the ID of the envelope of the request
+	RequestID string `json:"request_id,omitempty"`
+	To        string `json:"to"`
+	// Status is queued, sent, acked or failed
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	// Error is the reason of the failed status
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	AckedAt   *time.Time `json:"acked_at,omitempty"`
+}
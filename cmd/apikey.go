@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/apikey"
+)
+
+// nolint:gochecknoglobals
+var apikeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "API keys",
+	Long:  `Manage the API keys of the frontend clients.`,
+}
+
+// nolint:gochecknoglobals
+var apikeyCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Create API key",
+	Long: `Create an API key for the client, which may speak for the UIDs.
+The key is printed only once, only its hash is stored.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		createAPIKey()
+	},
+}
+
+// nolint:gochecknoglobals
+var apikeyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List API keys",
+	Long:  `List the API keys, revoked keys, too.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listAPIKeys()
+	},
+}
+
+// nolint:gochecknoglobals
+var apikeyRevokeCmd = &cobra.Command{
+	Use:   "revoke <key ID>",
+	Short: "Revoke API key",
+	Long:  `Revoke the API key. The key is kept for auditing.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		revokeAPIKey(args[0])
+	},
+}
+
+func init() { // nolint:gochecknoinits
+	RootCmd.AddCommand(apikeyCmd)
+	apikeyCmd.AddCommand(apikeyCreateCmd, apikeyListCmd, apikeyRevokeCmd)
+
+	registerDbOptions(apikeyCmd)
+
+	registerStringOption(apikeyCreateCmd, config.OptAPIKeyClient, config.DefaultAPIKeyClient,
+		"client (tenant) of the API key")
+	registerStringOption(apikeyCreateCmd, config.OptAPIKeyUIDs, config.DefaultAPIKeyUIDs,
+		"UIDs (From), which the API key may speak for (comma separated, * at the end is prefix)")
+	registerStringOption(apikeyCreateCmd, config.OptAPIKeyScopes, config.DefaultAPIKeyScopes,
+		"scopes of the API key (comma separated)")
+	registerStringOption(apikeyCreateCmd, config.OptAPIKeyTTL, config.DefaultAPIKeyTTL,
+		"expiration of the API key, 0 means no expiration")
+}
+
+func createAPIKey() {
+	client := viper.GetString(config.OptAPIKeyClient)
+	uids := viper.GetString(config.OptAPIKeyUIDs)
+	if client == "" || strings.TrimSpace(uids) == "" {
+		logger.Panicf("%s and %s must be set", config.OptAPIKeyClient, config.OptAPIKeyUIDs)
+	}
+
+	var expiresAt *time.Time
+	if ttl := viper.GetDuration(config.OptAPIKeyTTL); ttl > 0 {
+		expires := time.Now().Add(ttl).UTC()
+		expiresAt = &expires
+	}
+
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	key, stored, err := apikey.Create(context.Background(), dbHandler,
+		client, uids, viper.GetString(config.OptAPIKeyScopes), expiresAt)
+	if err != nil {
+		logger.Panic("cannot create API key, ", err)
+	}
+	logger.Infof("Created API key %s for %s", stored.KeyID, stored.Client)
+
+	fmt.Println(key)
+}
+
+func listAPIKeys() {
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	keys, err := dbHandler.ListAPIKeysContext(context.Background())
+	if err != nil {
+		logger.Panic("cannot list API keys, ", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY ID\tCLIENT\tUIDS\tSCOPES\tCREATED\tEXPIRES\tREVOKED") // nolint:errcheck,gosec
+	for k := range keys {
+		key := &keys[k]
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", // nolint:errcheck,gosec
+			key.KeyID, key.Client, key.UIDs, key.Scopes, key.CreatedAt.UTC().Format(time.RFC3339),
+			formatOptionalTime(key.ExpiresAt), formatOptionalTime(key.RevokedAt))
+	}
+	writer.Flush() // nolint:errcheck,gosec
+}
+
+func revokeAPIKey(keyID string) {
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	if err := dbHandler.RevokeAPIKeyContext(context.Background(), keyID, time.Now().UTC()); err != nil {
+		logger.Panic("cannot revoke API key, ", err)
+	}
+	logger.Infof("Revoked API key %s", keyID)
+}
+
+// formatOptionalTime returns "-" for nil
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/crypt"
+	"github.com/pgillich/chat-bot/internal/db"
+	internalLogger "github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+func registerDbOptions(command *cobra.Command) {
+	registerStringOption(command, config.OptDbDriver, config.DefaultDbDriver, "DB driver (postgres, sqlite)")
+	registerStringOption(command, config.OptDbPath, config.DefaultDbPath, "DB file path, used by sqlite driver")
+	registerStringOption(command, config.OptDbHost, config.DefaultDbHost, "DB host")
+	registerStringOption(command, config.OptDbName, config.DefaultDbName, "DB name")
+	registerStringOption(command, config.OptDbUser, config.DefaultDbUser, "DB user")
+	registerStringOption(command, config.OptDbPassword, config.DefaultDbPassword, "DB password")
+
+	registerStringOption(command, config.OptMasterKeyFile, config.DefaultMasterKeyFile,
+		"file of master keys (id:base64key per line, the first is active) for encrypting personal data")
+	registerStringOption(command, config.OptMasterKeys, config.DefaultMasterKeys,
+		"master keys (id:base64key, comma separated, the first is active), if master-key-file is not set")
+}
+
+// newDbHandler makes the DbHandler, with encryption, if master keys are set
+func newDbHandler() db.DbHandler {
+	var dbHandler db.DbHandler
+
+	switch driver := viper.GetString(config.OptDbDriver); driver {
+	case db.DriverPostgres:
+		dbHandler = &db.RealDbHandler{
+			Host:     viper.GetString(config.OptDbHost),
+			Database: viper.GetString(config.OptDbName),
+			User:     viper.GetString(config.OptDbUser),
+			Password: viper.GetString(config.OptDbPassword),
+		}
+	case db.DriverSqlite:
+		dbHandler = &db.SqliteDbHandler{
+			Path: viper.GetString(config.OptDbPath),
+		}
+	default:
+		logger.Panicf("unknown DB driver: %s", driver)
+	}
+
+	if keyRing := loadKeyRing(); keyRing != nil {
+		logger.Infof("Personal data is encrypted, active key: %s", keyRing.ActiveKeyID())
+
+		return &db.EncryptingDbHandler{DbHandler: dbHandler, KeyRing: keyRing}
+	}
+
+	logger.Warning("Personal data is not encrypted, master key is not set")
+
+	return dbHandler
+}
+
+// connectDb connects to the DB for the management commands and the frontend, it must be closed
+func connectDb() db.DbHandler {
+	internalLogger.Init(viper.GetString(config.OptLogLevel))
+
+	dbHandler := newDbHandler()
+	if err := dbHandler.Connect(); err != nil {
+		logger.Panic("cannot connect to DB, ", err)
+	}
+
+	return dbHandler
+}
+
+// newCachingDbHandler wraps dbHandler by a cache, if the cache size is set
+// The cached users are invalidated in the other replicas on Redis
+func newCachingDbHandler(dbHandler db.DbHandler) db.DbHandler {
+	size := viper.GetInt(config.OptUserCacheSize)
+	if size <= 0 {
+		return dbHandler
+	}
+
+	logger.Infof("User cache size: %d", size)
+
+	return &db.CachingDbHandler{
+		DbHandler: dbHandler,
+		Size:      size,
+		TTL:       viper.GetDuration(config.OptUserCacheTTL),
+		Invalidator: &queue.RealCacheInvalidator{
+			Host:    viper.GetString(config.OptRedisHost),
+			Channel: viper.GetString(config.OptRedisInvalidationChannel),
+			Conn:    newRedisConnConfig(),
+		},
+	}
+}
+
+// loadKeyRing returns nil, if master keys are not set
+func loadKeyRing() *crypt.KeyRing {
+	var keyRing *crypt.KeyRing
+	var err error
+
+	if path := viper.GetString(config.OptMasterKeyFile); path != "" {
+		keyRing, err = crypt.LoadKeyRing(path)
+	} else if keys := viper.GetString(config.OptMasterKeys); keys != "" {
+		keyRing, err = crypt.ParseKeyRing(keys)
+	}
+
+	if err != nil {
+		logger.Panic("cannot load master keys, ", err)
+	}
+
+	return keyRing
+}
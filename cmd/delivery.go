@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/pkg/frontend"
+)
+
+// nolint:gochecknoglobals
+var deliveryCmd = &cobra.Command{
+	Use:   "delivery <message ID>",
+	Short: "Delivery status",
+	Long: `Show the delivery status of a response message (queued, sent, acked or failed).
+The message ID is the id field of the callback.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		showDelivery(args[0])
+	},
+}
+
+func init() { // nolint:gochecknoinits
+	RootCmd.AddCommand(deliveryCmd)
+
+	registerDbOptions(deliveryCmd)
+}
+
+func showDelivery(messageID string) {
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	delivery, err := dbHandler.GetDeliveryContext(context.Background(), messageID)
+	if err == db.ErrDeliveryNotFound {
+		logger.Panicf("unknown message ID: %s", messageID)
+	} else if err != nil {
+		logger.Panic("cannot get delivery, ", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(frontend.NewDeliveryStatus(&delivery)) // nolint:errcheck,gosec
+}
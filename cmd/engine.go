@@ -13,7 +13,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/pgillich/chat-bot/config"
-	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
 	"github.com/pgillich/chat-bot/internal/queue"
 	"github.com/pgillich/chat-bot/pkg/engine"
 )
@@ -32,12 +32,77 @@ func init() { // nolint:gochecknoinits
 	RootCmd.AddCommand(engineCmd)
 
 	registerStringOption(engineCmd, config.OptClientEndpoint, config.DefaultClientEndpoint, "client endpoint")
+	registerStringOption(engineCmd, config.OptClientAuth, config.DefaultClientAuth,
+		"authentication of the callbacks: jwt (Authorization: Bearer) or hmac (X-Signature)")
+	registerStringOption(engineCmd, config.OptClientHMACSecret, config.DefaultClientHMACSecret,
+		"shared secret of the HMAC signature, required by hmac authentication")
+	registerStringOption(engineCmd, config.OptRouteCacheTTL, config.DefaultRouteCacheTTL,
+		"max age of a cached callback route (see route command), 0 disables the cache")
+	registerStringOption(engineCmd, config.OptCallbackTimeout, config.DefaultCallbackTimeout,
+		"timeout of a callback request")
+	registerStringOption(engineCmd, config.OptCallbackAttempts, config.DefaultCallbackAttempts,
+		"max number of sending a callback (network error, 5xx or 429 is retried)")
+	registerStringOption(engineCmd, config.OptCallbackBackoff, config.DefaultCallbackBackoff,
+		"delay before the first retry of a callback, doubled by each retry")
+	registerStringOption(engineCmd, config.OptCircuitFailureThreshold, config.DefaultCircuitFailureThreshold,
+		"consecutive callback failures, which open the circuit of an endpoint, 0 disables the circuit breaker")
+	registerStringOption(engineCmd, config.OptCircuitOpenTimeout, config.DefaultCircuitOpenTimeout,
+		"time of the open circuit, before a trial callback")
+	registerStringOption(engineCmd, config.OptOutboxPollInterval, config.DefaultOutboxPollInterval,
+		"period of claiming the due responses from the outbox")
+	registerStringOption(engineCmd, config.OptOutboxLease, config.DefaultOutboxLease,
+		"time of sending a claimed response, before an other engine may send it again")
+	registerStringOption(engineCmd, config.OptOutboxConcurrency, config.DefaultOutboxConcurrency,
+		"max number of responses, which are sent at the same time")
+	registerStringOption(engineCmd, config.OptOutboxMaxAge, config.DefaultOutboxMaxAge,
+		"max age of a response, until it's sent again after a temporary failure (open circuit, network error, 5xx, 429), "+
+			"0 retries without limit")
 	registerStringOption(engineCmd, config.OptRsaKey, config.DefaultRsaKey, "RSA key for JWT")
+	registerStringOption(engineCmd, config.OptRsaKeyDir, config.DefaultRsaKeyDir,
+		"directory of JWT signing keys (*.key, the last one by name signs), reloaded on change or SIGHUP")
+	registerStringOption(engineCmd, config.OptJWKSMaxAge, config.DefaultJWKSMaxAge,
+		"cache max-age of the published JWKS, a new signing key is published at once, but it signs only after it")
+	registerStringOption(engineCmd, config.OptTokenAlgorithm, config.DefaultTokenAlgorithm,
+		"JWT signing algorithm (RS256, ES256 or EdDSA), empty accepts the algorithm of the active key")
+	registerStringOption(engineCmd, config.OptTokenIssuer, config.DefaultTokenIssuer, "iss claim of JWT, empty omits it")
+	registerStringOption(engineCmd, config.OptTokenAudience, config.DefaultTokenAudience,
+		"aud claim of JWT, empty omits it")
+	registerStringOption(engineCmd, config.OptTokenLifetime, config.DefaultTokenLifetime, "expiration of JWT")
+	registerStringOption(engineCmd, config.OptTokenPerRequest, config.DefaultTokenPerRequest,
+		"sign a JWT for each callback with to, iat, jti and body_sha256 claims")
+	registerStringOption(engineCmd, config.OptMessageTimeout, config.DefaultMessageTimeout,
+		"deadline of processing a message")
+	registerStringOption(engineCmd, config.OptUserLockTTL, config.DefaultUserLockTTL,
+		"expiration of the user lock, which serializes the messages of a user across the engines "+
+			"(longer than message-timeout), 0 disables the lock")
+	registerStringOption(engineCmd, config.OptRedisUserLockKey, config.DefaultRedisUserLockKey,
+		"key prefix of the user locks")
 
-	registerStringOption(engineCmd, config.OptDbHost, config.DefaultDbHost, "DB host")
-	registerStringOption(engineCmd, config.OptDbName, config.DefaultDbName, "DB name")
-	registerStringOption(engineCmd, config.OptDbUser, config.DefaultDbUser, "DB user")
-	registerStringOption(engineCmd, config.OptDbPassword, config.DefaultDbPassword, "DB password")
+	registerDbOptions(engineCmd)
+
+	registerStringOption(engineCmd, config.OptUserCacheSize, config.DefaultUserCacheSize,
+		"max number of cached users, 0 disables the cache")
+	registerStringOption(engineCmd, config.OptUserCacheTTL, config.DefaultUserCacheTTL, "max age of a cached user")
+	registerStringOption(engineCmd, config.OptRedisInvalidationChannel, config.DefaultRedisInvalidationChannel,
+		"Redis channel for invalidating cached users in the engine replicas")
+
+	registerStringOption(engineCmd, config.OptUserRetentionDays, config.DefaultUserRetentionDays,
+		"max inactivity of users in days, 0 disables purging")
+	registerStringOption(engineCmd, config.OptDeliveryRetentionDays, config.DefaultDeliveryRetentionDays,
+		"max age of the delivery statuses in days, 0 disables purging")
+	registerStringOption(engineCmd, config.OptOutboxRetentionDays, config.DefaultOutboxRetentionDays,
+		"max age of the sent responses in the outbox in days, 0 disables purging")
+	registerStringOption(engineCmd, config.OptIdempotencyTTL, config.DefaultIdempotencyTTL,
+		"retention of the processed request keys, which detect the redelivered requests "+
+			"(same to the frontend), 0 keeps them for 1h")
+	registerStringOption(engineCmd, config.OptTranscripts, config.DefaultTranscripts,
+		"store the requests and the responses in the transcripts of the users")
+	registerStringOption(engineCmd, config.OptTranscriptRetentionDays, config.DefaultTranscriptRetentionDays,
+		"max age of the transcript entries in days, 0 disables purging")
+	registerStringOption(engineCmd, config.OptRetentionInterval, config.DefaultRetentionInterval,
+		"period of purging, must be positive")
+	registerStringOption(engineCmd, config.OptRetentionDryRun, config.DefaultRetentionDryRun,
+		"only report, what would be purged")
 }
 
 func startEngine() {
@@ -46,22 +111,19 @@ func startEngine() {
 
 	subscriber := &queue.RealRedisSubscriber{
 		Host:           viper.GetString(config.OptRedisHost),
-		Key:            viper.GetString(config.OptRedisKey),
-		User:           viper.GetString(config.OptRedisUser),
 		RequestChannel: viper.GetString(config.OptRedisRequestChannel),
+		Conn:           newRedisConnConfig(),
 	}
 	defer subscriber.Close()
 
-	dbHandler := &db.RealDbHandler{
-		Host:     viper.GetString(config.OptDbHost),
-		Database: viper.GetString(config.OptDbName),
-		User:     viper.GetString(config.OptDbUser),
-		Password: viper.GetString(config.OptDbPassword),
-	}
+	registry := registerInstance("engine")
+	defer registry.Close()
+
+	dbHandler := newCachingDbHandler(newDbHandler())
 	defer dbHandler.Close()
 
 	httpClient := &http.Client{
-		Timeout: time.Second * 10,
+		Timeout: viper.GetDuration(config.OptCallbackTimeout),
 		Transport: &http.Transport{
 			Dial: (&net.Dialer{
 				Timeout: 5 * time.Second,
@@ -75,9 +137,34 @@ func startEngine() {
 
 	server := &http.Server{
 		Addr: viper.GetString(config.OptServiceHostPort),
-		Handler: engine.App(idleConnsClosed, subscriber, dbHandler, httpClient,
-			viper.GetString(config.OptRsaKey),
-			viper.GetString(config.OptClientEndpoint),
+		Handler: engine.App(idleConnsClosed, subscriber, dbHandler, newUserLocker(), httpClient,
+			newSigningKeys(),
+			engine.TokenOptions{
+				Issuer:     viper.GetString(config.OptTokenIssuer),
+				Audience:   viper.GetString(config.OptTokenAudience),
+				Lifetime:   viper.GetDuration(config.OptTokenLifetime),
+				PerRequest: viper.GetBool(config.OptTokenPerRequest),
+			},
+			&engine.CallbackRouter{
+				Routes:   dbHandler,
+				Default:  newClientEndpoint(),
+				CacheTTL: viper.GetDuration(config.OptRouteCacheTTL),
+			},
+			engine.CallbackPolicy{
+				Attempts:         viper.GetInt(config.OptCallbackAttempts),
+				Backoff:          viper.GetDuration(config.OptCallbackBackoff),
+				FailureThreshold: viper.GetInt(config.OptCircuitFailureThreshold),
+				OpenTimeout:      viper.GetDuration(config.OptCircuitOpenTimeout),
+			},
+			engine.OutboxPolicy{
+				PollInterval: viper.GetDuration(config.OptOutboxPollInterval),
+				Lease:        viper.GetDuration(config.OptOutboxLease),
+				Concurrency:  viper.GetInt(config.OptOutboxConcurrency),
+				MaxAge:       viper.GetDuration(config.OptOutboxMaxAge),
+			},
+			viper.GetDuration(config.OptMessageTimeout),
+			viper.GetBool(config.OptTranscripts),
+			newRetentionPolicy(),
 			viper.GetString(config.OptLogLevel),
 		),
 	}
@@ -99,3 +186,73 @@ func startEngine() {
 
 	logger.Info("App closing...")
 }
+
+// newUserLocker makes the user locker on Redis, nil is returned, if it's disabled
+func newUserLocker() queue.Locker {
+	ttl := viper.GetDuration(config.OptUserLockTTL)
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &queue.RealLocker{
+		Host: viper.GetString(config.OptRedisHost),
+		Key:  viper.GetString(config.OptRedisUserLockKey),
+		Conn: newRedisConnConfig(),
+		TTL:  ttl,
+	}
+}
+
+func newSigningKeys() *jwks.SigningKeys {
+	algorithm, err := jwks.ParseAlgorithm(viper.GetString(config.OptTokenAlgorithm))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	return &jwks.SigningKeys{
+		Dir:       viper.GetString(config.OptRsaKeyDir),
+		Path:      viper.GetString(config.OptRsaKey),
+		Algorithm: algorithm,
+		MaxAge:    viper.GetDuration(config.OptJWKSMaxAge),
+	}
+}
+
+func newClientEndpoint() *engine.ClientEndpoint {
+	auth, err := engine.ParseCallbackAuth(viper.GetString(config.OptClientAuth))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	endpoint := &engine.ClientEndpoint{
+		URL:    viper.GetString(config.OptClientEndpoint),
+		Auth:   auth,
+		Secret: []byte(viper.GetString(config.OptClientHMACSecret)),
+	}
+	if err := endpoint.Validate(); err != nil {
+		logger.Panic(err)
+	}
+
+	return endpoint
+}
+
+// newRetentionPolicy makes the retention policy, the interval must be positive
+func newRetentionPolicy() engine.RetentionPolicy {
+	interval := viper.GetDuration(config.OptRetentionInterval)
+	if interval <= 0 {
+		logger.Panicf("%s must be positive: %s", config.OptRetentionInterval, interval)
+	}
+
+	processedRequestAge := viper.GetDuration(config.OptIdempotencyTTL)
+	if processedRequestAge <= 0 {
+		processedRequestAge = config.ProcessedRequestMinAge
+	}
+
+	return engine.RetentionPolicy{
+		UserInactivity:      time.Duration(viper.GetInt(config.OptUserRetentionDays)) * 24 * time.Hour,
+		DeliveryAge:         time.Duration(viper.GetInt(config.OptDeliveryRetentionDays)) * 24 * time.Hour,
+		OutboxAge:           time.Duration(viper.GetInt(config.OptOutboxRetentionDays)) * 24 * time.Hour,
+		ProcessedRequestAge: processedRequestAge,
+		TranscriptAge:       time.Duration(viper.GetInt(config.OptTranscriptRetentionDays)) * 24 * time.Hour,
+		Interval:            interval,
+		DryRun:              viper.GetBool(config.OptRetentionDryRun),
+	}
+}
@@ -11,6 +11,9 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/apikey"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
 	"github.com/pgillich/chat-bot/internal/queue"
 	"github.com/pgillich/chat-bot/pkg/frontend"
 )
@@ -29,6 +32,48 @@ func init() { // nolint:gochecknoinits
 	RootCmd.AddCommand(frontendCmd)
 
 	registerStringOption(frontendCmd, config.OptChatPath, config.DefaultChatPath, "path to chat bot service")
+	registerStringOption(frontendCmd, config.OptRequestTimeout, config.DefaultRequestTimeout,
+		"deadline of handling a request")
+	registerStringOption(frontendCmd, config.OptMaxQueueDepth, config.DefaultMaxQueueDepth,
+		"max number of published, but not yet received messages, 0 disables the limit")
+	registerStringOption(frontendCmd, config.OptRetryAfter, config.DefaultRetryAfter,
+		"Retry-After of the requests, rejected by backpressure")
+
+	registerStringOption(frontendCmd, config.OptUserRateLimit, config.DefaultUserRateLimit,
+		"rate limit of a user (<rate per second>:<burst>), 0 disables the limit")
+	registerStringOption(frontendCmd, config.OptClientRateLimitTiers, config.DefaultClientRateLimitTiers,
+		"rate limits of the client tiers (<tier>=<rate per second>:<burst>, comma separated), "+
+			"not listed clients are in the default tier")
+	registerStringOption(frontendCmd, config.OptClientTiers, config.DefaultClientTiers,
+		"tiers of the clients (<client ID>=<tier>, comma separated)")
+	registerStringOption(frontendCmd, config.OptClientIDHeader, config.DefaultClientIDHeader,
+		"HTTP header of the client ID for rate limiting, set by a trusted proxy (the requests without API key "+
+			"and user JWT), empty disables it")
+	registerStringOption(frontendCmd, config.OptRedisRateLimitKey, config.DefaultRedisRateLimitKey,
+		"Redis key prefix of the rate limit buckets")
+
+	registerStringOption(frontendCmd, config.OptIdempotencyTTL, config.DefaultIdempotencyTTL,
+		"deduplication window of the idempotency keys (Idempotency-Key header or id), 0 disables the deduplication")
+	registerStringOption(frontendCmd, config.OptRedisIdempotencyKey, config.DefaultRedisIdempotencyKey,
+		"Redis key prefix of the idempotency keys")
+
+	registerStringOption(frontendCmd, config.OptRequireAPIKey, config.DefaultRequireAPIKey,
+		"require API key (X-API-Key header), the keys are stored in the DB")
+	registerStringOption(frontendCmd, config.OptDeliveryAPI, config.DefaultDeliveryAPI,
+		"serve the delivery status API (GET /deliveries/<ID>, POST /deliveries/<ID>/ack), the statuses are stored in the DB, "+
+			"it requires --require-api-key or --user-jwks")
+	registerDbOptions(frontendCmd)
+
+	registerStringOption(frontendCmd, config.OptUserJWKS, config.DefaultUserJWKS,
+		"JWKS file or URL for verifying the end-user JWT (Authorization: Bearer, RS256 or ES256), empty disables it")
+	registerStringOption(frontendCmd, config.OptUserJWKSRefresh, config.DefaultUserJWKSRefresh,
+		"reload interval of the JWKS")
+	registerStringOption(frontendCmd, config.OptUserJWTMode, config.DefaultUserJWTMode,
+		"fill: From is filled by the subject (sub) of the end-user JWT, match: a different From is rejected")
+	registerStringOption(frontendCmd, config.OptUserJWTIssuer, config.DefaultUserJWTIssuer,
+		"expected issuer (iss) of the end-user JWT, empty disables the check")
+	registerStringOption(frontendCmd, config.OptUserJWTAudience, config.DefaultUserJWTAudience,
+		"expected audience (aud) of the end-user JWT, empty disables the check")
 }
 
 func startFrontend() {
@@ -37,12 +82,45 @@ func startFrontend() {
 
 	publisher := &queue.RealRedisPublisher{
 		Host:           viper.GetString(config.OptRedisHost),
-		Key:            viper.GetString(config.OptRedisKey),
-		User:           viper.GetString(config.OptRedisUser),
 		RequestChannel: viper.GetString(config.OptRedisRequestChannel),
+		Conn:           newRedisConnConfig(),
+		MaxDepth:       viper.GetInt(config.OptMaxQueueDepth),
 	}
 	defer publisher.Close()
 
+	registry := registerInstance("frontend")
+	defer registry.Close()
+
+	rateLimits := newRateLimits()
+	if rateLimits != nil {
+		defer rateLimits.Limiter.Close()
+	}
+
+	deduplicator := newDeduplicator()
+	if deduplicator != nil {
+		defer deduplicator.Close()
+	}
+
+	userJWT := newUserJWT()
+	if viper.GetBool(config.OptDeliveryAPI) && !viper.GetBool(config.OptRequireAPIKey) && userJWT == nil {
+		logger.Panicf("%s requires %s or %s", config.OptDeliveryAPI, config.OptRequireAPIKey, config.OptUserJWKS)
+	}
+
+	// the API keys and the deliveries are in the same DB
+	var authenticator *apikey.Authenticator
+	var deliveries db.DeliveryStore
+	if viper.GetBool(config.OptRequireAPIKey) || viper.GetBool(config.OptDeliveryAPI) {
+		dbHandler := connectDb()
+		defer dbHandler.Close()
+
+		if viper.GetBool(config.OptRequireAPIKey) {
+			authenticator = &apikey.Authenticator{Keys: dbHandler}
+		}
+		if viper.GetBool(config.OptDeliveryAPI) {
+			deliveries = dbHandler
+		}
+	}
+
 	idleConnsClosed := make(chan struct{})
 	defer close(idleConnsClosed)
 
@@ -50,6 +128,13 @@ func startFrontend() {
 		Addr: viper.GetString(config.OptServiceHostPort),
 		Handler: frontend.App(idleConnsClosed, publisher,
 			viper.GetString(config.OptChatPath),
+			viper.GetDuration(config.OptRequestTimeout),
+			viper.GetDuration(config.OptRetryAfter),
+			rateLimits,
+			authenticator,
+			userJWT,
+			deduplicator,
+			deliveries,
 			viper.GetString(config.OptLogLevel),
 		),
 	}
@@ -71,3 +156,68 @@ func startFrontend() {
 
 	logger.Info("App closing...")
 }
+
+// newRateLimits makes the rate limits on Redis, nil is returned, if no limit is set
+func newRateLimits() *frontend.RateLimits {
+	rateLimits, err := frontend.ParseRateLimits(
+		viper.GetString(config.OptUserRateLimit),
+		viper.GetString(config.OptClientRateLimitTiers),
+		viper.GetString(config.OptClientTiers),
+	)
+	if err != nil {
+		logger.Panic("invalid rate limits, ", err)
+	}
+	if rateLimits == nil {
+		return nil
+	}
+
+	rateLimits.ClientIDHeader = viper.GetString(config.OptClientIDHeader)
+	rateLimits.Limiter = &queue.RealRateLimiter{
+		Host: viper.GetString(config.OptRedisHost),
+		Key:  viper.GetString(config.OptRedisRateLimitKey),
+		Conn: newRedisConnConfig(),
+	}
+
+	return rateLimits
+}
+
+// newDeduplicator makes the deduplicator of the idempotency keys on Redis, nil is returned, if it's disabled
+func newDeduplicator() queue.Deduplicator {
+	ttl := viper.GetDuration(config.OptIdempotencyTTL)
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &queue.RealDeduplicator{
+		Host: viper.GetString(config.OptRedisHost),
+		Key:  viper.GetString(config.OptRedisIdempotencyKey),
+		Conn: newRedisConnConfig(),
+		TTL:  ttl,
+	}
+}
+
+// newUserJWT makes the end-user JWT verifier, nil is returned, if JWKS is not set
+func newUserJWT() *frontend.UserJWT {
+	location := viper.GetString(config.OptUserJWKS)
+	if location == "" {
+		return nil
+	}
+
+	mode, err := frontend.ParseUserJWTMode(viper.GetString(config.OptUserJWTMode))
+	if err != nil {
+		logger.Panic(err)
+	}
+
+	return &frontend.UserJWT{
+		Verifier: &jwks.Verifier{
+			Keys: &jwks.Source{
+				Location:        location,
+				HTTPClient:      &http.Client{Timeout: viper.GetDuration(config.OptRequestTimeout)},
+				RefreshInterval: viper.GetDuration(config.OptUserJWKSRefresh),
+			},
+			Issuer:   viper.GetString(config.OptUserJWTIssuer),
+			Audience: viper.GetString(config.OptUserJWTAudience),
+		},
+		Mode: mode,
+	}
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pgillich/chat-bot/config"
+	internalLogger "github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+// nolint:gochecknoglobals
+var instancesCmd = &cobra.Command{
+	Use:   "instances",
+	Short: "Instances",
+	Long:  `List the live frontend and engine instances, registered in Redis.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listInstances()
+	},
+}
+
+func init() { // nolint:gochecknoinits
+	RootCmd.AddCommand(instancesCmd)
+}
+
+func newInstanceRegistry() *queue.RealInstanceRegistry {
+	return &queue.RealInstanceRegistry{
+		Host: viper.GetString(config.OptRedisHost),
+		Key:  viper.GetString(config.OptRedisKey),
+		Conn: newRedisConnConfig(),
+		TTL:  viper.GetDuration(config.OptInstanceTTL),
+	}
+}
+
+// registerInstance registers this instance with the role, the returned registry must be closed
+func registerInstance(role string) queue.InstanceRegistry {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Panic("cannot get hostname, ", err)
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		logger.Panic("cannot make instance ID, ", err)
+	}
+
+	address := viper.GetString(config.OptServiceHostPort)
+	if host, port, err := net.SplitHostPort(address); err == nil && host == "" {
+		address = net.JoinHostPort(hostname, port)
+	}
+
+	instance := queue.Instance{
+		ID:        hostname + "-" + hex.EncodeToString(suffix),
+		Role:      role,
+		Version:   config.Version,
+		Address:   address,
+		StartedAt: time.Now().UTC(),
+	}
+
+	registry := newInstanceRegistry()
+	if err := registry.Connect(context.Background()); err != nil {
+		logger.Panic("cannot connect to instance registry, ", err)
+	}
+	if err := registry.Register(context.Background(), instance); err != nil {
+		registry.Close()
+		logger.Panic("cannot register instance, ", err)
+	}
+	logger.Infof("Registered instance %s", instance.ID)
+
+	return registry
+}
+
+func listInstances() {
+	internalLogger.Init(viper.GetString(config.OptLogLevel))
+
+	registry := newInstanceRegistry()
+	if err := registry.Connect(context.Background()); err != nil {
+		logger.Panic("cannot connect to instance registry, ", err)
+	}
+	defer registry.Close()
+
+	instances, err := registry.List(context.Background())
+	if err != nil {
+		logger.Panic("cannot list instances, ", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tROLE\tVERSION\tADDRESS\tSTARTED") // nolint:errcheck,gosec
+	for _, instance := range instances {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", // nolint:errcheck,gosec
+			instance.ID, instance.Role, instance.Version, instance.Address, instance.StartedAt.Format(time.RFC3339))
+	}
+	writer.Flush() // nolint:errcheck,gosec
+}
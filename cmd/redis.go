@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"github.com/spf13/viper"
+
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+// newRedisConnConfig makes the topology, AUTH, DB index and TLS config of Redis
+func newRedisConnConfig() queue.ConnConfig {
+	connConfig := queue.ConnConfig{
+		Topology:         viper.GetString(config.OptRedisTopology),
+		SentinelMaster:   viper.GetString(config.OptRedisSentinelMaster),
+		SentinelPassword: viper.GetString(config.OptRedisSentinelPassword),
+		Username:         viper.GetString(config.OptRedisUser),
+		Password:         viper.GetString(config.OptRedisPassword),
+		Database:         viper.GetInt(config.OptRedisDb),
+	}
+	if err := connConfig.Validate(); err != nil {
+		logger.Panic("invalid Redis config, ", err)
+	}
+
+	if viper.GetBool(config.OptRedisTLS) {
+		tlsConfig, err := queue.LoadTLSConfig(
+			viper.GetString(config.OptRedisTLSCaFile),
+			viper.GetString(config.OptRedisTLSCertFile),
+			viper.GetString(config.OptRedisTLSKeyFile),
+		)
+		if err != nil {
+			logger.Panic("cannot load Redis TLS config, ", err)
+		}
+
+		connConfig.TLSConfig = tlsConfig
+	}
+
+	return connConfig
+}
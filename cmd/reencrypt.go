@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/db"
+	internalLogger "github.com/pgillich/chat-bot/internal/logger"
+)
+
+// nolint:gochecknoglobals
+var reencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Reencrypt",
+	Long: `Wrap the data keys of the stored personal data and callback route secrets by the active master key.
+Users and routes, stored without encryption, are encrypted.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		reencrypt()
+	},
+}
+
+func init() { // nolint:gochecknoinits
+	RootCmd.AddCommand(reencryptCmd)
+
+	registerDbOptions(reencryptCmd)
+}
+
+func reencrypt() {
+	internalLogger.Init(viper.GetString(config.OptLogLevel))
+
+	dbHandler, is := newDbHandler().(*db.EncryptingDbHandler)
+	if !is {
+		logger.Panic("master key is not set")
+	}
+
+	if err := dbHandler.Connect(); err != nil {
+		logger.Panic("cannot connect to DB, ", err)
+	}
+	defer dbHandler.Close()
+
+	updated, err := dbHandler.Reencrypt(context.Background())
+	logger.Infof("Reencrypted users and routes: %d", updated)
+
+	if err != nil {
+		logger.Panic("cannot reencrypt, ", err)
+	}
+}
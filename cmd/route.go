@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/pkg/engine"
+)
+
+// nolint:gochecknoglobals
+var routeCmd = &cobra.Command{
+	Use:   "route",
+	Short: "Callback routes",
+	Long: `Manage the callback endpoints of the clients (tenants).
+The responses of a client without route are sent to the default endpoint of the engine.`,
+}
+
+// nolint:gochecknoglobals
+var routeSetCmd = &cobra.Command{
+	Use:   "set <client>",
+	Short: "Set callback route",
+	Long:  `Create or update the callback endpoint of the client (the client of the API key).`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		setRoute(args[0])
+	},
+}
+
+// nolint:gochecknoglobals
+var routeListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List callback routes",
+	Long:  `List the callback routes, without the secrets.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listRoutes()
+	},
+}
+
+// nolint:gochecknoglobals
+var routeDeleteCmd = &cobra.Command{
+	Use:   "delete <client>",
+	Short: "Delete callback route",
+	Long:  `Delete the callback route of the client, its responses are sent to the default endpoint.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteRoute(args[0])
+	},
+}
+
+func init() { // nolint:gochecknoinits
+	RootCmd.AddCommand(routeCmd)
+	routeCmd.AddCommand(routeSetCmd, routeListCmd, routeDeleteCmd)
+
+	registerDbOptions(routeCmd)
+
+	registerStringOption(routeSetCmd, config.OptRouteURL, config.DefaultRouteURL, "callback URL of the client")
+	registerStringOption(routeSetCmd, config.OptRouteAuth, config.DefaultRouteAuth,
+		"authentication of the callbacks: jwt (Authorization: Bearer) or hmac (X-Signature)")
+	registerStringOption(routeSetCmd, config.OptRouteHMACSecret, config.DefaultRouteHMACSecret,
+		"shared secret of the HMAC signature, required by hmac authentication")
+}
+
+func setRoute(client string) {
+	endpoint := &engine.ClientEndpoint{
+		URL:    viper.GetString(config.OptRouteURL),
+		Auth:   viper.GetString(config.OptRouteAuth),
+		Secret: []byte(viper.GetString(config.OptRouteHMACSecret)),
+	}
+	if err := endpoint.Validate(); err != nil {
+		logger.Panic(err)
+	}
+
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	_, err := dbHandler.SetCallbackRouteContext(context.Background(), db.CallbackRoute{
+		Client: client, URL: endpoint.URL, Auth: endpoint.Auth, Secret: string(endpoint.Secret),
+	})
+	if err != nil {
+		logger.Panic("cannot set callback route, ", err)
+	}
+	logger.Infof("Callback route of %s: %s (%s)", client, endpoint.URL, endpoint.Auth)
+}
+
+func listRoutes() {
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	routes, err := dbHandler.ListCallbackRoutesContext(context.Background())
+	if err != nil {
+		logger.Panic("cannot list callback routes, ", err)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "CLIENT\tURL\tAUTH\tSECRET\tUPDATED") // nolint:errcheck,gosec
+	for r := range routes {
+		route := &routes[r]
+		secret := "-"
+		if route.Secret != "" {
+			secret = "set"
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n", // nolint:errcheck,gosec
+			route.Client, route.URL, route.Auth, secret, route.UpdatedAt.UTC().Format(time.RFC3339))
+	}
+	writer.Flush() // nolint:errcheck,gosec
+}
+
+func deleteRoute(client string) {
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	if err := dbHandler.DeleteCallbackRouteContext(context.Background(), client); err != nil {
+		logger.Panic("cannot delete callback route, ", err)
+	}
+	logger.Infof("Deleted callback route of %s", client)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// nolint:gochecknoglobals
+var transcriptCmd = &cobra.Command{
+	Use:   "transcript <UID>",
+	Short: "Transcript of a user",
+	Long: `Show the stored requests and responses of a user, in the order of processing.
+The transcripts are stored by the engine, if --transcripts is set.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		showTranscript(args[0])
+	},
+}
+
+// transcriptEntry is the JSON output of a transcript entry
+type transcriptEntry struct {
+	CreatedAt string `json:"created_at"`
+	RequestID string `json:"request_id,omitempty"`
+	Direction string `json:"direction"`
+	Text      string `json:"text"`
+}
+
+func init() { // nolint:gochecknoinits
+	RootCmd.AddCommand(transcriptCmd)
+
+	registerDbOptions(transcriptCmd)
+}
+
+func showTranscript(uid string) {
+	dbHandler := connectDb()
+	defer dbHandler.Close()
+
+	entries, err := dbHandler.ListTranscriptContext(context.Background(), uid)
+	if err != nil {
+		logger.Panic("cannot get transcript, ", err)
+	}
+
+	output := make([]transcriptEntry, 0, len(entries))
+	for e := range entries {
+		output = append(output, transcriptEntry{
+			CreatedAt: entries[e].CreatedAt.Format(time.RFC3339),
+			RequestID: entries[e].RequestID,
+			Direction: entries[e].Direction,
+			Text:      entries[e].Text,
+		})
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(output) // nolint:errcheck,gosec
+}
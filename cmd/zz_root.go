@@ -19,6 +19,10 @@ var RootCmd = &cobra.Command{ // nolint:gochecknoglobals
 	Use:   "chat-bot",
 	Short: "Sample chat bot",
 	Long:  `Sample chat bot`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// more commands may register the same option, the flags of the running command are used
+		viper.BindPFlags(cmd.Flags()) // nolint:errcheck,gosec
+	},
 }
 
 // nolint:gochecknoglobals
@@ -48,9 +52,29 @@ func init() { // nolint:gochecknoinits
 
 	registerStringOption(RootCmd, config.OptServiceHostPort, config.DefaultServiceHostPort, "host:port listening on")
 
-	registerStringOption(RootCmd, config.OptRedisHost, config.DefaultRedisHost, "URL to Redis server")
-	registerStringOption(RootCmd, config.OptRedisUser, config.DefaultRedisUser, "Redis user name")
-	registerStringOption(RootCmd, config.OptRedisKey, config.DefaultRedisKey, "Redis queue key")
+	registerStringOption(RootCmd, config.OptRedisHost, config.DefaultRedisHost,
+		"URL to Redis server (comma separated Sentinels or Cluster nodes, by redis-topology)")
+	registerStringOption(RootCmd, config.OptRedisTopology, config.DefaultRedisTopology,
+		"Redis topology (standalone, sentinel, cluster)")
+	registerStringOption(RootCmd, config.OptRedisSentinelMaster, config.DefaultRedisSentinelMaster,
+		"master name, monitored by Redis Sentinels")
+	registerStringOption(RootCmd, config.OptRedisSentinelPassword, config.DefaultRedisSentinelPassword,
+		"password of Redis Sentinels")
+	registerStringOption(RootCmd, config.OptRedisUser, config.DefaultRedisUser,
+		"Redis user name, it's the ACL user, if redis-password is set (empty: AUTH without user name)")
+	registerStringOption(RootCmd, config.OptRedisPassword, config.DefaultRedisPassword,
+		"Redis password, it enables AUTH")
+	registerStringOption(RootCmd, config.OptRedisDb, config.DefaultRedisDb, "Redis DB index, only 0 is supported by the cluster topology")
+	registerStringOption(RootCmd, config.OptRedisTLS, config.DefaultRedisTLS, "TLS to Redis")
+	registerStringOption(RootCmd, config.OptRedisTLSCaFile, config.DefaultRedisTLSCaFile,
+		"CA certificate file of Redis server, system CAs are used, if empty")
+	registerStringOption(RootCmd, config.OptRedisTLSCertFile, config.DefaultRedisTLSCertFile,
+		"client certificate file to Redis")
+	registerStringOption(RootCmd, config.OptRedisTLSKeyFile, config.DefaultRedisTLSKeyFile,
+		"client key file to Redis")
+	registerStringOption(RootCmd, config.OptRedisKey, config.DefaultRedisKey, "Redis key of the instance registry")
+	registerStringOption(RootCmd, config.OptInstanceTTL, config.DefaultInstanceTTL,
+		"expiration of an instance registration, refreshed by heartbeat")
 	registerStringOption(RootCmd, config.OptRedisRequestChannel, config.DefaultRedisRequestChannel,
 		"Redis channel name for sending message to worker")
 
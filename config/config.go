@@ -21,36 +21,347 @@ const (
 	// DefaultChatPath is default value to OptChatPath
 	DefaultChatPath = "/chat"
 
+	// OptRequestTimeout is the deadline of handling an incoming HTTP request
+	OptRequestTimeout = "request-timeout"
+	// DefaultRequestTimeout is default value to OptRequestTimeout
+	DefaultRequestTimeout = "5s"
+
+	// OptMaxQueueDepth is the max number of published, but not yet received messages, 0 disables the limit
+	OptMaxQueueDepth = "max-queue-depth"
+	// DefaultMaxQueueDepth is default value to OptMaxQueueDepth
+	DefaultMaxQueueDepth = "100"
+
+	// OptRetryAfter is the Retry-After of the requests, rejected by backpressure
+	OptRetryAfter = "retry-after"
+	// DefaultRetryAfter is default value to OptRetryAfter
+	DefaultRetryAfter = "1s"
+
+	// OptUserRateLimit is the rate limit of a user (<rate per second>:<burst>), 0 disables the limit
+	OptUserRateLimit = "user-rate-limit"
+	// DefaultUserRateLimit is default value to OptUserRateLimit
+	DefaultUserRateLimit = "0"
+
+	// OptClientRateLimitTiers are the rate limits of the client tiers (<tier>=<rate per second>:<burst>, comma separated)
+	// The clients, which are not listed in OptClientTiers, are in the "default" tier
+	OptClientRateLimitTiers = "client-rate-limit-tiers"
+	// DefaultClientRateLimitTiers is default value to OptClientRateLimitTiers
+	DefaultClientRateLimitTiers = ""
+
+	// OptClientTiers are the tiers of the clients (<client ID>=<tier>, comma separated)
+	OptClientTiers = "client-tiers"
+	// DefaultClientTiers is default value to OptClientTiers
+	DefaultClientTiers = ""
+
+	// OptClientIDHeader is the HTTP header of the client ID, set by a trusted proxy, empty disables it
+	OptClientIDHeader = "client-id-header"
+	// DefaultClientIDHeader is default value to OptClientIDHeader
+	DefaultClientIDHeader = ""
+
+	// OptIdempotencyTTL is the deduplication window of the idempotency keys, 0 disables the deduplication
+	OptIdempotencyTTL = "idempotency-ttl"
+	// DefaultIdempotencyTTL is default value to OptIdempotencyTTL
+	DefaultIdempotencyTTL = "24h"
+
+	// OptDeliveryAPI enables the delivery status API of the frontend
+	OptDeliveryAPI = "delivery-api"
+	// DefaultDeliveryAPI is default value to OptDeliveryAPI
+	DefaultDeliveryAPI = "false"
+
+	// OptRequireAPIKey enables the API key authentication of the frontend
+	OptRequireAPIKey = "require-api-key"
+	// DefaultRequireAPIKey is default value to OptRequireAPIKey
+	DefaultRequireAPIKey = "false"
+
+	// OptUserJWKS is the JWKS file or URL for verifying the end-user JWT, empty disables the verification
+	OptUserJWKS = "user-jwks"
+	// DefaultUserJWKS is default value to OptUserJWKS
+	DefaultUserJWKS = ""
+
+	// OptUserJWKSRefresh is the reload interval of the JWKS
+	OptUserJWKSRefresh = "user-jwks-refresh"
+	// DefaultUserJWKSRefresh is default value to OptUserJWKSRefresh
+	DefaultUserJWKSRefresh = "5m"
+
+	// OptUserJWTMode is the binding of From to the subject of the end-user JWT (fill or match)
+	OptUserJWTMode = "user-jwt-mode"
+	// DefaultUserJWTMode is default value to OptUserJWTMode
+	DefaultUserJWTMode = "fill"
+
+	// OptUserJWTIssuer is the expected issuer of the end-user JWT, empty disables the check
+	OptUserJWTIssuer = "user-jwt-issuer"
+	// DefaultUserJWTIssuer is default value to OptUserJWTIssuer
+	DefaultUserJWTIssuer = ""
+
+	// OptUserJWTAudience is the expected audience of the end-user JWT, empty disables the check
+	OptUserJWTAudience = "user-jwt-audience"
+	// DefaultUserJWTAudience is default value to OptUserJWTAudience
+	DefaultUserJWTAudience = ""
+
+	// OptAPIKeyClient is the client (tenant) of a new API key
+	OptAPIKeyClient = "api-key-client"
+	// DefaultAPIKeyClient is default value to OptAPIKeyClient
+	DefaultAPIKeyClient = ""
+
+	// OptAPIKeyUIDs are the UIDs (comma separated, * at the end is prefix), which a new API key may speak for
+	OptAPIKeyUIDs = "api-key-uids"
+	// DefaultAPIKeyUIDs is default value to OptAPIKeyUIDs
+	DefaultAPIKeyUIDs = ""
+
+	// OptAPIKeyScopes are the scopes (comma separated) of a new API key
+	OptAPIKeyScopes = "api-key-scopes"
+	// DefaultAPIKeyScopes is default value to OptAPIKeyScopes
+	DefaultAPIKeyScopes = "chat"
+
+	// OptAPIKeyTTL is the expiration of a new API key, 0 means no expiration
+	OptAPIKeyTTL = "api-key-ttl"
+	// DefaultAPIKeyTTL is default value to OptAPIKeyTTL
+	DefaultAPIKeyTTL = "0"
+
+	// OptRouteURL is the callback URL of the client
+	OptRouteURL = "route-url"
+	// DefaultRouteURL is default value to OptRouteURL
+	DefaultRouteURL = ""
+	// OptRouteAuth is the authentication of the callbacks to the client (jwt or hmac)
+	OptRouteAuth = "route-auth"
+	// DefaultRouteAuth is default value to OptRouteAuth
+	DefaultRouteAuth = "jwt"
+	// OptRouteHMACSecret is the shared secret of the HMAC signature of the callbacks to the client
+	OptRouteHMACSecret = "route-hmac-secret"
+	// DefaultRouteHMACSecret is default value to OptRouteHMACSecret
+	DefaultRouteHMACSecret = ""
+
+	// OptMessageTimeout is the deadline of processing a message by the engine
+	OptMessageTimeout = "message-timeout"
+	// DefaultMessageTimeout is default value to OptMessageTimeout
+	DefaultMessageTimeout = "10s"
+
+	// OptUserLockTTL is the expiration of the user lock of the engine, 0 disables the lock
+	OptUserLockTTL = "user-lock-ttl"
+	// DefaultUserLockTTL is default value to OptUserLockTTL, it's longer than DefaultMessageTimeout
+	DefaultUserLockTTL = "15s"
+
+	// OptUserRetentionDays is the max inactivity of users in days, 0 disables purging
+	OptUserRetentionDays = "user-retention-days"
+	// DefaultUserRetentionDays is default value to OptUserRetentionDays
+	DefaultUserRetentionDays = "0"
+
+	// OptDeliveryRetentionDays is the max age of the delivery statuses in days, 0 disables purging
+	OptDeliveryRetentionDays = "delivery-retention-days"
+	// DefaultDeliveryRetentionDays is default value to OptDeliveryRetentionDays
+	DefaultDeliveryRetentionDays = "30"
+
+	// OptOutboxRetentionDays is the max age of the sent outbox messages in days, 0 disables purging
+	OptOutboxRetentionDays = "outbox-retention-days"
+	// DefaultOutboxRetentionDays is default value to OptOutboxRetentionDays
+	DefaultOutboxRetentionDays = "1"
+
+	// OptTranscripts enables storing the requests and the responses in the transcripts of the users
+	OptTranscripts = "transcripts"
+	// DefaultTranscripts is default value to OptTranscripts
+	DefaultTranscripts = "false"
+
+	// OptTranscriptRetentionDays is the max age of the transcript entries in days, 0 disables purging
+	OptTranscriptRetentionDays = "transcript-retention-days"
+	// DefaultTranscriptRetentionDays is default value to OptTranscriptRetentionDays
+	DefaultTranscriptRetentionDays = "30"
+
+	// OptRetentionInterval is the period of purging, it must be positive
+	OptRetentionInterval = "retention-interval"
+	// DefaultRetentionInterval is default value to OptRetentionInterval
+	DefaultRetentionInterval = "1h"
+
+	// OptRetentionDryRun only reports, what would be purged
+	OptRetentionDryRun = "retention-dry-run"
+	// DefaultRetentionDryRun is default value to OptRetentionDryRun
+	DefaultRetentionDryRun = "false"
+
 	// OptClientEndpoint is the client endpoint
 	OptClientEndpoint = "client-endpoint"
 	// DefaultClientEndpoint is default value to OptClientEndpoint
 	DefaultClientEndpoint = "http://localhost:8089/"
+	// OptClientAuth is the authentication of the callbacks to the client endpoint (jwt or hmac)
+	OptClientAuth = "client-auth"
+	// DefaultClientAuth is default value to OptClientAuth
+	DefaultClientAuth = "jwt"
+	// OptClientHMACSecret is the shared secret of the HMAC signature of the callbacks
+	OptClientHMACSecret = "client-hmac-secret"
+	// DefaultClientHMACSecret is default value to OptClientHMACSecret
+	DefaultClientHMACSecret = ""
+	// OptRouteCacheTTL is the max age of a cached callback route in the engine, 0 disables the cache
+	OptRouteCacheTTL = "route-cache-ttl"
+	// DefaultRouteCacheTTL is default value to OptRouteCacheTTL
+	DefaultRouteCacheTTL = "1m"
+	// OptCallbackTimeout is the timeout of a callback request
+	OptCallbackTimeout = "callback-timeout"
+	// DefaultCallbackTimeout is default value to OptCallbackTimeout
+	DefaultCallbackTimeout = "10s"
+	// OptCallbackAttempts is the max number of sending a callback
+	OptCallbackAttempts = "callback-attempts"
+	// DefaultCallbackAttempts is default value to OptCallbackAttempts
+	DefaultCallbackAttempts = "3"
+	// OptCallbackBackoff is the delay before the first retry of a callback, doubled by each retry
+	OptCallbackBackoff = "callback-backoff"
+	// DefaultCallbackBackoff is default value to OptCallbackBackoff
+	DefaultCallbackBackoff = "500ms"
+	// OptCircuitFailureThreshold is the number of consecutive failures, which opens the circuit of an endpoint
+	OptCircuitFailureThreshold = "circuit-failure-threshold"
+	// DefaultCircuitFailureThreshold is default value to OptCircuitFailureThreshold
+	DefaultCircuitFailureThreshold = "5"
+	// OptCircuitOpenTimeout is the time of the open circuit, before a trial callback
+	OptCircuitOpenTimeout = "circuit-open-timeout"
+	// DefaultCircuitOpenTimeout is default value to OptCircuitOpenTimeout
+	DefaultCircuitOpenTimeout = "30s"
+
+	// OptOutboxPollInterval is the period of claiming the due outbox messages by the relay
+	OptOutboxPollInterval = "outbox-poll-interval"
+	// DefaultOutboxPollInterval is default value to OptOutboxPollInterval
+	DefaultOutboxPollInterval = "200ms"
+	// OptOutboxLease is the time of sending a claimed outbox message, before an other relay may claim it again
+	OptOutboxLease = "outbox-lease"
+	// DefaultOutboxLease is default value to OptOutboxLease
+	DefaultOutboxLease = "2m"
+	// OptOutboxConcurrency is the max number of outbox messages, which are sent at the same time by the relay
+	OptOutboxConcurrency = "outbox-concurrency"
+	// DefaultOutboxConcurrency is default value to OptOutboxConcurrency
+	DefaultOutboxConcurrency = "16"
+	// OptOutboxMaxAge is the max age of an outbox message, until its temporary failures are retried, 0 retries always
+	OptOutboxMaxAge = "outbox-max-age"
+	// DefaultOutboxMaxAge is default value to OptOutboxMaxAge
+	DefaultOutboxMaxAge = "1h"
 
 	// OptRsaKey is RSA key for JWT
 	OptRsaKey = "rsa-key"
 	// DefaultRsaKey is default value to OptRsaKey
 	DefaultRsaKey = "rsa/chat_rsa"
+	// OptRsaKeyDir is the directory of the JWT signing keys (*.key), it overrides OptRsaKey
+	OptRsaKeyDir = "rsa-key-dir"
+	// DefaultRsaKeyDir is default value to OptRsaKeyDir
+	DefaultRsaKeyDir = ""
+	// OptJWKSMaxAge is the cache max-age of the published JWKS, a new signing key becomes active after it
+	OptJWKSMaxAge = "jwks-max-age"
+	// DefaultJWKSMaxAge is default value to OptJWKSMaxAge
+	DefaultJWKSMaxAge = "5m"
+	// OptTokenAlgorithm is the JWT signing algorithm (RS256, ES256 or EdDSA), the active key must be of it
+	OptTokenAlgorithm = "token-algorithm"
+	// DefaultTokenAlgorithm is default value to OptTokenAlgorithm, empty accepts the algorithm of any key
+	DefaultTokenAlgorithm = ""
+	// OptTokenIssuer is the iss claim of the JWT
+	OptTokenIssuer = "token-issuer"
+	// DefaultTokenIssuer is default value to OptTokenIssuer
+	DefaultTokenIssuer = ""
+	// OptTokenAudience is the aud claim of the JWT
+	OptTokenAudience = "token-audience"
+	// DefaultTokenAudience is default value to OptTokenAudience
+	DefaultTokenAudience = ""
+	// OptTokenLifetime is the expiration of the JWT
+	OptTokenLifetime = "token-lifetime"
+	// DefaultTokenLifetime is default value to OptTokenLifetime
+	DefaultTokenLifetime = "2h"
+	// OptTokenPerRequest signs a JWT for each callback, bound to the recipient and to the body
+	OptTokenPerRequest = "token-per-request"
+	// DefaultTokenPerRequest is default value to OptTokenPerRequest
+	DefaultTokenPerRequest = "false"
 
 	// OptRedisHost is the URL to Redis server
 	OptRedisHost = "redis-host"
 	// DefaultRedisHost is default value to OptRedisHost
 	DefaultRedisHost = ":6379"
 
-	// OptRedisUser  is the Redis user name
+	// OptRedisUser  is the Redis user name, it's the ACL user, if OptRedisPassword is set
 	OptRedisUser = "redis-user"
-	// DefaultRedisUser is default value to OptRedisUser
-	DefaultRedisUser = "chat-bot"
+	// DefaultRedisUser is default value to OptRedisUser, AUTH is sent without user name (requirepass)
+	DefaultRedisUser = ""
 
-	// OptRedisKey is the queue key
+	// OptRedisKey is the key of the instance registry, an instance is stored in <key>:<instance ID>
 	OptRedisKey = "redis-key"
 	// DefaultRedisKey is default value to OptRedisKey
-	DefaultRedisKey = "online." + DefaultRedisUser
+	DefaultRedisKey = "online.chat-bot"
 
 	// OptRedisRequestChannel is the channel name for sending message to worker
 	OptRedisRequestChannel = "redis-channel"
 	// DefaultRedisRequestChannel is default value to OptRedisRequestChannel
 	DefaultRedisRequestChannel = "requests"
 
+	// OptRedisTopology is the Redis topology (standalone, sentinel, cluster)
+	OptRedisTopology = "redis-topology"
+	// DefaultRedisTopology is default value to OptRedisTopology
+	DefaultRedisTopology = "standalone"
+
+	// OptRedisSentinelMaster is the master name, monitored by Redis Sentinels
+	OptRedisSentinelMaster = "redis-sentinel-master"
+	// DefaultRedisSentinelMaster is default value to OptRedisSentinelMaster
+	DefaultRedisSentinelMaster = "mymaster"
+
+	// OptRedisSentinelPassword is the password of Redis Sentinels
+	OptRedisSentinelPassword = "redis-sentinel-password"
+	// DefaultRedisSentinelPassword is default value to OptRedisSentinelPassword
+	DefaultRedisSentinelPassword = ""
+
+	// OptRedisPassword is the Redis password, it enables AUTH
+	OptRedisPassword = "redis-password"
+	// DefaultRedisPassword is default value to OptRedisPassword
+	DefaultRedisPassword = ""
+
+	// OptRedisDb is the Redis DB index
+	OptRedisDb = "redis-db"
+	// DefaultRedisDb is default value to OptRedisDb
+	DefaultRedisDb = "0"
+
+	// OptRedisTLS enables TLS to Redis
+	OptRedisTLS = "redis-tls"
+	// DefaultRedisTLS is default value to OptRedisTLS
+	DefaultRedisTLS = "false"
+
+	// OptRedisTLSCaFile is the CA certificate file of Redis server
+	OptRedisTLSCaFile = "redis-tls-ca-file"
+	// DefaultRedisTLSCaFile is default value to OptRedisTLSCaFile
+	DefaultRedisTLSCaFile = ""
+
+	// OptRedisTLSCertFile is the client certificate file to Redis
+	OptRedisTLSCertFile = "redis-tls-cert-file"
+	// DefaultRedisTLSCertFile is default value to OptRedisTLSCertFile
+	DefaultRedisTLSCertFile = ""
+
+	// OptRedisTLSKeyFile is the client key file to Redis
+	OptRedisTLSKeyFile = "redis-tls-key-file"
+	// DefaultRedisTLSKeyFile is default value to OptRedisTLSKeyFile
+	DefaultRedisTLSKeyFile = ""
+
+	// OptRedisInvalidationChannel is the channel name for invalidating cached users in the engine replicas
+	OptRedisInvalidationChannel = "redis-invalidation-channel"
+	// DefaultRedisInvalidationChannel is default value to OptRedisInvalidationChannel
+	DefaultRedisInvalidationChannel = "user-invalidations"
+
+	// OptRedisRateLimitKey is the key prefix of the rate limit buckets
+	OptRedisRateLimitKey = "redis-rate-limit-key"
+	// DefaultRedisRateLimitKey is default value to OptRedisRateLimitKey
+	DefaultRedisRateLimitKey = "rate-limits"
+
+	// OptRedisIdempotencyKey is the key prefix of the idempotency keys
+	OptRedisIdempotencyKey = "redis-idempotency-key"
+	// DefaultRedisIdempotencyKey is default value to OptRedisIdempotencyKey
+	DefaultRedisIdempotencyKey = "idempotency"
+
+	// OptRedisUserLockKey is the key prefix of the user locks
+	OptRedisUserLockKey = "redis-user-lock-key"
+	// DefaultRedisUserLockKey is default value to OptRedisUserLockKey
+	DefaultRedisUserLockKey = "user-lock"
+
+	// OptInstanceTTL is the expiration of an instance registration, it's refreshed by heartbeat at TTL/3
+	OptInstanceTTL = "instance-ttl"
+	// DefaultInstanceTTL is default value to OptInstanceTTL
+	DefaultInstanceTTL = "30s"
+
+	// OptDbDriver is the DB driver (postgres or sqlite)
+	OptDbDriver = "db-driver"
+	// DefaultDbDriver is default value to OptDbDriver
+	DefaultDbDriver = "postgres"
+
+	// OptDbPath is the DB file path, used by sqlite driver
+	OptDbPath = "db-path"
+	// DefaultDbPath is default value to OptDbPath
+	DefaultDbPath = "chat_bot.db"
+
 	// OptDbHost is the DB host
 	OptDbHost = "db-host"
 	// DefaultDbHost is default value to OptDbHost
@@ -71,6 +382,26 @@ const (
 	// DefaultDbPassword is  default value to OptDbPassword
 	DefaultDbPassword = "bot_chat"
 
+	// OptMasterKeyFile is the file of master keys for encrypting personal data
+	OptMasterKeyFile = "master-key-file"
+	// DefaultMasterKeyFile is default value to OptMasterKeyFile
+	DefaultMasterKeyFile = ""
+
+	// OptMasterKeys is the list of master keys for encrypting personal data, if OptMasterKeyFile is not set
+	OptMasterKeys = "master-keys"
+	// DefaultMasterKeys is default value to OptMasterKeys
+	DefaultMasterKeys = ""
+
+	// OptUserCacheSize is the max number of cached users, 0 disables the cache
+	OptUserCacheSize = "user-cache-size"
+	// DefaultUserCacheSize is default value to OptUserCacheSize
+	DefaultUserCacheSize = "0"
+
+	// OptUserCacheTTL is the max age of a cached user
+	OptUserCacheTTL = "user-cache-ttl"
+	// DefaultUserCacheTTL is default value to OptUserCacheTTL
+	DefaultUserCacheTTL = "1m"
+
 	// DefaultDelayMillis is longer than 1s
 	DefaultDelayMillis = 1100
 	// DefaultDelay is longer than 1s
@@ -80,8 +411,13 @@ const (
 	// LongDelayMaxMillis is 5s
 	LongDelayMaxMillis = 5000
 
-	// TokenExpirationDuration is the expiration duration of JWT token
-	TokenExpirationDuration = time.Hour * 2
-	// TokenRefreshDuration is the refresh time of JWT token
-	TokenRefreshDuration = time.Hour * 1
+	// UpdateConflictAttempts is the max number of processing a message, if the user is updated concurrently
+	UpdateConflictAttempts = 3
+
+	// ProcessedRequestMinAge is the retention of the processed request keys in the engine,
+	// if the deduplication is disabled (OptIdempotencyTTL is 0), the redeliveries to the engines come within it
+	ProcessedRequestMinAge = time.Hour
 )
+
+// Version is the version of the service, set by -ldflags "-X github.com/pgillich/chat-bot/config.Version=..."
+var Version = "dev" // nolint:gochecknoglobals
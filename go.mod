@@ -4,11 +4,14 @@ go 1.13
 
 require (
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/garyburd/redigo v1.6.0
 	github.com/jinzhu/gorm v1.9.11
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/prometheus/client_golang v1.2.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/viper v1.5.0
 	github.com/stretchr/testify v1.3.0
+	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
 )
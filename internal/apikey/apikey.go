@@ -0,0 +1,131 @@
+// Package apikey provides API keys for authenticating the clients of the frontend
+//
+// An API key is "cb_<key ID>_<secret>". The key ID is stored in plain text, the secret only as SHA-256 hash.
+// The key is shown only once, at creation.
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/pgillich/chat-bot/internal/db"
+)
+
+// ScopeChat allows sending messages to the chat bot
+const ScopeChat = "chat"
+
+const (
+	keyPrefix  = "cb"
+	keySep     = "_"
+	keyIDSize  = 8
+	secretSize = 24
+)
+
+var (
+	// ErrUnauthorized is returned, if the key is missing, invalid, expired or revoked
+	ErrUnauthorized = errors.New("unauthorized") // nolint:gochecknoglobals
+	// ErrForbidden is returned, if the key has no scope or cannot speak for the user
+	ErrForbidden = errors.New("forbidden") // nolint:gochecknoglobals
+)
+
+// Generate makes a new key and its stored part (KeyID, Hash)
+func Generate() (string, db.APIKey, error) {
+	keyID, err := randomHex(keyIDSize)
+	if err != nil {
+		return "", db.APIKey{}, err
+	}
+
+	secret, err := randomHex(secretSize)
+	if err != nil {
+		return "", db.APIKey{}, err
+	}
+
+	return strings.Join([]string{keyPrefix, keyID, secret}, keySep), db.APIKey{KeyID: keyID, Hash: hash(secret)}, nil
+}
+
+// Create generates and stores a new key of the client, which may speak for the UIDs (comma separated)
+// The key does not expire, if expiresAt is nil. The key is returned, it cannot be restored later.
+func Create(ctx context.Context, keys db.APIKeyStore,
+	client string, uids string, scopes string, expiresAt *time.Time,
+) (string, db.APIKey, error) {
+	key, stored, err := Generate()
+	if err != nil {
+		return "", stored, err
+	}
+
+	stored.Client = client
+	stored.UIDs = uids
+	stored.Scopes = scopes
+	stored.ExpiresAt = expiresAt
+
+	stored, err = keys.CreateAPIKeyContext(ctx, stored)
+	if err != nil {
+		return "", stored, err
+	}
+
+	return key, stored, nil
+}
+
+// Parse splits the key to key ID and secret
+func Parse(key string) (string, string, error) {
+	parts := strings.Split(key, keySep)
+	if len(parts) != 3 || parts[0] != keyPrefix || parts[1] == "" || parts[2] == "" {
+		return "", "", ErrUnauthorized
+	}
+
+	return parts[1], parts[2], nil
+}
+
+// Authenticator checks the keys, stored in Keys
+type Authenticator struct {
+	Keys db.APIKeyStore
+}
+
+// Authenticate checks the key and the scope, the stored key is returned
+// ErrUnauthorized or ErrForbidden is returned, if the key is not accepted, other errors are DB errors.
+func (authenticator *Authenticator) Authenticate(ctx context.Context, key string, scope string) (db.APIKey, error) {
+	keyID, secret, err := Parse(key)
+	if err != nil {
+		return db.APIKey{}, err
+	}
+
+	stored, err := authenticator.Keys.GetAPIKeyContext(ctx, keyID)
+	if err == db.ErrAPIKeyNotFound {
+		return db.APIKey{}, ErrUnauthorized
+	} else if err != nil {
+		return db.APIKey{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hash(secret)), []byte(stored.Hash)) != 1 || !stored.IsActive(time.Now()) {
+		return db.APIKey{}, ErrUnauthorized
+	}
+
+	if !stored.HasScope(scope) {
+		return stored, ErrForbidden
+	}
+
+	return stored, nil
+}
+
+// hash returns the SHA-256 hash of the secret in hex
+func hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// randomHex returns size random bytes in hex
+func randomHex(size int) (string, error) {
+	buf := make([]byte, size)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,78 @@
+package apikey_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/apikey"
+	"github.com/pgillich/chat-bot/internal/db"
+)
+
+func TestGenerateParse(t *testing.T) {
+	key, stored, err := apikey.Generate()
+	if !assert.NoError(t, err, "Generate") {
+		return
+	}
+	assert.True(t, strings.HasPrefix(key, "cb_"+stored.KeyID+"_"), "key format")
+	assert.NotContains(t, stored.Hash, strings.Split(key, "_")[2], "secret is not stored")
+
+	keyID, secret, err := apikey.Parse(key)
+	if assert.NoError(t, err, "Parse") {
+		assert.Equal(t, stored.KeyID, keyID, "KeyID")
+		assert.NotEmpty(t, secret, "secret")
+	}
+
+	for _, invalid := range []string{"", "cb_", "cb__secret", "xx_id_secret", "cb_id_secret_more"} {
+		_, _, err := apikey.Parse(invalid)
+		assert.Equal(t, apikey.ErrUnauthorized, err, "Parse "+invalid)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	keys := &db.FakeDbHandler{}
+	if err := keys.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+
+	ctx := context.Background()
+	authenticator := &apikey.Authenticator{Keys: keys}
+
+	key, created, err := apikey.Create(ctx, keys, "acme", "001,acme-*", apikey.ScopeChat, nil)
+	if !assert.NoError(t, err, "Create") {
+		return
+	}
+
+	stored, err := authenticator.Authenticate(ctx, key, apikey.ScopeChat)
+	if assert.NoError(t, err, "Authenticate") {
+		assert.Equal(t, created.ID, stored.ID, "ID")
+		assert.Equal(t, "acme", stored.Client, "Client")
+		assert.True(t, stored.CanSpeakFor("acme-001"), "CanSpeakFor")
+	}
+
+	_, err = authenticator.Authenticate(ctx, key, "admin")
+	assert.Equal(t, apikey.ErrForbidden, err, "Authenticate without scope")
+
+	keyID, _, _ := apikey.Parse(key) // nolint:errcheck
+	_, err = authenticator.Authenticate(ctx, "cb_"+keyID+"_bad", apikey.ScopeChat)
+	assert.Equal(t, apikey.ErrUnauthorized, err, "Authenticate bad secret")
+
+	other, _, _ := apikey.Generate() // nolint:errcheck
+	_, err = authenticator.Authenticate(ctx, other, apikey.ScopeChat)
+	assert.Equal(t, apikey.ErrUnauthorized, err, "Authenticate unknown key")
+
+	expiresAt := time.Now().Add(-time.Minute)
+	expired, _, err := apikey.Create(ctx, keys, "acme", "001", apikey.ScopeChat, &expiresAt)
+	if assert.NoError(t, err, "Create expired") {
+		_, err = authenticator.Authenticate(ctx, expired, apikey.ScopeChat)
+		assert.Equal(t, apikey.ErrUnauthorized, err, "Authenticate expired")
+	}
+
+	assert.NoError(t, keys.RevokeAPIKeyContext(ctx, created.KeyID, time.Now()), "Revoke")
+	_, err = authenticator.Authenticate(ctx, key, apikey.ScopeChat)
+	assert.Equal(t, apikey.ErrUnauthorized, err, "Authenticate revoked")
+}
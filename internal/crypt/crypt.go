@@ -0,0 +1,221 @@
+// Package crypt provides envelope encryption of personal data
+//
+// Each value is encrypted by a random data key (AES-256-GCM), the data key is wrapped by a master key.
+// The master key ID is stored alongside the ciphertext, so master keys can be rotated.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	keySize = 32
+
+	sealedVersion = "v1"
+	sealedSep     = "."
+)
+
+var (
+	// ErrUnknownKey is returned, if the master key of a sealed value is not in the KeyRing
+	ErrUnknownKey = errors.New("unknown master key") // nolint:gochecknoglobals
+	// ErrInvalidSealed is returned, if a sealed value cannot be parsed
+	ErrInvalidSealed = errors.New("invalid sealed value") // nolint:gochecknoglobals
+)
+
+// KeyRing holds the master keys
+// The first key is the active one, which is used for sealing. The others are used only for opening.
+type KeyRing struct {
+	keys     map[string][]byte
+	activeID string
+}
+
+// ParseKeyRing parses master keys in "id:base64key" format, separated by comma or new line
+// Each key must be 32 bytes long, the first one is the active key
+func ParseKeyRing(text string) (*KeyRing, error) {
+	keyRing := &KeyRing{keys: map[string][]byte{}}
+
+	for _, item := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' || r == '\r' }) {
+		item = strings.TrimSpace(item)
+		if item == "" || strings.HasPrefix(item, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.New("invalid master key format, expected id:base64key")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %s, %s", parts[0], err)
+		}
+		if len(key) != keySize {
+			return nil, fmt.Errorf("invalid master key %s, length must be %d bytes", parts[0], keySize)
+		}
+
+		if _, has := keyRing.keys[parts[0]]; has {
+			return nil, fmt.Errorf("duplicated master key %s", parts[0])
+		}
+		keyRing.keys[parts[0]] = key
+
+		if keyRing.activeID == "" {
+			keyRing.activeID = parts[0]
+		}
+	}
+
+	if keyRing.activeID == "" {
+		return nil, errors.New("no master key")
+	}
+
+	return keyRing, nil
+}
+
+// LoadKeyRing reads master keys from a file, see ParseKeyRing
+func LoadKeyRing(path string) (*KeyRing, error) {
+	text, err := ioutil.ReadFile(path) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseKeyRing(string(text))
+}
+
+// GenerateKey returns a new master key in base64 format
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ActiveKeyID returns the ID of the master key, used for sealing
+func (keyRing *KeyRing) ActiveKeyID() string {
+	return keyRing.activeID
+}
+
+// Seal encrypts plaintext by a new data key, which is wrapped by the active master key
+// aad is authenticated, but not encrypted (for example the owner ID), the same must be given to Open
+func (keyRing *KeyRing) Seal(plaintext []byte, aad []byte) (keyID string, sealed string, err error) {
+	dataKey := make([]byte, keySize)
+	if _, err = io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", "", err
+	}
+
+	ciphertext, err := encrypt(dataKey, plaintext, aad)
+	if err != nil {
+		return "", "", err
+	}
+
+	return keyRing.wrap(dataKey, ciphertext)
+}
+
+// Open decrypts a value, sealed by the master key keyID
+func (keyRing *KeyRing) Open(keyID string, sealed string, aad []byte) ([]byte, error) {
+	dataKey, ciphertext, err := keyRing.unwrap(keyID, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	return decrypt(dataKey, ciphertext, aad)
+}
+
+// Rewrap wraps the data key of a sealed value by the active master key
+// The ciphertext of the value is not changed
+func (keyRing *KeyRing) Rewrap(keyID string, sealed string) (newKeyID string, newSealed string, err error) {
+	dataKey, ciphertext, err := keyRing.unwrap(keyID, sealed)
+	if err != nil {
+		return "", "", err
+	}
+
+	return keyRing.wrap(dataKey, ciphertext)
+}
+
+func (keyRing *KeyRing) wrap(dataKey []byte, ciphertext []byte) (string, string, error) {
+	wrappedKey, err := encrypt(keyRing.keys[keyRing.activeID], dataKey, []byte(keyRing.activeID))
+	if err != nil {
+		return "", "", err
+	}
+
+	return keyRing.activeID, strings.Join([]string{
+		sealedVersion,
+		base64.RawStdEncoding.EncodeToString(wrappedKey),
+		base64.RawStdEncoding.EncodeToString(ciphertext),
+	}, sealedSep), nil
+}
+
+func (keyRing *KeyRing) unwrap(keyID string, sealed string) ([]byte, []byte, error) {
+	masterKey, has := keyRing.keys[keyID]
+	if !has {
+		return nil, nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	parts := strings.Split(sealed, sealedSep)
+	if len(parts) != 3 || parts[0] != sealedVersion {
+		return nil, nil, ErrInvalidSealed
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrInvalidSealed
+	}
+
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, ErrInvalidSealed
+	}
+
+	dataKey, err := decrypt(masterKey, wrappedKey, []byte(keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, ciphertext, nil
+}
+
+// encrypt returns nonce+ciphertext
+func encrypt(key []byte, plaintext []byte, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// decrypt opens nonce+ciphertext
+func decrypt(key []byte, ciphertext []byte, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrInvalidSealed
+	}
+
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], aad)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,108 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeKeyRing(t *testing.T, ids ...string) *KeyRing {
+	text := ""
+	for _, id := range ids {
+		key, err := GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		text += id + ":" + key + "\n"
+	}
+
+	keyRing, err := ParseKeyRing(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyRing
+}
+
+func TestSealOpen(t *testing.T) {
+	keyRing := makeKeyRing(t, "k1", "k0")
+	assert.Equal(t, "k1", keyRing.ActiveKeyID(), "ActiveKeyID")
+
+	keyID, sealed, err := keyRing.Seal([]byte("John Doe"), []byte("001"))
+	if !assert.NoError(t, err, "Seal") {
+		return
+	}
+	assert.Equal(t, "k1", keyID, "keyID")
+	assert.NotContains(t, sealed, "John Doe", "sealed")
+
+	plaintext, err := keyRing.Open(keyID, sealed, []byte("001"))
+	if assert.NoError(t, err, "Open") {
+		assert.Equal(t, "John Doe", string(plaintext), "plaintext")
+	}
+
+	_, err = keyRing.Open(keyID, sealed, []byte("002"))
+	assert.Error(t, err, "Open by other aad")
+
+	_, err = keyRing.Open("k0", sealed, []byte("001"))
+	assert.Error(t, err, "Open by other key")
+
+	_, err = keyRing.Open("k9", sealed, []byte("001"))
+	assert.True(t, errors.Is(err, ErrUnknownKey), "Open by unknown key")
+
+	_, err = keyRing.Open(keyID, "v1.x", []byte("001"))
+	assert.Equal(t, ErrInvalidSealed, err, "Open invalid")
+}
+
+func TestRewrap(t *testing.T) {
+	oldKeyRing := makeKeyRing(t, "k0")
+	keyID, sealed, err := oldKeyRing.Seal([]byte("Jane Doe"), []byte("002"))
+	if !assert.NoError(t, err, "Seal") {
+		return
+	}
+
+	// k1 is the new active key, k0 is kept for opening
+	newKeyRing, err := ParseKeyRing("k1:" + mustGenerateKey(t) + ",k0:" +
+		mustEncodedKey(oldKeyRing, "k0"))
+	if !assert.NoError(t, err, "ParseKeyRing") {
+		return
+	}
+
+	newKeyID, newSealed, err := newKeyRing.Rewrap(keyID, sealed)
+	if !assert.NoError(t, err, "Rewrap") {
+		return
+	}
+	assert.Equal(t, "k1", newKeyID, "newKeyID")
+
+	plaintext, err := newKeyRing.Open(newKeyID, newSealed, []byte("002"))
+	if assert.NoError(t, err, "Open") {
+		assert.Equal(t, "Jane Doe", string(plaintext), "plaintext")
+	}
+}
+
+func TestParseKeyRingErrors(t *testing.T) {
+	for name, text := range map[string]string{
+		"empty":     "",
+		"format":    "k1",
+		"base64":    "k1:???",
+		"length":    "k1:YWJj",
+		"duplicate": "k1:" + mustGenerateKey(t) + ",k1:" + mustGenerateKey(t),
+	} {
+		_, err := ParseKeyRing(text)
+		assert.Error(t, err, name)
+	}
+}
+
+func mustGenerateKey(t *testing.T) string {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func mustEncodedKey(keyRing *KeyRing, id string) string {
+	return base64.StdEncoding.EncodeToString(keyRing.keys[id])
+}
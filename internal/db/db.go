@@ -2,6 +2,9 @@
 package db
 
 import (
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -13,13 +16,34 @@ import (
 	"github.com/pgillich/chat-bot/internal/logger"
 )
 
+const (
+	// DriverPostgres selects RealDbHandler
+	DriverPostgres = "postgres"
+	// DriverSqlite selects SqliteDbHandler
+	DriverSqlite = "sqlite"
+)
+
 // User table
 type User struct {
 	gorm.Model
+	// UID is not unique in the schema (uniq_key is not a gorm tag), a unique index needs deduplicating the users
 	UID    string `gorm:"uniq_key"`
 	Name   string
 	BornOn *time.Time
 	BornAt string
+	// Version is incremented by each Update, for optimistic concurrency control
+	Version uint `gorm:"not null"`
+	// Sealed holds the encrypted personal data, see EncryptingDbHandler
+	Sealed string `gorm:"type:text"`
+	// KeyID is the ID of the master key, which wraps the data key of Sealed
+	KeyID string `gorm:"index"`
+	// LastRequestKey is the idempotency key (or message ID) of the last processed request,
+	// it's updated together with the state, and it's stored in the processed requests (see ProcessedRequest),
+	// so a redelivered request is not processed twice
+	LastRequestKey string
+	// FenceToken is the fencing token of the user lock of the last update (see queue.Lease),
+	// an update with a lower token is rejected, so a writer with an expired lock cannot overwrite the user
+	FenceToken int64 `gorm:"not null;default:0"`
 }
 
 // TableName forces table name singular
@@ -27,33 +51,149 @@ func (User) TableName() string {
 	return "user"
 }
 
+// ConflictError is returned by Update, if the user was updated by someone else since it was read
+type ConflictError struct {
+	UID     string
+	Version uint
+}
+
+func (err *ConflictError) Error() string {
+	return fmt.Sprintf("user %s was updated concurrently, version %d is outdated", err.UID, err.Version)
+}
+
+// IsConflict tells if the error is a ConflictError
+func IsConflict(err error) bool {
+	var conflictErr *ConflictError
+
+	return errors.As(err, &conflictErr)
+}
+
 // DbHandler is an interface for DB backend (and faking)
+// The Context variants give up waiting, if the context is done
+// The consumers get only the store, which they need.
 type DbHandler interface { // nolint:golint
 	Connect() error
+	ConnectContext(ctx context.Context) error
 	Close()
+
+	UserStore
+	APIKeyStore
+	RouteStore
+	DeliveryStore
+	OutboxStore
+	TranscriptStore
+}
+
+// UserStore stores the users (the dialog state) and the keys of the processed requests
+type UserStore interface {
 	GetOrCreateUser(uid string) (User, error)
+	GetOrCreateUserContext(ctx context.Context, uid string) (User, error)
+	// Update stores the user, if its Version is not changed since it was read
+	// and no higher FenceToken was stored, else returns ConflictError
 	Update(user User) error
+	UpdateContext(ctx context.Context, user User) error
+	// IsRequestProcessedContext tells, if the request (User.LastRequestKey of an earlier update) was processed
+	IsRequestProcessedContext(ctx context.Context, uid string, requestKey string) (bool, error)
+	// PurgeProcessedRequestsContext deletes the processed request keys, stored before createdBefore,
+	// and returns the number of them
+	// Nothing is deleted, if dryRun is set
+	PurgeProcessedRequestsContext(ctx context.Context, createdBefore time.Time, dryRun bool) (int, error)
+	// UpdateSealedContext stores only the personal data (Sealed, KeyID and the plain fields) of the sealed user,
+	// if its Version is not changed since it was read, else returns ConflictError
+	// Version and UpdatedAt are kept, it's used by the reencryption.
+	UpdateSealedContext(ctx context.Context, user User) error
+	// ListUsersContext returns max limit users, ordered by ID, starting after afterID
+	ListUsersContext(ctx context.Context, afterID uint, limit int) ([]User, error)
+	// PurgeUsersContext deletes the users, not updated since inactiveSince, and returns the number of them
+	// Nothing is deleted, if dryRun is set
+	PurgeUsersContext(ctx context.Context, inactiveSince time.Time, dryRun bool) (int, error)
 }
 
-// RealDbHandler is a real implementation of DbHandler
-type RealDbHandler struct {
-	Host     string
-	User     string
-	Database string
-	Password string
+// APIKeyStore stores the API keys of the clients
+type APIKeyStore interface {
+	// CreateAPIKeyContext stores a new API key
+	CreateAPIKeyContext(ctx context.Context, key APIKey) (APIKey, error)
+	// GetAPIKeyContext returns the API key (revoked, too), or ErrAPIKeyNotFound
+	GetAPIKeyContext(ctx context.Context, keyID string) (APIKey, error)
+	// ListAPIKeysContext returns the API keys (revoked, too), ordered by ID
+	ListAPIKeysContext(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKeyContext revokes the API key, or returns ErrAPIKeyNotFound
+	RevokeAPIKeyContext(ctx context.Context, keyID string, revokedAt time.Time) error
+}
+
+// RouteStore stores the callback routes of the clients
+type RouteStore interface {
+	// SetCallbackRouteContext creates or updates the callback route of the client
+	SetCallbackRouteContext(ctx context.Context, route CallbackRoute) (CallbackRoute, error)
+	// GetCallbackRouteContext returns the callback route of the client, or ErrCallbackRouteNotFound
+	GetCallbackRouteContext(ctx context.Context, client string) (CallbackRoute, error)
+	// ListCallbackRoutesContext returns the callback routes, ordered by client
+	ListCallbackRoutesContext(ctx context.Context) ([]CallbackRoute, error)
+	// DeleteCallbackRouteContext deletes the callback route of the client, or returns ErrCallbackRouteNotFound
+	DeleteCallbackRouteContext(ctx context.Context, client string) error
+}
+
+// DeliveryStore stores the delivery statuses of the responses, they are created by OutboxStore
+type DeliveryStore interface {
+	// GetDeliveryContext returns the delivery of the message, or ErrDeliveryNotFound
+	GetDeliveryContext(ctx context.Context, messageID string) (Delivery, error)
+	// UpdateDeliveryContext changes the status of the delivery, or returns ErrDeliveryNotFound or ErrDeliveryStatus
+	UpdateDeliveryContext(ctx context.Context, messageID string, event DeliveryEvent) (Delivery, error)
+	// PurgeDeliveriesContext deletes the deliveries, created before createdBefore, and returns the number of them
+	// Nothing is deleted, if dryRun is set
+	PurgeDeliveriesContext(ctx context.Context, createdBefore time.Time, dryRun bool) (int, error)
+}
+
+// OutboxStore stores the responses until they are sent
+type OutboxStore interface {
+	// UpdateWithOutboxContext updates the user (if not nil, like UpdateContext) and stores the outbox messages
+	// with their queued deliveries, in one transaction
+	UpdateWithOutboxContext(ctx context.Context, user *User, messages []OutboxMessage) error
+	// ClaimOutboxContext leases max limit due messages until leaseUntil, the first pending one of each request
+	ClaimOutboxContext(ctx context.Context, now time.Time, leaseUntil time.Time, limit int) ([]OutboxMessage, error)
+	// RetryOutboxContext keeps the leased message pending, it's claimed again at retryAt
+	RetryOutboxContext(ctx context.Context, messageID string, retryAt time.Time) error
+	// DoneOutboxContext marks the pending messages of the request done, up to lastSequence, and returns them
+	DoneOutboxContext(ctx context.Context, requestID string, lastSequence int, doneAt time.Time) ([]OutboxMessage, error)
+	// PurgeOutboxContext deletes the messages, done before doneBefore, and returns the number of them
+	// Nothing is deleted, if dryRun is set
+	PurgeOutboxContext(ctx context.Context, doneBefore time.Time, dryRun bool) (int, error)
+}
+
+// TranscriptStore stores the transcripts of the users
+type TranscriptStore interface {
+	// AppendTranscriptContext stores the transcript entries
+	AppendTranscriptContext(ctx context.Context, entries []TranscriptEntry) error
+	// ListTranscriptContext returns the transcript entries of the user, in the order of storing
+	ListTranscriptContext(ctx context.Context, uid string) ([]TranscriptEntry, error)
+	// PurgeTranscriptsContext deletes the transcript entries, created before createdBefore, and returns the number of them
+	// Nothing is deleted, if dryRun is set
+	PurgeTranscriptsContext(ctx context.Context, createdBefore time.Time, dryRun bool) (int, error)
+}
 
+// gormDbHandler is the common part of the gorm based DbHandler implementations
+type gormDbHandler struct {
 	db *gorm.DB
 
 	mx *sync.RWMutex
 }
 
-// Connect connects to the DB
-func (dbHandler *RealDbHandler) Connect() error {
-	var err error
+// open opens the DB and migrates the schema
+func (dbHandler *gormDbHandler) open(ctx context.Context, dialect string, driver string, source string) error {
+	sqlDB, err := sql.Open(driver, source)
+	if err != nil {
+		return err
+	}
+
+	if err = sqlDB.PingContext(ctx); err != nil {
+		sqlDB.Close() // nolint:errcheck,gosec
+
+		return err
+	}
+
+	if dbHandler.db, err = gorm.Open(dialect, sqlDB); err != nil {
+		sqlDB.Close() // nolint:errcheck,gosec
 
-	dbURI := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s",
-		dbHandler.Host, dbHandler.User, dbHandler.Database, dbHandler.Password)
-	if dbHandler.db, err = gorm.Open("postgres", dbURI); err != nil {
 		return err
 	}
 
@@ -61,7 +201,8 @@ func (dbHandler *RealDbHandler) Connect() error {
 		dbHandler.db = dbHandler.db.Debug()
 	}
 
-	dbHandler.db = dbHandler.db.AutoMigrate(&User{})
+	dbHandler.db = dbHandler.db.AutoMigrate(&User{}, &APIKey{}, &CallbackRoute{}, &Delivery{}, &OutboxMessage{},
+		&TranscriptEntry{}, &ProcessedRequest{})
 	if dbHandler.db.Error != nil {
 		return dbHandler.db.Error
 	}
@@ -72,7 +213,7 @@ func (dbHandler *RealDbHandler) Connect() error {
 }
 
 // Close closes DB connection
-func (dbHandler *RealDbHandler) Close() {
+func (dbHandler *gormDbHandler) Close() {
 	dbHandler.mx.Lock()
 	defer dbHandler.mx.Unlock()
 
@@ -81,31 +222,195 @@ func (dbHandler *RealDbHandler) Close() {
 	}
 }
 
+// transaction runs fn in a transaction, which is bound to ctx
+func (dbHandler *gormDbHandler) transaction(ctx context.Context, fn func(tx *gorm.DB) error) error {
+	tx := dbHandler.db.BeginTx(ctx, nil)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
 // GetOrCreateUser creates a new user or returns, if exists
-func (dbHandler *RealDbHandler) GetOrCreateUser(uid string) (User, error) {
+func (dbHandler *gormDbHandler) GetOrCreateUser(uid string) (User, error) {
+	return dbHandler.GetOrCreateUserContext(context.Background(), uid)
+}
+
+// GetOrCreateUserContext creates a new user or returns, if exists
+func (dbHandler *gormDbHandler) GetOrCreateUserContext(ctx context.Context, uid string) (User, error) {
 	dbHandler.mx.RLock()
 	defer dbHandler.mx.RUnlock()
 
 	templateUser := User{UID: uid}
 	user := User{}
 
-	db := dbHandler.db.Where(templateUser).FirstOrCreate(&user)
-	if db.Error != nil {
-		return templateUser, db.Error
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Where(templateUser).FirstOrCreate(&user).Error
+	})
+	if err != nil && ctx.Err() == nil {
+		// a concurrent call may have created the same user, between the query and the insert,
+		// if the DB has a unique index on UID
+		user = User{}
+		errFirst := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+			return tx.Where(templateUser).First(&user).Error
+		})
+		if errFirst == nil {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		return templateUser, err
 	}
 
 	return user, nil
 }
 
 // Update updates user
-func (dbHandler *RealDbHandler) Update(user User) error { // nolint:gocritic
+func (dbHandler *gormDbHandler) Update(user User) error { // nolint:gocritic
+	return dbHandler.UpdateContext(context.Background(), user)
+}
+
+// UpdateContext updates user
+func (dbHandler *gormDbHandler) UpdateContext(ctx context.Context, user User) error { // nolint:gocritic
 	dbHandler.mx.RLock()
 	defer dbHandler.mx.RUnlock()
 
-	db := dbHandler.db.Save(user)
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return updateUser(tx, user)
+	})
+}
+
+// updateUser creates or updates the user in the transaction, ConflictError is returned, if Version is outdated
+// or the user was updated with a higher FenceToken
+// The LastRequestKey is stored in the processed requests, in the same transaction.
+func updateUser(tx *gorm.DB, user User) error { // nolint:gocritic
+	if user.ID == 0 {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+
+		return recordProcessedRequest(tx, &user)
+	}
+
+	db := tx.Model(&User{}).Where("id = ? AND version = ? AND fence_token <= ?", user.ID, user.Version, user.FenceToken).
+		Updates(map[string]interface{}{
+			"name":             user.Name,
+			"born_on":          user.BornOn,
+			"born_at":          user.BornAt,
+			"sealed":           user.Sealed,
+			"key_id":           user.KeyID,
+			"version":          user.Version + 1,
+			"last_request_key": user.LastRequestKey,
+			"fence_token":      user.FenceToken,
+		})
 	if db.Error != nil {
 		return db.Error
 	}
 
-	return nil
+	if db.RowsAffected == 0 {
+		return &ConflictError{UID: user.UID, Version: user.Version}
+	}
+
+	return recordProcessedRequest(tx, &user)
+}
+
+// UpdateSealedContext stores only the personal data columns of the user, if its Version is not changed
+// UpdateColumns doesn't change Version and UpdatedAt, so the reencryption doesn't conflict with the engines
+// and doesn't reset the inactivity of the user (see PurgeUsersContext).
+func (dbHandler *gormDbHandler) UpdateSealedContext(ctx context.Context, user User) error { // nolint:gocritic
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		db := tx.Model(&User{}).Where("id = ? AND version = ?", user.ID, user.Version).
+			UpdateColumns(map[string]interface{}{
+				"name":    user.Name,
+				"born_on": user.BornOn,
+				"born_at": user.BornAt,
+				"sealed":  user.Sealed,
+				"key_id":  user.KeyID,
+			})
+		if db.Error != nil {
+			return db.Error
+		}
+
+		if db.RowsAffected == 0 {
+			return &ConflictError{UID: user.UID, Version: user.Version}
+		}
+
+		return nil
+	})
+}
+
+// ListUsersContext returns max limit users, ordered by ID, starting after afterID
+func (dbHandler *gormDbHandler) ListUsersContext(ctx context.Context, afterID uint, limit int) ([]User, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	users := []User{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Where("id > ?", afterID).Order("id").Limit(limit).Find(&users).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// PurgeUsersContext deletes the users, not updated since inactiveSince, and returns the number of them
+// The rows are deleted physically (not only marked by DeletedAt)
+func (dbHandler *gormDbHandler) PurgeUsersContext(ctx context.Context, inactiveSince time.Time, dryRun bool,
+) (int, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	purged := 0
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		inactive := tx.Unscoped().Model(&User{}).Where("updated_at < ?", inactiveSince)
+
+		if dryRun {
+			return inactive.Count(&purged).Error
+		}
+
+		db := inactive.Delete(&User{})
+		purged = int(db.RowsAffected)
+
+		return db.Error
+	})
+
+	return purged, err
+}
+
+// RealDbHandler is a real implementation of DbHandler, on Postgres
+type RealDbHandler struct {
+	Host     string
+	User     string
+	Database string
+	Password string
+
+	gormDbHandler
+}
+
+// Connect connects to the DB
+func (dbHandler *RealDbHandler) Connect() error {
+	return dbHandler.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the DB
+func (dbHandler *RealDbHandler) ConnectContext(ctx context.Context) error {
+	dbURI := fmt.Sprintf("host=%s user=%s dbname=%s sslmode=disable password=%s",
+		dbHandler.Host, dbHandler.User, dbHandler.Database, dbHandler.Password)
+
+	return dbHandler.open(ctx, DriverPostgres, "postgres", dbURI)
 }
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrAPIKeyNotFound is returned, if the API key does not exist
+var ErrAPIKeyNotFound = errors.New("API key not found") // nolint:gochecknoglobals
+
+// APIKey table, the secret of the key is stored only as hash
+type APIKey struct {
+	gorm.Model
+	// KeyID is the public part of the key
+	KeyID string `gorm:"unique_index"`
+	// Hash is the hash of the secret part of the key
+	Hash string `gorm:"not null"`
+	// Client is the client (tenant) of the key
+	Client string `gorm:"index"`
+	// Scopes are the comma separated allowed scopes
+	Scopes string
+	// UIDs are the comma separated UIDs, which the client may speak for (RequestMessage.From)
+	// A UID ending with * is a prefix
+	UIDs      string `gorm:"type:text"`
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+}
+
+// TableName forces table name singular
+func (APIKey) TableName() string {
+	return "api_key"
+}
+
+// HasScope tells, if the scope is allowed
+func (key *APIKey) HasScope(scope string) bool {
+	return containsItem(key.Scopes, func(item string) bool { return item == scope })
+}
+
+// CanSpeakFor tells, if the client may send messages from the UID
+func (key *APIKey) CanSpeakFor(uid string) bool {
+	return uid != "" && containsItem(key.UIDs, func(item string) bool {
+		if strings.HasSuffix(item, "*") {
+			return strings.HasPrefix(uid, strings.TrimSuffix(item, "*"))
+		}
+
+		return item == uid
+	})
+}
+
+// IsActive tells, if the key is not revoked and not expired at now
+func (key *APIKey) IsActive(now time.Time) bool {
+	return key.RevokedAt == nil && (key.ExpiresAt == nil || now.Before(*key.ExpiresAt))
+}
+
+// containsItem tells, if any item of the comma separated list matches
+func containsItem(list string, match func(item string) bool) bool {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" && match(item) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CreateAPIKeyContext stores a new API key
+func (dbHandler *gormDbHandler) CreateAPIKeyContext(ctx context.Context, key APIKey) (APIKey, error) { // nolint:gocritic
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Create(&key).Error
+	})
+
+	return key, err
+}
+
+// GetAPIKeyContext returns the API key, or ErrAPIKeyNotFound
+func (dbHandler *gormDbHandler) GetAPIKeyContext(ctx context.Context, keyID string) (APIKey, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	key := APIKey{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Where(APIKey{KeyID: keyID}).First(&key).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return key, ErrAPIKeyNotFound
+	}
+
+	return key, err
+}
+
+// ListAPIKeysContext returns the API keys, ordered by ID
+func (dbHandler *gormDbHandler) ListAPIKeysContext(ctx context.Context) ([]APIKey, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	keys := []APIKey{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Order("id").Find(&keys).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKeyContext revokes the API key, or returns ErrAPIKeyNotFound
+// The revoked keys are kept for auditing
+func (dbHandler *gormDbHandler) RevokeAPIKeyContext(ctx context.Context, keyID string, revokedAt time.Time) error {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		db := tx.Model(&APIKey{}).Where("key_id = ? AND revoked_at IS NULL", keyID).Update("revoked_at", revokedAt)
+		if db.Error != nil {
+			return db.Error
+		}
+
+		if db.RowsAffected == 0 {
+			count := 0
+			if err := tx.Model(&APIKey{}).Where("key_id = ?", keyID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count == 0 {
+				return ErrAPIKeyNotFound
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,296 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// cacheInvalidateAll is the invalidated key, which evicts all users
+const cacheInvalidateAll = "*"
+
+// nolint:gochecknoglobals
+var cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "chat_bot",
+	Subsystem: "user_cache",
+	Name:      "requests_total",
+	Help:      "Number of user lookups in the cache, by result (hit, miss)",
+}, []string{"result"})
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(cacheRequests)
+}
+
+// CacheInvalidator broadcasts the invalidated cache keys to the replicas of CachingDbHandler
+// It's implemented on Redis by queue.RealCacheInvalidator.
+type CacheInvalidator interface {
+	Connect() error
+	Close()
+	// Invalidate sends the key to the other replicas
+	Invalidate(ctx context.Context, key string) error
+	// Invalidations returns the keys, invalidated by the other replicas, "*" invalidates all keys
+	// The channel is closed by Close
+	Invalidations() <-chan string
+}
+
+// cacheEntry is an element of CachingDbHandler.lru
+type cacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// CachingDbHandler is a read-through LRU cache of users, by UID
+// It's a decorator: GetOrCreateUser reads the wrapped DbHandler only on cache miss,
+// Update writes the wrapped DbHandler and the cache (write-through).
+// Updated users are invalidated in the other replicas by Invalidator (optional).
+// A stale user is detected by the version check of Update, the conflicting user is evicted,
+// so the next GetOrCreateUser reloads it.
+type CachingDbHandler struct {
+	DbHandler
+
+	// Size is the max number of cached users
+	Size int
+	// TTL is the max age of a cached user
+	TTL time.Duration
+	// Invalidator connects the caches of the replicas, nil if there are no replicas
+	Invalidator CacheInvalidator
+
+	entries map[string]*list.Element
+	lru     *list.List
+
+	mx sync.Mutex
+}
+
+// Connect connects to the DB and to the Invalidator
+func (dbHandler *CachingDbHandler) Connect() error {
+	return dbHandler.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to the DB and to the Invalidator
+func (dbHandler *CachingDbHandler) ConnectContext(ctx context.Context) error {
+	if err := dbHandler.DbHandler.ConnectContext(ctx); err != nil {
+		return err
+	}
+
+	dbHandler.clear()
+
+	if dbHandler.Invalidator != nil {
+		if err := dbHandler.Invalidator.Connect(); err != nil {
+			dbHandler.DbHandler.Close()
+
+			return err
+		}
+
+		go dbHandler.listen(dbHandler.Invalidator.Invalidations())
+	}
+
+	return nil
+}
+
+// listen evicts the users, invalidated by the other replicas, until the Invalidator is closed
+func (dbHandler *CachingDbHandler) listen(invalidations <-chan string) {
+	for uid := range invalidations {
+		if uid == cacheInvalidateAll {
+			dbHandler.clear()
+		} else {
+			dbHandler.remove(uid)
+		}
+	}
+}
+
+// Close closes the Invalidator and the DB connection
+func (dbHandler *CachingDbHandler) Close() {
+	if dbHandler.Invalidator != nil {
+		dbHandler.Invalidator.Close()
+	}
+
+	dbHandler.clear()
+	dbHandler.DbHandler.Close()
+}
+
+// GetOrCreateUser creates a new user or returns, if exists
+func (dbHandler *CachingDbHandler) GetOrCreateUser(uid string) (User, error) {
+	return dbHandler.GetOrCreateUserContext(context.Background(), uid)
+}
+
+// GetOrCreateUserContext creates a new user or returns, if exists
+func (dbHandler *CachingDbHandler) GetOrCreateUserContext(ctx context.Context, uid string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{UID: uid}, err
+	}
+
+	if user, has := dbHandler.get(uid); has {
+		cacheRequests.WithLabelValues("hit").Inc()
+
+		return user, nil
+	}
+	cacheRequests.WithLabelValues("miss").Inc()
+
+	user, err := dbHandler.DbHandler.GetOrCreateUserContext(ctx, uid)
+	if err != nil {
+		return user, err
+	}
+
+	dbHandler.put(user)
+
+	return user, nil
+}
+
+// Update updates user
+func (dbHandler *CachingDbHandler) Update(user User) error { // nolint:gocritic
+	return dbHandler.UpdateContext(context.Background(), user)
+}
+
+// UpdateContext updates user in the DB and in the cache
+func (dbHandler *CachingDbHandler) UpdateContext(ctx context.Context, user User) error { // nolint:gocritic
+	return dbHandler.updated(ctx, user, dbHandler.DbHandler.UpdateContext(ctx, user))
+}
+
+// UpdateWithOutboxContext updates user and stores the outbox messages in the DB, and updates the cache
+func (dbHandler *CachingDbHandler) UpdateWithOutboxContext(ctx context.Context, user *User, messages []OutboxMessage,
+) error {
+	err := dbHandler.DbHandler.UpdateWithOutboxContext(ctx, user, messages)
+	if user == nil {
+		return err
+	}
+
+	return dbHandler.updated(ctx, *user, err)
+}
+
+// UpdateSealedContext stores the personal data of the user and evicts it from the caches
+// The Version is not changed, so the cached user cannot be replaced by version.
+func (dbHandler *CachingDbHandler) UpdateSealedContext(ctx context.Context, user User) error { // nolint:gocritic
+	err := dbHandler.DbHandler.UpdateSealedContext(ctx, user)
+	dbHandler.remove(user.UID)
+	if err == nil {
+		dbHandler.invalidate(ctx, user.UID)
+	}
+
+	return err
+}
+
+// updated updates the cache by the result of updating the user in the DB
+func (dbHandler *CachingDbHandler) updated(ctx context.Context, user User, err error) error { // nolint:gocritic
+	if err != nil {
+		// the cached user is stale or the stored state is unknown
+		dbHandler.remove(user.UID)
+
+		return err
+	}
+
+	if user.ID == 0 {
+		// created, but the ID is not known
+		dbHandler.remove(user.UID)
+	} else {
+		user.Version++
+		user.UpdatedAt = time.Now()
+		dbHandler.put(user)
+	}
+
+	dbHandler.invalidate(ctx, user.UID)
+
+	return nil
+}
+
+// PurgeUsersContext deletes the inactive users and evicts all users from the cache
+func (dbHandler *CachingDbHandler) PurgeUsersContext(ctx context.Context, inactiveSince time.Time, dryRun bool) (int, error) {
+	purged, err := dbHandler.DbHandler.PurgeUsersContext(ctx, inactiveSince, dryRun)
+
+	if !dryRun && (purged > 0 || err != nil) {
+		dbHandler.clear()
+		dbHandler.invalidate(ctx, cacheInvalidateAll)
+	}
+
+	return purged, err
+}
+
+// invalidate sends uid to the other replicas
+// The DB is already updated, so an error is only logged, the replicas detect the stale user at Update
+func (dbHandler *CachingDbHandler) invalidate(ctx context.Context, uid string) {
+	if dbHandler.Invalidator == nil {
+		return
+	}
+
+	if err := dbHandler.Invalidator.Invalidate(ctx, uid); err != nil {
+		logger.Get().Warning("cannot invalidate user in replicas, ", err)
+	}
+}
+
+func (dbHandler *CachingDbHandler) get(uid string) (User, bool) {
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	element, has := dbHandler.entries[uid]
+	if !has {
+		return User{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		dbHandler.lru.Remove(element)
+		delete(dbHandler.entries, uid)
+
+		return User{}, false
+	}
+
+	dbHandler.lru.MoveToFront(element)
+
+	return entry.user, true
+}
+
+// put stores user, a newer cached version is kept
+func (dbHandler *CachingDbHandler) put(user User) { // nolint:gocritic
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if dbHandler.Size <= 0 {
+		return
+	}
+
+	if dbHandler.entries == nil {
+		dbHandler.entries = map[string]*list.Element{}
+		dbHandler.lru = list.New()
+	}
+
+	if element, has := dbHandler.entries[user.UID]; has {
+		entry := element.Value.(*cacheEntry)
+		if entry.user.Version <= user.Version {
+			entry.user = user
+			entry.expires = time.Now().Add(dbHandler.TTL)
+		}
+		dbHandler.lru.MoveToFront(element)
+
+		return
+	}
+
+	dbHandler.entries[user.UID] = dbHandler.lru.PushFront(&cacheEntry{user: user, expires: time.Now().Add(dbHandler.TTL)})
+
+	for dbHandler.lru.Len() > dbHandler.Size {
+		oldest := dbHandler.lru.Back()
+		dbHandler.lru.Remove(oldest)
+		delete(dbHandler.entries, oldest.Value.(*cacheEntry).user.UID)
+	}
+}
+
+func (dbHandler *CachingDbHandler) remove(uid string) {
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if element, has := dbHandler.entries[uid]; has {
+		dbHandler.lru.Remove(element)
+		delete(dbHandler.entries, uid)
+	}
+}
+
+func (dbHandler *CachingDbHandler) clear() {
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	dbHandler.entries = map[string]*list.Element{}
+	dbHandler.lru = list.New()
+}
@@ -0,0 +1,184 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// DeliveryQueued is the status of a response, which is not sent yet
+	DeliveryQueued = "queued"
+	// DeliverySent is the status of a response, which was accepted by the callback endpoint
+	DeliverySent = "sent"
+	// DeliveryAcked is the status of a response, which was acknowledged by the client
+	DeliveryAcked = "acked"
+	// DeliveryFailed is the status of a response, which could not be sent
+	DeliveryFailed = "failed"
+)
+
+var (
+	// ErrDeliveryNotFound is returned, if the message ID is unknown
+	ErrDeliveryNotFound = errors.New("delivery not found") // nolint:gochecknoglobals
+	// ErrDeliveryStatus is returned, if the status of the delivery cannot be changed to the new one
+	ErrDeliveryStatus = errors.New("invalid delivery status change") // nolint:gochecknoglobals
+)
+
+// Delivery table, the delivery status of a response message
+type Delivery struct {
+	gorm.Model
+	// MessageID is the ID of the response (api.ResponseMessage.ID)
+	MessageID string `gorm:"unique_index"`
+	// RequestID is the ID of the envelope of the request
+	RequestID string `gorm:"index"`
+	// Client is the client of the request, identified by the frontend (API key)
+	Client string `gorm:"index"`
+	// Recipient is the UID of the user (api.ResponseMessage.To)
+	Recipient string
+	Status    string `gorm:"not null"`
+	// Attempts is the number of callback attempts
+	Attempts int
+	// LastError is the reason of DeliveryFailed
+	LastError string `gorm:"type:text"`
+	SentAt    *time.Time
+	AckedAt   *time.Time
+}
+
+// TableName forces table name singular
+func (Delivery) TableName() string {
+	return "delivery"
+}
+
+// DeliveryEvent is a status change of a delivery
+type DeliveryEvent struct {
+	Status string
+	At     time.Time
+	// Attempts is the number of callback attempts, it's not changed, if 0
+	Attempts int
+	// Error is the reason of DeliveryFailed
+	Error string
+}
+
+// CanChangeDeliveryStatus tells, if the status of a delivery can be changed from the status to the other
+// A queued delivery becomes sent or failed. Any delivery can be acked, because the client may have
+// received a response, which was recorded as failed (for example, the callback timed out). Acked is final.
+func CanChangeDeliveryStatus(from string, to string) bool {
+	switch to {
+	case DeliverySent, DeliveryFailed:
+		return from == DeliveryQueued
+	case DeliveryAcked:
+		return from != DeliveryAcked
+	default:
+		return false
+	}
+}
+
+// apply changes the delivery by the event, the changed columns are returned
+func (delivery *Delivery) apply(event DeliveryEvent) map[string]interface{} { // nolint:gocritic
+	at := event.At
+	delivery.Status = event.Status
+	fields := map[string]interface{}{"status": event.Status}
+
+	if event.Attempts > 0 {
+		delivery.Attempts = event.Attempts
+		fields["attempts"] = event.Attempts
+	}
+
+	switch event.Status {
+	case DeliverySent:
+		delivery.SentAt = &at
+		fields["sent_at"] = &at
+	case DeliveryAcked:
+		delivery.AckedAt = &at
+		fields["acked_at"] = &at
+	case DeliveryFailed:
+		delivery.LastError = event.Error
+		fields["last_error"] = event.Error
+	}
+
+	return fields
+}
+
+// GetDeliveryContext returns the delivery of the message, or ErrDeliveryNotFound
+func (dbHandler *gormDbHandler) GetDeliveryContext(ctx context.Context, messageID string) (Delivery, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	delivery := Delivery{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Where(Delivery{MessageID: messageID}).First(&delivery).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return delivery, ErrDeliveryNotFound
+	}
+
+	return delivery, err
+}
+
+// UpdateDeliveryContext changes the status of the delivery of the message, the changed delivery is returned
+// Setting the current status again does nothing. ErrDeliveryNotFound or ErrDeliveryStatus is returned,
+// if the delivery is unknown or its status cannot be changed (see CanChangeDeliveryStatus).
+func (dbHandler *gormDbHandler) UpdateDeliveryContext(ctx context.Context, messageID string, event DeliveryEvent,
+) (Delivery, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	delivery := Delivery{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		if err := tx.Where(Delivery{MessageID: messageID}).First(&delivery).Error; err != nil {
+			return err
+		}
+		if delivery.Status == event.Status {
+			return nil
+		}
+		if !CanChangeDeliveryStatus(delivery.Status, event.Status) {
+			return ErrDeliveryStatus
+		}
+
+		status := delivery.Status
+		db := tx.Model(&Delivery{}).Where("id = ? AND status = ?", delivery.ID, status).Updates(delivery.apply(event))
+		if db.Error != nil {
+			return db.Error
+		}
+		// the status was changed concurrently
+		if db.RowsAffected == 0 {
+			return ErrDeliveryStatus
+		}
+
+		return nil
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return delivery, ErrDeliveryNotFound
+	}
+
+	return delivery, err
+}
+
+// PurgeDeliveriesContext deletes the deliveries, created before createdBefore, and returns the number of them
+// The rows are deleted physically (not only marked by DeletedAt)
+func (dbHandler *gormDbHandler) PurgeDeliveriesContext(ctx context.Context, createdBefore time.Time, dryRun bool,
+) (int, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	purged := 0
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		old := tx.Unscoped().Model(&Delivery{}).Where("created_at < ?", createdBefore)
+
+		if dryRun {
+			return old.Count(&purged).Error
+		}
+
+		db := old.Delete(&Delivery{})
+		purged = int(db.RowsAffected)
+
+		return db.Error
+	})
+
+	return purged, err
+}
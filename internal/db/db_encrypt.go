@@ -0,0 +1,379 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/pgillich/chat-bot/internal/crypt"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+const reencryptBatchSize = 100
+
+// sealedUser is the personal data of User, which is encrypted
+type sealedUser struct {
+	Name   string     `json:"name,omitempty"`
+	BornOn *time.Time `json:"born_on,omitempty"`
+	BornAt string     `json:"born_at,omitempty"`
+}
+
+// EncryptingDbHandler encrypts the personal data of User (Name, BornOn, BornAt),
+// the secret of CallbackRoute and the texts of OutboxMessage and TranscriptEntry at rest
+// It's a decorator: the wrapped DbHandler stores the encrypted data in User.Sealed and User.KeyID,
+// while the users returned by EncryptingDbHandler contain the decrypted data
+// Users, stored before the encryption was enabled, are encrypted at the next Update
+type EncryptingDbHandler struct {
+	DbHandler
+
+	KeyRing *crypt.KeyRing
+}
+
+// GetOrCreateUser creates a new user or returns, if exists
+func (dbHandler *EncryptingDbHandler) GetOrCreateUser(uid string) (User, error) {
+	return dbHandler.GetOrCreateUserContext(context.Background(), uid)
+}
+
+// GetOrCreateUserContext creates a new user or returns, if exists
+func (dbHandler *EncryptingDbHandler) GetOrCreateUserContext(ctx context.Context, uid string) (User, error) {
+	user, err := dbHandler.DbHandler.GetOrCreateUserContext(ctx, uid)
+	if err != nil {
+		return user, err
+	}
+
+	return dbHandler.open(user)
+}
+
+// Update updates user
+func (dbHandler *EncryptingDbHandler) Update(user User) error { // nolint:gocritic
+	return dbHandler.UpdateContext(context.Background(), user)
+}
+
+// UpdateContext updates user
+func (dbHandler *EncryptingDbHandler) UpdateContext(ctx context.Context, user User) error { // nolint:gocritic
+	sealed, err := dbHandler.seal(user)
+	if err != nil {
+		return err
+	}
+
+	return dbHandler.DbHandler.UpdateContext(ctx, sealed)
+}
+
+// UpdateWithOutboxContext seals the user and the texts of the messages, and stores them
+func (dbHandler *EncryptingDbHandler) UpdateWithOutboxContext(ctx context.Context, user *User, messages []OutboxMessage,
+) error {
+	if user != nil {
+		sealed, err := dbHandler.seal(*user)
+		if err != nil {
+			return err
+		}
+		user = &sealed
+	}
+
+	sealedMessages := make([]OutboxMessage, len(messages))
+	for m := range messages {
+		var err error
+		if sealedMessages[m], err = dbHandler.sealMessage(messages[m]); err != nil {
+			return err
+		}
+	}
+
+	return dbHandler.DbHandler.UpdateWithOutboxContext(ctx, user, sealedMessages)
+}
+
+// ClaimOutboxContext returns the claimed messages with the opened texts
+func (dbHandler *EncryptingDbHandler) ClaimOutboxContext(ctx context.Context, now time.Time, leaseUntil time.Time,
+	limit int,
+) ([]OutboxMessage, error) {
+	messages, err := dbHandler.DbHandler.ClaimOutboxContext(ctx, now, leaseUntil, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return dbHandler.openMessages(messages)
+}
+
+// DoneOutboxContext returns the done messages with the opened texts
+func (dbHandler *EncryptingDbHandler) DoneOutboxContext(ctx context.Context, requestID string, lastSequence int,
+	doneAt time.Time,
+) ([]OutboxMessage, error) {
+	messages, err := dbHandler.DbHandler.DoneOutboxContext(ctx, requestID, lastSequence, doneAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return dbHandler.openMessages(messages)
+}
+
+// AppendTranscriptContext seals the texts of the entries, the UID is the associated data, and stores them
+// The entries are not reencrypted, an old master key is needed until its entries are purged by the retention.
+func (dbHandler *EncryptingDbHandler) AppendTranscriptContext(ctx context.Context, entries []TranscriptEntry) error {
+	sealedEntries := make([]TranscriptEntry, len(entries))
+	for e := range entries {
+		sealedEntries[e] = entries[e]
+
+		var err error
+		sealedEntries[e].KeyID, sealedEntries[e].Text, err = dbHandler.KeyRing.Seal(
+			[]byte(entries[e].Text), []byte(entries[e].UID))
+		if err != nil {
+			return err
+		}
+	}
+
+	return dbHandler.DbHandler.AppendTranscriptContext(ctx, sealedEntries)
+}
+
+// ListTranscriptContext returns the transcript entries of the user with the opened texts
+func (dbHandler *EncryptingDbHandler) ListTranscriptContext(ctx context.Context, uid string) ([]TranscriptEntry, error) {
+	entries, err := dbHandler.DbHandler.ListTranscriptContext(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	for e := range entries {
+		if entries[e].KeyID == "" {
+			continue
+		}
+
+		plaintext, err := dbHandler.KeyRing.Open(entries[e].KeyID, entries[e].Text, []byte(entries[e].UID))
+		if err != nil {
+			return nil, err
+		}
+		entries[e].Text, entries[e].KeyID = string(plaintext), ""
+	}
+
+	return entries, nil
+}
+
+// ListUsersContext returns max limit users, ordered by ID, starting after afterID
+func (dbHandler *EncryptingDbHandler) ListUsersContext(ctx context.Context, afterID uint, limit int) ([]User, error) {
+	users, err := dbHandler.DbHandler.ListUsersContext(ctx, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for u := range users {
+		if users[u], err = dbHandler.open(users[u]); err != nil {
+			return nil, err
+		}
+	}
+
+	return users, nil
+}
+
+// SetCallbackRouteContext seals the secret and stores the route
+// nolint:gocritic
+func (dbHandler *EncryptingDbHandler) SetCallbackRouteContext(ctx context.Context, route CallbackRoute) (CallbackRoute, error) {
+	sealed, err := dbHandler.sealRoute(route)
+	if err != nil {
+		return route, err
+	}
+
+	if sealed, err = dbHandler.DbHandler.SetCallbackRouteContext(ctx, sealed); err != nil {
+		return route, err
+	}
+
+	return dbHandler.openRoute(sealed)
+}
+
+// GetCallbackRouteContext returns the route of the client with the opened secret
+func (dbHandler *EncryptingDbHandler) GetCallbackRouteContext(ctx context.Context, client string) (CallbackRoute, error) {
+	route, err := dbHandler.DbHandler.GetCallbackRouteContext(ctx, client)
+	if err != nil {
+		return route, err
+	}
+
+	return dbHandler.openRoute(route)
+}
+
+// ListCallbackRoutesContext returns the routes with the opened secrets
+func (dbHandler *EncryptingDbHandler) ListCallbackRoutesContext(ctx context.Context) ([]CallbackRoute, error) {
+	routes, err := dbHandler.DbHandler.ListCallbackRoutesContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for r := range routes {
+		if routes[r], err = dbHandler.openRoute(routes[r]); err != nil {
+			return nil, err
+		}
+	}
+
+	return routes, nil
+}
+
+// Reencrypt wraps the data keys of the stored users and callback routes by the active master key
+// Users and routes, stored without encryption, are encrypted
+// It returns the number of updated users and routes. Concurrently updated users are skipped.
+func (dbHandler *EncryptingDbHandler) Reencrypt(ctx context.Context) (int, error) {
+	updated, routeErr := dbHandler.reencryptRoutes(ctx)
+	if routeErr != nil {
+		return updated, routeErr
+	}
+	activeKeyID := dbHandler.KeyRing.ActiveKeyID()
+
+	for afterID := uint(0); ; {
+		users, err := dbHandler.DbHandler.ListUsersContext(ctx, afterID, reencryptBatchSize)
+		if err != nil {
+			return updated, err
+		}
+		if len(users) == 0 {
+			return updated, nil
+		}
+
+		for _, user := range users { // nolint:gocritic
+			afterID = user.ID
+
+			if user.Sealed != "" && user.KeyID == activeKeyID {
+				continue
+			}
+
+			if user.Sealed != "" {
+				user.KeyID, user.Sealed, err = dbHandler.KeyRing.Rewrap(user.KeyID, user.Sealed)
+			} else {
+				user, err = dbHandler.seal(user)
+			}
+			if err != nil {
+				return updated, err
+			}
+
+			if err := dbHandler.DbHandler.UpdateSealedContext(ctx, user); err != nil {
+				if IsConflict(err) {
+					logger.Get().Warning("skipped, ", err)
+
+					continue
+				}
+
+				return updated, err
+			}
+
+			updated++
+		}
+	}
+}
+
+// reencryptRoutes wraps the secrets of the routes by the active master key
+func (dbHandler *EncryptingDbHandler) reencryptRoutes(ctx context.Context) (int, error) {
+	updated := 0
+	activeKeyID := dbHandler.KeyRing.ActiveKeyID()
+
+	routes, err := dbHandler.DbHandler.ListCallbackRoutesContext(ctx)
+	if err != nil {
+		return updated, err
+	}
+
+	for _, route := range routes { // nolint:gocritic
+		if route.Secret == "" || route.KeyID == activeKeyID {
+			continue
+		}
+
+		if route.KeyID != "" {
+			route.KeyID, route.Secret, err = dbHandler.KeyRing.Rewrap(route.KeyID, route.Secret)
+		} else {
+			route, err = dbHandler.sealRoute(route)
+		}
+		if err != nil {
+			return updated, err
+		}
+
+		if _, err := dbHandler.DbHandler.SetCallbackRouteContext(ctx, route); err != nil {
+			return updated, err
+		}
+
+		updated++
+	}
+
+	return updated, nil
+}
+
+// sealRoute seals the secret of the route, the client is the associated data
+func (dbHandler *EncryptingDbHandler) sealRoute(route CallbackRoute) (CallbackRoute, error) { // nolint:gocritic
+	if route.Secret == "" {
+		route.KeyID = ""
+
+		return route, nil
+	}
+
+	var err error
+	route.KeyID, route.Secret, err = dbHandler.KeyRing.Seal([]byte(route.Secret), []byte(route.Client))
+
+	return route, err
+}
+
+// openRoute opens the sealed secret of the route
+func (dbHandler *EncryptingDbHandler) openRoute(route CallbackRoute) (CallbackRoute, error) { // nolint:gocritic
+	if route.KeyID == "" {
+		return route, nil
+	}
+
+	plaintext, err := dbHandler.KeyRing.Open(route.KeyID, route.Secret, []byte(route.Client))
+	if err != nil {
+		return route, err
+	}
+	route.Secret, route.KeyID = string(plaintext), ""
+
+	return route, nil
+}
+
+// sealMessage seals the text of the outbox message, the message ID is the associated data
+// The outbox messages are not reencrypted, because they are sent shortly after storing.
+func (dbHandler *EncryptingDbHandler) sealMessage(message OutboxMessage) (OutboxMessage, error) { // nolint:gocritic
+	var err error
+	message.KeyID, message.Text, err = dbHandler.KeyRing.Seal([]byte(message.Text), []byte(message.MessageID))
+
+	return message, err
+}
+
+// openMessages opens the sealed texts of the outbox messages
+func (dbHandler *EncryptingDbHandler) openMessages(messages []OutboxMessage) ([]OutboxMessage, error) {
+	for m := range messages {
+		if messages[m].KeyID == "" {
+			continue
+		}
+
+		plaintext, err := dbHandler.KeyRing.Open(messages[m].KeyID, messages[m].Text, []byte(messages[m].MessageID))
+		if err != nil {
+			return nil, err
+		}
+		messages[m].Text, messages[m].KeyID = string(plaintext), ""
+	}
+
+	return messages, nil
+}
+
+// seal moves the personal data into Sealed
+func (dbHandler *EncryptingDbHandler) seal(user User) (User, error) { // nolint:gocritic
+	plaintext, err := json.Marshal(sealedUser{Name: user.Name, BornOn: user.BornOn, BornAt: user.BornAt})
+	if err != nil {
+		return user, err
+	}
+
+	if user.KeyID, user.Sealed, err = dbHandler.KeyRing.Seal(plaintext, []byte(user.UID)); err != nil {
+		return user, err
+	}
+
+	user.Name, user.BornOn, user.BornAt = "", nil, ""
+
+	return user, nil
+}
+
+// open restores the personal data from Sealed
+func (dbHandler *EncryptingDbHandler) open(user User) (User, error) { // nolint:gocritic
+	if user.Sealed == "" {
+		return user, nil
+	}
+
+	plaintext, err := dbHandler.KeyRing.Open(user.KeyID, user.Sealed, []byte(user.UID))
+	if err != nil {
+		return user, err
+	}
+
+	data := sealedUser{}
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return user, err
+	}
+
+	user.Name, user.BornOn, user.BornAt = data.Name, data.BornOn, data.BornAt
+
+	return user, nil
+}
@@ -1,41 +1,841 @@
 package db
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
+// ErrFakeClosed is returned by FakeDbHandler, if it's used after Close
+var ErrFakeClosed = errors.New("fake database is closed") // nolint:gochecknoglobals
+
 // FakeDbHandler is a fake implementation of DbHandler
+// It follows the semantics of RealDbHandler: IDs and timestamps are filled,
+// data survives Close and Connect
 type FakeDbHandler struct {
-	data sync.Map
+	users          map[string]User
+	lastID         uint
+	apiKeys        map[string]APIKey
+	lastKeyID      uint
+	routes         map[string]CallbackRoute
+	lastRouteID    uint
+	deliveries     map[string]Delivery
+	lastDeliveryID uint
+	outbox         map[string]OutboxMessage
+	lastOutboxID   uint
+	transcript     []TranscriptEntry
+	lastEntryID    uint
+	processed      map[string]ProcessedRequest
+	lastProcessed  uint
+	connected      bool
+
+	mx sync.Mutex
 }
 
-// Connect resets everything
+// Connect opens the DB, the stored data is kept
 func (dbHandler *FakeDbHandler) Connect() error {
-	dbHandler.data = sync.Map{}
+	return dbHandler.ConnectContext(context.Background())
+}
+
+// ConnectContext opens the DB, the stored data is kept
+func (dbHandler *FakeDbHandler) ConnectContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if dbHandler.users == nil {
+		dbHandler.users = map[string]User{}
+	}
+	if dbHandler.apiKeys == nil {
+		dbHandler.apiKeys = map[string]APIKey{}
+	}
+	if dbHandler.routes == nil {
+		dbHandler.routes = map[string]CallbackRoute{}
+	}
+	if dbHandler.deliveries == nil {
+		dbHandler.deliveries = map[string]Delivery{}
+	}
+	if dbHandler.outbox == nil {
+		dbHandler.outbox = map[string]OutboxMessage{}
+	}
+	if dbHandler.processed == nil {
+		dbHandler.processed = map[string]ProcessedRequest{}
+	}
+	dbHandler.connected = true
 
 	return nil
 }
 
-// Close deletes DB
+// Close closes DB, the stored data is kept
 func (dbHandler *FakeDbHandler) Close() {
-	dbHandler.data.Range(func(key interface{}, value interface{}) bool {
-		dbHandler.data.Delete(key)
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
 
-		return true
-	})
+	dbHandler.connected = false
 }
 
 // GetOrCreateUser creates a new user or returns, if exists
 func (dbHandler *FakeDbHandler) GetOrCreateUser(uid string) (User, error) {
-	userIf, _ := dbHandler.data.LoadOrStore(uid, User{UID: uid})
-	user, _ := userIf.(User) // nolint:errcheck
+	return dbHandler.GetOrCreateUserContext(context.Background(), uid)
+}
+
+// GetOrCreateUserContext creates a new user or returns, if exists
+func (dbHandler *FakeDbHandler) GetOrCreateUserContext(ctx context.Context, uid string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{UID: uid}, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return User{UID: uid}, ErrFakeClosed
+	}
+
+	if user, has := dbHandler.users[uid]; has {
+		return user, nil
+	}
+
+	user := dbHandler.newUser(User{UID: uid})
+	dbHandler.users[uid] = user
 
 	return user, nil
 }
 
 // Update updates user
 func (dbHandler *FakeDbHandler) Update(user User) error { // nolint:gocritic
-	dbHandler.data.Store(user.UID, user)
+	return dbHandler.UpdateContext(context.Background(), user)
+}
+
+// UpdateContext updates user
+func (dbHandler *FakeDbHandler) UpdateContext(ctx context.Context, user User) error { // nolint:gocritic
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	return dbHandler.update(user)
+}
+
+// UpdateSealedContext stores only the personal data of the user, Version and UpdatedAt are kept
+func (dbHandler *FakeDbHandler) UpdateSealedContext(ctx context.Context, user User) error { // nolint:gocritic
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	stored, has := dbHandler.users[user.UID]
+	if !has || stored.Version != user.Version {
+		return &ConflictError{UID: user.UID, Version: user.Version}
+	}
+
+	stored.Name = user.Name
+	stored.BornOn = user.BornOn
+	stored.BornAt = user.BornAt
+	stored.Sealed = user.Sealed
+	stored.KeyID = user.KeyID
+	dbHandler.users[user.UID] = stored
+
+	return nil
+}
+
+// update updates the user, mx must be locked
+func (dbHandler *FakeDbHandler) update(user User) error { // nolint:gocritic
+	if user.ID == 0 {
+		user = dbHandler.newUser(user)
+	} else {
+		stored, has := dbHandler.users[user.UID]
+		if !has || stored.Version != user.Version || stored.FenceToken > user.FenceToken {
+			return &ConflictError{UID: user.UID, Version: user.Version}
+		}
+
+		user.Version++
+		user.UpdatedAt = time.Now()
+	}
+	dbHandler.users[user.UID] = user
+
+	if user.LastRequestKey != "" {
+		key := processedKey(user.UID, user.LastRequestKey)
+		if _, has := dbHandler.processed[key]; !has {
+			dbHandler.lastProcessed++
+			processed := ProcessedRequest{UID: user.UID, RequestKey: user.LastRequestKey}
+			processed.ID = dbHandler.lastProcessed
+			processed.CreatedAt = time.Now()
+			processed.UpdatedAt = processed.CreatedAt
+			dbHandler.processed[key] = processed
+		}
+	}
+
+	return nil
+}
+
+// processedKey is the key of FakeDbHandler.processed
+func processedKey(uid string, requestKey string) string {
+	return uid + "\x00" + requestKey
+}
+
+// IsRequestProcessedContext tells, if the request (User.LastRequestKey of an earlier update) was processed
+func (dbHandler *FakeDbHandler) IsRequestProcessedContext(ctx context.Context, uid string, requestKey string,
+) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return false, ErrFakeClosed
+	}
+
+	_, has := dbHandler.processed[processedKey(uid, requestKey)]
+
+	return has, nil
+}
+
+// PurgeProcessedRequestsContext deletes the processed request keys, stored before createdBefore,
+// and returns the number of them
+func (dbHandler *FakeDbHandler) PurgeProcessedRequestsContext(ctx context.Context, createdBefore time.Time,
+	dryRun bool,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return 0, ErrFakeClosed
+	}
+
+	purged := 0
+	for key, processed := range dbHandler.processed { // nolint:gocritic
+		if processed.CreatedAt.Before(createdBefore) {
+			purged++
+			if !dryRun {
+				delete(dbHandler.processed, key)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// ListUsersContext returns max limit users, ordered by ID, starting after afterID
+func (dbHandler *FakeDbHandler) ListUsersContext(ctx context.Context, afterID uint, limit int) ([]User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return nil, ErrFakeClosed
+	}
+
+	users := []User{}
+	for _, user := range dbHandler.users { // nolint:gocritic
+		if user.ID > afterID {
+			users = append(users, user)
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	if len(users) > limit {
+		users = users[:limit]
+	}
+
+	return users, nil
+}
+
+// PurgeUsersContext deletes the users, not updated since inactiveSince, and returns the number of them
+func (dbHandler *FakeDbHandler) PurgeUsersContext(ctx context.Context, inactiveSince time.Time, dryRun bool,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return 0, ErrFakeClosed
+	}
+
+	purged := 0
+	for uid, user := range dbHandler.users { // nolint:gocritic
+		if user.UpdatedAt.Before(inactiveSince) {
+			purged++
+
+			if !dryRun {
+				delete(dbHandler.users, uid)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// CreateAPIKeyContext stores a new API key
+func (dbHandler *FakeDbHandler) CreateAPIKeyContext(ctx context.Context, key APIKey) (APIKey, error) { // nolint:gocritic
+	if err := ctx.Err(); err != nil {
+		return key, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return key, ErrFakeClosed
+	}
+
+	if _, has := dbHandler.apiKeys[key.KeyID]; has {
+		return key, fmt.Errorf("duplicate API key: %s", key.KeyID)
+	}
+
+	now := time.Now()
+	dbHandler.lastKeyID++
+	key.ID = dbHandler.lastKeyID
+	key.CreatedAt = now
+	key.UpdatedAt = now
+	dbHandler.apiKeys[key.KeyID] = key
+
+	return key, nil
+}
+
+// GetAPIKeyContext returns the API key, or ErrAPIKeyNotFound
+func (dbHandler *FakeDbHandler) GetAPIKeyContext(ctx context.Context, keyID string) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return APIKey{}, ErrFakeClosed
+	}
+
+	key, has := dbHandler.apiKeys[keyID]
+	if !has {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+
+	return key, nil
+}
+
+// ListAPIKeysContext returns the API keys, ordered by ID
+func (dbHandler *FakeDbHandler) ListAPIKeysContext(ctx context.Context) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return nil, ErrFakeClosed
+	}
+
+	keys := []APIKey{}
+	for _, key := range dbHandler.apiKeys { // nolint:gocritic
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys, nil
+}
+
+// RevokeAPIKeyContext revokes the API key, or returns ErrAPIKeyNotFound
+func (dbHandler *FakeDbHandler) RevokeAPIKeyContext(ctx context.Context, keyID string, revokedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	key, has := dbHandler.apiKeys[keyID]
+	if !has {
+		return ErrAPIKeyNotFound
+	}
+
+	if key.RevokedAt == nil {
+		key.RevokedAt = &revokedAt
+		key.UpdatedAt = time.Now()
+		dbHandler.apiKeys[keyID] = key
+	}
+
+	return nil
+}
+
+// newUser fills ID and timestamps, like gorm does on create
+func (dbHandler *FakeDbHandler) newUser(user User) User { // nolint:gocritic
+	now := time.Now()
+
+	dbHandler.lastID++
+	user.ID = dbHandler.lastID
+	user.CreatedAt = now
+	user.UpdatedAt = now
+
+	return user
+}
+
+// SetCallbackRouteContext creates or updates the route of the client
+// nolint:gocritic
+func (dbHandler *FakeDbHandler) SetCallbackRouteContext(ctx context.Context, route CallbackRoute) (CallbackRoute, error) {
+	if err := ctx.Err(); err != nil {
+		return route, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return route, ErrFakeClosed
+	}
+
+	now := time.Now()
+	if stored, has := dbHandler.routes[route.Client]; has {
+		route.Model = stored.Model
+	} else {
+		dbHandler.lastRouteID++
+		route.ID = dbHandler.lastRouteID
+		route.CreatedAt = now
+	}
+	route.UpdatedAt = now
+	dbHandler.routes[route.Client] = route
+
+	return route, nil
+}
+
+// GetCallbackRouteContext returns the route of the client, or ErrCallbackRouteNotFound
+func (dbHandler *FakeDbHandler) GetCallbackRouteContext(ctx context.Context, client string) (CallbackRoute, error) {
+	if err := ctx.Err(); err != nil {
+		return CallbackRoute{}, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return CallbackRoute{}, ErrFakeClosed
+	}
+
+	route, has := dbHandler.routes[client]
+	if !has {
+		return CallbackRoute{}, ErrCallbackRouteNotFound
+	}
+
+	return route, nil
+}
+
+// ListCallbackRoutesContext returns the routes, ordered by client
+func (dbHandler *FakeDbHandler) ListCallbackRoutesContext(ctx context.Context) ([]CallbackRoute, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return nil, ErrFakeClosed
+	}
+
+	routes := []CallbackRoute{}
+	for _, route := range dbHandler.routes { // nolint:gocritic
+		routes = append(routes, route)
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].Client < routes[j].Client })
+
+	return routes, nil
+}
+
+// DeleteCallbackRouteContext deletes the route of the client, or returns ErrCallbackRouteNotFound
+func (dbHandler *FakeDbHandler) DeleteCallbackRouteContext(ctx context.Context, client string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	if _, has := dbHandler.routes[client]; !has {
+		return ErrCallbackRouteNotFound
+	}
+	delete(dbHandler.routes, client)
+
+	return nil
+}
+
+// storeDelivery fills ID and timestamps, and stores the delivery, mx must be locked
+func (dbHandler *FakeDbHandler) storeDelivery(delivery Delivery) Delivery { // nolint:gocritic
+	now := time.Now()
+
+	dbHandler.lastDeliveryID++
+	delivery.ID = dbHandler.lastDeliveryID
+	delivery.CreatedAt = now
+	delivery.UpdatedAt = now
+	dbHandler.deliveries[delivery.MessageID] = delivery
+
+	return delivery
+}
+
+// GetDeliveryContext returns the delivery of the message, or ErrDeliveryNotFound
+func (dbHandler *FakeDbHandler) GetDeliveryContext(ctx context.Context, messageID string) (Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return Delivery{}, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return Delivery{}, ErrFakeClosed
+	}
+
+	delivery, has := dbHandler.deliveries[messageID]
+	if !has {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+
+	return delivery, nil
+}
+
+// UpdateDeliveryContext changes the status of the delivery of the message, the changed delivery is returned
+func (dbHandler *FakeDbHandler) UpdateDeliveryContext(ctx context.Context, messageID string, event DeliveryEvent,
+) (Delivery, error) {
+	if err := ctx.Err(); err != nil {
+		return Delivery{}, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return Delivery{}, ErrFakeClosed
+	}
+
+	delivery, has := dbHandler.deliveries[messageID]
+	if !has {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+	if delivery.Status == event.Status {
+		return delivery, nil
+	}
+	if !CanChangeDeliveryStatus(delivery.Status, event.Status) {
+		return delivery, ErrDeliveryStatus
+	}
+
+	delivery.apply(event)
+	delivery.UpdatedAt = time.Now()
+	dbHandler.deliveries[messageID] = delivery
+
+	return delivery, nil
+}
+
+// PurgeDeliveriesContext deletes the deliveries, created before createdBefore, and returns the number of them
+func (dbHandler *FakeDbHandler) PurgeDeliveriesContext(ctx context.Context, createdBefore time.Time, dryRun bool,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return 0, ErrFakeClosed
+	}
+
+	purged := 0
+	for messageID, delivery := range dbHandler.deliveries { // nolint:gocritic
+		if delivery.CreatedAt.Before(createdBefore) {
+			purged++
+			if !dryRun {
+				delete(dbHandler.deliveries, messageID)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// UpdateWithOutboxContext updates the user (if not nil) and stores the messages in the outbox,
+// with their queued deliveries, atomically
+func (dbHandler *FakeDbHandler) UpdateWithOutboxContext(ctx context.Context, user *User, messages []OutboxMessage,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	for m := range messages {
+		if _, has := dbHandler.outbox[messages[m].MessageID]; has {
+			return fmt.Errorf("duplicate message ID %s", messages[m].MessageID)
+		}
+		if _, has := dbHandler.deliveries[messages[m].MessageID]; has {
+			return fmt.Errorf("duplicate message ID %s", messages[m].MessageID)
+		}
+	}
+
+	if user != nil {
+		if err := dbHandler.update(*user); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	for _, message := range messages { // nolint:gocritic
+		dbHandler.lastOutboxID++
+		message.ID = dbHandler.lastOutboxID
+		message.CreatedAt = now
+		message.UpdatedAt = now
+		dbHandler.outbox[message.MessageID] = message
+		dbHandler.storeDelivery(newDelivery(&message))
+	}
 
 	return nil
 }
+
+// ClaimOutboxContext leases max limit due messages until leaseUntil, the first pending one of each request
+func (dbHandler *FakeDbHandler) ClaimOutboxContext(ctx context.Context, now time.Time, leaseUntil time.Time, limit int,
+) ([]OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return nil, ErrFakeClosed
+	}
+
+	// the first pending message of each request
+	first := map[string]OutboxMessage{}
+	for _, message := range dbHandler.outbox { // nolint:gocritic
+		if message.DoneAt != nil {
+			continue
+		}
+		if earlier, has := first[message.RequestID]; !has || message.Sequence < earlier.Sequence {
+			first[message.RequestID] = message
+		}
+	}
+
+	claimed := []OutboxMessage{}
+	for _, message := range first { // nolint:gocritic
+		if message.SendAt.After(now) || (message.LeasedUntil != nil && !message.LeasedUntil.Before(now)) {
+			continue
+		}
+		claimed = append(claimed, message)
+	}
+
+	sort.Slice(claimed, func(i, j int) bool { return claimed[i].ID < claimed[j].ID })
+	if len(claimed) > limit {
+		claimed = claimed[:limit]
+	}
+
+	for c := range claimed {
+		claimed[c].LeasedUntil = &leaseUntil
+		claimed[c].UpdatedAt = time.Now()
+		dbHandler.outbox[claimed[c].MessageID] = claimed[c]
+	}
+
+	return claimed, nil
+}
+
+// RetryOutboxContext changes the lease of the pending message to retryAt
+func (dbHandler *FakeDbHandler) RetryOutboxContext(ctx context.Context, messageID string, retryAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	message, has := dbHandler.outbox[messageID]
+	if !has || message.DoneAt != nil {
+		return nil
+	}
+	message.LeasedUntil = &retryAt
+	message.UpdatedAt = time.Now()
+	dbHandler.outbox[messageID] = message
+
+	return nil
+}
+
+// DoneOutboxContext marks the pending messages of the request done, up to lastSequence, and returns them
+func (dbHandler *FakeDbHandler) DoneOutboxContext(ctx context.Context, requestID string, lastSequence int,
+	doneAt time.Time,
+) ([]OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return nil, ErrFakeClosed
+	}
+
+	done := []OutboxMessage{}
+	for _, message := range dbHandler.outbox { // nolint:gocritic
+		if message.RequestID == requestID && message.Sequence <= lastSequence && message.DoneAt == nil {
+			message.DoneAt = &doneAt
+			message.UpdatedAt = time.Now()
+			dbHandler.outbox[message.MessageID] = message
+			done = append(done, message)
+		}
+	}
+
+	sort.Slice(done, func(i, j int) bool { return done[i].Sequence < done[j].Sequence })
+
+	return done, nil
+}
+
+// PurgeOutboxContext deletes the messages, done before doneBefore, and returns the number of them
+func (dbHandler *FakeDbHandler) PurgeOutboxContext(ctx context.Context, doneBefore time.Time, dryRun bool,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return 0, ErrFakeClosed
+	}
+
+	purged := 0
+	for messageID, message := range dbHandler.outbox { // nolint:gocritic
+		if message.DoneAt != nil && message.DoneAt.Before(doneBefore) {
+			purged++
+			if !dryRun {
+				delete(dbHandler.outbox, messageID)
+			}
+		}
+	}
+
+	return purged, nil
+}
+
+// AppendTranscriptContext stores the transcript entries
+func (dbHandler *FakeDbHandler) AppendTranscriptContext(ctx context.Context, entries []TranscriptEntry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return ErrFakeClosed
+	}
+
+	now := time.Now()
+	for _, entry := range entries { // nolint:gocritic
+		dbHandler.lastEntryID++
+		entry.ID = dbHandler.lastEntryID
+		entry.CreatedAt = now
+		entry.UpdatedAt = now
+		dbHandler.transcript = append(dbHandler.transcript, entry)
+	}
+
+	return nil
+}
+
+// ListTranscriptContext returns the transcript entries of the user, in the order of storing
+func (dbHandler *FakeDbHandler) ListTranscriptContext(ctx context.Context, uid string) ([]TranscriptEntry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return nil, ErrFakeClosed
+	}
+
+	entries := []TranscriptEntry{}
+	for _, entry := range dbHandler.transcript { // nolint:gocritic
+		if entry.UID == uid {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+// PurgeTranscriptsContext deletes the transcript entries, created before createdBefore, and returns the number of them
+func (dbHandler *FakeDbHandler) PurgeTranscriptsContext(ctx context.Context, createdBefore time.Time, dryRun bool,
+) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	dbHandler.mx.Lock()
+	defer dbHandler.mx.Unlock()
+
+	if !dbHandler.connected {
+		return 0, ErrFakeClosed
+	}
+
+	kept := []TranscriptEntry{}
+	for _, entry := range dbHandler.transcript { // nolint:gocritic
+		if !entry.CreatedAt.Before(createdBefore) {
+			kept = append(kept, entry)
+		}
+	}
+	purged := len(dbHandler.transcript) - len(kept)
+
+	if !dryRun {
+		dbHandler.transcript = kept
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// OutboxMessage table, a response, which is stored together with the user update, and sent by the relay
+type OutboxMessage struct {
+	gorm.Model
+	// MessageID is the ID of the response (api.ResponseMessage.ID)
+	MessageID string `gorm:"unique_index"`
+	// RequestID groups the responses of a request, they are sent in the order of Sequence
+	RequestID string `gorm:"index"`
+	Sequence  int
+	// Client is the client of the request, identified by the frontend (API key)
+	Client string
+	// Recipient is the UID of the user (api.ResponseMessage.To)
+	Recipient string
+	// Text is the response, sealed by EncryptingDbHandler
+	Text string `gorm:"type:text"`
+	// KeyID is the ID of the master key, which sealed Text, empty if Text is not sealed
+	KeyID string
+	// SendAt is the earliest time of sending (the artificial delay of the response)
+	SendAt time.Time `gorm:"index"`
+	// LeasedUntil is set by the relay, which sends the message, it's not claimed by other relays until then
+	LeasedUntil *time.Time
+	// DoneAt is set, when the message was sent or it failed
+	DoneAt *time.Time `gorm:"index"`
+}
+
+// TableName forces table name singular
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// newDelivery returns the queued delivery of the message
+func newDelivery(message *OutboxMessage) Delivery {
+	return Delivery{
+		MessageID: message.MessageID,
+		RequestID: message.RequestID,
+		Client:    message.Client,
+		Recipient: message.Recipient,
+		Status:    DeliveryQueued,
+	}
+}
+
+// UpdateWithOutboxContext updates the user (like UpdateContext) and stores the messages in the outbox,
+// with their queued deliveries, in one transaction
+// If user is nil, only the messages are stored.
+func (dbHandler *gormDbHandler) UpdateWithOutboxContext(ctx context.Context, user *User, messages []OutboxMessage,
+) error {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		if user != nil {
+			if err := updateUser(tx, *user); err != nil {
+				return err
+			}
+		}
+
+		for m := range messages {
+			message := messages[m]
+			if err := tx.Create(&message).Error; err != nil {
+				return err
+			}
+
+			delivery := newDelivery(&message)
+			if err := tx.Create(&delivery).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ClaimOutboxContext leases max limit pending messages, which are due at now, until leaseUntil
+// A message is claimed, if it's not leased by an other relay and the previous messages of its request are done,
+// so the responses of a request are sent in order.
+func (dbHandler *gormDbHandler) ClaimOutboxContext(ctx context.Context, now time.Time, leaseUntil time.Time, limit int,
+) ([]OutboxMessage, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	claimed := []OutboxMessage{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		candidates := []OutboxMessage{}
+		err := tx.Where("done_at IS NULL AND send_at <= ? AND (leased_until IS NULL OR leased_until < ?)", now, now).
+			Where("NOT EXISTS (SELECT 1 FROM outbox earlier WHERE earlier.request_id = outbox.request_id" +
+				" AND earlier.sequence < outbox.sequence AND earlier.done_at IS NULL)").
+			Order("id").Limit(limit).Find(&candidates).Error
+		if err != nil {
+			return err
+		}
+
+		for c := range candidates {
+			// an other relay may have claimed it since the query
+			db := tx.Model(&OutboxMessage{}).
+				Where("id = ? AND (leased_until IS NULL OR leased_until < ?)", candidates[c].ID, now).
+				Update("leased_until", leaseUntil)
+			if db.Error != nil {
+				return db.Error
+			}
+			if db.RowsAffected == 1 {
+				candidates[c].LeasedUntil = &leaseUntil
+				claimed = append(claimed, candidates[c])
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+// RetryOutboxContext changes the lease of the pending message to retryAt, so it's claimed again after it
+// A done message is not changed.
+func (dbHandler *gormDbHandler) RetryOutboxContext(ctx context.Context, messageID string, retryAt time.Time) error {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Model(&OutboxMessage{}).Where("message_id = ? AND done_at IS NULL", messageID).
+			Update("leased_until", retryAt).Error
+	})
+}
+
+// DoneOutboxContext marks the pending messages of the request done, up to lastSequence
+// The marked messages are returned, ordered by Sequence.
+func (dbHandler *gormDbHandler) DoneOutboxContext(ctx context.Context, requestID string, lastSequence int,
+	doneAt time.Time,
+) ([]OutboxMessage, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	done := []OutboxMessage{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		err := tx.Where("request_id = ? AND sequence <= ? AND done_at IS NULL", requestID, lastSequence).
+			Order("sequence").Find(&done).Error
+		if err != nil || len(done) == 0 {
+			return err
+		}
+
+		ids := make([]uint, 0, len(done))
+		for d := range done {
+			done[d].DoneAt = &doneAt
+			ids = append(ids, done[d].ID)
+		}
+
+		return tx.Model(&OutboxMessage{}).Where("id IN (?)", ids).Update("done_at", doneAt).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return done, nil
+}
+
+// PurgeOutboxContext deletes the messages, done before doneBefore, and returns the number of them
+// The rows are deleted physically (not only marked by DeletedAt)
+func (dbHandler *gormDbHandler) PurgeOutboxContext(ctx context.Context, doneBefore time.Time, dryRun bool,
+) (int, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	purged := 0
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		old := tx.Unscoped().Model(&OutboxMessage{}).Where("done_at < ?", doneBefore)
+
+		if dryRun {
+			return old.Count(&purged).Error
+		}
+
+		db := old.Delete(&OutboxMessage{})
+		purged = int(db.RowsAffected)
+
+		return db.Error
+	})
+
+	return purged, err
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ProcessedRequest table, the idempotency keys (or message IDs) of the processed requests of the users
+// A key is stored by the update of the user, which processed the request (User.LastRequestKey),
+// so a redelivered request is detected, even if the user was updated by later requests since.
+type ProcessedRequest struct {
+	gorm.Model
+	UID        string `gorm:"unique_index:idx_processed_request"`
+	RequestKey string `gorm:"unique_index:idx_processed_request"`
+}
+
+// TableName forces table name singular
+func (ProcessedRequest) TableName() string {
+	return "processed_request"
+}
+
+// recordProcessedRequest stores the LastRequestKey of the updated user, if it's not stored yet
+func recordProcessedRequest(tx *gorm.DB, user *User) error {
+	if user.LastRequestKey == "" {
+		return nil
+	}
+
+	processed := ProcessedRequest{}
+
+	return tx.Where(ProcessedRequest{UID: user.UID, RequestKey: user.LastRequestKey}).FirstOrCreate(&processed).Error
+}
+
+// IsRequestProcessedContext tells, if the request of the user was processed (its key is stored)
+func (dbHandler *gormDbHandler) IsRequestProcessedContext(ctx context.Context, uid string, requestKey string,
+) (bool, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	count := 0
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Model(&ProcessedRequest{}).Where("uid = ? AND request_key = ?", uid, requestKey).Count(&count).Error
+	})
+
+	return count > 0, err
+}
+
+// PurgeProcessedRequestsContext deletes the keys, stored before createdBefore, and returns the number of them
+// The rows are deleted physically (not only marked by DeletedAt)
+func (dbHandler *gormDbHandler) PurgeProcessedRequestsContext(ctx context.Context, createdBefore time.Time,
+	dryRun bool,
+) (int, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	purged := 0
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		old := tx.Unscoped().Model(&ProcessedRequest{}).Where("created_at < ?", createdBefore)
+
+		if dryRun {
+			return old.Count(&purged).Error
+		}
+
+		db := old.Delete(&ProcessedRequest{})
+		purged = int(db.RowsAffected)
+
+		return db.Error
+	})
+
+	return purged, err
+}
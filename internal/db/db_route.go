@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrCallbackRouteNotFound is returned, if the client has no callback route
+var ErrCallbackRouteNotFound = errors.New("callback route not found") // nolint:gochecknoglobals
+
+// CallbackRoute table, the callback endpoint of a client (tenant)
+type CallbackRoute struct {
+	gorm.Model
+	// Client is the client of the requests, identified by the frontend (API key)
+	Client string `gorm:"unique_index"`
+	URL    string `gorm:"not null"`
+	// Auth is the authentication of the callbacks (jwt or hmac)
+	Auth string `gorm:"not null"`
+	// Secret is the shared HMAC secret, sealed by EncryptingDbHandler
+	Secret string `gorm:"type:text"`
+	// KeyID is the ID of the master key, which sealed Secret, empty if Secret is not sealed
+	KeyID string
+}
+
+// TableName forces table name singular
+func (CallbackRoute) TableName() string {
+	return "callback_route"
+}
+
+// SetCallbackRouteContext creates or updates the route of the client
+// nolint:gocritic
+func (dbHandler *gormDbHandler) SetCallbackRouteContext(ctx context.Context, route CallbackRoute) (CallbackRoute, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		stored := CallbackRoute{}
+		err := tx.Where(CallbackRoute{Client: route.Client}).First(&stored).Error
+		if gorm.IsRecordNotFoundError(err) {
+			return tx.Create(&route).Error
+		} else if err != nil {
+			return err
+		}
+
+		route.Model = stored.Model
+
+		return tx.Model(&route).Updates(map[string]interface{}{
+			"url": route.URL, "auth": route.Auth, "secret": route.Secret, "key_id": route.KeyID,
+		}).Error
+	})
+
+	return route, err
+}
+
+// GetCallbackRouteContext returns the route of the client, or ErrCallbackRouteNotFound
+func (dbHandler *gormDbHandler) GetCallbackRouteContext(ctx context.Context, client string) (CallbackRoute, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	route := CallbackRoute{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Where(CallbackRoute{Client: client}).First(&route).Error
+	})
+	if gorm.IsRecordNotFoundError(err) {
+		return route, ErrCallbackRouteNotFound
+	}
+
+	return route, err
+}
+
+// ListCallbackRoutesContext returns the routes, ordered by client
+func (dbHandler *gormDbHandler) ListCallbackRoutesContext(ctx context.Context) ([]CallbackRoute, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	routes := []CallbackRoute{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Order("client").Find(&routes).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// DeleteCallbackRouteContext deletes the route of the client, or returns ErrCallbackRouteNotFound
+// The responses to the client are sent to the default endpoint.
+func (dbHandler *gormDbHandler) DeleteCallbackRouteContext(ctx context.Context, client string) error {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		db := tx.Unscoped().Where("client = ?", client).Delete(&CallbackRoute{})
+		if db.Error != nil {
+			return db.Error
+		}
+		if db.RowsAffected == 0 {
+			return ErrCallbackRouteNotFound
+		}
+
+		return nil
+	})
+}
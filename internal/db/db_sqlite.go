@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // import SQLite dialect
+	_ "github.com/mattn/go-sqlite3"            // import SQLite driver, opened by sql.Open
+)
+
+// sqliteDSNOptions makes concurrent writers wait instead of failing
+const sqliteDSNOptions = "?_busy_timeout=5000&_foreign_keys=1"
+
+// SqliteDbHandler is a real implementation of DbHandler, on SQLite
+// It's for single-node deployments and local development
+type SqliteDbHandler struct {
+	Path string
+
+	gormDbHandler
+}
+
+// Connect opens (or creates) the DB file
+func (dbHandler *SqliteDbHandler) Connect() error {
+	return dbHandler.ConnectContext(context.Background())
+}
+
+// ConnectContext opens (or creates) the DB file
+func (dbHandler *SqliteDbHandler) ConnectContext(ctx context.Context) error {
+	if err := dbHandler.open(ctx, "sqlite3", "sqlite3", dbHandler.Path+sqliteDSNOptions); err != nil {
+		return err
+	}
+
+	// SQLite allows only one writer, serializing here avoids "database is locked" errors
+	dbHandler.db.DB().SetMaxOpenConns(1)
+
+	return nil
+}
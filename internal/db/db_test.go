@@ -0,0 +1,415 @@
+package db_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/crypt"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/db/dbtest"
+	"github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
+	"github.com/pgillich/chat-bot/internal/test"
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(test.GetLogLevel())
+
+	exitVal := m.Run()
+
+	os.Exit(exitVal)
+}
+
+func TestFakeDbHandler(t *testing.T) {
+	dbtest.RunConformance(t, func() db.DbHandler {
+		return &db.FakeDbHandler{}
+	})
+}
+
+func TestSqliteDbHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-bot-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	dbtest.RunConformance(t, func() db.DbHandler {
+		return &db.SqliteDbHandler{Path: filepath.Join(dir, "chat_bot.db")}
+	})
+}
+
+// TestRealDbHandler runs only if TEST_DB_HOST is set
+func TestRealDbHandler(t *testing.T) {
+	host := os.Getenv("TEST_DB_HOST")
+	if host == "" {
+		t.Skip("TEST_DB_HOST is not set")
+	}
+
+	dbtest.RunConformance(t, func() db.DbHandler {
+		return &db.RealDbHandler{
+			Host:     host,
+			Database: os.Getenv("TEST_DB_NAME"),
+			User:     os.Getenv("TEST_DB_USER"),
+			Password: os.Getenv("TEST_DB_PASSWORD"),
+		}
+	})
+}
+
+func makeKeyRing(t *testing.T, ids ...string) *crypt.KeyRing {
+	keys := []string{}
+	for _, id := range ids {
+		key, err := crypt.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, id+":"+key)
+	}
+
+	keyRing, err := crypt.ParseKeyRing(strings.Join(keys, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyRing
+}
+
+func TestEncryptingDbHandler(t *testing.T) {
+	keyRing := makeKeyRing(t, "k1")
+
+	dbtest.RunConformance(t, func() db.DbHandler {
+		return &db.EncryptingDbHandler{DbHandler: &db.FakeDbHandler{}, KeyRing: keyRing}
+	})
+}
+
+func TestEncryptionAtRest(t *testing.T) {
+	plainDbHandler := &db.FakeDbHandler{}
+	dbHandler := &db.EncryptingDbHandler{DbHandler: plainDbHandler, KeyRing: makeKeyRing(t, "k1")}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	user, err := dbHandler.GetOrCreateUser("001")
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+	bornOn := time.Date(1976, 4, 24, 0, 0, 0, 0, time.UTC)
+	user.Name, user.BornOn, user.BornAt = "John Doe", &bornOn, "Mucsajröcsöge"
+	if !assert.NoError(t, dbHandler.Update(user), "Update") {
+		return
+	}
+
+	stored, err := plainDbHandler.GetOrCreateUser("001")
+	if assert.NoError(t, err, "GetOrCreateUser plain") {
+		assert.Empty(t, stored.Name, "Name")
+		assert.Nil(t, stored.BornOn, "BornOn")
+		assert.Empty(t, stored.BornAt, "BornAt")
+		assert.Equal(t, "k1", stored.KeyID, "KeyID")
+		assert.NotContains(t, stored.Sealed, "John Doe", "Sealed")
+	}
+
+	decrypted, err := dbHandler.GetOrCreateUser("001")
+	if assert.NoError(t, err, "GetOrCreateUser") {
+		assert.Equal(t, "John Doe", decrypted.Name, "Name")
+		assert.Equal(t, "Mucsajröcsöge", decrypted.BornAt, "BornAt")
+		if assert.NotNil(t, decrypted.BornOn, "BornOn") {
+			assert.True(t, bornOn.Equal(*decrypted.BornOn), "BornOn")
+		}
+	}
+
+	_, err = dbHandler.SetCallbackRouteContext(context.Background(), db.CallbackRoute{
+		Client: "acme", URL: "http://acme/chat", Auth: "hmac", Secret: "secret",
+	})
+	if !assert.NoError(t, err, "SetCallbackRouteContext") {
+		return
+	}
+	storedRoute, err := plainDbHandler.GetCallbackRouteContext(context.Background(), "acme")
+	if assert.NoError(t, err, "GetCallbackRouteContext plain") {
+		assert.Equal(t, "k1", storedRoute.KeyID, "route KeyID")
+		assert.NotContains(t, storedRoute.Secret, "secret", "route Secret")
+	}
+	route, err := dbHandler.GetCallbackRouteContext(context.Background(), "acme")
+	if assert.NoError(t, err, "GetCallbackRouteContext") {
+		assert.Equal(t, "secret", route.Secret, "route Secret")
+	}
+
+	now := time.Now()
+	err = dbHandler.UpdateWithOutboxContext(context.Background(), nil, []db.OutboxMessage{
+		{MessageID: "m1", RequestID: "r1", Recipient: "001", Text: "Hello John Doe", SendAt: now},
+	})
+	if !assert.NoError(t, err, "UpdateWithOutboxContext") {
+		return
+	}
+	storedMessages, err := plainDbHandler.ClaimOutboxContext(context.Background(), now, now.Add(time.Minute), 10)
+	if assert.NoError(t, err, "ClaimOutboxContext plain") && assert.Len(t, storedMessages, 1, "claimed") {
+		assert.Equal(t, "k1", storedMessages[0].KeyID, "message KeyID")
+		assert.NotContains(t, storedMessages[0].Text, "John Doe", "message Text")
+	}
+	messages, err := dbHandler.DoneOutboxContext(context.Background(), "r1", 0, now)
+	if assert.NoError(t, err, "DoneOutboxContext") && assert.Len(t, messages, 1, "done") {
+		assert.Equal(t, "Hello John Doe", messages[0].Text, "message Text")
+	}
+}
+
+func TestReencrypt(t *testing.T) {
+	oldKey := mustGenerateKey(t)
+	oldKeyRing, err := crypt.ParseKeyRing("k0:" + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plainDbHandler := &db.FakeDbHandler{}
+	if err := plainDbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer plainDbHandler.Close()
+
+	// 001 and the route are stored by the old key, 002 is stored before encryption was enabled
+	oldDbHandler := &db.EncryptingDbHandler{DbHandler: plainDbHandler, KeyRing: oldKeyRing}
+	for _, stored := range []struct {
+		updater db.DbHandler
+		uid     string
+		name    string
+	}{
+		{oldDbHandler, "001", "John Doe"},
+		{plainDbHandler, "002", "Jane Doe"},
+	} {
+		user, err := stored.updater.GetOrCreateUser(stored.uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Name = stored.name
+		if err := stored.updater.Update(user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := oldDbHandler.SetCallbackRouteContext(context.Background(), db.CallbackRoute{
+		Client: "acme", URL: "http://acme/chat", Auth: "hmac", Secret: "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// k1 is the new active key, k0 is still needed for opening
+	newKeyRing, err := crypt.ParseKeyRing("k1:" + mustGenerateKey(t) + ",k0:" + oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newDbHandler := &db.EncryptingDbHandler{DbHandler: plainDbHandler, KeyRing: newKeyRing}
+
+	storedUsers, err := plainDbHandler.ListUsersContext(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := newDbHandler.Reencrypt(context.Background())
+	if !assert.NoError(t, err, "Reencrypt") {
+		return
+	}
+	assert.Equal(t, 3, updated, "updated")
+
+	users, err := newDbHandler.ListUsersContext(context.Background(), 0, 10)
+	if !assert.NoError(t, err, "ListUsersContext") || !assert.Equal(t, 2, len(users), "users") {
+		return
+	}
+	assert.Equal(t, "John Doe", users[0].Name, "Name 001")
+	assert.Equal(t, "Jane Doe", users[1].Name, "Name 002")
+	for u, user := range users { // nolint:gocritic
+		assert.Equal(t, "k1", user.KeyID, "KeyID "+user.UID)
+		// the engines can still update the users, they are not purged later because of the reencryption
+		assert.Equal(t, storedUsers[u].Version, user.Version, "Version "+user.UID)
+		assert.True(t, storedUsers[u].UpdatedAt.Equal(user.UpdatedAt), "UpdatedAt "+user.UID)
+	}
+
+	route, err := plainDbHandler.GetCallbackRouteContext(context.Background(), "acme")
+	if assert.NoError(t, err, "GetCallbackRouteContext plain") {
+		assert.Equal(t, "k1", route.KeyID, "route KeyID")
+	}
+	route, err = newDbHandler.GetCallbackRouteContext(context.Background(), "acme")
+	if assert.NoError(t, err, "GetCallbackRouteContext") {
+		assert.Equal(t, "secret", route.Secret, "route Secret")
+	}
+
+	updated, err = newDbHandler.Reencrypt(context.Background())
+	assert.NoError(t, err, "Reencrypt again")
+	assert.Equal(t, 0, updated, "updated again")
+}
+
+func mustGenerateKey(t *testing.T) string {
+	key, err := crypt.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestCachingDbHandler(t *testing.T) {
+	bus := &queue.FakeCacheBus{}
+
+	dbtest.RunConformance(t, func() db.DbHandler {
+		return &db.CachingDbHandler{
+			DbHandler:   &db.FakeDbHandler{},
+			Size:        100,
+			TTL:         time.Minute,
+			Invalidator: &queue.FakeCacheInvalidator{Bus: bus},
+		}
+	})
+}
+
+// countingDbHandler counts the reads of the wrapped DbHandler
+type countingDbHandler struct {
+	db.DbHandler
+
+	reads int
+}
+
+func (dbHandler *countingDbHandler) GetOrCreateUserContext(ctx context.Context, uid string) (db.User, error) {
+	dbHandler.reads++
+
+	return dbHandler.DbHandler.GetOrCreateUserContext(ctx, uid)
+}
+
+func getCacheRequests(t *testing.T, result string) float64 {
+	metricFamilies, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, metricFamily := range metricFamilies {
+		if metricFamily.GetName() != "chat_bot_user_cache_requests_total" {
+			continue
+		}
+		for _, metric := range metricFamily.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "result" && label.GetValue() == result {
+					return metric.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+
+	return 0
+}
+
+func TestCacheReadThrough(t *testing.T) {
+	counting := &countingDbHandler{DbHandler: &db.FakeDbHandler{}}
+	dbHandler := &db.CachingDbHandler{DbHandler: counting, Size: 2, TTL: time.Minute}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	hits, misses := getCacheRequests(t, "hit"), getCacheRequests(t, "miss")
+
+	user, err := dbHandler.GetOrCreateUser("001")
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+	user.Name = "John Doe"
+	if !assert.NoError(t, dbHandler.Update(user), "Update") {
+		return
+	}
+
+	cached, err := dbHandler.GetOrCreateUser("001")
+	if assert.NoError(t, err, "GetOrCreateUser cached") {
+		assert.Equal(t, "John Doe", cached.Name, "write-through Name")
+		assert.Equal(t, user.Version+1, cached.Version, "write-through Version")
+	}
+	assert.Equal(t, 1, counting.reads, "reads")
+	assert.Equal(t, hits+1, getCacheRequests(t, "hit"), "hits")
+	assert.Equal(t, misses+1, getCacheRequests(t, "miss"), "misses")
+
+	cached.Name = "Jane Doe"
+	assert.NoError(t, dbHandler.Update(cached), "Update cached")
+
+	// 001 is the least recently used, so it's evicted
+	for _, uid := range []string{"002", "003"} {
+		if _, err := dbHandler.GetOrCreateUser(uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloaded, err := dbHandler.GetOrCreateUser("001")
+	if assert.NoError(t, err, "GetOrCreateUser evicted") {
+		assert.Equal(t, "Jane Doe", reloaded.Name, "Name")
+	}
+	assert.Equal(t, 4, counting.reads, "reads after eviction")
+}
+
+func TestCacheTTL(t *testing.T) {
+	counting := &countingDbHandler{DbHandler: &db.FakeDbHandler{}}
+	dbHandler := &db.CachingDbHandler{DbHandler: counting, Size: 10, TTL: 50 * time.Millisecond}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	for r := 0; r < 2; r++ {
+		if _, err := dbHandler.GetOrCreateUser("001"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, 1, counting.reads, "reads before expiration")
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := dbHandler.GetOrCreateUser("001"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, counting.reads, "reads after expiration")
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	shared := &db.FakeDbHandler{}
+	bus := &queue.FakeCacheBus{}
+	replicas := []*db.CachingDbHandler{}
+	for r := 0; r < 2; r++ {
+		replica := &db.CachingDbHandler{
+			DbHandler: shared, Size: 10, TTL: time.Minute,
+			Invalidator: &queue.FakeCacheInvalidator{Bus: bus},
+		}
+		if err := replica.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		defer replica.Close()
+
+		replicas = append(replicas, replica)
+	}
+
+	if _, err := replicas[0].GetOrCreateUser("001"); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := replicas[1].GetOrCreateUser("001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Name = "John Doe"
+	if !assert.NoError(t, replicas[1].Update(user), "Update") {
+		return
+	}
+
+	// the invalidation is asynchronous
+	deadline := time.Now().Add(time.Second)
+	for {
+		cached, err := replicas[0].GetOrCreateUser("001")
+		if !assert.NoError(t, err, "GetOrCreateUser") {
+			return
+		}
+		if cached.Name == "John Doe" {
+			break
+		}
+		if time.Now().After(deadline) {
+			assert.Fail(t, "stale user is not invalidated")
+
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
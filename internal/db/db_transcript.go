@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// TranscriptRequest is the direction of a message from the user
+	TranscriptRequest = "request"
+	// TranscriptResponse is the direction of a message to the user
+	TranscriptResponse = "response"
+)
+
+// TranscriptEntry table, a message of the conversation with a user, purged by the retention policy
+type TranscriptEntry struct {
+	gorm.Model
+	UID string `gorm:"index"`
+	// RequestID is the ID of the request, which the message belongs to
+	RequestID string
+	// Direction is TranscriptRequest or TranscriptResponse
+	Direction string
+	// Text is the message, sealed by EncryptingDbHandler
+	Text string `gorm:"type:text"`
+	// KeyID is the ID of the master key, which sealed Text, empty if Text is not sealed
+	KeyID string
+}
+
+// TableName forces table name singular
+func (TranscriptEntry) TableName() string {
+	return "transcript"
+}
+
+// AppendTranscriptContext stores the entries in one transaction
+func (dbHandler *gormDbHandler) AppendTranscriptContext(ctx context.Context, entries []TranscriptEntry) error {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	return dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		for e := range entries {
+			entry := entries[e]
+			if err := tx.Create(&entry).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ListTranscriptContext returns the entries of the user, in the order of storing
+func (dbHandler *gormDbHandler) ListTranscriptContext(ctx context.Context, uid string) ([]TranscriptEntry, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	entries := []TranscriptEntry{}
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		return tx.Where("uid = ?", uid).Order("id").Find(&entries).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// PurgeTranscriptsContext deletes the entries, created before createdBefore, and returns the number of them
+// The rows are deleted physically (not only marked by DeletedAt)
+func (dbHandler *gormDbHandler) PurgeTranscriptsContext(ctx context.Context, createdBefore time.Time, dryRun bool,
+) (int, error) {
+	dbHandler.mx.RLock()
+	defer dbHandler.mx.RUnlock()
+
+	purged := 0
+
+	err := dbHandler.transaction(ctx, func(tx *gorm.DB) error {
+		old := tx.Unscoped().Model(&TranscriptEntry{}).Where("created_at < ?", createdBefore)
+
+		if dryRun {
+			return old.Count(&purged).Error
+		}
+
+		db := old.Delete(&TranscriptEntry{})
+		purged = int(db.RowsAffected)
+
+		return db.Error
+	})
+
+	return purged, err
+}
@@ -0,0 +1,939 @@
+// Package dbtest is a conformance test suite for db.DbHandler implementations
+package dbtest
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/db"
+)
+
+const concurrency = 10
+
+// NewDbHandler makes a new, not connected DbHandler
+type NewDbHandler func() db.DbHandler
+
+// RunConformance runs the tests, which must be passed by every DbHandler implementation
+func RunConformance(t *testing.T, newDbHandler NewDbHandler) {
+	t.Run("CreateGetUpdate", func(t *testing.T) { testCreateGetUpdate(t, newDbHandler) })
+	t.Run("UnknownUID", func(t *testing.T) { testUnknownUID(t, newDbHandler) })
+	t.Run("ConcurrentCreate", func(t *testing.T) { testConcurrentCreate(t, newDbHandler) })
+	t.Run("ConcurrentUpdates", func(t *testing.T) { testConcurrentUpdates(t, newDbHandler) })
+	t.Run("ConflictingUpdate", func(t *testing.T) { testConflictingUpdate(t, newDbHandler) })
+	t.Run("UpdateSealed", func(t *testing.T) { testUpdateSealed(t, newDbHandler) })
+	t.Run("ConcurrentUpdatesSameUser", func(t *testing.T) { testConcurrentUpdatesSameUser(t, newDbHandler) })
+	t.Run("FencedUpdate", func(t *testing.T) { testFencedUpdate(t, newDbHandler) })
+	t.Run("ProcessedRequests", func(t *testing.T) { testProcessedRequests(t, newDbHandler) })
+	t.Run("ListUsers", func(t *testing.T) { testListUsers(t, newDbHandler) })
+	t.Run("PurgeUsers", func(t *testing.T) { testPurgeUsers(t, newDbHandler) })
+	t.Run("APIKeys", func(t *testing.T) { testAPIKeys(t, newDbHandler) })
+	t.Run("CallbackRoutes", func(t *testing.T) { testCallbackRoutes(t, newDbHandler) })
+	t.Run("Deliveries", func(t *testing.T) { testDeliveries(t, newDbHandler) })
+	t.Run("PurgeDeliveries", func(t *testing.T) { testPurgeDeliveries(t, newDbHandler) })
+	t.Run("Outbox", func(t *testing.T) { testOutbox(t, newDbHandler) })
+	t.Run("Transcript", func(t *testing.T) { testTranscript(t, newDbHandler) })
+	t.Run("CloseReconnect", func(t *testing.T) { testCloseReconnect(t, newDbHandler) })
+	t.Run("ContextDone", func(t *testing.T) { testContextDone(t, newDbHandler) })
+}
+
+// MakeUID returns a UID, which is not used by earlier test runs on a persistent DB
+func MakeUID(name string) string {
+	return fmt.Sprintf("%s-%d", name, time.Now().UnixNano())
+}
+
+func connect(t *testing.T, newDbHandler NewDbHandler) db.DbHandler {
+	dbHandler := newDbHandler()
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal("cannot connect, ", err)
+	}
+
+	return dbHandler
+}
+
+func testCreateGetUpdate(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("create")
+	created, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+	assert.Equal(t, uid, created.UID, "UID")
+	assert.NotZero(t, created.ID, "ID")
+	assert.False(t, created.CreatedAt.IsZero(), "CreatedAt")
+	assert.False(t, created.UpdatedAt.IsZero(), "UpdatedAt")
+	assert.Empty(t, created.Name, "Name")
+	assert.Nil(t, created.BornOn, "BornOn")
+	assert.Empty(t, created.BornAt, "BornAt")
+
+	bornOn := time.Date(1976, 4, 24, 0, 0, 0, 0, time.UTC)
+	user := created
+	user.Name = "John Doe"
+	user.BornOn = &bornOn
+	user.BornAt = "Mucsajröcsöge"
+	user.LastRequestKey = "request-1"
+	if !assert.NoError(t, dbHandler.Update(user), "Update") {
+		return
+	}
+
+	stored, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+	assert.Equal(t, created.ID, stored.ID, "ID")
+	assert.Equal(t, "John Doe", stored.Name, "Name")
+	assert.Equal(t, "Mucsajröcsöge", stored.BornAt, "BornAt")
+	assert.Equal(t, "request-1", stored.LastRequestKey, "LastRequestKey")
+	if assert.NotNil(t, stored.BornOn, "BornOn") {
+		assert.True(t, bornOn.Equal(*stored.BornOn), "BornOn")
+	}
+	assert.False(t, stored.UpdatedAt.Before(created.UpdatedAt.Truncate(time.Millisecond)), "UpdatedAt")
+}
+
+func testUnknownUID(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("unknown")
+	first, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+
+	second, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser again") {
+		return
+	}
+	assert.Equal(t, first.ID, second.ID, "same UID, same ID")
+
+	other, err := dbHandler.GetOrCreateUser(MakeUID("other"))
+	if !assert.NoError(t, err, "GetOrCreateUser other") {
+		return
+	}
+	assert.NotEqual(t, first.ID, other.ID, "other UID, other ID")
+}
+
+func testConcurrentCreate(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("concurrent-create")
+	users := make([]db.User, concurrency)
+	errs := make([]error, concurrency)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			users[i], errs[i] = dbHandler.GetOrCreateUser(uid)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < concurrency; i++ {
+		if assert.NoError(t, errs[i], fmt.Sprintf("GetOrCreateUser #%d", i)) {
+			assert.Equal(t, users[0].ID, users[i].ID, fmt.Sprintf("ID #%d", i))
+		}
+	}
+}
+
+func testConcurrentUpdates(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	prefix := MakeUID("concurrent-update")
+	errs := make([]error, concurrency)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			user, err := dbHandler.GetOrCreateUser(fmt.Sprintf("%s-%d", prefix, i))
+			if err != nil {
+				errs[i] = err
+
+				return
+			}
+
+			user.Name = fmt.Sprintf("User %d", i)
+			errs[i] = dbHandler.Update(user)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < concurrency; i++ {
+		if !assert.NoError(t, errs[i], fmt.Sprintf("Update #%d", i)) {
+			continue
+		}
+
+		user, err := dbHandler.GetOrCreateUser(fmt.Sprintf("%s-%d", prefix, i))
+		if assert.NoError(t, err, fmt.Sprintf("GetOrCreateUser #%d", i)) {
+			assert.Equal(t, fmt.Sprintf("User %d", i), user.Name, fmt.Sprintf("Name #%d", i))
+		}
+	}
+}
+
+// testUpdateSealed checks, that only the personal data is stored, Version and UpdatedAt are kept
+func testUpdateSealed(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	uid := MakeUID("sealed")
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+	user.Name = "John Doe"
+	if !assert.NoError(t, dbHandler.Update(user), "Update") {
+		return
+	}
+	user, err = dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser after Update") {
+		return
+	}
+
+	// the decorators don't seal it, so it's stored in plain
+	sealed := user
+	sealed.Name = "Jane Doe"
+	sealed.Sealed = ""
+	sealed.KeyID = ""
+	time.Sleep(10 * time.Millisecond)
+	sealedAt := time.Now()
+	if !assert.NoError(t, dbHandler.UpdateSealedContext(ctx, sealed), "UpdateSealedContext") {
+		return
+	}
+
+	stored, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser after UpdateSealedContext") {
+		return
+	}
+	assert.Equal(t, "Jane Doe", stored.Name, "Name")
+	assert.Equal(t, user.Version, stored.Version, "Version")
+	assert.True(t, stored.UpdatedAt.Before(sealedAt), "UpdatedAt")
+
+	// the user is still up to date for the engines
+	assert.NoError(t, dbHandler.Update(stored), "Update after UpdateSealedContext")
+
+	err = dbHandler.UpdateSealedContext(ctx, sealed)
+	assert.True(t, db.IsConflict(err), fmt.Sprintf("UpdateSealedContext outdated: %v", err))
+}
+
+func testConflictingUpdate(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("conflict")
+	first, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser first") {
+		return
+	}
+	second, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser second") {
+		return
+	}
+
+	first.Name = "First"
+	if !assert.NoError(t, dbHandler.Update(first), "Update first") {
+		return
+	}
+
+	second.Name = "Second"
+	err = dbHandler.Update(second)
+	assert.True(t, db.IsConflict(err), fmt.Sprintf("Update second: %v", err))
+
+	reloaded, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser reloaded") {
+		return
+	}
+	assert.Equal(t, "First", reloaded.Name, "Name")
+	assert.Equal(t, first.Version+1, reloaded.Version, "Version")
+
+	reloaded.Name = "Second"
+	assert.NoError(t, dbHandler.Update(reloaded), "Update reloaded")
+}
+
+// testProcessedRequests checks, that the request keys of the updates are kept, until they are purged,
+// and the key of a rejected update is not stored
+func testProcessedRequests(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	uid := MakeUID("processed")
+	user, err := dbHandler.GetOrCreateUserContext(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed := func(requestKey string) bool {
+		has, err := dbHandler.IsRequestProcessedContext(ctx, uid, requestKey)
+		assert.NoError(t, err, "IsRequestProcessedContext "+requestKey)
+
+		return has
+	}
+
+	outdated := user
+	for _, requestKey := range []string{"k1", "k2", "k2"} {
+		user.LastRequestKey = requestKey
+		if !assert.NoError(t, dbHandler.UpdateContext(ctx, user), "UpdateContext "+requestKey) {
+			return
+		}
+		if user, err = dbHandler.GetOrCreateUserContext(ctx, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.True(t, processed("k1"), "k1 is kept")
+	assert.True(t, processed("k2"), "k2")
+
+	outdated.LastRequestKey = "k3"
+	assert.True(t, db.IsConflict(dbHandler.UpdateContext(ctx, outdated)), "UpdateContext outdated")
+	assert.False(t, processed("k3"), "k3 of the rejected update")
+
+	other, err := dbHandler.IsRequestProcessedContext(ctx, MakeUID("processed"), "k1")
+	if assert.NoError(t, err, "IsRequestProcessedContext of other user") {
+		assert.False(t, other, "k1 of other user")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	createdBefore := time.Now()
+
+	purged, err := dbHandler.PurgeProcessedRequestsContext(ctx, createdBefore, true)
+	if assert.NoError(t, err, "PurgeProcessedRequestsContext dry run") {
+		assert.True(t, purged >= 2, fmt.Sprintf("dry run purged: %d", purged))
+	}
+	assert.True(t, processed("k1"), "k1 is kept by dry run")
+
+	purgedReal, err := dbHandler.PurgeProcessedRequestsContext(ctx, createdBefore, false)
+	if assert.NoError(t, err, "PurgeProcessedRequestsContext") {
+		assert.Equal(t, purged, purgedReal, "purged")
+	}
+	assert.False(t, processed("k1"), "k1 is purged")
+}
+
+// testFencedUpdate checks, that an update with a lower fencing token is rejected
+func testFencedUpdate(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("fenced")
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+
+	user.Name = "Second"
+	user.FenceToken = 2
+	if !assert.NoError(t, dbHandler.Update(user), "Update by token 2") {
+		return
+	}
+
+	user, err = dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser after token 2") {
+		return
+	}
+	assert.Equal(t, int64(2), user.FenceToken, "FenceToken")
+
+	stale := user
+	stale.Name = "First"
+	stale.FenceToken = 1
+	err = dbHandler.Update(stale)
+	assert.True(t, db.IsConflict(err), fmt.Sprintf("Update by token 1: %v", err))
+
+	user.Name = "Third"
+	if !assert.NoError(t, dbHandler.Update(user), "Update by the stored token") {
+		return
+	}
+
+	user, err = dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser after update by the stored token") {
+		assert.Equal(t, "Third", user.Name, "Name")
+		assert.Equal(t, int64(2), user.FenceToken, "FenceToken")
+	}
+}
+
+func testConcurrentUpdatesSameUser(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("concurrent-same")
+	errs := make([]error, concurrency)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			for {
+				user, err := dbHandler.GetOrCreateUser(uid)
+				if err != nil {
+					errs[i] = err
+
+					return
+				}
+
+				user.BornAt += "x"
+				if err = dbHandler.Update(user); !db.IsConflict(err) {
+					errs[i] = err
+
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < concurrency; i++ {
+		assert.NoError(t, errs[i], fmt.Sprintf("Update #%d", i))
+	}
+
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser") {
+		assert.Equal(t, concurrency, len(user.BornAt), "no lost update")
+	}
+}
+
+func testListUsers(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	prefix := MakeUID("list")
+	created := make([]db.User, 3)
+	for u := range created {
+		var err error
+		if created[u], err = dbHandler.GetOrCreateUser(fmt.Sprintf("%s-%d", prefix, u)); err != nil {
+			t.Fatal(err)
+		}
+
+		created[u].Name = fmt.Sprintf("User %d", u)
+		if err = dbHandler.Update(created[u]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	firstPage, err := dbHandler.ListUsersContext(context.Background(), created[0].ID-1, 2)
+	if !assert.NoError(t, err, "ListUsersContext first") || !assert.Equal(t, 2, len(firstPage), "first page") {
+		return
+	}
+	nextPage, err := dbHandler.ListUsersContext(context.Background(), firstPage[1].ID, 1)
+	if !assert.NoError(t, err, "ListUsersContext next") || !assert.Equal(t, 1, len(nextPage), "next page") {
+		return
+	}
+
+	for u, user := range append(firstPage, nextPage...) { // nolint:gocritic
+		assert.Equal(t, created[u].ID, user.ID, fmt.Sprintf("ID #%d", u))
+		assert.Equal(t, created[u].UID, user.UID, fmt.Sprintf("UID #%d", u))
+		assert.Equal(t, fmt.Sprintf("User %d", u), user.Name, fmt.Sprintf("Name #%d", u))
+	}
+}
+
+// testPurgeUsers deletes all users, created before the test
+func testPurgeUsers(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	inactive, err := dbHandler.GetOrCreateUser(MakeUID("inactive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	inactiveSince := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	active, err := dbHandler.GetOrCreateUser(MakeUID("active"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := dbHandler.PurgeUsersContext(context.Background(), inactiveSince, true)
+	if assert.NoError(t, err, "PurgeUsersContext dry run") {
+		assert.True(t, purged >= 1, fmt.Sprintf("dry run purged: %d", purged))
+	}
+
+	users, err := dbHandler.ListUsersContext(context.Background(), inactive.ID-1, 1)
+	if assert.NoError(t, err, "ListUsersContext after dry run") && assert.Equal(t, 1, len(users), "users") {
+		assert.Equal(t, inactive.ID, users[0].ID, "inactive is kept by dry run")
+	}
+
+	purgedReal, err := dbHandler.PurgeUsersContext(context.Background(), inactiveSince, false)
+	if assert.NoError(t, err, "PurgeUsersContext") {
+		assert.Equal(t, purged, purgedReal, "purged")
+	}
+
+	users, err = dbHandler.ListUsersContext(context.Background(), inactive.ID-1, 1)
+	if assert.NoError(t, err, "ListUsersContext after purge") && assert.Equal(t, 1, len(users), "users") {
+		assert.Equal(t, active.ID, users[0].ID, "only active is kept")
+	}
+
+	purged, err = dbHandler.PurgeUsersContext(context.Background(), inactiveSince, false)
+	if assert.NoError(t, err, "PurgeUsersContext again") {
+		assert.Equal(t, 0, purged, "purged again")
+	}
+}
+
+func testAPIKeys(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	created, err := dbHandler.CreateAPIKeyContext(ctx, db.APIKey{
+		KeyID: MakeUID("key"), Hash: "hash", Client: "acme", Scopes: "chat", UIDs: "001, acme-*", ExpiresAt: &expiresAt,
+	})
+	if !assert.NoError(t, err, "CreateAPIKeyContext") {
+		return
+	}
+	assert.NotZero(t, created.ID, "ID")
+
+	_, err = dbHandler.CreateAPIKeyContext(ctx, db.APIKey{KeyID: created.KeyID, Hash: "other"})
+	assert.Error(t, err, "CreateAPIKeyContext duplicate")
+
+	stored, err := dbHandler.GetAPIKeyContext(ctx, created.KeyID)
+	if assert.NoError(t, err, "GetAPIKeyContext") {
+		assert.Equal(t, created.ID, stored.ID, "ID")
+		assert.Equal(t, "hash", stored.Hash, "Hash")
+		assert.Equal(t, "acme", stored.Client, "Client")
+		assert.True(t, stored.HasScope("chat"), "HasScope chat")
+		assert.False(t, stored.HasScope("admin"), "HasScope admin")
+		assert.True(t, stored.CanSpeakFor("001"), "CanSpeakFor 001")
+		assert.True(t, stored.CanSpeakFor("acme-002"), "CanSpeakFor acme-002")
+		assert.False(t, stored.CanSpeakFor("002"), "CanSpeakFor 002")
+		assert.False(t, stored.CanSpeakFor(""), "CanSpeakFor empty")
+		assert.True(t, stored.IsActive(time.Now()), "IsActive")
+		assert.False(t, stored.IsActive(expiresAt), "IsActive at expiry")
+	}
+
+	_, err = dbHandler.GetAPIKeyContext(ctx, MakeUID("unknown-key"))
+	assert.Equal(t, db.ErrAPIKeyNotFound, err, "GetAPIKeyContext unknown")
+
+	assert.NoError(t, dbHandler.RevokeAPIKeyContext(ctx, created.KeyID, time.Now()), "RevokeAPIKeyContext")
+	assert.NoError(t, dbHandler.RevokeAPIKeyContext(ctx, created.KeyID, time.Now()), "RevokeAPIKeyContext again")
+	assert.Equal(t, db.ErrAPIKeyNotFound, dbHandler.RevokeAPIKeyContext(ctx, MakeUID("unknown-key"), time.Now()),
+		"RevokeAPIKeyContext unknown")
+
+	keys, err := dbHandler.ListAPIKeysContext(ctx)
+	if assert.NoError(t, err, "ListAPIKeysContext") {
+		found := false
+		for _, key := range keys { // nolint:gocritic
+			if key.KeyID == created.KeyID {
+				found = true
+				assert.NotNil(t, key.RevokedAt, "RevokedAt")
+				assert.False(t, key.IsActive(time.Now()), "IsActive after revoke")
+			}
+		}
+		assert.True(t, found, "revoked key is listed")
+	}
+}
+
+func testCallbackRoutes(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	client := MakeUID("tenant")
+	created, err := dbHandler.SetCallbackRouteContext(ctx, db.CallbackRoute{
+		Client: client, URL: "http://acme/chat", Auth: "hmac", Secret: "secret",
+	})
+	if !assert.NoError(t, err, "SetCallbackRouteContext") {
+		return
+	}
+	assert.NotZero(t, created.ID, "ID")
+
+	updated, err := dbHandler.SetCallbackRouteContext(ctx, db.CallbackRoute{
+		Client: client, URL: "http://acme/chat/v2", Auth: "jwt",
+	})
+	if assert.NoError(t, err, "SetCallbackRouteContext update") {
+		assert.Equal(t, created.ID, updated.ID, "ID of update")
+	}
+
+	stored, err := dbHandler.GetCallbackRouteContext(ctx, client)
+	if assert.NoError(t, err, "GetCallbackRouteContext") {
+		assert.Equal(t, "http://acme/chat/v2", stored.URL, "URL")
+		assert.Equal(t, "jwt", stored.Auth, "Auth")
+		assert.Empty(t, stored.Secret, "Secret")
+	}
+
+	_, err = dbHandler.SetCallbackRouteContext(ctx, db.CallbackRoute{
+		Client: client, URL: "http://acme/chat/v3", Auth: "hmac", Secret: "secret-3",
+	})
+	assert.NoError(t, err, "SetCallbackRouteContext secret")
+
+	routes, err := dbHandler.ListCallbackRoutesContext(ctx)
+	if assert.NoError(t, err, "ListCallbackRoutesContext") {
+		found := false
+		for _, route := range routes { // nolint:gocritic
+			if route.Client == client {
+				found = true
+				assert.Equal(t, "secret-3", route.Secret, "listed Secret")
+			}
+		}
+		assert.True(t, found, "route is listed")
+	}
+
+	assert.NoError(t, dbHandler.DeleteCallbackRouteContext(ctx, client), "DeleteCallbackRouteContext")
+	_, err = dbHandler.GetCallbackRouteContext(ctx, client)
+	assert.Equal(t, db.ErrCallbackRouteNotFound, err, "GetCallbackRouteContext deleted")
+	assert.Equal(t, db.ErrCallbackRouteNotFound, dbHandler.DeleteCallbackRouteContext(ctx, client),
+		"DeleteCallbackRouteContext deleted")
+
+	_, err = dbHandler.SetCallbackRouteContext(ctx, db.CallbackRoute{Client: client, URL: "http://acme/chat", Auth: "jwt"})
+	assert.NoError(t, err, "SetCallbackRouteContext after delete")
+	assert.NoError(t, dbHandler.DeleteCallbackRouteContext(ctx, client), "DeleteCallbackRouteContext again")
+}
+
+func testDeliveries(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	first, second := MakeUID("message"), MakeUID("message")
+	err := dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{
+		{MessageID: first, RequestID: "request", Client: "acme", Recipient: "001", Text: "Hello", SendAt: time.Now()},
+		{MessageID: second, RequestID: "request", Sequence: 1, Client: "acme", Recipient: "001", Text: "Bye",
+			SendAt: time.Now()},
+	})
+	if !assert.NoError(t, err, "UpdateWithOutboxContext") {
+		return
+	}
+
+	queued, err := dbHandler.GetDeliveryContext(ctx, first)
+	if assert.NoError(t, err, "GetDeliveryContext queued") {
+		assert.NotZero(t, queued.ID, "ID")
+		assert.Equal(t, db.DeliveryQueued, queued.Status, "Status")
+	}
+
+	sentAt := time.Now().UTC().Truncate(time.Second)
+	sent, err := dbHandler.UpdateDeliveryContext(ctx, first, db.DeliveryEvent{
+		Status: db.DeliverySent, At: sentAt, Attempts: 2,
+	})
+	if assert.NoError(t, err, "UpdateDeliveryContext sent") {
+		assert.Equal(t, db.DeliverySent, sent.Status, "Status")
+		assert.Equal(t, 2, sent.Attempts, "Attempts")
+	}
+
+	_, err = dbHandler.UpdateDeliveryContext(ctx, first, db.DeliveryEvent{Status: db.DeliveryFailed, At: time.Now()})
+	assert.Equal(t, db.ErrDeliveryStatus, err, "UpdateDeliveryContext failed after sent")
+
+	_, err = dbHandler.UpdateDeliveryContext(ctx, first, db.DeliveryEvent{Status: db.DeliveryAcked, At: time.Now()})
+	assert.NoError(t, err, "UpdateDeliveryContext acked")
+	_, err = dbHandler.UpdateDeliveryContext(ctx, first, db.DeliveryEvent{Status: db.DeliveryAcked, At: time.Now()})
+	assert.NoError(t, err, "UpdateDeliveryContext acked again")
+	_, err = dbHandler.UpdateDeliveryContext(ctx, first, db.DeliveryEvent{Status: db.DeliverySent, At: time.Now()})
+	assert.Equal(t, db.ErrDeliveryStatus, err, "UpdateDeliveryContext sent after acked")
+
+	stored, err := dbHandler.GetDeliveryContext(ctx, first)
+	if assert.NoError(t, err, "GetDeliveryContext") {
+		assert.Equal(t, db.DeliveryAcked, stored.Status, "Status")
+		assert.Equal(t, "acme", stored.Client, "Client")
+		assert.Equal(t, "001", stored.Recipient, "Recipient")
+		assert.Equal(t, 2, stored.Attempts, "Attempts")
+		if assert.NotNil(t, stored.SentAt, "SentAt") {
+			assert.True(t, sentAt.Equal(*stored.SentAt), "SentAt")
+		}
+		assert.NotNil(t, stored.AckedAt, "AckedAt")
+	}
+
+	failed, err := dbHandler.UpdateDeliveryContext(ctx, second, db.DeliveryEvent{
+		Status: db.DeliveryFailed, At: time.Now(), Attempts: 3, Error: "callback status 503",
+	})
+	if assert.NoError(t, err, "UpdateDeliveryContext failed") {
+		assert.Equal(t, "callback status 503", failed.LastError, "LastError")
+	}
+	acked, err := dbHandler.UpdateDeliveryContext(ctx, second, db.DeliveryEvent{Status: db.DeliveryAcked, At: time.Now()})
+	if assert.NoError(t, err, "UpdateDeliveryContext acked after failed") {
+		assert.Equal(t, db.DeliveryAcked, acked.Status, "Status")
+		assert.Equal(t, 3, acked.Attempts, "Attempts")
+	}
+
+	_, err = dbHandler.GetDeliveryContext(ctx, "unknown")
+	assert.Equal(t, db.ErrDeliveryNotFound, err, "GetDeliveryContext unknown")
+	_, err = dbHandler.UpdateDeliveryContext(ctx, "unknown", db.DeliveryEvent{Status: db.DeliveryAcked, At: time.Now()})
+	assert.Equal(t, db.ErrDeliveryNotFound, err, "UpdateDeliveryContext unknown")
+}
+
+// testPurgeDeliveries deletes all deliveries, created before the test
+func testPurgeDeliveries(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	old := MakeUID("old")
+	err := dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{{MessageID: old, SendAt: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	createdBefore := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	recent := MakeUID("recent")
+	err = dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{{MessageID: recent, SendAt: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := dbHandler.PurgeDeliveriesContext(ctx, createdBefore, true)
+	if assert.NoError(t, err, "PurgeDeliveriesContext dry run") {
+		assert.True(t, purged >= 1, fmt.Sprintf("dry run purged: %d", purged))
+	}
+	_, err = dbHandler.GetDeliveryContext(ctx, old)
+	assert.NoError(t, err, "old is kept by dry run")
+
+	purgedReal, err := dbHandler.PurgeDeliveriesContext(ctx, createdBefore, false)
+	if assert.NoError(t, err, "PurgeDeliveriesContext") {
+		assert.Equal(t, purged, purgedReal, "purged")
+	}
+	_, err = dbHandler.GetDeliveryContext(ctx, old)
+	assert.Equal(t, db.ErrDeliveryNotFound, err, "old is purged")
+	_, err = dbHandler.GetDeliveryContext(ctx, recent)
+	assert.NoError(t, err, "recent is kept")
+}
+
+// claimOutbox claims the due messages and returns the texts of the requests
+// The messages of earlier test runs are claimed, too, but they are ignored.
+func claimOutbox(t *testing.T, dbHandler db.DbHandler, now time.Time, requestIDs ...string) []string {
+	messages, err := dbHandler.ClaimOutboxContext(context.Background(), now, now.Add(time.Minute), 1000)
+	if !assert.NoError(t, err, "ClaimOutboxContext") {
+		return nil
+	}
+
+	claimed := []string{}
+	for _, message := range messages { // nolint:gocritic
+		for _, requestID := range requestIDs {
+			if message.RequestID == requestID {
+				claimed = append(claimed, message.Text)
+			}
+		}
+	}
+
+	return claimed
+}
+
+func testOutbox(t *testing.T, newDbHandler NewDbHandler) { // nolint:funlen
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	uid := MakeUID("outbox")
+	user, err := dbHandler.GetOrCreateUserContext(ctx, uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, later := MakeUID("request"), MakeUID("request")
+	message := func(requestID string, sequence int, text string, sendAt time.Time) db.OutboxMessage {
+		return db.OutboxMessage{
+			MessageID: MakeUID("message"), RequestID: requestID, Sequence: sequence,
+			Client: "acme", Recipient: uid, Text: text, SendAt: sendAt,
+		}
+	}
+	messages := []db.OutboxMessage{
+		message(first, 0, "Hi", now.Add(-time.Second)),
+		message(first, 1, "What's your name?", now.Add(-time.Second)),
+		message(later, 0, "Later", now.Add(time.Minute)),
+	}
+
+	user.Name = "Outbox Doe"
+	if !assert.NoError(t, dbHandler.UpdateWithOutboxContext(ctx, &user, messages), "UpdateWithOutboxContext") {
+		return
+	}
+
+	stored, err := dbHandler.GetOrCreateUserContext(ctx, uid)
+	if assert.NoError(t, err, "GetOrCreateUserContext") {
+		assert.Equal(t, "Outbox Doe", stored.Name, "Name")
+	}
+	delivery, err := dbHandler.GetDeliveryContext(ctx, messages[0].MessageID)
+	if assert.NoError(t, err, "GetDeliveryContext") {
+		assert.Equal(t, db.DeliveryQueued, delivery.Status, "Status")
+		assert.Equal(t, first, delivery.RequestID, "RequestID")
+	}
+
+	// the outdated user is not stored, and the messages are not stored, too
+	conflicting := message(MakeUID("request"), 0, "Conflicting", now)
+	err = dbHandler.UpdateWithOutboxContext(ctx, &user, []db.OutboxMessage{conflicting})
+	assert.True(t, db.IsConflict(err), "UpdateWithOutboxContext conflict")
+	_, err = dbHandler.GetDeliveryContext(ctx, conflicting.MessageID)
+	assert.Equal(t, db.ErrDeliveryNotFound, err, "GetDeliveryContext of conflicting")
+
+	assert.Equal(t, []string{"Hi"}, claimOutbox(t, dbHandler, now, first, later), "claimed first")
+	assert.Empty(t, claimOutbox(t, dbHandler, now, first, later), "claimed first again")
+
+	done, err := dbHandler.DoneOutboxContext(ctx, first, 0, now)
+	if assert.NoError(t, err, "DoneOutboxContext") && assert.Len(t, done, 1, "done") {
+		assert.Equal(t, "Hi", done[0].Text, "done Text")
+		assert.NotNil(t, done[0].DoneAt, "DoneAt")
+	}
+	assert.Equal(t, []string{"What's your name?"}, claimOutbox(t, dbHandler, now, first, later), "claimed second")
+
+	// the lease of later expires
+	assert.Equal(t, []string{"Later"}, claimOutbox(t, dbHandler, now.Add(2*time.Minute), later), "claimed later")
+	assert.Empty(t, claimOutbox(t, dbHandler, now.Add(2*time.Minute), later), "leased later")
+	assert.Equal(t, []string{"Later"}, claimOutbox(t, dbHandler, now.Add(4*time.Minute), later), "lease expired")
+
+	done, err = dbHandler.DoneOutboxContext(ctx, later, math.MaxInt32, now)
+	if assert.NoError(t, err, "DoneOutboxContext all") {
+		assert.Len(t, done, 1, "done all")
+	}
+	done, err = dbHandler.DoneOutboxContext(ctx, first, math.MaxInt32, now)
+	if assert.NoError(t, err, "DoneOutboxContext remaining") && assert.Len(t, done, 1, "done remaining") {
+		assert.Equal(t, "What's your name?", done[0].Text, "remaining Text")
+	}
+	assert.Empty(t, claimOutbox(t, dbHandler, now.Add(time.Hour), first, later), "claimed done")
+
+	purged, err := dbHandler.PurgeOutboxContext(ctx, now.Add(time.Second), true)
+	if assert.NoError(t, err, "PurgeOutboxContext dry run") {
+		assert.True(t, purged >= 3, fmt.Sprintf("dry run purged: %d", purged))
+	}
+	purgedReal, err := dbHandler.PurgeOutboxContext(ctx, now.Add(time.Second), false)
+	if assert.NoError(t, err, "PurgeOutboxContext") {
+		assert.Equal(t, purged, purgedReal, "purged")
+	}
+	purged, err = dbHandler.PurgeOutboxContext(ctx, now.Add(time.Second), false)
+	if assert.NoError(t, err, "PurgeOutboxContext again") {
+		assert.Equal(t, 0, purged, "purged again")
+	}
+
+	// only the messages are stored without user
+	alone := message(MakeUID("request"), 0, "Alone", now)
+	assert.NoError(t, dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{alone}),
+		"UpdateWithOutboxContext without user")
+	assert.Equal(t, []string{"Alone"}, claimOutbox(t, dbHandler, now, alone.RequestID), "claimed alone")
+
+	// the failed message is retried later
+	assert.NoError(t, dbHandler.RetryOutboxContext(ctx, alone.MessageID, now.Add(30*time.Second)), "RetryOutboxContext")
+	assert.Empty(t, claimOutbox(t, dbHandler, now.Add(10*time.Second), alone.RequestID), "claimed before retry")
+	assert.Equal(t, []string{"Alone"}, claimOutbox(t, dbHandler, now.Add(40*time.Second), alone.RequestID), "retried")
+	_, err = dbHandler.DoneOutboxContext(ctx, alone.RequestID, 0, now)
+	assert.NoError(t, err, "DoneOutboxContext alone")
+	assert.NoError(t, dbHandler.RetryOutboxContext(ctx, alone.MessageID, now), "RetryOutboxContext done")
+	assert.Empty(t, claimOutbox(t, dbHandler, now.Add(time.Hour), alone.RequestID), "done is not retried")
+}
+
+// testTranscript purges all transcript entries, created before the test
+func testTranscript(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	uid, other := MakeUID("transcript"), MakeUID("transcript")
+	requestID := MakeUID("request")
+	err := dbHandler.AppendTranscriptContext(ctx, []db.TranscriptEntry{
+		{UID: uid, RequestID: requestID, Direction: db.TranscriptRequest, Text: "Hello"},
+		{UID: uid, RequestID: requestID, Direction: db.TranscriptResponse, Text: "Hi"},
+		{UID: other, RequestID: MakeUID("request"), Direction: db.TranscriptRequest, Text: "Other"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	createdBefore := time.Now()
+	time.Sleep(10 * time.Millisecond)
+
+	err = dbHandler.AppendTranscriptContext(ctx, []db.TranscriptEntry{
+		{UID: uid, RequestID: MakeUID("request"), Direction: db.TranscriptResponse, Text: "What's your name?"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	texts := func() []string {
+		entries, err := dbHandler.ListTranscriptContext(ctx, uid)
+		if !assert.NoError(t, err, "ListTranscriptContext") {
+			return nil
+		}
+
+		texts := []string{}
+		for e := range entries {
+			assert.Equal(t, uid, entries[e].UID, "UID")
+			texts = append(texts, entries[e].Text)
+		}
+
+		return texts
+	}
+	assert.Equal(t, []string{"Hello", "Hi", "What's your name?"}, texts(), "transcript")
+
+	purged, err := dbHandler.PurgeTranscriptsContext(ctx, createdBefore, true)
+	if assert.NoError(t, err, "PurgeTranscriptsContext dry run") {
+		assert.True(t, purged >= 3, fmt.Sprintf("dry run purged: %d", purged))
+	}
+	assert.Len(t, texts(), 3, "kept by dry run")
+
+	purgedReal, err := dbHandler.PurgeTranscriptsContext(ctx, createdBefore, false)
+	if assert.NoError(t, err, "PurgeTranscriptsContext") {
+		assert.Equal(t, purged, purgedReal, "purged")
+	}
+	assert.Equal(t, []string{"What's your name?"}, texts(), "recent is kept")
+}
+
+func testCloseReconnect(t *testing.T, newDbHandler NewDbHandler) {
+	dbHandler := connect(t, newDbHandler)
+
+	uid := MakeUID("reconnect")
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		dbHandler.Close()
+
+		return
+	}
+	user.Name = "Jane Doe"
+	assert.NoError(t, dbHandler.Update(user), "Update")
+
+	dbHandler.Close()
+
+	_, err = dbHandler.GetOrCreateUser(uid)
+	assert.Error(t, err, "GetOrCreateUser after Close")
+
+	if !assert.NoError(t, dbHandler.Connect(), "Connect again") {
+		return
+	}
+	defer dbHandler.Close()
+
+	stored, err := dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser after reconnect") {
+		assert.Equal(t, user.ID, stored.ID, "ID")
+		assert.Equal(t, "Jane Doe", stored.Name, "Name")
+	}
+}
+
+func testContextDone(t *testing.T, newDbHandler NewDbHandler) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Error(t, newDbHandler().ConnectContext(ctx), "ConnectContext")
+
+	dbHandler := connect(t, newDbHandler)
+	defer dbHandler.Close()
+
+	uid := MakeUID("context")
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if !assert.NoError(t, err, "GetOrCreateUser") {
+		return
+	}
+
+	_, err = dbHandler.GetOrCreateUserContext(ctx, MakeUID("context-new"))
+	assert.Error(t, err, "GetOrCreateUserContext")
+
+	user.Name = "Canceled"
+	assert.Error(t, dbHandler.UpdateContext(ctx, user), "UpdateContext")
+
+	stored, err := dbHandler.GetOrCreateUserContext(context.Background(), uid)
+	if assert.NoError(t, err, "GetOrCreateUserContext") {
+		assert.Empty(t, stored.Name, "Name")
+		assert.Equal(t, user.Version, stored.Version, "Version")
+	}
+}
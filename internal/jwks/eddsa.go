@@ -0,0 +1,53 @@
+package jwks
+
+import (
+	"crypto/ed25519"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// SigningMethodEdDSA is the Ed25519 signing method (RFC 8037), which is not provided by jwt-go
+// It's registered as "EdDSA", so jwt.Parse accepts it.
+var SigningMethodEdDSA = &signingMethodEdDSA{} // nolint:gochecknoglobals
+
+type signingMethodEdDSA struct{}
+
+func init() { // nolint:gochecknoinits
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+// Alg returns the name of the algorithm
+func (*signingMethodEdDSA) Alg() string {
+	return "EdDSA"
+}
+
+// Sign signs by an ed25519.PrivateKey
+func (*signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, is := key.(ed25519.PrivateKey)
+	if !is {
+		return "", jwt.ErrInvalidKeyType
+	}
+
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// Verify verifies the signature by an ed25519.PublicKey
+func (*signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, is := key.(ed25519.PublicKey)
+	if !is {
+		return jwt.ErrInvalidKeyType
+	}
+
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+
+	return nil
+}
@@ -0,0 +1,324 @@
+// Package jwks provides JSON Web Key Sets (RFC 7517) for verifying RS256, ES256 and EdDSA JWTs
+//
+// The key set is loaded from a file or an HTTP(S) URL. It's reloaded regularly,
+// and when a token is signed by an unknown key (kid), so the issuer can rotate its keys.
+// SigningKeys is the issuer side: it signs by the active private key and publishes the public keys.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRefreshInterval is the reload interval of the key set, if Source.RefreshInterval is not set
+const DefaultRefreshInterval = 5 * time.Minute
+
+// p256Size is the size of the P-256 coordinates
+const p256Size = 32
+
+// minRefreshInterval limits the reloading, triggered by unknown kid
+const minRefreshInterval = 10 * time.Second
+
+// ErrUnknownKey is returned, if the key set has no key with the kid
+var ErrUnknownKey = errors.New("unknown key") // nolint:gochecknoglobals
+
+// JSONWebKey is a public key in JWK format
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// N and E are the modulus and the exponent of RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Crv, X and Y are the curve and the coordinates of EC keys
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JSONWebKeySet is a key set in JWKS format
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// KeySet holds the public keys by kid
+type KeySet struct {
+	keys map[string]crypto.PublicKey
+}
+
+// ParseKeySet parses a key set in JWKS format
+// Only RSA, P-256 EC and Ed25519 signing keys are used, the other keys are skipped.
+func ParseKeySet(data []byte) (*KeySet, error) {
+	jsonKeySet := JSONWebKeySet{}
+	if err := json.Unmarshal(data, &jsonKeySet); err != nil {
+		return nil, fmt.Errorf("invalid JWKS, %s", err)
+	}
+
+	keySet := &KeySet{keys: map[string]crypto.PublicKey{}}
+	for k := range jsonKeySet.Keys {
+		jsonKey := &jsonKeySet.Keys[k]
+		if jsonKey.Use != "" && jsonKey.Use != "sig" {
+			continue
+		}
+
+		key, err := jsonKey.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s, %s", jsonKey.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+
+		if _, has := keySet.keys[jsonKey.Kid]; has {
+			return nil, fmt.Errorf("duplicated key %s", jsonKey.Kid)
+		}
+		keySet.keys[jsonKey.Kid] = key
+	}
+
+	return keySet, nil
+}
+
+// PublicKey returns the RSA, P-256 ECDSA or Ed25519 public key, nil for the other key types
+func (jsonKey *JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch jsonKey.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jsonKey.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jsonKey.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		return jsonKey.ecPublicKey()
+	case "OKP":
+		return jsonKey.okpPublicKey()
+	default:
+		return nil, nil
+	}
+}
+
+func (jsonKey *JSONWebKey) ecPublicKey() (crypto.PublicKey, error) {
+	if jsonKey.Crv != "P-256" {
+		return nil, nil
+	}
+
+	x, err := decodeBigInt(jsonKey.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(jsonKey.Y)
+	if err != nil {
+		return nil, err
+	}
+	if !elliptic.P256().IsOnCurve(x, y) {
+		return nil, errors.New("EC point is not on the curve")
+	}
+
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// okpPublicKey returns the Ed25519 key (RFC 8037), nil for the other curves
+func (jsonKey *JSONWebKey) okpPublicKey() (crypto.PublicKey, error) {
+	if jsonKey.Crv != "Ed25519" {
+		return nil, nil
+	}
+
+	x, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(jsonKey.X, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(x) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid Ed25519 key size")
+	}
+
+	return ed25519.PublicKey(x), nil
+}
+
+// NewJSONWebKey makes a JWK from an RSA, P-256 ECDSA or Ed25519 public key
+func NewJSONWebKey(kid string, key crypto.PublicKey) (JSONWebKey, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return JSONWebKey{
+			Kty: "RSA", Kid: kid, Use: "sig", Alg: "RS256",
+			N: encodeBigInt(key.N), E: encodeBigInt(big.NewInt(int64(key.E))),
+		}, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return JSONWebKey{}, errors.New("unsupported EC curve")
+		}
+
+		return JSONWebKey{
+			Kty: "EC", Kid: kid, Use: "sig", Alg: "ES256", Crv: "P-256",
+			X: encodeFixed(key.X, p256Size), Y: encodeFixed(key.Y, p256Size),
+		}, nil
+	case ed25519.PublicKey:
+		return JSONWebKey{
+			Kty: "OKP", Kid: kid, Use: "sig", Alg: SigningMethodEdDSA.Alg(), Crv: "Ed25519",
+			X: base64.RawURLEncoding.EncodeToString(key),
+		}, nil
+	default:
+		return JSONWebKey{}, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// Key returns the key of the kid
+// If kid is empty and the set has only one key, it's returned.
+func (keySet *KeySet) Key(kid string) (crypto.PublicKey, error) {
+	if key, has := keySet.keys[kid]; has {
+		return key, nil
+	}
+
+	if kid == "" && len(keySet.keys) == 1 {
+		for _, key := range keySet.keys {
+			return key, nil
+		}
+	}
+
+	return nil, ErrUnknownKey
+}
+
+// Len returns the number of keys
+func (keySet *KeySet) Len() int {
+	return len(keySet.keys)
+}
+
+// Source loads the key set from Location (file path or HTTP(S) URL)
+// The key set is reloaded after RefreshInterval, or if a kid is unknown.
+// If reloading fails, the previous key set is used.
+type Source struct {
+	Location        string
+	HTTPClient      *http.Client
+	RefreshInterval time.Duration
+
+	keySet   *KeySet
+	loadedAt time.Time
+
+	mx sync.Mutex
+}
+
+// Load loads the key set
+func (source *Source) Load(ctx context.Context) error {
+	source.mx.Lock()
+	defer source.mx.Unlock()
+
+	return source.load(ctx)
+}
+
+// Key returns the key of the kid
+func (source *Source) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	source.mx.Lock()
+	defer source.mx.Unlock()
+
+	refreshInterval := source.RefreshInterval
+	if refreshInterval <= 0 {
+		refreshInterval = DefaultRefreshInterval
+	}
+
+	if source.keySet == nil || time.Since(source.loadedAt) > refreshInterval {
+		if err := source.load(ctx); err != nil && source.keySet == nil {
+			return nil, err
+		}
+	}
+
+	key, err := source.keySet.Key(kid)
+	if err == ErrUnknownKey && time.Since(source.loadedAt) > minRefreshInterval {
+		if loadErr := source.load(ctx); loadErr != nil {
+			return nil, ErrUnknownKey
+		}
+
+		return source.keySet.Key(kid)
+	}
+
+	return key, err
+}
+
+func (source *Source) load(ctx context.Context) error {
+	data, err := source.read(ctx)
+	if err == nil {
+		var keySet *KeySet
+		if keySet, err = ParseKeySet(data); err == nil {
+			source.keySet = keySet
+		}
+	}
+
+	// the failed loading is not retried until minRefreshInterval
+	source.loadedAt = time.Now()
+
+	return err
+}
+
+func (source *Source) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(source.Location, "http://") && !strings.HasPrefix(source.Location, "https://") {
+		return ioutil.ReadFile(source.Location)
+	}
+
+	httpClient := source.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.Location, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cannot get JWKS, status %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func decodeBigInt(text string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(text, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty value")
+	}
+
+	return new(big.Int).SetBytes(data), nil
+}
+
+func encodeBigInt(value *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(value.Bytes())
+}
+
+// encodeFixed encodes the value on size bytes, as EC coordinates must be (RFC 7518)
+func encodeFixed(value *big.Int, size int) string {
+	data := value.Bytes()
+	if len(data) < size {
+		data = append(make([]byte, size-len(data)), data...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
@@ -0,0 +1,216 @@
+package jwks_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/jwks"
+)
+
+type signingKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func makeKeys(t *testing.T) []signingKey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return []signingKey{
+		{kid: "rsa-1", method: jwt.SigningMethodRS256, key: rsaKey},
+		{kid: "ec-1", method: jwt.SigningMethodES256, key: ecKey},
+		{kid: "ed-1", method: jwks.SigningMethodEdDSA, key: edKey},
+	}
+}
+
+func marshalKeySet(t *testing.T, keys ...signingKey) []byte {
+	keySet := jwks.JSONWebKeySet{}
+	for _, key := range keys {
+		jsonKey, err := jwks.NewJSONWebKey(key.kid, key.key.Public())
+		if err != nil {
+			t.Fatal(err)
+		}
+		keySet.Keys = append(keySet.Keys, jsonKey)
+	}
+
+	data, err := json.Marshal(keySet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func sign(t *testing.T, key signingKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(key.method, claims)
+	token.Header["kid"] = key.kid
+
+	tokenString, err := token.SignedString(key.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tokenString
+}
+
+func writeKeySet(t *testing.T, data []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "chat-bot-jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path, func() { os.RemoveAll(dir) } // nolint:errcheck
+}
+
+func TestParseKeySet(t *testing.T) {
+	keys := makeKeys(t)
+	keySet, err := jwks.ParseKeySet(marshalKeySet(t, keys...))
+	if !assert.NoError(t, err, "ParseKeySet") {
+		return
+	}
+	assert.Equal(t, len(keys), keySet.Len(), "Len")
+
+	for _, key := range keys {
+		publicKey, err := keySet.Key(key.kid)
+		if assert.NoError(t, err, "Key "+key.kid) {
+			assert.Equal(t, key.key.Public(), publicKey, "public key "+key.kid)
+		}
+	}
+
+	_, err = keySet.Key("unknown")
+	assert.Equal(t, jwks.ErrUnknownKey, err, "unknown kid")
+	_, err = keySet.Key("")
+	assert.Equal(t, jwks.ErrUnknownKey, err, "empty kid of more keys")
+
+	keySet, err = jwks.ParseKeySet([]byte(`{"keys":[{"kty":"oct","k":"c2VjcmV0"},{"kty":"RSA","use":"enc","n":"AQAB","e":"AQAB"}]}`))
+	if assert.NoError(t, err, "ParseKeySet skipped") {
+		assert.Equal(t, 0, keySet.Len(), "only signing RSA and EC keys are used")
+	}
+
+	for _, invalid := range []string{
+		`{`, `{"keys":[{"kty":"RSA","n":"!","e":"AQAB"}]}`, `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`,
+		`{"keys":[{"kty":"OKP","crv":"Ed25519","x":"AQ"}]}`,
+	} {
+		_, err := jwks.ParseKeySet([]byte(invalid))
+		assert.Error(t, err, "ParseKeySet "+invalid)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	keys := makeKeys(t)
+	path, remove := writeKeySet(t, marshalKeySet(t, keys...))
+	defer remove()
+
+	verifier := &jwks.Verifier{Keys: &jwks.Source{Location: path}, Issuer: "idp", Audience: "chat-bot"}
+	ctx := context.Background()
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, key := range keys {
+		claims, err := verifier.Verify(ctx, sign(t, key, jwt.MapClaims{
+			"sub": "001", "iss": "idp", "aud": []string{"other", "chat-bot"}, "exp": exp,
+		}))
+		if assert.NoError(t, err, "Verify "+key.kid) {
+			assert.Equal(t, "001", claims.Subject, "Subject")
+			assert.Equal(t, "idp", claims.Issuer, "Issuer")
+			assert.Equal(t, exp, claims.ExpiresAt, "ExpiresAt")
+		}
+	}
+
+	for name, tokenString := range map[string]string{
+		"expired":      sign(t, keys[0], jwt.MapClaims{"sub": "001", "iss": "idp", "aud": "chat-bot", "exp": 1}),
+		"no subject":   sign(t, keys[0], jwt.MapClaims{"iss": "idp", "aud": "chat-bot"}),
+		"bad issuer":   sign(t, keys[0], jwt.MapClaims{"sub": "001", "iss": "other", "aud": "chat-bot"}),
+		"bad audience": sign(t, keys[0], jwt.MapClaims{"sub": "001", "iss": "idp", "aud": "other"}),
+		"unknown kid":  sign(t, signingKey{kid: "rsa-2", method: keys[0].method, key: keys[0].key}, jwt.MapClaims{"sub": "001"}),
+		"bad alg":      sign(t, signingKey{kid: "rsa-1", method: jwt.SigningMethodRS512, key: keys[0].key}, jwt.MapClaims{"sub": "001"}),
+		"key mismatch": sign(t, signingKey{kid: "ec-1", method: keys[0].method, key: keys[0].key}, jwt.MapClaims{"sub": "001"}),
+		"garbage":      "not.a.token",
+	} {
+		_, err := verifier.Verify(ctx, tokenString)
+		assert.Error(t, err, "Verify "+name)
+	}
+
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "001"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifier.Verify(ctx, hmacToken)
+	assert.Error(t, err, "Verify HS256")
+}
+
+func TestSourceURL(t *testing.T) {
+	keys := makeKeys(t)
+	mx := sync.Mutex{}
+	keySet := marshalKeySet(t, keys[0])
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mx.Lock()
+		defer mx.Unlock()
+
+		requests++
+		w.Write(keySet) // nolint:errcheck,gosec
+	}))
+	defer server.Close()
+
+	source := &jwks.Source{Location: server.URL, HTTPClient: server.Client(), RefreshInterval: 100 * time.Millisecond}
+	ctx := context.Background()
+
+	_, err := source.Key(ctx, keys[0].kid)
+	assert.NoError(t, err, "Key")
+	_, err = source.Key(ctx, keys[0].kid)
+	assert.NoError(t, err, "Key cached")
+
+	// rotation
+	mx.Lock()
+	keySet = marshalKeySet(t, keys[1])
+	mx.Unlock()
+
+	_, err = source.Key(ctx, keys[1].kid)
+	assert.Equal(t, jwks.ErrUnknownKey, err, "Key before refresh")
+
+	time.Sleep(150 * time.Millisecond)
+	_, err = source.Key(ctx, keys[1].kid)
+	assert.NoError(t, err, "Key after refresh")
+	_, err = source.Key(ctx, keys[0].kid)
+	assert.Equal(t, jwks.ErrUnknownKey, err, "rotated key")
+
+	mx.Lock()
+	assert.Equal(t, 2, requests, "requests")
+	mx.Unlock()
+}
@@ -0,0 +1,327 @@
+package jwks
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// KeyFileExt is the extension of the private key files in SigningKeys.Dir
+const KeyFileExt = ".key"
+
+// SigningKey is a private key with its ID (kid)
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	Key    crypto.Signer
+}
+
+// SigningKeys is the key set of the token issuer
+// The keys are loaded from the *.key PEM files (RSA, P-256 EC or Ed25519) of Dir, the kid is the file name
+// without extension. The active key is the last one by name, so a new key is activated by adding
+// a file, which is sorted after the current one (for example, 2020-06-01.key).
+// The other keys are kept in the public key set, until the file is removed.
+// If Dir is empty, the only key is loaded from Path.
+// If Algorithm is set (RS256, ES256 or EdDSA), the active key must be of it. The previous keys
+// can be of other algorithms, so the algorithm can be changed by a key rotation.
+// MaxAge is the cache max-age of the published key set. A key, added by a reload, is published at once,
+// but it becomes active only after MaxAge, so the clients, which cached the previous key set, know it
+// by then. The keys of the first load are active at once.
+type SigningKeys struct {
+	Dir       string
+	Path      string
+	Algorithm string
+	MaxAge    time.Duration
+
+	keys []*SigningKey
+	// published is the time of publishing the keys by kid, zero for the keys of the first load
+	published map[string]time.Time
+
+	mx sync.RWMutex
+}
+
+// Load (re)loads the keys
+// If loading fails, the previous keys are kept.
+func (signingKeys *SigningKeys) Load() error {
+	paths, err := signingKeys.keyPaths()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no signing key in %s", signingKeys.Dir)
+	}
+
+	keys := make([]*SigningKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := readSigningKey(path)
+		if err != nil {
+			return fmt.Errorf("cannot load signing key %s, %s", path, err)
+		}
+		keys = append(keys, key)
+	}
+
+	active := keys[len(keys)-1]
+	if signingKeys.Algorithm != "" && active.Method.Alg() != signingKeys.Algorithm {
+		return fmt.Errorf("the active signing key %s is %s, not %s", active.ID, active.Method.Alg(), signingKeys.Algorithm)
+	}
+
+	signingKeys.mx.Lock()
+	defer signingKeys.mx.Unlock()
+
+	now := time.Now()
+	published := make(map[string]time.Time, len(keys))
+	for _, key := range keys {
+		if publishedAt, has := signingKeys.published[key.ID]; has {
+			published[key.ID] = publishedAt
+		} else if signingKeys.published != nil {
+			published[key.ID] = now
+		} else {
+			published[key.ID] = time.Time{}
+		}
+	}
+
+	signingKeys.keys = keys
+	signingKeys.published = published
+
+	return nil
+}
+
+// Active returns the key for signing, nil if the keys are not loaded
+// It's the last key by name, which was published at least MaxAge ago. If there is no such key
+// (all of the previous keys were removed), the last key is returned.
+func (signingKeys *SigningKeys) Active() *SigningKey {
+	signingKeys.mx.RLock()
+	defer signingKeys.mx.RUnlock()
+
+	if len(signingKeys.keys) == 0 {
+		return nil
+	}
+
+	activeBefore := time.Now().Add(-signingKeys.MaxAge)
+	for k := len(signingKeys.keys) - 1; k >= 0; k-- {
+		key := signingKeys.keys[k]
+		if !signingKeys.published[key.ID].After(activeBefore) {
+			return key
+		}
+	}
+
+	return signingKeys.keys[len(signingKeys.keys)-1]
+}
+
+// Pending returns the last key, if it's published, but not active yet, else nil
+func (signingKeys *SigningKeys) Pending() *SigningKey {
+	active := signingKeys.Active()
+
+	signingKeys.mx.RLock()
+	defer signingKeys.mx.RUnlock()
+
+	if len(signingKeys.keys) == 0 {
+		return nil
+	}
+	if last := signingKeys.keys[len(signingKeys.keys)-1]; last != active {
+		return last
+	}
+
+	return nil
+}
+
+// JSONWebKeySet returns the public keys, the active key is the first one
+func (signingKeys *SigningKeys) JSONWebKeySet() (JSONWebKeySet, error) {
+	signingKeys.mx.RLock()
+	defer signingKeys.mx.RUnlock()
+
+	keySet := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for k := len(signingKeys.keys) - 1; k >= 0; k-- {
+		key := signingKeys.keys[k]
+		jsonKey, err := NewJSONWebKey(key.ID, key.Key.Public())
+		if err != nil {
+			return JSONWebKeySet{}, err
+		}
+		keySet.Keys = append(keySet.Keys, jsonKey)
+	}
+
+	return keySet, nil
+}
+
+// Watch reloads the keys on SIGHUP and on changing the key files, until done is closed
+func (signingKeys *SigningKeys) Watch(done <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close() // nolint:errcheck
+
+	watched := signingKeys.Dir
+	if watched == "" {
+		watched = filepath.Dir(signingKeys.Path)
+	}
+	if err := watcher.Add(watched); err != nil {
+		return err
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-hangup:
+			signingKeys.reload("SIGHUP")
+		case event := <-watcher.Events:
+			if signingKeys.isKeyPath(event.Name) {
+				signingKeys.reload(event.String())
+			}
+		case err := <-watcher.Errors:
+			logger.Get().Warning("cannot watch signing keys, ", err)
+		}
+	}
+}
+
+func (signingKeys *SigningKeys) reload(reason string) {
+	if err := signingKeys.Load(); err != nil {
+		logger.Get().Warningf("cannot reload signing keys (%s), %s", reason, err)
+
+		return
+	}
+
+	if active := signingKeys.Active(); active != nil {
+		logger.Get().Infof("Signing keys reloaded (%s), active key: %s", reason, active.ID)
+	}
+	if pending := signingKeys.Pending(); pending != nil {
+		logger.Get().Infof("Signing key %s is published, it becomes active after %s", pending.ID, signingKeys.MaxAge)
+	}
+}
+
+func (signingKeys *SigningKeys) isKeyPath(path string) bool {
+	if signingKeys.Dir == "" {
+		return filepath.Clean(path) == filepath.Clean(signingKeys.Path)
+	}
+
+	return isKeyFile(filepath.Base(path))
+}
+
+// keyPaths returns the key files, sorted by name
+func (signingKeys *SigningKeys) keyPaths() ([]string, error) {
+	if signingKeys.Dir == "" {
+		if signingKeys.Path == "" {
+			return nil, errors.New("no signing key")
+		}
+
+		return []string{signingKeys.Path}, nil
+	}
+
+	files, err := ioutil.ReadDir(signingKeys.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, file := range files {
+		if file.Mode().IsRegular() && isKeyFile(file.Name()) {
+			paths = append(paths, filepath.Join(signingKeys.Dir, file.Name()))
+		}
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+func isKeyFile(name string) bool {
+	return !strings.HasPrefix(name, ".") && filepath.Ext(name) == KeyFileExt
+}
+
+// readSigningKey reads an RSA (PKCS1 or PKCS8), a P-256 EC (SEC1 or PKCS8) or an Ed25519 (PKCS8)
+// private key in PEM format
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := ioutil.ReadFile(path) // nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+
+	method, err := signingMethod(key.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:     strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Method: method,
+		Key:    key,
+	}, nil
+}
+
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM file")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, is := key.(crypto.Signer); is {
+			return signer, nil
+		}
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	return nil, errors.New("not an RSA, EC or Ed25519 private key")
+}
+
+// signingMethod returns the algorithm of the key
+func signingMethod(key crypto.PublicKey) (jwt.SigningMethod, error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return nil, errors.New("unsupported EC curve")
+		}
+
+		return jwt.SigningMethodES256, nil
+	case ed25519.PublicKey:
+		return SigningMethodEdDSA, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// ParseAlgorithm checks the signing algorithm, empty means any supported algorithm
+func ParseAlgorithm(alg string) (string, error) {
+	switch alg {
+	case "", jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg(), SigningMethodEdDSA.Alg():
+		return alg, nil
+	default:
+		return "", fmt.Errorf("unsupported signing algorithm: %s", alg)
+	}
+}
@@ -0,0 +1,193 @@
+package jwks_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/jwks"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+func writeSigningKey(t *testing.T, dir string, name string, key signingKey) {
+	var block *pem.Block
+	switch privateKey := key.key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
+	case *ecdsa.PrivateKey:
+		data, err := x509.MarshalECPrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: data}
+	default:
+		data, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: data}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSigningKeys(t *testing.T) {
+	keys := makeKeys(t)
+	dir, err := ioutil.TempDir("", "chat-bot-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	signingKeys := &jwks.SigningKeys{Dir: dir}
+	assert.Error(t, signingKeys.Load(), "Load empty")
+	assert.Nil(t, signingKeys.Active(), "Active empty")
+
+	writeSigningKey(t, dir, "2020-01.key", keys[0])
+	writeSigningKey(t, dir, "2020-02.key", keys[1])
+	writeSigningKey(t, dir, "2020-03.pem", keys[2])
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+
+	active := signingKeys.Active()
+	assert.Equal(t, "2020-02", active.ID, "active ID")
+	assert.Equal(t, "ES256", active.Method.Alg(), "active Method")
+
+	keySet, err := signingKeys.JSONWebKeySet()
+	if assert.NoError(t, err, "JSONWebKeySet") && assert.Len(t, keySet.Keys, 2, "keys") {
+		assert.Equal(t, "2020-02", keySet.Keys[0].Kid, "first key")
+		assert.Equal(t, "2020-01", keySet.Keys[1].Kid, "previous key")
+		assert.Equal(t, "RS256", keySet.Keys[1].Alg, "previous alg")
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "2020-04.key"), []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, signingKeys.Load(), "Load invalid")
+	assert.Equal(t, "2020-02", signingKeys.Active().ID, "kept active ID")
+
+	signingKeys = &jwks.SigningKeys{Path: filepath.Join(dir, "2020-03.pem")}
+	if assert.NoError(t, signingKeys.Load(), "Load Path") {
+		assert.Equal(t, "2020-03", signingKeys.Active().ID, "Path ID")
+		assert.Equal(t, "EdDSA", signingKeys.Active().Method.Alg(), "Path Method")
+	}
+
+	signingKeys = &jwks.SigningKeys{Path: filepath.Join(dir, "2020-01.key"), Algorithm: "ES256"}
+	assert.Error(t, signingKeys.Load(), "Load other Algorithm")
+	signingKeys.Algorithm = "RS256"
+	assert.NoError(t, signingKeys.Load(), "Load Algorithm")
+
+	for _, alg := range []string{"", "RS256", "ES256", "EdDSA"} {
+		_, err := jwks.ParseAlgorithm(alg)
+		assert.NoError(t, err, "ParseAlgorithm "+alg)
+	}
+	_, err = jwks.ParseAlgorithm("HS256")
+	assert.Error(t, err, "ParseAlgorithm HS256")
+}
+
+func TestSigningKeysMaxAge(t *testing.T) {
+	keys := makeKeys(t)
+	dir, err := ioutil.TempDir("", "chat-bot-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	writeSigningKey(t, dir, "a.key", keys[0])
+	writeSigningKey(t, dir, "b.key", keys[1])
+	signingKeys := &jwks.SigningKeys{Dir: dir, MaxAge: 200 * time.Millisecond}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+	assert.Equal(t, "b", signingKeys.Active().ID, "first load")
+	assert.Nil(t, signingKeys.Pending(), "first load pending")
+
+	writeSigningKey(t, dir, "c.key", keys[2])
+	if !assert.NoError(t, signingKeys.Load(), "Load new") {
+		return
+	}
+	keySet, err := signingKeys.JSONWebKeySet()
+	if assert.NoError(t, err, "JSONWebKeySet") && assert.Len(t, keySet.Keys, 3, "keys") {
+		assert.Equal(t, "c", keySet.Keys[0].Kid, "published")
+	}
+	assert.Equal(t, "b", signingKeys.Active().ID, "not active yet")
+	if assert.NotNil(t, signingKeys.Pending(), "pending") {
+		assert.Equal(t, "c", signingKeys.Pending().ID, "pending ID")
+	}
+
+	assert.NoError(t, signingKeys.Load(), "Load again")
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, "c", signingKeys.Active().ID, "active after MaxAge")
+	assert.Nil(t, signingKeys.Pending(), "no pending")
+
+	if err := os.Remove(filepath.Join(dir, "a.key")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "b.key")); err != nil {
+		t.Fatal(err)
+	}
+	writeSigningKey(t, dir, "d.key", keys[0])
+	if !assert.NoError(t, signingKeys.Load(), "Load rotated") {
+		return
+	}
+	assert.Equal(t, "c", signingKeys.Active().ID, "previous active")
+
+	if err := os.Remove(filepath.Join(dir, "c.key")); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NoError(t, signingKeys.Load(), "Load only new") {
+		assert.Equal(t, "d", signingKeys.Active().ID, "only key")
+	}
+}
+
+func TestSigningKeysWatch(t *testing.T) {
+	logger.Init("info")
+
+	keys := makeKeys(t)
+	dir, err := ioutil.TempDir("", "chat-bot-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	writeSigningKey(t, dir, "a.key", keys[0])
+	signingKeys := &jwks.SigningKeys{Dir: dir}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+
+	done := make(chan struct{})
+	watched := make(chan error, 1)
+	go func() {
+		watched <- signingKeys.Watch(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	writeSigningKey(t, dir, "b.key", keys[1])
+	for wait := 0; wait < 50 && signingKeys.Active().ID != "b"; wait++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, "b", signingKeys.Active().ID, "rotated")
+
+	if err := os.Remove(filepath.Join(dir, "b.key")); err != nil {
+		t.Fatal(err)
+	}
+	for wait := 0; wait < 50 && signingKeys.Active().ID != "a"; wait++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, "a", signingKeys.Active().ID, "removed")
+
+	close(done)
+	assert.NoError(t, <-watched, "Watch")
+}
@@ -0,0 +1,109 @@
+package jwks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// Claims are the verified claims of a token
+type Claims struct {
+	Subject  string
+	Issuer   string
+	Audience []string
+	// ExpiresAt is Unix time, 0 if the token does not expire
+	ExpiresAt int64
+}
+
+// Verifier verifies RS256, ES256 and EdDSA tokens by the keys of Keys
+// Issuer and Audience are checked, if they are set.
+type Verifier struct {
+	Keys     *Source
+	Issuer   string
+	Audience string
+}
+
+// nolint:gochecknoglobals
+var allowedAlgs = map[string]bool{
+	jwt.SigningMethodRS256.Alg(): true,
+	jwt.SigningMethodES256.Alg(): true,
+	SigningMethodEdDSA.Alg():     true,
+}
+
+// Verify verifies the signature and the claims of the token
+// The token must have a subject (sub).
+func (verifier *Verifier) Verify(ctx context.Context, tokenString string) (Claims, error) {
+	mapClaims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, mapClaims, func(token *jwt.Token) (interface{}, error) {
+		if !allowedAlgs[token.Method.Alg()] {
+			return nil, fmt.Errorf("unsupported algorithm %s", token.Method.Alg())
+		}
+
+		kid, _ := token.Header["kid"].(string) // nolint:errcheck
+
+		return verifier.Keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return Claims{}, err
+	}
+
+	claims := Claims{
+		Subject:  stringClaim(mapClaims, "sub"),
+		Issuer:   stringClaim(mapClaims, "iss"),
+		Audience: audienceClaim(mapClaims),
+	}
+	if exp, is := mapClaims["exp"].(float64); is {
+		claims.ExpiresAt = int64(exp)
+	}
+
+	if claims.Subject == "" {
+		return claims, errors.New("missing subject")
+	}
+
+	if verifier.Issuer != "" && claims.Issuer != verifier.Issuer {
+		return claims, fmt.Errorf("invalid issuer %s", claims.Issuer)
+	}
+
+	if verifier.Audience != "" && !containsString(claims.Audience, verifier.Audience) {
+		return claims, fmt.Errorf("invalid audience %v", claims.Audience)
+	}
+
+	return claims, nil
+}
+
+func stringClaim(mapClaims jwt.MapClaims, name string) string {
+	value, _ := mapClaims[name].(string) // nolint:errcheck
+
+	return value
+}
+
+// audienceClaim returns the audience, which can be a string or an array (RFC 7519)
+func audienceClaim(mapClaims jwt.MapClaims) []string {
+	switch aud := mapClaims["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		audience := []string{}
+		for _, item := range aud {
+			if text, is := item.(string); is {
+				audience = append(audience, text)
+			}
+		}
+
+		return audience
+	default:
+		return nil
+	}
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,282 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	clusterSlots = 16384
+	// clusterMaxRedirects limits the MOVED and ASK redirections of a command
+	clusterMaxRedirects = 5
+)
+
+// clusterConn is a connection to a Redis Cluster
+// Commands are sent to the node of the slot of the first argument, if the node is known (from a MOVED reply),
+// else to the seed node. MOVED and ASK redirections are followed.
+// Pub/Sub (Send, Flush, Receive) uses the seed node, because the messages are broadcasted to all nodes.
+type clusterConn struct {
+	seed       redis.Conn
+	connConfig ConnConfig
+	// nodes are the connections to the other nodes, by address
+	nodes map[string]redis.Conn
+	// slots are the node addresses of the slots, learned from MOVED replies
+	slots map[uint16]string
+}
+
+// dialCluster connects to the first available node
+func dialCluster(ctx context.Context, nodes []string, connConfig ConnConfig) (redis.Conn, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("no Redis Cluster node address")
+	}
+
+	errs := []string{}
+	for _, node := range nodes {
+		seed, err := dialNode(ctx, node, connConfig)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", node, err))
+
+			continue
+		}
+
+		return &clusterConn{
+			seed: seed, connConfig: connConfig,
+			nodes: map[string]redis.Conn{}, slots: map[uint16]string{},
+		}, nil
+	}
+
+	return nil, fmt.Errorf("cannot connect to Redis Cluster, %s", strings.Join(errs, "; "))
+}
+
+func (conn *clusterConn) Close() error {
+	for _, node := range conn.nodes {
+		node.Close() // nolint:errcheck,gosec
+	}
+
+	return conn.seed.Close()
+}
+
+func (conn *clusterConn) Err() error {
+	return conn.seed.Err()
+}
+
+func (conn *clusterConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	return conn.DoWithTimeout(0, commandName, args...)
+}
+
+// DoWithTimeout sends the command to the node of the slot, a zero timeout means no timeout
+// PUBSUB NUMSUB is sent to all nodes, and the numbers of the subscribers are summed.
+func (conn *clusterConn) DoWithTimeout(timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	if strings.EqualFold(commandName, "PUBSUB") && len(args) == 2 && strings.EqualFold(fmt.Sprint(args[0]), "NUMSUB") {
+		return conn.numSub(timeout, args[1])
+	}
+
+	slot, hasSlot := commandSlot(commandName, args)
+
+	node := conn.seed
+	if addr, has := conn.slots[slot]; hasSlot && has {
+		var err error
+		if node, err = conn.node(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	for redirects := 0; ; redirects++ {
+		reply, err := doWithTimeout(node, timeout, commandName, args...)
+
+		redirection, addr := parseRedirection(err)
+		if redirection == "" || redirects >= clusterMaxRedirects {
+			return reply, err
+		}
+
+		if node, err = conn.node(addr); err != nil {
+			return nil, err
+		}
+
+		if redirection == "MOVED" {
+			conn.slots[slot] = addr
+		} else if _, err := doWithTimeout(node, timeout, "ASKING"); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (conn *clusterConn) Send(commandName string, args ...interface{}) error {
+	return conn.seed.Send(commandName, args...)
+}
+
+func (conn *clusterConn) Flush() error {
+	return conn.seed.Flush()
+}
+
+func (conn *clusterConn) Receive() (interface{}, error) {
+	return conn.seed.Receive()
+}
+
+func (conn *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(conn.seed, timeout)
+}
+
+// numSub returns the PUBSUB NUMSUB reply of the channel, summed over all nodes
+// A node counts only its own subscribers, and a published message is forwarded to all nodes.
+func (conn *clusterConn) numSub(timeout time.Duration, channel interface{}) (interface{}, error) {
+	nodes, err := redis.String(doWithTimeout(conn.seed, timeout, "CLUSTER", "NODES"))
+	if err != nil {
+		return nil, err
+	}
+
+	subscribers := int64(0)
+	for _, addr := range parseClusterNodes(nodes) {
+		node := conn.seed
+		if addr != "" {
+			if node, err = conn.node(addr); err != nil {
+				return nil, err
+			}
+		}
+
+		reply, err := redis.Values(doWithTimeout(node, timeout, "PUBSUB", "NUMSUB", channel))
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) != 2 {
+			return nil, fmt.Errorf("invalid PUBSUB NUMSUB reply of %s", addr)
+		}
+		count, err := redis.Int64(reply[1], nil)
+		if err != nil {
+			return nil, err
+		}
+		subscribers += count
+	}
+
+	return []interface{}{channel, subscribers}, nil
+}
+
+// parseClusterNodes returns the addresses of the connected nodes from the CLUSTER NODES reply
+// The address of the node itself (myself) is empty.
+func parseClusterNodes(nodes string) []string {
+	addrs := []string{}
+	for _, line := range strings.Split(nodes, "\n") {
+		// <id> <ip:port@cport[,hostname]> <flags> ...
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		flags := "," + fields[2] + ","
+		switch {
+		case strings.Contains(flags, ",myself,"):
+			addrs = append(addrs, "")
+		case strings.Contains(flags, ",fail,") || strings.Contains(flags, ",noaddr,") ||
+			strings.Contains(flags, ",handshake,"):
+		default:
+			addr := strings.SplitN(strings.SplitN(fields[1], ",", 2)[0], "@", 2)[0]
+			if !strings.HasPrefix(addr, ":") {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	return addrs
+}
+
+// node returns the connection to the node, a new connection is made, if needed
+func (conn *clusterConn) node(addr string) (redis.Conn, error) {
+	if node, has := conn.nodes[addr]; has && node.Err() == nil {
+		return node, nil
+	}
+
+	node, err := dialNode(context.Background(), addr, conn.connConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn.nodes[addr] = node
+
+	return node, nil
+}
+
+func doWithTimeout(conn redis.Conn, timeout time.Duration, commandName string, args ...interface{}) (interface{}, error) {
+	if timeout == 0 {
+		return conn.Do(commandName, args...)
+	}
+
+	return redis.DoWithTimeout(conn, timeout, commandName, args...)
+}
+
+// parseRedirection returns the redirection (MOVED or ASK) and the node address from an error reply
+func parseRedirection(err error) (string, string) {
+	redisErr, is := err.(redis.Error)
+	if !is {
+		return "", ""
+	}
+
+	// MOVED <slot> <host:port>
+	fields := strings.Fields(string(redisErr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", ""
+	}
+
+	return fields[0], fields[2]
+}
+
+// commandSlot returns the slot of the first key
+// The key is the first argument of most commands, EVAL and EVALSHA have the keys after the script and numkeys.
+func commandSlot(commandName string, args []interface{}) (uint16, bool) {
+	if strings.EqualFold(commandName, "EVAL") || strings.EqualFold(commandName, "EVALSHA") {
+		if len(args) < 3 || fmt.Sprint(args[1]) == "0" {
+			return 0, false
+		}
+
+		return argsSlot(args[2:])
+	}
+
+	return argsSlot(args)
+}
+
+// argsSlot returns the slot of the first argument
+func argsSlot(args []interface{}) (uint16, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+
+	switch arg := args[0].(type) {
+	case string:
+		return keySlot([]byte(arg)), true
+	case []byte:
+		return keySlot(arg), true
+	default:
+		return keySlot([]byte(fmt.Sprint(arg))), true
+	}
+}
+
+// keySlot returns the slot of the key, the hash tag ({...}) is taken into account
+func keySlot(key []byte) uint16 {
+	if start := strings.IndexByte(string(key), '{'); start >= 0 {
+		if end := strings.IndexByte(string(key[start+1:]), '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return crc16(key) % clusterSlots
+}
+
+// crc16 is CRC-16/XMODEM, used by Redis Cluster
+func crc16(data []byte) uint16 {
+	crc := uint16(0)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeySlot(t *testing.T) {
+	// CRC-16/XMODEM check value is 0x31C3
+	assert.Equal(t, uint16(0x31C3), crc16([]byte("123456789")), "crc16")
+
+	assert.Equal(t, uint16(12182), keySlot([]byte("foo")), "foo")
+	assert.Equal(t, keySlot([]byte("user1000")), keySlot([]byte("{user1000}.following")), "hash tag")
+	assert.NotEqual(t, keySlot([]byte("")), keySlot([]byte("{}.following")), "empty hash tag is not a tag")
+}
+
+func TestCommandSlot(t *testing.T) {
+	slot, has := commandSlot("SET", []interface{}{"foo", "bar"})
+	assert.True(t, has, "SET has slot")
+	assert.Equal(t, keySlot([]byte("foo")), slot, "SET")
+
+	slot, has = commandSlot("EVAL", []interface{}{"return 1", 1, "foo", "bar"})
+	assert.True(t, has, "EVAL has slot")
+	assert.Equal(t, keySlot([]byte("foo")), slot, "EVAL")
+
+	_, has = commandSlot("EVAL", []interface{}{"return 1", 0})
+	assert.False(t, has, "EVAL without keys")
+	_, has = commandSlot("PING", nil)
+	assert.False(t, has, "PING")
+}
+
+func TestParseClusterNodes(t *testing.T) {
+	nodes := "07c37dfeb235213a872192d90877d0cd55635b91 127.0.0.1:30004@31004 slave e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca" +
+		" 0 1426238317239 4 connected\n" +
+		"67ed2db8d677e59ec4a4cefb06858cf2a1a89fa1 127.0.0.1:30002@31002,node-2 master - 0 1426238316232 2 connected" +
+		" 5461-10922\n" +
+		"292f8b365bb7edb5e285caf0b7e6ddc7265d2f4f 127.0.0.1:30003@31003 master,fail - 0 1426238318243 3 connected\n" +
+		"e7d1eecce10fd6bb5eb35b9f99a514335d9ba9ca 127.0.0.1:30001@31001 myself,master - 0 0 1 connected 0-5460\n" +
+		"6ec23923021cf3ffec47632106199cb7f496ce01 :0@0 master,noaddr - 0 1426238316232 5 disconnected\n"
+
+	assert.Equal(t, []string{"127.0.0.1:30004", "127.0.0.1:30002", ""}, parseClusterNodes(nodes), "addresses")
+}
@@ -0,0 +1,156 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// TopologyStandalone is a single Redis server, the host is its address
+	TopologyStandalone = "standalone"
+	// TopologySentinel is a Redis master, monitored by Sentinels, the host is the comma separated Sentinel addresses
+	TopologySentinel = "sentinel"
+	// TopologyCluster is a Redis Cluster, the host is the comma separated addresses of (some) nodes
+	TopologyCluster = "cluster"
+)
+
+// ConnConfig is the connection config of Redis, besides the host
+type ConnConfig struct {
+	// Topology is TopologyStandalone (default, if empty), TopologySentinel or TopologyCluster
+	Topology string
+	// SentinelMaster is the master name, monitored by the Sentinels
+	SentinelMaster string
+	// SentinelPassword enables AUTH to the Sentinels
+	SentinelPassword string
+
+	// Username is the ACL user (Redis 6), used only if Password is set
+	// If it's empty, AUTH is sent only with Password (requirepass of Redis 5)
+	Username string
+	// Password enables AUTH
+	Password string
+	// Database is the DB index, selected after AUTH, Redis Cluster has only DB 0
+	Database int
+	// TLSConfig enables TLS, if not nil
+	TLSConfig *tls.Config
+}
+
+// Validate checks the topology and its settings
+func (connConfig *ConnConfig) Validate() error {
+	switch connConfig.Topology {
+	case "", TopologyStandalone, TopologySentinel:
+	case TopologyCluster:
+		if connConfig.Database != 0 {
+			return fmt.Errorf("only DB 0 is supported by Redis Cluster, DB index: %d", connConfig.Database)
+		}
+	default:
+		return fmt.Errorf("unknown Redis topology: %s", connConfig.Topology)
+	}
+
+	return nil
+}
+
+// LoadTLSConfig makes a TLS config for Redis
+// caFile is the CA of the server certificate, the system CAs are used, if it's empty
+// certFile and keyFile are the client certificate, optional
+func LoadTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		caPEM, err := ioutil.ReadFile(caFile) // nolint:gosec
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no CA certificate in " + caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// dial connects to Redis, according to the topology
+func dial(ctx context.Context, host string, connConfig ConnConfig) (redis.Conn, error) {
+	switch connConfig.Topology {
+	case "", TopologyStandalone:
+		return dialNode(ctx, host, connConfig)
+	case TopologySentinel:
+		return dialSentinel(ctx, splitHosts(host), connConfig)
+	case TopologyCluster:
+		return dialCluster(ctx, splitHosts(host), connConfig)
+	default:
+		return nil, fmt.Errorf("unknown Redis topology: %s", connConfig.Topology)
+	}
+}
+
+func splitHosts(hosts string) []string {
+	addrs := []string{}
+	for _, addr := range strings.Split(hosts, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs
+}
+
+// dialNode connects to a Redis server, authenticates and selects the DB
+func dialNode(ctx context.Context, host string, connConfig ConnConfig) (redis.Conn, error) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	options := []redis.DialOption{
+		redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		}),
+		redis.DialWriteTimeout(dialTimeout),
+	}
+	if connConfig.TLSConfig != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(connConfig.TLSConfig))
+	}
+
+	conn, err := redis.Dial("tcp", host, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// redigo supports only AUTH without user name, so AUTH and SELECT are sent here
+	if connConfig.Password != "" {
+		args := []interface{}{connConfig.Password}
+		if connConfig.Username != "" {
+			args = []interface{}{connConfig.Username, connConfig.Password}
+		}
+
+		if _, err := redis.DoWithTimeout(conn, dialTimeout, "AUTH", args...); err != nil {
+			conn.Close() // nolint:errcheck,gosec
+
+			return nil, err
+		}
+	}
+
+	if connConfig.Database != 0 {
+		if _, err := redis.DoWithTimeout(conn, dialTimeout, "SELECT", connConfig.Database); err != nil {
+			conn.Close() // nolint:errcheck,gosec
+
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,364 @@
+package queue_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+// respServer is a minimal Redis server, which records the commands
+// AUTH is accepted only with password "secret", (UN)SUBSCRIBE is confirmed, GET returns nil,
+// PUBLISH and the counters return 1, other commands are answered by OK
+type respServer struct {
+	listener net.Listener
+	commands chan string
+	// handler overrides the reply of a command, if it returns non-empty reply
+	handler func(args []string) string
+
+	conns map[net.Conn]struct{}
+	mx    sync.Mutex
+}
+
+func newRespServer(t *testing.T, tlsConfig *tls.Config) *respServer {
+	return newRespServerWithHandler(t, tlsConfig, nil)
+}
+
+func newRespServerWithHandler(t *testing.T, tlsConfig *tls.Config, handler func(args []string) string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	server := &respServer{
+		listener: listener, commands: make(chan string, 100), handler: handler, conns: map[net.Conn]struct{}{},
+	}
+	go server.serve()
+
+	return server
+}
+
+func (server *respServer) serve() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go server.handle(conn)
+	}
+}
+
+func (server *respServer) handle(conn net.Conn) {
+	server.mx.Lock()
+	server.conns[conn] = struct{}{}
+	server.mx.Unlock()
+
+	defer func() {
+		server.mx.Lock()
+		delete(server.conns, conn)
+		server.mx.Unlock()
+
+		conn.Close() // nolint:errcheck,gosec
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		server.commands <- strings.Join(args, " ")
+
+		reply := "+OK\r\n"
+		switch {
+		case server.handler != nil && server.handler(args) != "":
+			reply = server.handler(args)
+		case strings.EqualFold(args[0], "AUTH") && args[len(args)-1] != "secret":
+			reply = "-WRONGPASS invalid username-password pair\r\n"
+		case strings.EqualFold(args[0], "SUBSCRIBE"):
+			reply = respArray("subscribe", args[1]) + ":1\r\n"
+		case strings.EqualFold(args[0], "UNSUBSCRIBE"):
+			reply = respArray("unsubscribe", args[1]) + ":0\r\n"
+		case strings.EqualFold(args[0], "GET"):
+			reply = "$-1\r\n"
+		case strings.EqualFold(args[0], "PUBSUB") && len(args) == 3:
+			reply = respArray(args[2]) + ":1\r\n"
+		case strings.EqualFold(args[0], "PUBLISH"), strings.EqualFold(args[0], "INCRBY"),
+			strings.EqualFold(args[0], "DECR"):
+			reply = ":1\r\n"
+		}
+		if err := server.write(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (server *respServer) write(conn net.Conn, reply string) error {
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	_, err := conn.Write([]byte(reply))
+
+	return err
+}
+
+// respArray makes an array header with bulk strings, the last element is appended by the caller
+func respArray(items ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items)+1)
+	for _, item := range items {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(item), item)
+	}
+
+	return reply
+}
+
+// respBulkArray makes an array of bulk strings
+func respBulkArray(items ...string) string {
+	reply := fmt.Sprintf("*%d\r\n", len(items))
+	for _, item := range items {
+		reply += fmt.Sprintf("$%d\r\n%s\r\n", len(item), item)
+	}
+
+	return reply
+}
+
+// publish sends a message to all connections
+func (server *respServer) publish(channel string, data string) {
+	for _, conn := range server.connections() {
+		server.write(conn, respArray("message", channel)+fmt.Sprintf("$%d\r\n%s\r\n", len(data), data)) // nolint:errcheck,gosec
+	}
+}
+
+// disconnect closes all connections, like a restarted Redis
+func (server *respServer) disconnect() {
+	for _, conn := range server.connections() {
+		conn.Close() // nolint:errcheck,gosec
+	}
+}
+
+func (server *respServer) connections() []net.Conn {
+	server.mx.Lock()
+	defer server.mx.Unlock()
+
+	conns := []net.Conn{}
+	for conn := range server.conns {
+		conns = append(conns, conn)
+	}
+
+	return conns
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid command: %s", line)
+	}
+
+	args := make([]string, count)
+	for a := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[a] = string(data[:length])
+	}
+
+	return args, nil
+}
+
+func (server *respServer) nextCommand(t *testing.T) string {
+	t.Helper()
+
+	select {
+	case command := <-server.commands:
+		return command
+	case <-time.After(5 * time.Second):
+		t.Fatal("no command received")
+
+		return ""
+	}
+}
+
+func TestConnAuth(t *testing.T) {
+	server := newRespServer(t, nil)
+	defer server.listener.Close() // nolint:errcheck
+
+	publisher := &queue.RealRedisPublisher{
+		Host: server.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{Username: "chat-bot", Password: "secret", Database: 2},
+	}
+	if !assert.NoError(t, publisher.Connect(), "Connect") {
+		return
+	}
+	defer publisher.Close()
+
+	assert.Equal(t, "AUTH chat-bot secret", server.nextCommand(t), "AUTH")
+	assert.Equal(t, "SELECT 2", server.nextCommand(t), "SELECT")
+	assert.Equal(t, "PING", server.nextCommand(t), "PING")
+}
+
+func TestConnAuthWithoutUsername(t *testing.T) {
+	server := newRespServer(t, nil)
+	defer server.listener.Close() // nolint:errcheck
+
+	subscriber := &queue.RealRedisSubscriber{
+		Host: server.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{Password: "secret"},
+	}
+	if !assert.NoError(t, subscriber.Connect(), "Connect") {
+		return
+	}
+	defer subscriber.Close()
+
+	assert.Equal(t, "AUTH secret", server.nextCommand(t), "AUTH")
+	assert.Equal(t, "SUBSCRIBE requests", server.nextCommand(t), "SUBSCRIBE")
+}
+
+func TestConnAuthRejected(t *testing.T) {
+	server := newRespServer(t, nil)
+	defer server.listener.Close() // nolint:errcheck
+
+	subscriber := &queue.RealRedisSubscriber{
+		Host: server.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{Username: "chat-bot", Password: "wrong"},
+	}
+
+	assert.Error(t, subscriber.Connect(), "Connect")
+}
+
+func TestConnTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-bot-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(mustParseCert(t, cert))
+
+	server := newRespServer(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	defer server.listener.Close() // nolint:errcheck
+
+	// the self-signed certificate is the CA, the server and the client certificate
+	tlsConfig, err := queue.LoadTLSConfig(certFile, certFile, keyFile)
+	if !assert.NoError(t, err, "LoadTLSConfig") {
+		return
+	}
+
+	subscriber := &queue.RealRedisSubscriber{
+		Host: server.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{Password: "secret", TLSConfig: tlsConfig},
+	}
+	if !assert.NoError(t, subscriber.Connect(), "Connect") {
+		return
+	}
+	defer subscriber.Close()
+
+	assert.Equal(t, "AUTH secret", server.nextCommand(t), "AUTH")
+
+	untrusted, err := queue.LoadTLSConfig("", "", "")
+	if !assert.NoError(t, err, "LoadTLSConfig untrusted") {
+		return
+	}
+	untrustedSubscriber := &queue.RealRedisSubscriber{
+		Host: server.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{TLSConfig: untrusted},
+	}
+	assert.Error(t, untrustedSubscriber.Connect(), "Connect untrusted")
+
+	_, err = queue.LoadTLSConfig(filepath.Join(dir, "missing.pem"), "", "")
+	assert.Error(t, err, "LoadTLSConfig missing CA")
+}
+
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "redis.crt"), filepath.Join(dir, "redis.key")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return certFile, keyFile
+}
+
+func mustParseCert(t *testing.T, cert tls.Certificate) *x509.Certificate {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
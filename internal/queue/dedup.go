@@ -0,0 +1,180 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultDedupTTL is the expiration of the claimed keys, if TTL is not set
+const DefaultDedupTTL = 24 * time.Hour
+
+// Deduplicator can be real or fake deduplicator of idempotency keys
+// The keys are shared by the deduplicators, which use the same storage
+type Deduplicator interface {
+	Connect(ctx context.Context) error
+	Close()
+	// Claim marks the key as seen for TTL, false is returned, if it was already claimed
+	Claim(ctx context.Context, key string) (bool, error)
+	// Release forgets the key, so it can be claimed again (for example, if the processing failed)
+	Release(ctx context.Context, key string) error
+}
+
+func dedupTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultDedupTTL
+	}
+
+	return ttl
+}
+
+// RealDeduplicator is a real Deduplicator on Redis
+// Each key is stored in the <Key>:<key> key by SET NX with TTL expiration.
+type RealDeduplicator struct {
+	Host string
+	Key  string
+	// Conn is the topology, AUTH, DB index and TLS config
+	Conn ConnConfig
+	TTL  time.Duration
+
+	pool *redis.Pool
+}
+
+// Connect connects to Redis
+func (deduplicator *RealDeduplicator) Connect(ctx context.Context) error {
+	deduplicator.pool = newPool(deduplicator.Host, deduplicator.Conn)
+
+	conn, err := deduplicator.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	_, err = doContext(ctx, conn, "PING")
+
+	return err
+}
+
+// Close closes the connections
+func (deduplicator *RealDeduplicator) Close() {
+	if deduplicator.pool != nil {
+		deduplicator.pool.Close() // nolint:errcheck,gosec
+
+		deduplicator.pool = nil
+	}
+}
+
+// Claim marks the key as seen for TTL, false is returned, if it was already claimed
+func (deduplicator *RealDeduplicator) Claim(ctx context.Context, key string) (bool, error) {
+	if deduplicator.pool == nil {
+		return false, ErrClosed
+	}
+
+	conn, err := deduplicator.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	reply, err := doContext(ctx, conn, "SET", deduplicator.Key+":"+key, time.Now().Unix(), "NX",
+		"PX", dedupTTL(deduplicator.TTL).Nanoseconds()/int64(time.Millisecond))
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// Release forgets the key
+func (deduplicator *RealDeduplicator) Release(ctx context.Context, key string) error {
+	if deduplicator.pool == nil {
+		return ErrClosed
+	}
+
+	conn, err := deduplicator.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	_, err = doContext(ctx, conn, "DEL", deduplicator.Key+":"+key)
+
+	return err
+}
+
+// FakeDedupStore is the storage of FakeDeduplicator, like a Redis server
+type FakeDedupStore struct {
+	expiresAt map[string]time.Time
+
+	mx sync.Mutex
+}
+
+// FakeDeduplicator is a fake Deduplicator, the deduplicators must use the same Store
+type FakeDeduplicator struct {
+	Store *FakeDedupStore
+	TTL   time.Duration
+
+	connected bool
+}
+
+// Connect connects to the Store
+func (deduplicator *FakeDeduplicator) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	deduplicator.connected = true
+
+	return nil
+}
+
+// Close disconnects from the Store
+func (deduplicator *FakeDeduplicator) Close() {
+	deduplicator.connected = false
+}
+
+// Claim marks the key as seen for TTL, false is returned, if it was already claimed
+func (deduplicator *FakeDeduplicator) Claim(ctx context.Context, key string) (bool, error) {
+	if !deduplicator.connected {
+		return false, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	store := deduplicator.Store
+	store.mx.Lock()
+	defer store.mx.Unlock()
+
+	if store.expiresAt == nil {
+		store.expiresAt = map[string]time.Time{}
+	}
+
+	now := time.Now()
+	if expiresAt, has := store.expiresAt[key]; has && now.Before(expiresAt) {
+		return false, nil
+	}
+	store.expiresAt[key] = now.Add(dedupTTL(deduplicator.TTL))
+
+	return true, nil
+}
+
+// Release forgets the key
+func (deduplicator *FakeDeduplicator) Release(ctx context.Context, key string) error {
+	if !deduplicator.connected {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store := deduplicator.Store
+	store.mx.Lock()
+	defer store.mx.Unlock()
+
+	delete(store.expiresAt, key)
+
+	return nil
+}
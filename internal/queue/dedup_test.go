@@ -0,0 +1,73 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+func TestFakeDeduplicator(t *testing.T) {
+	store := &queue.FakeDedupStore{}
+	ttl := 100 * time.Millisecond
+
+	testDeduplicator(t,
+		&queue.FakeDeduplicator{Store: store, TTL: ttl}, &queue.FakeDeduplicator{Store: store, TTL: ttl})
+}
+
+func TestRealDeduplicator(t *testing.T) {
+	host, connConfig := testRedis(t)
+
+	key := fmt.Sprintf("test-idempotency-%d", time.Now().UnixNano())
+	ttl := 100 * time.Millisecond
+	testDeduplicator(t,
+		&queue.RealDeduplicator{Host: host, Key: key, Conn: connConfig, TTL: ttl},
+		&queue.RealDeduplicator{Host: host, Key: key, Conn: connConfig, TTL: ttl},
+	)
+}
+
+// testDeduplicator checks, that the deduplicators (replicas) share the keys, which expire after 100ms
+func testDeduplicator(t *testing.T, deduplicator queue.Deduplicator, replica queue.Deduplicator) {
+	ctx := context.Background()
+	for _, d := range []queue.Deduplicator{deduplicator, replica} {
+		if err := d.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer replica.Close()
+
+	claimed, err := deduplicator.Claim(ctx, "001:a")
+	if assert.NoError(t, err, "Claim") {
+		assert.True(t, claimed, "first Claim")
+	}
+
+	claimed, err = replica.Claim(ctx, "001:a")
+	if assert.NoError(t, err, "Claim again") {
+		assert.False(t, claimed, "Claim of duplicate")
+	}
+
+	claimed, err = replica.Claim(ctx, "001:b")
+	if assert.NoError(t, err, "Claim other key") {
+		assert.True(t, claimed, "Claim of other key")
+	}
+
+	assert.NoError(t, replica.Release(ctx, "001:b"), "Release")
+	claimed, err = deduplicator.Claim(ctx, "001:b")
+	if assert.NoError(t, err, "Claim after Release") {
+		assert.True(t, claimed, "Claim of released key")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	claimed, err = replica.Claim(ctx, "001:a")
+	if assert.NoError(t, err, "Claim after TTL") {
+		assert.True(t, claimed, "Claim of expired key")
+	}
+
+	deduplicator.Close()
+	_, err = deduplicator.Claim(ctx, "001:c")
+	assert.Error(t, err, "Claim after Close")
+}
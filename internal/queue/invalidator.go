@@ -0,0 +1,201 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+const (
+	invalidationsBufferSize = 100
+	// invalidateAll is the key, which invalidates all keys (same to the key of db.CachingDbHandler)
+	invalidateAll = "*"
+)
+
+// RealCacheInvalidator is a real db.CacheInvalidator, on a Redis channel
+// If the connection is broken, it reconnects with exponential backoff, and all keys are invalidated,
+// because the invalidations, sent meanwhile, are lost.
+type RealCacheInvalidator struct {
+	Host    string
+	Channel string
+	// Conn is the AUTH, DB index and TLS config
+	Conn ConnConfig
+	// ReconnectMinDelay is the first delay of reconnecting, DefaultReconnectMinDelay, if 0
+	ReconnectMinDelay time.Duration
+	// ReconnectMaxDelay is the max delay of reconnecting, DefaultReconnectMaxDelay, if 0
+	ReconnectMaxDelay time.Duration
+
+	instanceID    string
+	pool          *redis.Pool
+	subscriber    *RealRedisSubscriber
+	invalidations chan string
+}
+
+// Connect connects to Redis and starts listening to the channel
+func (invalidator *RealCacheInvalidator) Connect() error {
+	instanceID := make([]byte, 8)
+	if _, err := rand.Read(instanceID); err != nil {
+		return err
+	}
+	invalidator.instanceID = hex.EncodeToString(instanceID)
+
+	invalidator.pool = newPool(invalidator.Host, invalidator.Conn)
+
+	invalidations := make(chan string, invalidationsBufferSize)
+	invalidator.subscriber = &RealRedisSubscriber{
+		Host: invalidator.Host, RequestChannel: invalidator.Channel, Conn: invalidator.Conn,
+		ReconnectMinDelay: invalidator.ReconnectMinDelay, ReconnectMaxDelay: invalidator.ReconnectMaxDelay,
+		skipDepth: true,
+		resubscribed: func() {
+			invalidations <- invalidateAll
+		},
+	}
+	if err := invalidator.subscriber.Connect(); err != nil {
+		return err
+	}
+
+	invalidator.invalidations = invalidations
+	go invalidator.listen(invalidator.subscriber, invalidator.invalidations)
+
+	return nil
+}
+
+func (invalidator *RealCacheInvalidator) listen(subscriber *RealRedisSubscriber, invalidations chan string) {
+	defer close(invalidations)
+
+	for {
+		switch msg := subscriber.Receive().(type) {
+		case redis.Message:
+			// message format: "<instance ID> <key>"
+			parts := strings.SplitN(string(msg.Data), " ", 2)
+			if len(parts) == 2 && parts[0] != invalidator.instanceID {
+				invalidations <- parts[1]
+			}
+		case redis.Subscription:
+			if msg.Count == 0 {
+				return
+			}
+		case error:
+			if subscriber.isClosed() {
+				logger.Get().Info("Closing invalidations, ", msg)
+
+				return
+			}
+
+			// an invalidation may be lost
+			logger.Get().Warning("cannot receive invalidation, invalidating all, ", msg)
+			invalidations <- invalidateAll
+		}
+	}
+}
+
+// Close stops listening and closes the connections
+func (invalidator *RealCacheInvalidator) Close() {
+	if invalidator.subscriber != nil {
+		invalidator.subscriber.Close()
+		invalidator.subscriber = nil
+	}
+
+	if invalidator.pool != nil {
+		invalidator.pool.Close() // nolint:errcheck,gosec
+		invalidator.pool = nil
+	}
+}
+
+// Invalidate sends the key to the other replicas
+func (invalidator *RealCacheInvalidator) Invalidate(ctx context.Context, key string) error {
+	if invalidator.pool == nil {
+		return ErrClosed
+	}
+
+	conn, err := invalidator.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	_, err = doContext(ctx, conn, "PUBLISH", invalidator.Channel, invalidator.instanceID+" "+key)
+
+	return err
+}
+
+// Invalidations returns the keys, invalidated by the other replicas
+func (invalidator *RealCacheInvalidator) Invalidations() <-chan string {
+	return invalidator.invalidations
+}
+
+// FakeCacheBus connects FakeCacheInvalidators, like a Redis channel
+type FakeCacheBus struct {
+	invalidators map[*FakeCacheInvalidator]struct{}
+
+	mx sync.Mutex
+}
+
+// FakeCacheInvalidator is a fake CacheInvalidator, the replicas must use the same Bus
+type FakeCacheInvalidator struct {
+	Bus *FakeCacheBus
+
+	invalidations chan string
+}
+
+// Connect joins to the Bus
+func (invalidator *FakeCacheInvalidator) Connect() error {
+	invalidator.Bus.mx.Lock()
+	defer invalidator.Bus.mx.Unlock()
+
+	if invalidator.Bus.invalidators == nil {
+		invalidator.Bus.invalidators = map[*FakeCacheInvalidator]struct{}{}
+	}
+
+	invalidator.invalidations = make(chan string, invalidationsBufferSize)
+	invalidator.Bus.invalidators[invalidator] = struct{}{}
+
+	return nil
+}
+
+// Close leaves the Bus
+func (invalidator *FakeCacheInvalidator) Close() {
+	invalidator.Bus.mx.Lock()
+	defer invalidator.Bus.mx.Unlock()
+
+	if _, has := invalidator.Bus.invalidators[invalidator]; has {
+		delete(invalidator.Bus.invalidators, invalidator)
+		close(invalidator.invalidations)
+	}
+}
+
+// Invalidate sends the key to the other replicas
+func (invalidator *FakeCacheInvalidator) Invalidate(ctx context.Context, key string) error {
+	invalidator.Bus.mx.Lock()
+	defer invalidator.Bus.mx.Unlock()
+
+	if _, has := invalidator.Bus.invalidators[invalidator]; !has {
+		return ErrClosed
+	}
+
+	for other := range invalidator.Bus.invalidators {
+		if other == invalidator {
+			continue
+		}
+
+		select {
+		case other.invalidations <- key:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+// Invalidations returns the keys, invalidated by the other replicas
+func (invalidator *FakeCacheInvalidator) Invalidations() <-chan string {
+	return invalidator.invalidations
+}
@@ -0,0 +1,103 @@
+package queue_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+// the invalidators implement the invalidator of the user cache
+var (
+	_ db.CacheInvalidator = (*queue.RealCacheInvalidator)(nil)
+	_ db.CacheInvalidator = (*queue.FakeCacheInvalidator)(nil)
+)
+
+func TestFakeCacheInvalidator(t *testing.T) {
+	bus := &queue.FakeCacheBus{}
+
+	testCacheInvalidator(t, &queue.FakeCacheInvalidator{Bus: bus}, &queue.FakeCacheInvalidator{Bus: bus})
+}
+
+func TestRealCacheInvalidator(t *testing.T) {
+	host, connConfig := testRedis(t)
+
+	channel := "test-invalidations-" + t.Name()
+	testCacheInvalidator(t,
+		&queue.RealCacheInvalidator{Host: host, Channel: channel, Conn: connConfig},
+		&queue.RealCacheInvalidator{Host: host, Channel: channel, Conn: connConfig},
+	)
+}
+
+func testCacheInvalidator(t *testing.T, sender db.CacheInvalidator, receiver db.CacheInvalidator) {
+	for _, invalidator := range []db.CacheInvalidator{receiver, sender} {
+		if err := invalidator.Connect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer receiver.Close()
+
+	if !assert.NoError(t, sender.Invalidate(context.Background(), "001"), "Invalidate") {
+		sender.Close()
+
+		return
+	}
+
+	select {
+	case key := <-receiver.Invalidations():
+		assert.Equal(t, "001", key, "invalidated key")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "invalidation is not received")
+	}
+
+	select {
+	case key := <-sender.Invalidations():
+		assert.Fail(t, "own invalidation is received: "+key)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sender.Close()
+	assert.Error(t, sender.Invalidate(context.Background(), "002"), "Invalidate after Close")
+}
+
+func TestRealCacheInvalidatorReconnect(t *testing.T) {
+	server := newRespServer(t, nil)
+	defer server.listener.Close() // nolint:errcheck
+
+	invalidator := &queue.RealCacheInvalidator{
+		Host: server.listener.Addr().String(), Channel: "invalidations",
+		ReconnectMinDelay: 10 * time.Millisecond, ReconnectMaxDelay: 50 * time.Millisecond,
+	}
+	if err := invalidator.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer invalidator.Close()
+
+	assert.Equal(t, "SUBSCRIBE invalidations", server.nextCommand(t), "SUBSCRIBE")
+
+	server.disconnect()
+	assert.Equal(t, "SUBSCRIBE invalidations", server.nextCommand(t), "SUBSCRIBE again")
+
+	select {
+	case key := <-invalidator.Invalidations():
+		assert.Equal(t, "*", key, "all keys are invalidated after reconnecting")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "invalidation is not received")
+	}
+
+	server.publish("invalidations", "other 001")
+	select {
+	case key := <-invalidator.Invalidations():
+		assert.Equal(t, "001", key, "invalidated key after reconnecting")
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "invalidation is not received after reconnecting")
+	}
+
+	invalidator.Close()
+	_, open := <-invalidator.Invalidations()
+	assert.False(t, open, "Invalidations after Close")
+}
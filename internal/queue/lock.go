@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// DefaultLockTTL is the expiration of the locks, if TTL is not set
+const DefaultLockTTL = 15 * time.Second
+
+// ErrLockLost is returned by Unlock, if the lease expired (the lock may be held by an other lease)
+var ErrLockLost = errors.New("lock is lost") // nolint:gochecknoglobals
+
+// Lease is a held lock of a key
+type Lease struct {
+	Key string
+	// Token is the fencing token, which is increased by each lock of the key,
+	// so the storage can reject the writes of an expired lease
+	Token int64
+
+	owner string
+}
+
+// Locker can be real or fake lease lock of keys
+// The locks are shared by the lockers, which use the same storage
+type Locker interface {
+	Connect(ctx context.Context) error
+	Close()
+	// TryLock takes the lock of the key for TTL, false is returned, if it's held by an other lease
+	TryLock(ctx context.Context, key string) (Lease, bool, error)
+	// Unlock releases the lock, if it's still held by the lease, else returns ErrLockLost
+	Unlock(ctx context.Context, lease Lease) error
+}
+
+func lockTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		return DefaultLockTTL
+	}
+
+	return ttl
+}
+
+// newLockOwner returns a random ID of the lease, only the owner can release the lock
+func newLockOwner() (string, error) {
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(owner), nil
+}
+
+// lockScript takes the lock and increments the fencing token
+// KEYS[1]: lock, KEYS[2]: fencing token, ARGV: owner, TTL (ms)
+// Returns the fencing token, or 0, if the lock is held
+const lockScript = `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`
+
+// unlockScript deletes the lock, if it's held by the owner
+// KEYS[1]: lock, ARGV: owner
+// Returns 1, if the lock was deleted
+const unlockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+
+// RealLocker is a real Locker on Redis
+// The lock of a key is the <Key>:{<key>} key, set by SET NX with TTL expiration, its value is the owner of the lease.
+// The fencing token is the <Key>:{<key>}:fence counter, it's not expired. The hash tag keeps them on the same
+// Redis Cluster node.
+type RealLocker struct {
+	Host string
+	Key  string
+	// Conn is the topology, AUTH, DB index and TLS config
+	Conn ConnConfig
+	TTL  time.Duration
+
+	pool *redis.Pool
+}
+
+// Connect connects to Redis
+func (locker *RealLocker) Connect(ctx context.Context) error {
+	locker.pool = newPool(locker.Host, locker.Conn)
+
+	conn, err := locker.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	_, err = doContext(ctx, conn, "PING")
+
+	return err
+}
+
+// Close closes the connections
+func (locker *RealLocker) Close() {
+	if locker.pool != nil {
+		locker.pool.Close() // nolint:errcheck,gosec
+
+		locker.pool = nil
+	}
+}
+
+// TryLock takes the lock of the key for TTL, false is returned, if it's held by an other lease
+func (locker *RealLocker) TryLock(ctx context.Context, key string) (Lease, bool, error) {
+	if locker.pool == nil {
+		return Lease{}, false, ErrClosed
+	}
+
+	owner, err := newLockOwner()
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	conn, err := locker.pool.GetContext(ctx)
+	if err != nil {
+		return Lease{}, false, err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	lockKey := locker.Key + ":{" + key + "}"
+	token, err := redis.Int64(doContext(ctx, conn, "EVAL", lockScript, 2, lockKey, lockKey+":fence",
+		owner, lockTTL(locker.TTL).Nanoseconds()/int64(time.Millisecond)))
+	if err != nil || token == 0 {
+		return Lease{}, false, err
+	}
+
+	return Lease{Key: key, Token: token, owner: owner}, true, nil
+}
+
+// Unlock releases the lock, if it's still held by the lease, else returns ErrLockLost
+func (locker *RealLocker) Unlock(ctx context.Context, lease Lease) error {
+	if locker.pool == nil {
+		return ErrClosed
+	}
+
+	conn, err := locker.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	deleted, err := redis.Int(doContext(ctx, conn, "EVAL", unlockScript, 1, locker.Key+":{"+lease.Key+"}", lease.owner))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrLockLost
+	}
+
+	return nil
+}
+
+// fakeLock is a held lock of FakeLocker
+type fakeLock struct {
+	owner     string
+	expiresAt time.Time
+}
+
+// FakeLockStore is the storage of FakeLocker, like a Redis server
+type FakeLockStore struct {
+	locks  map[string]fakeLock
+	tokens map[string]int64
+
+	mx sync.Mutex
+}
+
+// FakeLocker is a fake Locker, the lockers must use the same Store
+type FakeLocker struct {
+	Store *FakeLockStore
+	TTL   time.Duration
+
+	connected bool
+}
+
+// Connect connects to the Store
+func (locker *FakeLocker) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	locker.connected = true
+
+	return nil
+}
+
+// Close disconnects from the Store
+func (locker *FakeLocker) Close() {
+	locker.connected = false
+}
+
+// TryLock takes the lock of the key for TTL, false is returned, if it's held by an other lease
+func (locker *FakeLocker) TryLock(ctx context.Context, key string) (Lease, bool, error) {
+	if !locker.connected {
+		return Lease{}, false, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return Lease{}, false, err
+	}
+
+	owner, err := newLockOwner()
+	if err != nil {
+		return Lease{}, false, err
+	}
+
+	store := locker.Store
+	store.mx.Lock()
+	defer store.mx.Unlock()
+
+	if store.locks == nil {
+		store.locks = map[string]fakeLock{}
+		store.tokens = map[string]int64{}
+	}
+
+	now := time.Now()
+	if lock, has := store.locks[key]; has && now.Before(lock.expiresAt) {
+		return Lease{}, false, nil
+	}
+	store.locks[key] = fakeLock{owner: owner, expiresAt: now.Add(lockTTL(locker.TTL))}
+	store.tokens[key]++
+
+	return Lease{Key: key, Token: store.tokens[key], owner: owner}, true, nil
+}
+
+// Unlock releases the lock, if it's still held by the lease, else returns ErrLockLost
+func (locker *FakeLocker) Unlock(ctx context.Context, lease Lease) error {
+	if !locker.connected {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	store := locker.Store
+	store.mx.Lock()
+	defer store.mx.Unlock()
+
+	lock, has := store.locks[lease.Key]
+	if !has || lock.owner != lease.owner || !time.Now().Before(lock.expiresAt) {
+		return ErrLockLost
+	}
+	delete(store.locks, lease.Key)
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+func TestFakeLocker(t *testing.T) {
+	store := &queue.FakeLockStore{}
+	ttl := 100 * time.Millisecond
+
+	testLocker(t, &queue.FakeLocker{Store: store, TTL: ttl}, &queue.FakeLocker{Store: store, TTL: ttl})
+}
+
+func TestRealLocker(t *testing.T) {
+	host, connConfig := testRedis(t)
+
+	key := fmt.Sprintf("test-user-lock-%d", time.Now().UnixNano())
+	ttl := 100 * time.Millisecond
+	testLocker(t,
+		&queue.RealLocker{Host: host, Key: key, Conn: connConfig, TTL: ttl},
+		&queue.RealLocker{Host: host, Key: key, Conn: connConfig, TTL: ttl},
+	)
+}
+
+// testLocker checks, that the lockers (replicas) share the locks, which expire after 100ms,
+// and the fencing tokens are increasing
+func testLocker(t *testing.T, locker queue.Locker, replica queue.Locker) {
+	ctx := context.Background()
+	for _, l := range []queue.Locker{locker, replica} {
+		if err := l.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer replica.Close()
+
+	first, locked, err := locker.TryLock(ctx, "001")
+	if !assert.NoError(t, err, "TryLock") || !assert.True(t, locked, "first TryLock") {
+		return
+	}
+
+	_, locked, err = replica.TryLock(ctx, "001")
+	if assert.NoError(t, err, "TryLock again") {
+		assert.False(t, locked, "TryLock of held lock")
+	}
+
+	other, locked, err := replica.TryLock(ctx, "002")
+	if assert.NoError(t, err, "TryLock other key") {
+		assert.True(t, locked, "TryLock of other key")
+	}
+	assert.NoError(t, replica.Unlock(ctx, other), "Unlock other key")
+
+	assert.NoError(t, locker.Unlock(ctx, first), "Unlock")
+	second, locked, err := replica.TryLock(ctx, "001")
+	if !assert.NoError(t, err, "TryLock after Unlock") || !assert.True(t, locked, "TryLock of released lock") {
+		return
+	}
+	assert.True(t, second.Token > first.Token, "fencing token")
+
+	time.Sleep(150 * time.Millisecond)
+	third, locked, err := locker.TryLock(ctx, "001")
+	if assert.NoError(t, err, "TryLock after TTL") && assert.True(t, locked, "TryLock of expired lock") {
+		assert.True(t, third.Token > second.Token, "fencing token after TTL")
+	}
+	assert.Equal(t, queue.ErrLockLost, replica.Unlock(ctx, second), "Unlock of expired lease")
+	assert.NoError(t, locker.Unlock(ctx, third), "Unlock of new lease")
+
+	locker.Close()
+	_, _, err = locker.TryLock(ctx, "003")
+	assert.Error(t, err, "TryLock after Close")
+}
@@ -0,0 +1,229 @@
+// Package queuetest is a conformance test suite for queue.RedisPublisher and queue.RedisSubscriber implementations
+package queuetest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+const (
+	messageCount   = 5
+	receiveTimeout = 5 * time.Second
+)
+
+// NewPair makes a new, not connected publisher and subscriber on the same channel
+type NewPair func() (queue.RedisPublisher, queue.RedisSubscriber)
+
+// NewLimitedPair makes a new, not connected publisher and subscriber on the same channel, with max queue depth
+type NewLimitedPair func(maxDepth int) (queue.RedisPublisher, queue.RedisSubscriber)
+
+// RunConformance runs the tests, which must be passed by every publisher-subscriber implementation
+func RunConformance(t *testing.T, newPair NewPair) {
+	t.Run("PublishReceive", func(t *testing.T) { testPublishReceive(t, newPair) })
+	t.Run("ReceiveAfterClose", func(t *testing.T) { testReceiveAfterClose(t, newPair) })
+	t.Run("RequestAfterClose", func(t *testing.T) { testRequestAfterClose(t, newPair) })
+	t.Run("ReceiveContextDone", func(t *testing.T) { testReceiveContextDone(t, newPair) })
+	t.Run("RequestContextDone", func(t *testing.T) { testRequestContextDone(t, newPair) })
+	t.Run("Connected", func(t *testing.T) { testConnected(t, newPair) })
+	t.Run("NoConsumer", func(t *testing.T) { testNoConsumer(t, newPair) })
+}
+
+// RunBackpressure runs the tests of the max queue depth, which must be passed by every implementation
+func RunBackpressure(t *testing.T, newLimitedPair NewLimitedPair) {
+	t.Run("QueueFull", func(t *testing.T) { testQueueFull(t, newLimitedPair) })
+}
+
+func connect(t *testing.T, newPair NewPair) (queue.RedisPublisher, queue.RedisSubscriber) {
+	publisher, subscriber := newPair()
+
+	// Pub/Sub does not store messages, so the subscriber must be the first
+	if err := subscriber.Connect(); err != nil {
+		t.Fatal("cannot connect subscriber, ", err)
+	}
+
+	if err := publisher.Connect(); err != nil {
+		subscriber.Close()
+		t.Fatal("cannot connect publisher, ", err)
+	}
+
+	return publisher, subscriber
+}
+
+// Receive returns the next message or error, subscription messages are skipped
+func Receive(subscriber queue.RedisSubscriber, timeout time.Duration) (interface{}, bool) {
+	received := make(chan interface{}, 1)
+
+	go func() {
+		for {
+			msg := subscriber.Receive()
+			if _, is := msg.(redis.Subscription); !is {
+				received <- msg
+
+				return
+			}
+		}
+	}()
+
+	select {
+	case msg := <-received:
+		return msg, true
+	case <-time.After(timeout):
+		return nil, false
+	}
+}
+
+func testPublishReceive(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	for m := 0; m < messageCount; m++ {
+		assert.NoError(t, publisher.Request([]byte(fmt.Sprintf("message %d", m))), fmt.Sprintf("Request #%d", m))
+	}
+
+	for m := 0; m < messageCount; m++ {
+		msg, ok := Receive(subscriber, receiveTimeout)
+		if !assert.True(t, ok, fmt.Sprintf("Receive timeout #%d", m)) {
+			return
+		}
+
+		if message, is := msg.(redis.Message); assert.True(t, is, fmt.Sprintf("Message type #%d: %v", m, msg)) {
+			assert.Equal(t, fmt.Sprintf("message %d", m), string(message.Data), fmt.Sprintf("Data #%d", m))
+		}
+	}
+}
+
+func testReceiveAfterClose(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer publisher.Close()
+
+	subscriber.Close()
+
+	msg, ok := Receive(subscriber, receiveTimeout)
+	if assert.True(t, ok, "Receive timeout") {
+		_, is := msg.(error)
+		assert.True(t, is, fmt.Sprintf("Receive error: %v", msg))
+	}
+}
+
+func testRequestAfterClose(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer subscriber.Close()
+
+	publisher.Close()
+
+	assert.Error(t, publisher.Request([]byte("closed")), "Request")
+	assert.True(t, subscriber.Connected(), "subscriber is not closed by the publisher")
+}
+
+func testReceiveContextDone(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	received := make(chan interface{}, 1)
+	go func() {
+		for {
+			msg := subscriber.ReceiveContext(ctx)
+			if _, is := msg.(redis.Subscription); !is {
+				received <- msg
+
+				return
+			}
+		}
+	}()
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, context.DeadlineExceeded, msg, "ReceiveContext")
+	case <-time.After(receiveTimeout):
+		assert.Fail(t, "ReceiveContext is not stopped by ctx")
+	}
+}
+
+func testRequestContextDone(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Equal(t, context.Canceled, publisher.RequestContext(ctx, []byte("canceled")), "RequestContext")
+}
+
+func testConnected(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer publisher.Close()
+
+	assert.True(t, subscriber.Connected(), "Connected")
+
+	subscriber.Close()
+
+	assert.False(t, subscriber.Connected(), "Connected after Close")
+}
+
+// testNoConsumer checks, that the publisher is not closed by the subscriber,
+// and the messages are rejected, if nobody is subscribed
+func testNoConsumer(t *testing.T, newPair NewPair) {
+	publisher, subscriber := connect(t, newPair)
+	defer publisher.Close()
+
+	assert.NoError(t, publisher.Request([]byte("received")), "Request")
+	_, ok := Receive(subscriber, receiveTimeout)
+	assert.True(t, ok, "Receive timeout")
+
+	subscriber.Close()
+
+	// the server may notice the unsubscription a bit later
+	var err error
+	for deadline := time.Now().Add(receiveTimeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err = publisher.Request([]byte("lost")); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, queue.ErrNoConsumer, err, "Request without subscriber")
+}
+
+func testQueueFull(t *testing.T, newLimitedPair NewLimitedPair) {
+	const maxDepth = 3
+
+	publisher, subscriber := connect(t, func() (queue.RedisPublisher, queue.RedisSubscriber) {
+		return newLimitedPair(maxDepth)
+	})
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	for m := 0; m < maxDepth; m++ {
+		assert.NoError(t, publisher.Request([]byte(fmt.Sprintf("message %d", m))), fmt.Sprintf("Request #%d", m))
+	}
+
+	assert.Equal(t, queue.ErrQueueFull, publisher.Request([]byte("full")), "Request to full queue")
+
+	// receiving makes room for a new message
+	msg, ok := Receive(subscriber, receiveTimeout)
+	if !assert.True(t, ok, "Receive timeout") {
+		return
+	}
+	if message, is := msg.(redis.Message); assert.True(t, is, fmt.Sprintf("Message type: %v", msg)) {
+		assert.Equal(t, "message 0", string(message.Data), "Data")
+	}
+
+	assert.NoError(t, publisher.Request([]byte("not full")), "Request after Receive")
+
+	// the queue is emptied, so the depth is not left for the next tests
+	for m := 0; m < maxDepth; m++ {
+		_, ok := Receive(subscriber, receiveTimeout)
+		assert.True(t, ok, fmt.Sprintf("Receive timeout #%d", m))
+	}
+}
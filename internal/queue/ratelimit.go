@@ -0,0 +1,219 @@
+package queue
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Limit is a token bucket: Burst tokens at most, refilled by Rate tokens per second
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitResult is the result of taking a token
+type RateLimitResult struct {
+	Allowed bool
+	// Remaining is the number of tokens, left in the bucket
+	Remaining int
+	// RetryAfter is the time until the next token, if not allowed
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full
+	Reset time.Duration
+}
+
+// RateLimiter can be real or fake token bucket rate limiter
+// The buckets are shared by the limiters, which use the same storage
+type RateLimiter interface {
+	Connect(ctx context.Context) error
+	Close()
+	// Allow takes a token from the bucket of the key
+	Allow(ctx context.Context, key string, limit Limit) (RateLimitResult, error)
+}
+
+// takeToken refills the bucket since the last update and takes a token, if there is
+func takeToken(tokens float64, updatedAt time.Time, now time.Time, limit Limit) (float64, RateLimitResult) {
+	if elapsed := now.Sub(updatedAt); elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+	}
+
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+
+	return tokens, bucketResult(allowed, tokens, limit)
+}
+
+// bucketResult makes the result from the tokens, left in the bucket
+func bucketResult(allowed bool, tokens float64, limit Limit) RateLimitResult {
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Remaining: int(tokens),
+		Reset:     rateDuration(float64(limit.Burst)-tokens, limit.Rate),
+	}
+	if !allowed {
+		result.RetryAfter = rateDuration(1-tokens, limit.Rate)
+	}
+
+	return result
+}
+
+// rateDuration returns the refill time of the tokens
+func rateDuration(tokens float64, rate float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / rate * float64(time.Second)))
+}
+
+// tokenBucketScript implements takeToken in Redis, the bucket is a hash (tokens, updated_at in ms)
+// KEYS[1]: bucket, ARGV: rate (per second), burst, now (ms)
+// Returns allowed (0 or 1) and tokens (string)
+const tokenBucketScript = `
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated_at')
+local tokens = tonumber(bucket[1]) or burst
+local updatedAt = tonumber(bucket[2]) or now
+if now > updatedAt then
+	tokens = math.min(burst, tokens + (now - updatedAt) * rate / 1000)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated_at', math.max(now, updatedAt))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// RealRateLimiter is a real RateLimiter on Redis
+// Each bucket is stored in the <Key>:<key> hash, which expires, when the bucket is full.
+// The time is taken from the frontend, so the clocks of the replicas should be synchronized.
+type RealRateLimiter struct {
+	Host string
+	Key  string
+	// Conn is the topology, AUTH, DB index and TLS config
+	Conn ConnConfig
+
+	pool *redis.Pool
+}
+
+// Connect connects to Redis
+func (limiter *RealRateLimiter) Connect(ctx context.Context) error {
+	limiter.pool = newPool(limiter.Host, limiter.Conn)
+
+	conn, err := limiter.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	_, err = doContext(ctx, conn, "PING")
+
+	return err
+}
+
+// Close closes the connections
+func (limiter *RealRateLimiter) Close() {
+	if limiter.pool != nil {
+		limiter.pool.Close() // nolint:errcheck,gosec
+
+		limiter.pool = nil
+	}
+}
+
+// Allow takes a token from the bucket of the key
+func (limiter *RealRateLimiter) Allow(ctx context.Context, key string, limit Limit) (RateLimitResult, error) {
+	if limiter.pool == nil {
+		return RateLimitResult{}, ErrClosed
+	}
+
+	conn, err := limiter.pool.GetContext(ctx)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	values, err := redis.Values(doContext(ctx, conn, "EVAL", tokenBucketScript, 1, limiter.Key+":"+key,
+		limit.Rate, limit.Burst, now))
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	var allowed int
+	var tokens float64
+	if _, err := redis.Scan(values, &allowed, &tokens); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	return bucketResult(allowed == 1, tokens, limit), nil
+}
+
+// fakeBucket is a token bucket of FakeRateLimiter
+type fakeBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// FakeRateStore is the storage of FakeRateLimiter, like a Redis server
+type FakeRateStore struct {
+	buckets map[string]fakeBucket
+
+	mx sync.Mutex
+}
+
+// FakeRateLimiter is a fake RateLimiter, the limiters must use the same Store
+type FakeRateLimiter struct {
+	Store *FakeRateStore
+
+	connected bool
+}
+
+// Connect connects to the Store
+func (limiter *FakeRateLimiter) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	limiter.connected = true
+
+	return nil
+}
+
+// Close disconnects from the Store
+func (limiter *FakeRateLimiter) Close() {
+	limiter.connected = false
+}
+
+// Allow takes a token from the bucket of the key
+func (limiter *FakeRateLimiter) Allow(ctx context.Context, key string, limit Limit) (RateLimitResult, error) {
+	if !limiter.connected {
+		return RateLimitResult{}, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return RateLimitResult{}, err
+	}
+
+	store := limiter.Store
+	store.mx.Lock()
+	defer store.mx.Unlock()
+
+	if store.buckets == nil {
+		store.buckets = map[string]fakeBucket{}
+	}
+
+	now := time.Now()
+	bucket, has := store.buckets[key]
+	if !has {
+		bucket = fakeBucket{tokens: float64(limit.Burst), updatedAt: now}
+	}
+
+	tokens, result := takeToken(bucket.tokens, bucket.updatedAt, now, limit)
+	store.buckets[key] = fakeBucket{tokens: tokens, updatedAt: now}
+
+	return result, nil
+}
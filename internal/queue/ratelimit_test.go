@@ -0,0 +1,74 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+func TestFakeRateLimiter(t *testing.T) {
+	store := &queue.FakeRateStore{}
+
+	testRateLimiter(t, &queue.FakeRateLimiter{Store: store}, &queue.FakeRateLimiter{Store: store})
+}
+
+func TestRealRateLimiter(t *testing.T) {
+	host, connConfig := testRedis(t)
+
+	key := fmt.Sprintf("test-rate-limits-%d", time.Now().UnixNano())
+	testRateLimiter(t,
+		&queue.RealRateLimiter{Host: host, Key: key, Conn: connConfig},
+		&queue.RealRateLimiter{Host: host, Key: key, Conn: connConfig},
+	)
+}
+
+// testRateLimiter checks, that the limiters (replicas) share the buckets
+func testRateLimiter(t *testing.T, limiter queue.RateLimiter, replica queue.RateLimiter) {
+	ctx := context.Background()
+	for _, l := range []queue.RateLimiter{limiter, replica} {
+		if err := l.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer replica.Close()
+
+	limit := queue.Limit{Rate: 10, Burst: 3}
+
+	for n := 0; n < limit.Burst; n++ {
+		result, err := []queue.RateLimiter{limiter, replica}[n%2].Allow(ctx, "user-1", limit)
+		if assert.NoError(t, err, fmt.Sprintf("Allow #%d", n)) {
+			assert.True(t, result.Allowed, fmt.Sprintf("Allowed #%d", n))
+			assert.Equal(t, limit.Burst-1-n, result.Remaining, fmt.Sprintf("Remaining #%d", n))
+		}
+	}
+
+	result, err := replica.Allow(ctx, "user-1", limit)
+	if assert.NoError(t, err, "Allow over burst") {
+		assert.False(t, result.Allowed, "Allowed over burst")
+		assert.Equal(t, 0, result.Remaining, "Remaining over burst")
+		assert.True(t, result.RetryAfter > 0 && result.RetryAfter <= 100*time.Millisecond,
+			fmt.Sprintf("RetryAfter %s", result.RetryAfter))
+		assert.True(t, result.Reset > 200*time.Millisecond && result.Reset <= 300*time.Millisecond,
+			fmt.Sprintf("Reset %s", result.Reset))
+	}
+
+	result, err = limiter.Allow(ctx, "user-2", limit)
+	if assert.NoError(t, err, "Allow other key") {
+		assert.True(t, result.Allowed, "Allowed other key")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	result, err = limiter.Allow(ctx, "user-1", limit)
+	if assert.NoError(t, err, "Allow after refill") {
+		assert.True(t, result.Allowed, "Allowed after refill")
+	}
+
+	limiter.Close()
+	_, err = limiter.Allow(ctx, "user-1", limit)
+	assert.Error(t, err, "Allow after Close")
+}
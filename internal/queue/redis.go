@@ -2,46 +2,112 @@
 package queue
 
 import (
+	"context"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/pgillich/chat-bot/internal/logger"
 )
 
+// dialTimeout limits connecting and writing, if the context has no deadline
+const dialTimeout = 5 * time.Second
+
+const (
+	// DefaultReconnectMinDelay is the first delay of reconnecting
+	DefaultReconnectMinDelay = 100 * time.Millisecond
+	// DefaultReconnectMaxDelay is the max delay of reconnecting
+	DefaultReconnectMaxDelay = 30 * time.Second
+
+	// DefaultPublishTimeout limits Request, which has no context
+	DefaultPublishTimeout = 5 * time.Second
+	// DefaultDepthTTL is the expiration of the queue depth counter, if nothing is published
+	DefaultDepthTTL = time.Minute
+)
+
+// nolint:gochecknoglobals
+var (
+	// ErrClosed is returned, if the queue is used after Close
+	ErrClosed = errors.New("queue is closed")
+	// ErrQueueFull is returned by Request, if the queue depth reached the max depth
+	ErrQueueFull = errors.New("queue is full")
+	// ErrNoConsumer is returned by Request, if nobody is subscribed to the channel
+	ErrNoConsumer = errors.New("no consumer")
+)
+
+// nolint:gochecknoglobals
+var (
+	subscriberConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chat_bot",
+		Subsystem: "redis_subscriber",
+		Name:      "connected",
+		Help:      "1, if the subscriber is connected to the channel, else 0",
+	}, []string{"channel"})
+	subscriberReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat_bot",
+		Subsystem: "redis_subscriber",
+		Name:      "reconnects_total",
+		Help:      "Number of reconnections of the subscriber, after a broken connection",
+	}, []string{"channel"})
+	publisherQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chat_bot",
+		Subsystem: "redis_publisher",
+		Name:      "queue_depth",
+		Help:      "Number of published, but not yet received messages, summed over the subscribers",
+	}, []string{"channel"})
+)
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(subscriberConnected, subscriberReconnects, publisherQueueDepth)
+}
+
 // ReceiveOnce calls PubSubConn.Receive() and unsubscribes
 type ReceiveOnce func() ([]byte, error)
 
 // RedisPublisher can be real or fake publisher
+// The Context variants give up waiting, if the context is done
+// Request gives up after DefaultPublishTimeout.
+// A message is not published, if the queue depth reached the max depth: ErrQueueFull is returned.
 type RedisPublisher interface {
 	Connect() error
+	ConnectContext(ctx context.Context) error
 	Close()
 	Request(message []byte) error
+	RequestContext(ctx context.Context, message []byte) error
 }
 
 // RealRedisPublisher is a real publisher
+// The queue depth is counted in the <RequestChannel>:depth key: it's increased by the number of receivers
+// at publishing and decreased by RealRedisSubscriber at receiving.
 type RealRedisPublisher struct {
 	Host           string
-	Key            string
-	User           string
 	RequestChannel string
+	// Conn is the AUTH, DB index and TLS config
+	Conn ConnConfig
+	// MaxDepth is the max queue depth, summed over the subscribers, 0 disables the limit
+	MaxDepth int
+	// DepthTTL is the expiration of the depth counter (of crashed subscribers), DefaultDepthTTL, if 0
+	DepthTTL time.Duration
 
 	pool *redis.Pool
 }
 
-func newPool(server string) *redis.Pool {
+// depthKey is the key of the queue depth counter
+func depthKey(channel string) string {
+	return channel + ":depth"
+}
+
+func newPool(server string, connConfig ConnConfig) *redis.Pool {
 	return &redis.Pool{
 
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
 
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", server)
-			if err != nil {
-				return nil, err
-			}
-			return c, err
+			return dial(context.Background(), server, connConfig)
 		},
 
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
@@ -51,100 +117,225 @@ func newPool(server string) *redis.Pool {
 	}
 }
 
+// doContext executes a command, the read timeout is taken from the deadline of ctx
+func doContext(ctx context.Context, conn redis.Conn, command string, args ...interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if deadline, has := ctx.Deadline(); has {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+
+		return redis.DoWithTimeout(conn, timeout, command, args...)
+	}
+
+	return conn.Do(command, args...)
+}
+
 // Connect connects to Redis
 func (publisher *RealRedisPublisher) Connect() error {
-	var err error
-
-	publisher.pool = newPool(publisher.Host)
+	return publisher.ConnectContext(context.Background())
+}
 
-	conn := publisher.pool.Get()
-	defer conn.Close() // nolint:errcheck
+// ConnectContext connects to Redis
+func (publisher *RealRedisPublisher) ConnectContext(ctx context.Context) error {
+	publisher.pool = newPool(publisher.Host, publisher.Conn)
 
-	_, err = conn.Do("SET", publisher.Key, publisher.User, "NX")
+	conn, err := publisher.pool.GetContext(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close() // nolint:errcheck
 
-	_, err = conn.Do("SADD", "users", publisher.User)
-	if err != nil {
-		return err
-	}
+	_, err = doContext(ctx, conn, "PING")
 
-	return nil
+	return err
 }
 
-// Close deletes key+user and closes Redis sendConn
+// Close closes Redis sendConn
 func (publisher *RealRedisPublisher) Close() {
 	logger.Get().Info("Closing...")
 
 	if publisher.pool != nil {
-		conn := publisher.pool.Get()
-		defer conn.Close() // nolint:errcheck
-
-		conn.Do("DEL", publisher.Key)            // nolint:errcheck,gosec
-		conn.Do("SREM", "users", publisher.User) // nolint:errcheck,gosec
-		publisher.pool.Close()                   // nolint:errcheck,gosec
+		publisher.pool.Close() // nolint:errcheck,gosec
 
 		publisher.pool = nil
 	}
 }
 
-// Request sends a message to the queue
+// Request sends a message to the queue, within DefaultPublishTimeout
 func (publisher *RealRedisPublisher) Request(message []byte) error {
-	conn := publisher.pool.Get()
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPublishTimeout)
+	defer cancel()
+
+	return publisher.RequestContext(ctx, message)
+}
+
+// RequestContext sends a message to the queue
+// ErrQueueFull is returned, if the queue depth reached MaxDepth, ErrNoConsumer, if nobody received the message
+func (publisher *RealRedisPublisher) RequestContext(ctx context.Context, message []byte) error {
+	if publisher.pool == nil {
+		return ErrClosed
+	}
+
+	conn, err := publisher.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
 	defer conn.Close() // nolint:errcheck
 
-	if _, err := conn.Do("PUBLISH", publisher.RequestChannel, message); err != nil {
+	key := depthKey(publisher.RequestChannel)
+
+	if publisher.MaxDepth > 0 {
+		depth, err := redis.Int(doContext(ctx, conn, "GET", key))
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+
+		if depth >= publisher.MaxDepth {
+			publisherQueueDepth.WithLabelValues(publisher.RequestChannel).Set(float64(depth))
+
+			return ErrQueueFull
+		}
+	}
+
+	receivers, err := publisher.publish(ctx, conn, message)
+	if err != nil {
 		return err
 	}
+	if receivers == 0 {
+		return ErrNoConsumer
+	}
 
-	return nil
+	depth, err := redis.Int(doContext(ctx, conn, "INCRBY", key, receivers))
+	if err != nil {
+		return err
+	}
+	publisherQueueDepth.WithLabelValues(publisher.RequestChannel).Set(float64(depth))
+
+	depthTTL := publisher.DepthTTL
+	if depthTTL <= 0 {
+		depthTTL = DefaultDepthTTL
+	}
+	_, err = doContext(ctx, conn, "PEXPIRE", key, depthTTL.Nanoseconds()/int64(time.Millisecond))
+
+	return err
+}
+
+// publish publishes the message and returns the number of the receivers
+// In a cluster, PUBLISH counts only the subscribers of the node, so the subscribers of all nodes are counted
+// before publishing, and the message is not published, if there is no subscriber.
+func (publisher *RealRedisPublisher) publish(ctx context.Context, conn redis.Conn, message []byte) (int, error) {
+	if publisher.Conn.Topology != TopologyCluster {
+		return redis.Int(doContext(ctx, conn, "PUBLISH", publisher.RequestChannel, message))
+	}
+
+	reply, err := redis.Values(doContext(ctx, conn, "PUBSUB", "NUMSUB", publisher.RequestChannel))
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) != 2 {
+		return 0, errors.New("invalid PUBSUB NUMSUB reply")
+	}
+	subscribers, err := redis.Int(reply[1], nil)
+	if err != nil || subscribers == 0 {
+		return 0, err
+	}
+
+	_, err = doContext(ctx, conn, "PUBLISH", publisher.RequestChannel, message)
+
+	return subscribers, err
 }
 
 // RedisSubscriber can be real or fake subscriber
+// The Context variants give up waiting, if the context is done
 type RedisSubscriber interface {
 	Connect() error
+	ConnectContext(ctx context.Context) error
 	Close()
 	Receive() interface{}
+	// ReceiveContext returns the error of ctx, if it's done before a message is received
+	ReceiveContext(ctx context.Context) interface{}
+	// Connected reports, if the subscription is alive
+	Connected() bool
 }
 
 // RealRedisSubscriber is a real subscriber
+// If the connection is broken, Receive reconnects with exponential backoff and subscribes again
+// Receiving a message decreases the queue depth counter of RealRedisPublisher.
 type RealRedisSubscriber struct {
 	Host           string
-	Key            string
-	User           string
 	RequestChannel string
+	// Conn is the AUTH, DB index and TLS config
+	Conn ConnConfig
+	// ReconnectMinDelay is the first delay of reconnecting, DefaultReconnectMinDelay, if 0
+	ReconnectMinDelay time.Duration
+	// ReconnectMaxDelay is the max delay of reconnecting, DefaultReconnectMaxDelay, if 0
+	ReconnectMaxDelay time.Duration
 
 	conn        redis.Conn
 	requestsPsc *redis.PubSubConn
+	closed      bool
+	// pool is used for decreasing the queue depth, because the subscribed connection cannot send commands
+	pool *redis.Pool
+	// skipDepth disables decreasing the queue depth, if the channel is not published by RealRedisPublisher
+	skipDepth bool
+	// resubscribed is called by Receive after reconnecting, the messages published meanwhile are lost
+	resubscribed func()
 
-	mx *sync.Mutex
+	mx sync.Mutex
 }
 
 // Connect connects to Redis
 func (subscriber *RealRedisSubscriber) Connect() error {
-	var err error
+	return subscriber.ConnectContext(context.Background())
+}
 
-	subscriber.conn, err = redis.Dial("tcp", subscriber.Host)
+// ConnectContext connects to Redis
+func (subscriber *RealRedisSubscriber) ConnectContext(ctx context.Context) error {
+	conn, requestsPsc, err := subscriber.subscribe(ctx)
 	if err != nil {
 		return err
 	}
 
-	subscriber.requestsPsc = &redis.PubSubConn{Conn: subscriber.conn}
-	if err := subscriber.requestsPsc.Subscribe(subscriber.RequestChannel); err != nil {
-		return err
-	}
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
 
-	subscriber.mx = new(sync.Mutex)
+	subscriber.conn, subscriber.requestsPsc, subscriber.closed = conn, requestsPsc, false
+	if subscriber.pool == nil {
+		subscriber.pool = newPool(subscriber.Host, subscriber.Conn)
+	}
+	subscriberConnected.WithLabelValues(subscriber.RequestChannel).Set(1)
 
 	return nil
 }
 
-// Close deletes key+user and closes Redis recvConn
+func (subscriber *RealRedisSubscriber) subscribe(ctx context.Context) (redis.Conn, *redis.PubSubConn, error) {
+	conn, err := dial(ctx, subscriber.Host, subscriber.Conn)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	requestsPsc := &redis.PubSubConn{Conn: conn}
+	if err := requestsPsc.Subscribe(subscriber.RequestChannel); err != nil {
+		conn.Close() // nolint:errcheck,gosec
+
+		return nil, nil, err
+	}
+
+	return conn, requestsPsc, nil
+}
+
+// Close closes Redis recvConn
 func (subscriber *RealRedisSubscriber) Close() {
 	subscriber.mx.Lock()
 	defer subscriber.mx.Unlock()
 
+	subscriber.closed = true
+
 	if subscriber.conn != nil {
 		logger.Get().Info("Closing...")
 
@@ -155,10 +346,199 @@ func (subscriber *RealRedisSubscriber) Close() {
 		subscriber.conn.Close() // nolint:errcheck,gosec
 
 		subscriber.conn = nil
+		subscriberConnected.WithLabelValues(subscriber.RequestChannel).Set(0)
+	}
+
+	if subscriber.pool != nil {
+		subscriber.pool.Close() // nolint:errcheck,gosec
+
+		subscriber.pool = nil
 	}
 }
 
+// Connected reports, if the subscription is alive
+func (subscriber *RealRedisSubscriber) Connected() bool {
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	return subscriber.conn != nil && subscriber.conn.Err() == nil
+}
+
 // Receive listens to request channel
 func (subscriber *RealRedisSubscriber) Receive() interface{} {
-	return subscriber.requestsPsc.Receive()
+	return subscriber.ReceiveContext(context.Background())
+}
+
+// ReceiveContext listens to request channel, until ctx is done
+// A broken connection is not returned as error, but reconnected
+func (subscriber *RealRedisSubscriber) ReceiveContext(ctx context.Context) interface{} {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		conn, requestsPsc := subscriber.current()
+		if conn == nil {
+			return ErrClosed
+		}
+
+		msg := subscriber.receive(ctx, requestsPsc)
+		if _, is := msg.(redis.Message); is && !subscriber.skipDepth {
+			subscriber.decreaseDepth()
+		}
+		if _, is := msg.(error); !is || ctx.Err() != nil || conn.Err() == nil {
+			return msg
+		}
+
+		if subscriber.isClosed() {
+			return ErrClosed
+		}
+
+		logger.Get().Warningf("broken connection to request channel, %s", msg)
+		if err := subscriber.reconnect(ctx, conn); err != nil {
+			return err
+		}
+		if subscriber.resubscribed != nil {
+			subscriber.resubscribed()
+		}
+	}
+}
+
+// decreaseDepth decreases the queue depth counter, a negative counter (after expiration) is deleted
+func (subscriber *RealRedisSubscriber) decreaseDepth() {
+	subscriber.mx.Lock()
+	pool := subscriber.pool
+	subscriber.mx.Unlock()
+
+	if pool == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		logger.Get().Warning("cannot decrease queue depth, ", err)
+
+		return
+	}
+	defer conn.Close() // nolint:errcheck
+
+	key := depthKey(subscriber.RequestChannel)
+	depth, err := redis.Int(doContext(ctx, conn, "DECR", key))
+	if err != nil {
+		logger.Get().Warning("cannot decrease queue depth, ", err)
+
+		return
+	}
+
+	if depth < 0 {
+		doContext(ctx, conn, "DEL", key) // nolint:errcheck,gosec
+	}
+}
+
+func (subscriber *RealRedisSubscriber) isClosed() bool {
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	return subscriber.closed
+}
+
+func (subscriber *RealRedisSubscriber) current() (redis.Conn, *redis.PubSubConn) {
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	return subscriber.conn, subscriber.requestsPsc
+}
+
+// receive waits for a message
+// A blocking read cannot be interrupted, so the subscription is stopped, if ctx is done
+func (subscriber *RealRedisSubscriber) receive(ctx context.Context, requestsPsc *redis.PubSubConn) interface{} {
+	received := make(chan struct{})
+	defer close(received)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := requestsPsc.Unsubscribe(subscriber.RequestChannel); err != nil {
+				logger.Get().Warning("cannot unsubscribe request channel", err)
+			}
+		case <-received:
+		}
+	}()
+
+	msg := requestsPsc.Receive()
+	if subscription, is := msg.(redis.Subscription); is && subscription.Count == 0 && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return msg
+}
+
+// reconnect replaces the broken connection, until succeeded, ctx is done or Close is called
+func (subscriber *RealRedisSubscriber) reconnect(ctx context.Context, broken redis.Conn) error {
+	subscriberConnected.WithLabelValues(subscriber.RequestChannel).Set(0)
+
+	minDelay, maxDelay := subscriber.ReconnectMinDelay, subscriber.ReconnectMaxDelay
+	if minDelay <= 0 {
+		minDelay = DefaultReconnectMinDelay
+	}
+	if maxDelay <= 0 {
+		maxDelay = DefaultReconnectMaxDelay
+	}
+
+	for delay := minDelay; ; delay *= 2 {
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if subscriber.isClosed() {
+			return ErrClosed
+		}
+
+		conn, requestsPsc, err := subscriber.subscribe(ctx)
+		if err != nil {
+			logger.Get().Warningf("cannot reconnect to request channel, retry in %s, %s", delay, err)
+
+			continue
+		}
+
+		return subscriber.replace(broken, conn, requestsPsc)
+	}
+}
+
+// replace swaps the broken connection, if it's not replaced (by a concurrent Receive) or closed meanwhile
+func (subscriber *RealRedisSubscriber) replace(broken redis.Conn, conn redis.Conn, requestsPsc *redis.PubSubConn) error {
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	if subscriber.closed {
+		conn.Close() // nolint:errcheck,gosec
+
+		return ErrClosed
+	}
+
+	if subscriber.conn != broken {
+		conn.Close() // nolint:errcheck,gosec
+
+		return nil
+	}
+
+	broken.Close() // nolint:errcheck,gosec
+	subscriber.conn, subscriber.requestsPsc = conn, requestsPsc
+	subscriberConnected.WithLabelValues(subscriber.RequestChannel).Set(1)
+	subscriberReconnects.WithLabelValues(subscriber.RequestChannel).Inc()
+	logger.Get().Info("Reconnected to request channel")
+
+	return nil
 }
@@ -1,42 +1,244 @@
 package queue
 
 import (
+	"context"
+	"sync"
+
 	"github.com/garyburd/redigo/redis"
 )
 
 const fakeRedisQueueSize = 10
 
-// FakeRedis is a fake implementation for RedisPublisher and RedisSubscriber
-// Only for one-to-one connection (1 publisher, 1 subscriber)
-// TODO more subscriber, more channel
+// FakeRedis is a fake Redis channel, shared by FakeRedisPublisher and FakeRedisSubscriber
+// It's for one subscriber (one engine): the subscriber receives the messages in order.
+// Like Pub/Sub, the messages are published only, if a subscriber is connected, and the pending messages
+// are dropped, when the last subscriber is closed.
 type FakeRedis struct {
-	queue chan redis.Message
+	// MaxDepth is the size of the queue, fakeRedisQueueSize, if 0
+	MaxDepth int
+
+	queue       chan redis.Message
+	subscribers int
+
+	mx sync.Mutex
 }
 
-// Connect makes a new queue
-// It's called twice: on publisher and on substriber side
-func (fakeRedis *FakeRedis) Connect() error {
-	fakeRedis.queue = make(chan redis.Message, fakeRedisQueueSize)
+// init makes the queue, if it's not made yet
+func (fakeRedis *FakeRedis) init() {
+	fakeRedis.mx.Lock()
+	defer fakeRedis.mx.Unlock()
 
-	return nil
+	if fakeRedis.queue == nil {
+		maxDepth := fakeRedis.MaxDepth
+		if maxDepth <= 0 {
+			maxDepth = fakeRedisQueueSize
+		}
+
+		fakeRedis.queue = make(chan redis.Message, maxDepth)
+	}
 }
 
-// Close does nothing
-// It's called twice: on publisher and on substriber side
-// TODO empty queue
-func (fakeRedis *FakeRedis) Close() {
+// subscribe counts the connected subscribers, delta is 1 or -1
+func (fakeRedis *FakeRedis) subscribe(delta int) {
+	fakeRedis.mx.Lock()
+	defer fakeRedis.mx.Unlock()
+
+	fakeRedis.subscribers += delta
+	if fakeRedis.subscribers > 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-fakeRedis.queue:
+		default:
+			return
+		}
+	}
 }
 
-// Request puts a message into queue
-// TODO timeout (error) if queue is full
-func (fakeRedis *FakeRedis) Request(message []byte) error {
+// publish puts the message into the queue, if a subscriber is connected
+func (fakeRedis *FakeRedis) publish(message []byte) error {
+	fakeRedis.mx.Lock()
+	defer fakeRedis.mx.Unlock()
+
+	if len(fakeRedis.queue) >= cap(fakeRedis.queue) {
+		return ErrQueueFull
+	}
+	if fakeRedis.subscribers <= 0 {
+		return ErrNoConsumer
+	}
+
 	fakeRedis.queue <- redis.Message{Data: message}
 
 	return nil
 }
 
+// FakeRedisPublisher is a fake RedisPublisher on Redis
+type FakeRedisPublisher struct {
+	Redis *FakeRedis
+
+	closed chan struct{}
+
+	mx sync.Mutex
+}
+
+// Connect connects to Redis
+func (publisher *FakeRedisPublisher) Connect() error {
+	return publisher.ConnectContext(context.Background())
+}
+
+// ConnectContext connects to Redis
+func (publisher *FakeRedisPublisher) ConnectContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	publisher.Redis.init()
+
+	publisher.mx.Lock()
+	defer publisher.mx.Unlock()
+
+	publisher.closed = make(chan struct{})
+
+	return nil
+}
+
+// Close stops the later Request calls, the subscriber is not closed
+func (publisher *FakeRedisPublisher) Close() {
+	publisher.mx.Lock()
+	defer publisher.mx.Unlock()
+
+	if publisher.closed != nil && !isClosed(publisher.closed) {
+		close(publisher.closed)
+	}
+}
+
+// Request puts a message into queue, within DefaultPublishTimeout
+func (publisher *FakeRedisPublisher) Request(message []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultPublishTimeout)
+	defer cancel()
+
+	return publisher.RequestContext(ctx, message)
+}
+
+// RequestContext puts a message into queue, or gives up, if ctx is done
+// ErrQueueFull is returned, if the queue is full, ErrNoConsumer, if no subscriber is connected
+func (publisher *FakeRedisPublisher) RequestContext(ctx context.Context, message []byte) error {
+	publisher.mx.Lock()
+	closed := publisher.closed
+	publisher.mx.Unlock()
+
+	if closed == nil {
+		return ErrClosed
+	}
+	if err := checkDone(ctx, closed); err != nil {
+		return err
+	}
+
+	return publisher.Redis.publish(message)
+}
+
+// FakeRedisSubscriber is a fake RedisSubscriber on Redis
+type FakeRedisSubscriber struct {
+	Redis *FakeRedis
+
+	closed chan struct{}
+
+	mx sync.Mutex
+}
+
+// Connect subscribes to Redis
+func (subscriber *FakeRedisSubscriber) Connect() error {
+	return subscriber.ConnectContext(context.Background())
+}
+
+// ConnectContext subscribes to Redis
+func (subscriber *FakeRedisSubscriber) ConnectContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	subscriber.Redis.init()
+
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	if subscriber.closed != nil && !isClosed(subscriber.closed) {
+		return nil
+	}
+
+	subscriber.closed = make(chan struct{})
+	subscriber.Redis.subscribe(1)
+
+	return nil
+}
+
+// Close unsubscribes and stops pending and later Receive calls, the publisher is not closed
+func (subscriber *FakeRedisSubscriber) Close() {
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	if subscriber.closed != nil && !isClosed(subscriber.closed) {
+		close(subscriber.closed)
+		subscriber.Redis.subscribe(-1)
+	}
+}
+
+// Connected reports, if the subscriber is connected and not closed
+func (subscriber *FakeRedisSubscriber) Connected() bool {
+	subscriber.mx.Lock()
+	defer subscriber.mx.Unlock()
+
+	return subscriber.closed != nil && !isClosed(subscriber.closed)
+}
+
 // Receive reads (waits for) a message from the queue
-func (fakeRedis *FakeRedis) Receive() interface{} {
-	message := <-fakeRedis.queue
-	return message
+func (subscriber *FakeRedisSubscriber) Receive() interface{} {
+	return subscriber.ReceiveContext(context.Background())
+}
+
+// ReceiveContext reads (waits for) a message from the queue, or gives up, if ctx is done
+func (subscriber *FakeRedisSubscriber) ReceiveContext(ctx context.Context) interface{} {
+	subscriber.mx.Lock()
+	closed := subscriber.closed
+	subscriber.mx.Unlock()
+
+	if closed == nil {
+		return ErrClosed
+	}
+	if err := checkDone(ctx, closed); err != nil {
+		return err
+	}
+
+	subscriber.Redis.mx.Lock()
+	queue := subscriber.Redis.queue
+	subscriber.Redis.mx.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-closed:
+		return ErrClosed
+	case message := <-queue:
+		return message
+	}
+}
+
+// checkDone prefers the errors to a ready queue
+func checkDone(ctx context.Context, closed chan struct{}) error {
+	if isClosed(closed) {
+		return ErrClosed
+	}
+
+	return ctx.Err()
+}
+
+func isClosed(closed chan struct{}) bool {
+	select {
+	case <-closed:
+		return true
+	default:
+		return false
+	}
 }
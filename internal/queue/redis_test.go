@@ -0,0 +1,176 @@
+package queue_test
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
+	"github.com/pgillich/chat-bot/internal/queue/queuetest"
+	"github.com/pgillich/chat-bot/internal/test"
+)
+
+// nolint:gochecknoglobals
+var (
+	// localRedis is the redis-server of the TestRealX tests, if TEST_REDIS_HOST is not set
+	localRedis     *redisServers
+	localRedisAddr string
+	localRedisMx   sync.Mutex
+)
+
+func TestMain(m *testing.M) {
+	logger.Init(test.GetLogLevel())
+
+	exitVal := m.Run()
+
+	if localRedis != nil {
+		localRedis.stop()
+	}
+
+	os.Exit(exitVal)
+}
+
+// testRedis returns the address and the conn config of the Redis server of the TestRealX tests
+// TEST_REDIS_HOST (with the optional TEST_REDIS_USER and TEST_REDIS_PASSWORD) is used, if it's set,
+// else a local redis-server is started (shared by the tests), if it's installed, else the test is skipped.
+func testRedis(t *testing.T) (string, queue.ConnConfig) {
+	if host := os.Getenv("TEST_REDIS_HOST"); host != "" {
+		return host, queue.ConnConfig{
+			Username: os.Getenv("TEST_REDIS_USER"),
+			Password: os.Getenv("TEST_REDIS_PASSWORD"),
+		}
+	}
+
+	localRedisMx.Lock()
+	defer localRedisMx.Unlock()
+
+	if localRedis == nil {
+		servers := newRedisServers(t)
+		localRedisAddr = servers.start("")
+		localRedis = servers
+	}
+
+	return localRedisAddr, queue.ConnConfig{}
+}
+
+func TestFakeRedis(t *testing.T) {
+	queuetest.RunConformance(t, func() (queue.RedisPublisher, queue.RedisSubscriber) {
+		fakeRedis := &queue.FakeRedis{}
+
+		return &queue.FakeRedisPublisher{Redis: fakeRedis}, &queue.FakeRedisSubscriber{Redis: fakeRedis}
+	})
+
+	queuetest.RunBackpressure(t, func(maxDepth int) (queue.RedisPublisher, queue.RedisSubscriber) {
+		fakeRedis := &queue.FakeRedis{MaxDepth: maxDepth}
+
+		return &queue.FakeRedisPublisher{Redis: fakeRedis}, &queue.FakeRedisSubscriber{Redis: fakeRedis}
+	})
+}
+
+func TestRealRedis(t *testing.T) {
+	host, connConfig := testRedis(t)
+
+	queuetest.RunConformance(t, func() (queue.RedisPublisher, queue.RedisSubscriber) {
+		channel := "test-requests-" + t.Name()
+
+		return &queue.RealRedisPublisher{
+			Host: host, RequestChannel: channel, Conn: connConfig,
+		}, &queue.RealRedisSubscriber{
+			Host: host, RequestChannel: channel, Conn: connConfig,
+		}
+	})
+
+	queuetest.RunBackpressure(t, func(maxDepth int) (queue.RedisPublisher, queue.RedisSubscriber) {
+		channel := "test-requests-" + t.Name()
+
+		return &queue.RealRedisPublisher{
+			Host: host, RequestChannel: channel, Conn: connConfig, MaxDepth: maxDepth,
+		}, &queue.RealRedisSubscriber{
+			Host: host, RequestChannel: channel, Conn: connConfig,
+		}
+	})
+}
+
+func TestSubscriberReconnect(t *testing.T) {
+	server := newRespServer(t, nil)
+	defer server.listener.Close() // nolint:errcheck
+
+	subscriber := &queue.RealRedisSubscriber{
+		Host: server.listener.Addr().String(), RequestChannel: "requests",
+		ReconnectMinDelay: 10 * time.Millisecond, ReconnectMaxDelay: 50 * time.Millisecond,
+	}
+	if err := subscriber.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+
+	assert.Equal(t, "SUBSCRIBE requests", server.nextCommand(t), "SUBSCRIBE")
+	assert.True(t, subscriber.Connected(), "Connected")
+
+	server.disconnect()
+
+	received := make(chan interface{}, 1)
+	go func() {
+		msg, _ := queuetest.Receive(subscriber, 5*time.Second)
+		received <- msg
+	}()
+
+	assert.Equal(t, "SUBSCRIBE requests", server.nextCommand(t), "SUBSCRIBE again")
+	server.publish("requests", "after restart")
+
+	msg := <-received
+	if message, is := msg.(redis.Message); assert.True(t, is, fmt.Sprintf("Message type: %v", msg)) {
+		assert.Equal(t, "after restart", string(message.Data), "Data")
+	}
+	assert.True(t, subscriber.Connected(), "Connected again")
+
+	subscriber.Close()
+	assert.False(t, subscriber.Connected(), "Connected after Close")
+	assert.Equal(t, queue.ErrClosed, subscriber.Receive(), "Receive after Close")
+}
+
+func TestPublisherBackpressure(t *testing.T) {
+	depth, receivers := "5", "1"
+	server := newRespServerWithHandler(t, nil, func(args []string) string {
+		switch strings.ToUpper(args[0]) {
+		case "GET":
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(depth), depth)
+		case "PUBLISH":
+			return ":" + receivers + "\r\n"
+		}
+
+		return ""
+	})
+	defer server.listener.Close() // nolint:errcheck
+
+	publisher := &queue.RealRedisPublisher{
+		Host: server.listener.Addr().String(), RequestChannel: "requests", MaxDepth: 5, DepthTTL: time.Second,
+	}
+	if err := publisher.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	assert.Equal(t, "PING", server.nextCommand(t), "PING")
+
+	assert.Equal(t, queue.ErrQueueFull, publisher.Request([]byte("full")), "Request to full queue")
+	assert.Equal(t, "PING", server.nextCommand(t), "PING borrow")
+	assert.Equal(t, "GET requests:depth", server.nextCommand(t), "GET depth")
+
+	depth = "4"
+	assert.NoError(t, publisher.Request([]byte("hello")), "Request")
+	assert.Equal(t, "PING", server.nextCommand(t), "PING borrow")
+	assert.Equal(t, "GET requests:depth", server.nextCommand(t), "GET depth")
+	assert.Equal(t, "PUBLISH requests hello", server.nextCommand(t), "PUBLISH")
+	assert.Equal(t, "INCRBY requests:depth 1", server.nextCommand(t), "INCRBY")
+	assert.Equal(t, "PEXPIRE requests:depth 1000", server.nextCommand(t), "PEXPIRE")
+
+	receivers = "0"
+	assert.Equal(t, queue.ErrNoConsumer, publisher.Request([]byte("lost")), "Request without subscriber")
+}
@@ -0,0 +1,351 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// Instance is a running service instance
+type Instance struct {
+	ID        string    `json:"id"`
+	Role      string    `json:"role"`
+	Version   string    `json:"version"`
+	Address   string    `json:"address"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// InstanceRegistry can be real or fake registry of the running instances
+// A registered instance is kept alive by heartbeats, until Close. A crashed instance expires after TTL.
+type InstanceRegistry interface {
+	Connect(ctx context.Context) error
+	// Close deregisters the instance, if it's registered
+	Close()
+	// Register registers the instance and starts the heartbeat
+	Register(ctx context.Context, instance Instance) error
+	// List returns the live instances, ordered by role and start time
+	List(ctx context.Context) ([]Instance, error)
+}
+
+// DefaultInstanceTTL is the expiration of a registration, if TTL is not set
+const DefaultInstanceTTL = 30 * time.Second
+
+// instanceTTL returns DefaultInstanceTTL, if ttl is not set
+func instanceTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl
+	}
+
+	return DefaultInstanceTTL
+}
+
+// heartbeatInterval returns TTL/3, if interval is not set
+func heartbeatInterval(ttl time.Duration, interval time.Duration) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+
+	return instanceTTL(ttl) / 3
+}
+
+// heartbeat calls refresh regularly, until stop is closed
+func heartbeat(interval time.Duration, stop chan struct{}, stopped chan struct{}, refresh func(ctx context.Context) error) {
+	defer close(stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		if err := refresh(ctx); err != nil {
+			logger.Get().Warning("cannot refresh instance registration, ", err)
+		}
+		cancel()
+	}
+}
+
+func sortInstances(instances []Instance) {
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Role != instances[j].Role {
+			return instances[i].Role < instances[j].Role
+		}
+
+		return instances[i].StartedAt.Before(instances[j].StartedAt)
+	})
+}
+
+// RealInstanceRegistry is a real InstanceRegistry on Redis
+// Each instance is stored in its own key (<Key>:<ID>) with TTL.
+// The IDs are collected in the set <Key>, the expired IDs are removed by List.
+type RealInstanceRegistry struct {
+	Host string
+	Key  string
+	// Conn is the topology, AUTH, DB index and TLS config
+	Conn ConnConfig
+	// TTL is the expiration of a registration, DefaultInstanceTTL, if 0
+	TTL time.Duration
+	// HeartbeatInterval is the period of refreshing the registration, TTL/3, if 0
+	HeartbeatInterval time.Duration
+
+	pool     *redis.Pool
+	instance *Instance
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// Connect connects to Redis
+func (registry *RealInstanceRegistry) Connect(ctx context.Context) error {
+	registry.pool = newPool(registry.Host, registry.Conn)
+
+	conn, err := registry.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	_, err = doContext(ctx, conn, "PING")
+
+	return err
+}
+
+// Close deregisters the instance, if it's registered, and closes the connections
+func (registry *RealInstanceRegistry) Close() {
+	if registry.pool == nil {
+		return
+	}
+
+	if registry.instance != nil {
+		close(registry.stop)
+		<-registry.stopped
+
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+
+		if conn, err := registry.pool.GetContext(ctx); err == nil {
+			doContext(ctx, conn, "DEL", registry.instanceKey(registry.instance.ID)) // nolint:errcheck,gosec
+			doContext(ctx, conn, "SREM", registry.Key, registry.instance.ID)        // nolint:errcheck,gosec
+			conn.Close()                                                            // nolint:errcheck,gosec
+		}
+
+		registry.instance = nil
+	}
+
+	registry.pool.Close() // nolint:errcheck,gosec
+	registry.pool = nil
+}
+
+// Register registers the instance and starts the heartbeat
+func (registry *RealInstanceRegistry) Register(ctx context.Context, instance Instance) error {
+	if registry.pool == nil {
+		return ErrClosed
+	}
+
+	value, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+
+	refresh := func(ctx context.Context) error {
+		conn, err := registry.pool.GetContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close() // nolint:errcheck
+
+		if _, err := doContext(ctx, conn, "SET", registry.instanceKey(instance.ID), value,
+			"PX", instanceTTL(registry.TTL).Nanoseconds()/int64(time.Millisecond)); err != nil {
+			return err
+		}
+
+		// the ID may be removed by List, after a missed heartbeat
+		_, err = doContext(ctx, conn, "SADD", registry.Key, instance.ID)
+
+		return err
+	}
+
+	if err := refresh(ctx); err != nil {
+		return err
+	}
+
+	registry.instance = &instance
+	registry.stop, registry.stopped = make(chan struct{}), make(chan struct{})
+	go heartbeat(heartbeatInterval(registry.TTL, registry.HeartbeatInterval), registry.stop, registry.stopped, refresh)
+
+	return nil
+}
+
+// List returns the live instances, ordered by role and start time
+func (registry *RealInstanceRegistry) List(ctx context.Context) ([]Instance, error) {
+	if registry.pool == nil {
+		return nil, ErrClosed
+	}
+
+	conn, err := registry.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	ids, err := redis.Strings(doContext(ctx, conn, "SMEMBERS", registry.Key))
+	if err != nil {
+		return nil, err
+	}
+
+	instances := []Instance{}
+	for _, id := range ids {
+		value, err := redis.Bytes(doContext(ctx, conn, "GET", registry.instanceKey(id)))
+		if err == redis.ErrNil {
+			// expired
+			if _, err := doContext(ctx, conn, "SREM", registry.Key, id); err != nil {
+				return nil, err
+			}
+
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		instance := Instance{}
+		if err := json.Unmarshal(value, &instance); err != nil {
+			logger.Get().Warningf("invalid instance %s, %s", id, err)
+
+			continue
+		}
+		instances = append(instances, instance)
+	}
+
+	sortInstances(instances)
+
+	return instances, nil
+}
+
+func (registry *RealInstanceRegistry) instanceKey(id string) string {
+	return registry.Key + ":" + id
+}
+
+// FakeInstanceStore is the storage of FakeInstanceRegistry, like a Redis server
+type FakeInstanceStore struct {
+	instances map[string]Instance
+	expires   map[string]time.Time
+
+	mx sync.Mutex
+}
+
+// FakeInstanceRegistry is a fake InstanceRegistry, the instances must use the same Store
+type FakeInstanceRegistry struct {
+	Store *FakeInstanceStore
+	// TTL is the expiration of a registration, DefaultInstanceTTL, if 0
+	TTL time.Duration
+	// HeartbeatInterval is the period of refreshing the registration, TTL/3, if 0
+	HeartbeatInterval time.Duration
+
+	connected bool
+	instance  *Instance
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+// Connect connects to the Store
+func (registry *FakeInstanceRegistry) Connect(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	registry.connected = true
+
+	return nil
+}
+
+// Close deregisters the instance, if it's registered
+func (registry *FakeInstanceRegistry) Close() {
+	if registry.instance != nil {
+		close(registry.stop)
+		<-registry.stopped
+
+		store := registry.Store
+		store.mx.Lock()
+		delete(store.instances, registry.instance.ID)
+		delete(store.expires, registry.instance.ID)
+		store.mx.Unlock()
+
+		registry.instance = nil
+	}
+
+	registry.connected = false
+}
+
+// Register registers the instance and starts the heartbeat
+func (registry *FakeInstanceRegistry) Register(ctx context.Context, instance Instance) error {
+	if !registry.connected {
+		return ErrClosed
+	}
+
+	refresh := func(ctx context.Context) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		store := registry.Store
+		store.mx.Lock()
+		defer store.mx.Unlock()
+
+		if store.instances == nil {
+			store.instances, store.expires = map[string]Instance{}, map[string]time.Time{}
+		}
+		store.instances[instance.ID] = instance
+		store.expires[instance.ID] = time.Now().Add(instanceTTL(registry.TTL))
+
+		return nil
+	}
+
+	if err := refresh(ctx); err != nil {
+		return err
+	}
+
+	registry.instance = &instance
+	registry.stop, registry.stopped = make(chan struct{}), make(chan struct{})
+	go heartbeat(heartbeatInterval(registry.TTL, registry.HeartbeatInterval), registry.stop, registry.stopped, refresh)
+
+	return nil
+}
+
+// List returns the live instances, ordered by role and start time
+func (registry *FakeInstanceRegistry) List(ctx context.Context) ([]Instance, error) {
+	if !registry.connected {
+		return nil, ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	store := registry.Store
+	store.mx.Lock()
+	defer store.mx.Unlock()
+
+	instances := []Instance{}
+	for id, instance := range store.instances {
+		if time.Now().After(store.expires[id]) {
+			delete(store.instances, id)
+			delete(store.expires, id)
+
+			continue
+		}
+		instances = append(instances, instance)
+	}
+
+	sortInstances(instances)
+
+	return instances, nil
+}
@@ -0,0 +1,117 @@
+package queue_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+type newRegistry func(ttl time.Duration, heartbeatInterval time.Duration) queue.InstanceRegistry
+
+func TestFakeInstanceRegistry(t *testing.T) {
+	store := &queue.FakeInstanceStore{}
+
+	testInstanceRegistry(t, func(ttl time.Duration, heartbeatInterval time.Duration) queue.InstanceRegistry {
+		return &queue.FakeInstanceRegistry{Store: store, TTL: ttl, HeartbeatInterval: heartbeatInterval}
+	})
+}
+
+func TestRealInstanceRegistry(t *testing.T) {
+	host, connConfig := testRedis(t)
+
+	key := "test-instances-" + t.Name()
+	testInstanceRegistry(t, func(ttl time.Duration, heartbeatInterval time.Duration) queue.InstanceRegistry {
+		return &queue.RealInstanceRegistry{
+			Host: host, Key: key, Conn: connConfig, TTL: ttl, HeartbeatInterval: heartbeatInterval,
+		}
+	})
+}
+
+func testInstanceRegistry(t *testing.T, newRegistry newRegistry) {
+	t.Run("RegisterList", func(t *testing.T) { testRegisterList(t, newRegistry) })
+	t.Run("Expire", func(t *testing.T) { testRegistryExpire(t, newRegistry) })
+	t.Run("Heartbeat", func(t *testing.T) { testRegistryHeartbeat(t, newRegistry) })
+	t.Run("AfterClose", func(t *testing.T) { testRegistryAfterClose(t, newRegistry) })
+}
+
+func connectRegistry(t *testing.T, newRegistry newRegistry, ttl time.Duration, heartbeatInterval time.Duration,
+) queue.InstanceRegistry {
+	registry := newRegistry(ttl, heartbeatInterval)
+	if err := registry.Connect(context.Background()); err != nil {
+		t.Fatal("cannot connect registry, ", err)
+	}
+
+	return registry
+}
+
+func listIDs(t *testing.T, registry queue.InstanceRegistry) []string {
+	instances, err := registry.List(context.Background())
+	assert.NoError(t, err, "List")
+
+	ids := []string{}
+	for _, instance := range instances {
+		ids = append(ids, instance.ID)
+	}
+
+	return ids
+}
+
+func testRegisterList(t *testing.T, newRegistry newRegistry) {
+	startedAt := time.Now().UTC().Truncate(time.Second)
+	instances := []queue.Instance{
+		{ID: "engine-2", Role: "engine", Version: "v1", Address: "host-2:8080", StartedAt: startedAt},
+		{ID: "frontend-1", Role: "frontend", Version: "v1", Address: "host-1:8088", StartedAt: startedAt},
+		{ID: "engine-1", Role: "engine", Version: "v1", Address: "host-1:8080", StartedAt: startedAt.Add(-time.Minute)},
+	}
+
+	registries := []queue.InstanceRegistry{}
+	for _, instance := range instances {
+		registry := connectRegistry(t, newRegistry, time.Minute, 0)
+		defer registry.Close()
+
+		assert.NoError(t, registry.Register(context.Background(), instance), "Register "+instance.ID)
+		registries = append(registries, registry)
+	}
+
+	listed, err := registries[0].List(context.Background())
+	if assert.NoError(t, err, "List") {
+		assert.Equal(t, []queue.Instance{instances[2], instances[0], instances[1]}, listed, "instances")
+	}
+
+	registries[1].Close()
+	assert.Equal(t, []string{"engine-1", "engine-2"}, listIDs(t, registries[0]), "after Close")
+}
+
+func testRegistryExpire(t *testing.T, newRegistry newRegistry) {
+	registry := connectRegistry(t, newRegistry, 200*time.Millisecond, time.Hour)
+	defer registry.Close()
+
+	assert.NoError(t, registry.Register(context.Background(), queue.Instance{ID: "crashed"}), "Register")
+	assert.Equal(t, []string{"crashed"}, listIDs(t, registry), "before TTL")
+
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, []string{}, listIDs(t, registry), "after TTL")
+}
+
+func testRegistryHeartbeat(t *testing.T, newRegistry newRegistry) {
+	registry := connectRegistry(t, newRegistry, 200*time.Millisecond, 0)
+	defer registry.Close()
+
+	assert.NoError(t, registry.Register(context.Background(), queue.Instance{ID: "alive"}), "Register")
+
+	time.Sleep(600 * time.Millisecond)
+	assert.Equal(t, []string{"alive"}, listIDs(t, registry), "after TTL")
+}
+
+func testRegistryAfterClose(t *testing.T, newRegistry newRegistry) {
+	registry := connectRegistry(t, newRegistry, time.Minute, 0)
+	registry.Close()
+
+	assert.Error(t, registry.Register(context.Background(), queue.Instance{ID: "closed"}), "Register")
+	_, err := registry.List(context.Background())
+	assert.Error(t, err, "List")
+}
@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// dialSentinel asks the Sentinels for the address of the master and connects to it
+// The Sentinels are asked in order, the first one, which knows the master, is used.
+// After a failover, the Sentinels disconnect the clients of the old master,
+// so the next dial (reconnect of the subscriber, new connection of the pool) finds the new master.
+func dialSentinel(ctx context.Context, sentinels []string, connConfig ConnConfig) (redis.Conn, error) {
+	if len(sentinels) == 0 {
+		return nil, errors.New("no Sentinel address")
+	}
+
+	errs := []string{}
+	for _, sentinel := range sentinels {
+		addr, err := getMasterAddr(ctx, sentinel, connConfig)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", sentinel, err))
+
+			continue
+		}
+
+		conn, err := dialNode(ctx, addr, connConfig)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: master %s: %s", sentinel, addr, err))
+
+			continue
+		}
+
+		// the Sentinel may be not up to date, during a failover
+		if err := checkRole(conn, "master"); err != nil {
+			conn.Close() // nolint:errcheck,gosec
+			errs = append(errs, fmt.Sprintf("%s: master %s: %s", sentinel, addr, err))
+
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, fmt.Errorf("cannot connect to master %s, %s", connConfig.SentinelMaster, strings.Join(errs, "; "))
+}
+
+// getMasterAddr returns the address of the master, by a Sentinel
+func getMasterAddr(ctx context.Context, sentinel string, connConfig ConnConfig) (string, error) {
+	conn, err := dialNode(ctx, sentinel, ConnConfig{Password: connConfig.SentinelPassword, TLSConfig: connConfig.TLSConfig})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	hostPort, err := redis.Strings(redis.DoWithTimeout(conn, dialTimeout,
+		"SENTINEL", "get-master-addr-by-name", connConfig.SentinelMaster))
+	if err != nil {
+		return "", err
+	}
+	if len(hostPort) != 2 {
+		return "", fmt.Errorf("invalid master address: %v", hostPort)
+	}
+
+	return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+}
+
+// checkRole checks the role (master, slave, sentinel) of the connected server
+func checkRole(conn redis.Conn, expected string) error {
+	reply, err := redis.Values(redis.DoWithTimeout(conn, dialTimeout, "ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("empty role")
+	}
+
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != expected {
+		return fmt.Errorf("role is %s, instead of %s", role, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+	"github.com/pgillich/chat-bot/internal/queue/queuetest"
+)
+
+// The tests in this file start redis-server processes, they are skipped, if redis-server is not installed
+
+const serverStartTimeout = 10 * time.Second
+
+// redisServers starts local redis-server processes in a temp dir
+type redisServers struct {
+	t    *testing.T
+	dir  string
+	cmds []*exec.Cmd
+}
+
+func newRedisServers(t *testing.T) *redisServers {
+	if _, err := exec.LookPath("redis-server"); err != nil {
+		t.Skip("redis-server is not installed")
+	}
+
+	dir, err := ioutil.TempDir("", "chat-bot-redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &redisServers{t: t, dir: dir}
+}
+
+func (servers *redisServers) stop() {
+	for _, cmd := range servers.cmds {
+		cmd.Process.Kill() // nolint:errcheck,gosec
+		cmd.Wait()         // nolint:errcheck,gosec
+	}
+
+	os.RemoveAll(servers.dir) // nolint:errcheck,gosec
+}
+
+// start starts a redis-server with a config file and returns its address
+func (servers *redisServers) start(config string, args ...string) string {
+	port := freePort(servers.t)
+	configFile := filepath.Join(servers.dir, fmt.Sprintf("redis-%d.conf", port))
+	config = fmt.Sprintf("port %d\nbind 127.0.0.1\ndir %s\nsave \"\"\n%s", port, servers.dir, config)
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		servers.t.Fatal(err)
+	}
+
+	cmd := exec.Command("redis-server", append([]string{configFile}, args...)...) // nolint:gosec
+	if err := cmd.Start(); err != nil {
+		servers.t.Fatal(err)
+	}
+	servers.cmds = append(servers.cmds, cmd)
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	waitFor(servers.t, "redis-server "+addr, func() bool {
+		_, err := servers.do(addr, "PING")
+
+		return err == nil
+	})
+
+	return addr
+}
+
+// do sends a command to the server on a new connection
+func (servers *redisServers) do(addr string, command string, args ...interface{}) (interface{}, error) {
+	conn, err := redis.Dial("tcp", addr, redis.DialConnectTimeout(time.Second), redis.DialReadTimeout(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close() // nolint:errcheck
+
+	return conn.Do(command, args...)
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close() // nolint:errcheck
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func waitFor(t *testing.T, what string, ready func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(serverStartTimeout); !ready(); time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + what)
+		}
+	}
+}
+
+// startSentinel starts a master, optionally a replica, and a Sentinel
+func (servers *redisServers) startSentinel(withReplica bool) (string, string, string) {
+	master := servers.start("")
+
+	replica := ""
+	if withReplica {
+		host, port, _ := net.SplitHostPort(master) // nolint:errcheck
+		replica = servers.start(fmt.Sprintf("replicaof %s %s\n", host, port))
+		waitFor(servers.t, "replication", func() bool {
+			info, err := redis.String(servers.do(replica, "INFO", "replication"))
+
+			return err == nil && strings.Contains(info, "master_link_status:up")
+		})
+	}
+
+	host, port, _ := net.SplitHostPort(master) // nolint:errcheck
+	sentinel := servers.start(fmt.Sprintf(
+		"sentinel monitor mymaster %s %s 1\n"+
+			"sentinel down-after-milliseconds mymaster 1000\n"+
+			"sentinel failover-timeout mymaster 5000\n", host, port), "--sentinel")
+
+	if withReplica {
+		waitFor(servers.t, "Sentinel discovering the replica", func() bool {
+			replicas, err := redis.Values(servers.do(sentinel, "SENTINEL", "replicas", "mymaster"))
+
+			return err == nil && len(replicas) > 0
+		})
+	}
+
+	return master, replica, sentinel
+}
+
+func TestSentinelServers(t *testing.T) {
+	servers := newRedisServers(t)
+	defer servers.stop()
+
+	_, _, sentinel := servers.startSentinel(false)
+
+	connConfig := queue.ConnConfig{Topology: queue.TopologySentinel, SentinelMaster: "mymaster"}
+	queuetest.RunConformance(t, func() (queue.RedisPublisher, queue.RedisSubscriber) {
+		channel := "test-requests-" + t.Name()
+
+		return &queue.RealRedisPublisher{
+			Host: sentinel, RequestChannel: channel, Conn: connConfig,
+		}, &queue.RealRedisSubscriber{
+			Host: sentinel, RequestChannel: channel, Conn: connConfig,
+		}
+	})
+}
+
+func TestSentinelFailover(t *testing.T) {
+	servers := newRedisServers(t)
+	defer servers.stop()
+
+	_, replica, sentinel := servers.startSentinel(true)
+
+	connConfig := queue.ConnConfig{Topology: queue.TopologySentinel, SentinelMaster: "mymaster"}
+	subscriber := &queue.RealRedisSubscriber{
+		Host: sentinel, RequestChannel: "failover", Conn: connConfig,
+		ReconnectMinDelay: 100 * time.Millisecond, ReconnectMaxDelay: time.Second,
+	}
+	publisher := &queue.RealRedisPublisher{
+		Host: sentinel, RequestChannel: "failover", Conn: connConfig,
+	}
+	if err := subscriber.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer subscriber.Close()
+	if err := publisher.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+
+	if _, err := servers.do(sentinel, "SENTINEL", "FAILOVER", "mymaster"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "failover", func() bool {
+		hostPort, err := redis.Strings(servers.do(sentinel, "SENTINEL", "get-master-addr-by-name", "mymaster"))
+
+		return err == nil && len(hostPort) == 2 && net.JoinHostPort(hostPort[0], hostPort[1]) == replica
+	})
+
+	received := make(chan string, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			if message, is := subscriber.ReceiveContext(ctx).(redis.Message); is {
+				received <- string(message.Data)
+			}
+		}
+	}()
+
+	// the messages, published during the failover, are lost
+	for deadline := time.Now().Add(2 * serverStartTimeout); ; {
+		publisher.Request([]byte("after failover")) // nolint:errcheck,gosec
+
+		select {
+		case data := <-received:
+			assert.Equal(t, "after failover", data, "Data")
+
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if time.Now().After(deadline) {
+			assert.Fail(t, "no message after failover")
+
+			return
+		}
+	}
+}
+
+func TestClusterServers(t *testing.T) {
+	servers := newRedisServers(t)
+	defer servers.stop()
+
+	nodes := []string{}
+	for n := 0; n < 3; n++ {
+		nodes = append(nodes, servers.start(fmt.Sprintf(
+			"cluster-enabled yes\ncluster-config-file nodes-%d.conf\n", n)))
+	}
+
+	const slots = 16384
+	for n, node := range nodes {
+		args := []interface{}{"ADDSLOTS"}
+		for slot := n * slots / len(nodes); slot < (n+1)*slots/len(nodes); slot++ {
+			args = append(args, slot)
+		}
+		if _, err := servers.do(node, "CLUSTER", args...); err != nil {
+			t.Fatal(err)
+		}
+
+		host, port, _ := net.SplitHostPort(node) // nolint:errcheck
+		if _, err := servers.do(nodes[0], "CLUSTER", "MEET", host, port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, node := range nodes {
+		waitFor(t, "cluster "+node, func() bool {
+			info, err := redis.String(servers.do(node, "CLUSTER", "INFO"))
+
+			return err == nil && strings.Contains(info, "cluster_state:ok")
+		})
+	}
+
+	connConfig := queue.ConnConfig{Topology: queue.TopologyCluster}
+	queuetest.RunConformance(t, func() (queue.RedisPublisher, queue.RedisSubscriber) {
+		channel := "test-requests-" + t.Name()
+
+		// the publisher and the subscriber are connected to different nodes
+		return &queue.RealRedisPublisher{
+			Host: strings.Join(nodes, ","), RequestChannel: channel, Conn: connConfig,
+		}, &queue.RealRedisSubscriber{
+			Host: nodes[2], RequestChannel: channel, Conn: connConfig,
+		}
+	})
+}
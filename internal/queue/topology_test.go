@@ -0,0 +1,177 @@
+package queue_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+func newRoleServer(t *testing.T, role string) *respServer {
+	return newRespServerWithHandler(t, nil, func(args []string) string {
+		if strings.EqualFold(args[0], "ROLE") {
+			return respBulkArray(role)
+		}
+
+		return ""
+	})
+}
+
+func newSentinelServer(t *testing.T, master string, masterAddr string) *respServer {
+	host, port, err := net.SplitHostPort(masterAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return newRespServerWithHandler(t, nil, func(args []string) string {
+		if strings.EqualFold(args[0], "SENTINEL") {
+			if args[len(args)-1] != master {
+				return "*-1\r\n"
+			}
+
+			return respBulkArray(host, port)
+		}
+
+		return ""
+	})
+}
+
+func TestSentinel(t *testing.T) {
+	master := newRoleServer(t, "master")
+	defer master.listener.Close() // nolint:errcheck
+
+	sentinel := newSentinelServer(t, "mymaster", master.listener.Addr().String())
+	defer sentinel.listener.Close() // nolint:errcheck
+
+	// the first Sentinel is not available
+	unavailable, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unavailable.Close() // nolint:errcheck,gosec
+
+	publisher := &queue.RealRedisPublisher{
+		Host: unavailable.Addr().String() + "," + sentinel.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{Topology: queue.TopologySentinel, SentinelMaster: "mymaster"},
+	}
+	if !assert.NoError(t, publisher.Connect(), "Connect") {
+		return
+	}
+	defer publisher.Close()
+
+	assert.Equal(t, "SENTINEL get-master-addr-by-name mymaster", sentinel.nextCommand(t), "Sentinel")
+	assert.Equal(t, "ROLE", master.nextCommand(t), "ROLE")
+	assert.Equal(t, "PING", master.nextCommand(t), "PING")
+}
+
+func TestSentinelNotMaster(t *testing.T) {
+	replica := newRoleServer(t, "slave")
+	defer replica.listener.Close() // nolint:errcheck
+
+	sentinel := newSentinelServer(t, "mymaster", replica.listener.Addr().String())
+	defer sentinel.listener.Close() // nolint:errcheck
+
+	for _, master := range []string{"mymaster", "unknown"} {
+		subscriber := &queue.RealRedisSubscriber{
+			Host: sentinel.listener.Addr().String(), RequestChannel: "requests",
+			Conn: queue.ConnConfig{Topology: queue.TopologySentinel, SentinelMaster: master},
+		}
+
+		assert.Error(t, subscriber.Connect(), "Connect to "+master)
+	}
+}
+
+func TestClusterMoved(t *testing.T) {
+	target := newRespServer(t, nil)
+	defer target.listener.Close() // nolint:errcheck
+
+	seed := newRespServerWithHandler(t, nil, func(args []string) string {
+		if strings.EqualFold(args[0], "SET") {
+			return "-MOVED 1234 " + target.listener.Addr().String() + "\r\n"
+		}
+		if strings.EqualFold(args[0], "SADD") {
+			return "-ASK 5678 " + target.listener.Addr().String() + "\r\n"
+		}
+		if strings.EqualFold(args[0], "CLUSTER") {
+			nodes := "seed-id 127.0.0.1:1@11 myself,master - 0 0 1 connected 0-8191\n" +
+				"target-id " + target.listener.Addr().String() + "@2 master - 0 0 2 connected 8192-16383\n"
+
+			return fmt.Sprintf("$%d\r\n%s\r\n", len(nodes), nodes)
+		}
+		if strings.EqualFold(args[0], "PUBSUB") {
+			// the subscriber is connected to the target
+			return respArray(args[2]) + ":0\r\n"
+		}
+
+		return ""
+	})
+	defer seed.listener.Close() // nolint:errcheck
+
+	registry := &queue.RealInstanceRegistry{
+		Host: seed.listener.Addr().String(), Key: "instances",
+		Conn: queue.ConnConfig{Topology: queue.TopologyCluster}, TTL: time.Minute,
+	}
+	if !assert.NoError(t, registry.Connect(context.Background()), "Connect") {
+		return
+	}
+	defer registry.Close()
+	assert.Equal(t, "PING", seed.nextCommand(t), "PING seed")
+
+	if !assert.NoError(t, registry.Register(context.Background(), queue.Instance{ID: "id-1"}), "Register") {
+		return
+	}
+	assert.Equal(t, "PING", seed.nextCommand(t), "PING seed")
+	assert.True(t, strings.HasPrefix(seed.nextCommand(t), "SET instances:id-1 "), "SET seed")
+	assert.True(t, strings.HasPrefix(target.nextCommand(t), "SET instances:id-1 "), "SET moved")
+	assert.Equal(t, "SADD instances id-1", seed.nextCommand(t), "SADD seed")
+	assert.Equal(t, "ASKING", target.nextCommand(t), "ASKING")
+	assert.Equal(t, "SADD instances id-1", target.nextCommand(t), "SADD asked")
+
+	publisher := &queue.RealRedisPublisher{
+		Host: seed.listener.Addr().String(), RequestChannel: "requests",
+		Conn: queue.ConnConfig{Topology: queue.TopologyCluster},
+	}
+	if !assert.NoError(t, publisher.Connect(), "Connect publisher") {
+		return
+	}
+	defer publisher.Close()
+	assert.Equal(t, "PING", seed.nextCommand(t), "PING seed")
+
+	assert.NoError(t, publisher.Request([]byte("hello")), "Request")
+	assert.Equal(t, "PING", seed.nextCommand(t), "PING seed")
+	assert.Equal(t, "CLUSTER NODES", seed.nextCommand(t), "CLUSTER NODES seed")
+	assert.Equal(t, "PUBSUB NUMSUB requests", seed.nextCommand(t), "NUMSUB seed")
+	assert.Equal(t, "PUBSUB NUMSUB requests", target.nextCommand(t), "NUMSUB target")
+	assert.Equal(t, "PUBLISH requests hello", seed.nextCommand(t), "PUBLISH seed")
+}
+
+func TestUnknownTopology(t *testing.T) {
+	subscriber := &queue.RealRedisSubscriber{
+		Host: "127.0.0.1:6379", RequestChannel: "requests", Conn: queue.ConnConfig{Topology: "unknown"},
+	}
+
+	assert.Error(t, subscriber.Connect(), "Connect")
+}
+
+func TestConnConfigValidate(t *testing.T) {
+	for _, connConfig := range []queue.ConnConfig{
+		{},
+		{Topology: queue.TopologyStandalone, Database: 1},
+		{Topology: queue.TopologySentinel, SentinelMaster: "mymaster", Database: 1},
+		{Topology: queue.TopologyCluster},
+	} {
+		assert.NoError(t, connConfig.Validate(), connConfig.Topology)
+	}
+
+	connConfig := queue.ConnConfig{Topology: queue.TopologyCluster, Database: 1}
+	assert.EqualError(t, connConfig.Validate(), "only DB 0 is supported by Redis Cluster, DB index: 1", "cluster DB")
+
+	connConfig = queue.ConnConfig{Topology: "unknown"}
+	assert.Error(t, connConfig.Validate(), "unknown topology")
+}
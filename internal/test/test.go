@@ -11,7 +11,12 @@ import (
 	"github.com/pgillich/chat-bot/internal/db"
 )
 
-const defaultLogLevel = log.WarnLevel
+const (
+	defaultLogLevel = log.WarnLevel
+
+	requestTimeout = 500 * time.Millisecond
+	messageTimeout = 2 * time.Second
+)
 
 // MessagePair contains the incoming message and the expected response
 type MessagePair struct {
@@ -25,6 +30,16 @@ func GetLogLevel() string {
 	return defaultLogLevel.String()
 }
 
+// GetRequestTimeout returns the frontend request timeout for tests
+func GetRequestTimeout() time.Duration {
+	return requestTimeout
+}
+
+// GetMessageTimeout returns the engine message timeout for tests
+func GetMessageTimeout() time.Duration {
+	return messageTimeout
+}
+
 // GetMessagePairsJohnDoe returns conversation of John Doe
 func GetMessagePairsJohnDoe(to string) []MessagePair { // nolint:dupl
 	bornOnText := "1976.04.24."
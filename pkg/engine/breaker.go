@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// circuitState is the state of a circuit, the value is exported by the circuit_state metric
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (state circuitState) String() string {
+	switch state {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// nolint:gochecknoglobals
+var (
+	callbackRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat_bot",
+		Subsystem: "callback",
+		Name:      "requests_total",
+		Help:      "Number of callback requests by result (success, client_error, failure, cancelled, circuit_open)",
+	}, []string{"endpoint", "result"})
+	callbackDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "chat_bot",
+		Subsystem: "callback",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the callback requests",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	callbackCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chat_bot",
+		Subsystem: "callback",
+		Name:      "circuit_state",
+		Help:      "State of the circuit breaker of the endpoint: 0 closed, 1 half-open, 2 open",
+	}, []string{"endpoint"})
+)
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(callbackRequests, callbackDuration, callbackCircuitState)
+}
+
+// endpointKey returns the origin (scheme://host) of the endpoint URL
+// The circuit and the metrics are per origin, so the paths of a dead host share the circuit.
+func endpointKey(endpointURL string) string {
+	parsed, err := url.Parse(endpointURL)
+	if err != nil || parsed.Host == "" {
+		return endpointURL
+	}
+
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// circuit is the state of an endpoint
+type circuit struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+	// trial is set, if the trial request of the half-open state is in flight
+	trial bool
+}
+
+// circuitBreakers holds a circuit per endpoint
+// The circuit opens after threshold consecutive failures, and the requests are rejected without sending.
+// After openTimeout, one trial request is allowed (half-open): its success closes the circuit,
+// its failure opens it again.
+type circuitBreakers struct {
+	// threshold is the number of consecutive failures, which opens the circuit, 0 disables the breakers
+	threshold   int
+	openTimeout time.Duration
+	now         func() time.Time
+
+	circuits map[string]*circuit
+	mx       sync.Mutex
+}
+
+func newCircuitBreakers(threshold int, openTimeout time.Duration) *circuitBreakers {
+	return &circuitBreakers{
+		threshold:   threshold,
+		openTimeout: openTimeout,
+		now:         time.Now,
+		circuits:    map[string]*circuit{},
+	}
+}
+
+// allow tells, if a request can be sent to the endpoint
+func (breakers *circuitBreakers) allow(endpoint string) bool {
+	if breakers.threshold <= 0 {
+		return true
+	}
+
+	breakers.mx.Lock()
+	defer breakers.mx.Unlock()
+
+	c := breakers.circuit(endpoint)
+	switch c.state {
+	case circuitOpen:
+		if breakers.now().Sub(c.openedAt) < breakers.openTimeout {
+			return false
+		}
+		breakers.setState(endpoint, c, circuitHalfOpen)
+		c.trial = true
+
+		return true
+	case circuitHalfOpen:
+		if c.trial {
+			return false
+		}
+		c.trial = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+// report records the result of a request, which was allowed
+func (breakers *circuitBreakers) report(endpoint string, success bool) {
+	if breakers.threshold <= 0 {
+		return
+	}
+
+	breakers.mx.Lock()
+	defer breakers.mx.Unlock()
+
+	c := breakers.circuit(endpoint)
+	c.trial = false
+
+	if success {
+		c.failures = 0
+		breakers.setState(endpoint, c, circuitClosed)
+
+		return
+	}
+
+	c.failures++
+	if c.state == circuitHalfOpen || (c.state == circuitClosed && c.failures >= breakers.threshold) {
+		c.openedAt = breakers.now()
+		breakers.setState(endpoint, c, circuitOpen)
+	}
+}
+
+// release gives back an allowed request, which was not sent (for example, cancelled)
+// The state is not changed, so the next request of a half-open circuit is the trial.
+func (breakers *circuitBreakers) release(endpoint string) {
+	if breakers.threshold <= 0 {
+		return
+	}
+
+	breakers.mx.Lock()
+	defer breakers.mx.Unlock()
+
+	breakers.circuit(endpoint).trial = false
+}
+
+// state returns the state of the endpoint
+func (breakers *circuitBreakers) state(endpoint string) circuitState {
+	breakers.mx.Lock()
+	defer breakers.mx.Unlock()
+
+	return breakers.circuit(endpoint).state
+}
+
+// circuit returns the circuit of the endpoint, mx must be locked
+func (breakers *circuitBreakers) circuit(endpoint string) *circuit {
+	c, has := breakers.circuits[endpoint]
+	if !has {
+		c = &circuit{}
+		breakers.circuits[endpoint] = c
+		callbackCircuitState.WithLabelValues(endpoint).Set(float64(circuitClosed))
+	}
+
+	return c
+}
+
+// setState changes the state of the circuit, mx must be locked
+func (breakers *circuitBreakers) setState(endpoint string, c *circuit, state circuitState) {
+	if c.state == state {
+		return
+	}
+
+	logger.Get().Warningf("circuit of %s: %s -> %s", endpoint, c.state, state)
+	c.state = state
+	callbackCircuitState.WithLabelValues(endpoint).Set(float64(state))
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/jwks"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Unix(1590000000, 0)
+	breakers := newCircuitBreakers(2, time.Minute)
+	breakers.now = func() time.Time { return now }
+	endpoint := "http://acme"
+
+	assert.True(t, breakers.allow(endpoint), "closed")
+	breakers.report(endpoint, false)
+	assert.Equal(t, circuitClosed, breakers.state(endpoint), "below threshold")
+	breakers.report(endpoint, true)
+	breakers.report(endpoint, false)
+	assert.Equal(t, circuitClosed, breakers.state(endpoint), "success resets the failures")
+
+	breakers.report(endpoint, false)
+	assert.Equal(t, circuitOpen, breakers.state(endpoint), "threshold")
+	assert.False(t, breakers.allow(endpoint), "open")
+	assert.True(t, breakers.allow("http://other"), "other endpoint")
+
+	now = now.Add(time.Minute)
+	assert.True(t, breakers.allow(endpoint), "trial")
+	assert.Equal(t, circuitHalfOpen, breakers.state(endpoint), "half-open")
+	assert.False(t, breakers.allow(endpoint), "only one trial")
+	breakers.report(endpoint, false)
+	assert.Equal(t, circuitOpen, breakers.state(endpoint), "failed trial")
+	assert.False(t, breakers.allow(endpoint), "open again")
+
+	now = now.Add(time.Minute)
+	assert.True(t, breakers.allow(endpoint), "released trial")
+	breakers.release(endpoint)
+	assert.Equal(t, circuitHalfOpen, breakers.state(endpoint), "half-open after release")
+	assert.True(t, breakers.allow(endpoint), "second trial")
+	breakers.report(endpoint, true)
+	assert.Equal(t, circuitClosed, breakers.state(endpoint), "successful trial")
+	assert.True(t, breakers.allow(endpoint), "closed again")
+
+	disabled := newCircuitBreakers(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		disabled.report(endpoint, false)
+	}
+	assert.True(t, disabled.allow(endpoint), "disabled")
+
+	assert.Equal(t, "https://acme:8443", endpointKey("https://acme:8443/chat?tenant=1"), "endpointKey")
+}
+
+func TestCallbackSender(t *testing.T) {
+	signingKeys := &jwks.SigningKeys{Path: "../../" + config.DefaultRsaKey}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+	token := makeAutorefreshToken(signingKeys, TokenOptions{})
+
+	status := int32(http.StatusServiceUnavailable)
+	requests := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer server.Close()
+
+	sender := newCallbackSender(server.Client(), token, CallbackPolicy{
+		Attempts: 3, Backoff: time.Millisecond, FailureThreshold: 4, OpenTimeout: time.Hour,
+	}, nil)
+	endpoint := &ClientEndpoint{URL: server.URL, Auth: CallbackAuthJWT}
+	response := api.ResponseMessage{To: "001", Text: "Hello"}
+	ctx := context.Background()
+
+	attempts, err := sender.send(ctx, endpoint, response)
+	assert.Error(t, err, "send to failing endpoint")
+	assert.Equal(t, 3, attempts, "attempts")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "requests")
+
+	attempts, err = sender.send(ctx, endpoint, response)
+	assert.Equal(t, ErrCircuitOpen, err, "send until open")
+	assert.Equal(t, 1, attempts, "attempts until open")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests), "requests until open")
+	_, err = sender.send(ctx, endpoint, response)
+	assert.Equal(t, ErrCircuitOpen, err, "send to open circuit")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests), "no request to open circuit")
+
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer other.Close()
+	_, err = sender.send(ctx, &ClientEndpoint{URL: other.URL, Auth: CallbackAuthJWT}, response)
+	assert.NoError(t, err, "send to healthy endpoint")
+
+	sender = newCallbackSender(server.Client(), token, CallbackPolicy{Attempts: 3, Backoff: time.Millisecond}, nil)
+	atomic.StoreInt32(&status, http.StatusBadRequest)
+	atomic.StoreInt32(&requests, 0)
+	attempts, err = sender.send(ctx, endpoint, response)
+	assert.Error(t, err, "send rejected by client")
+	assert.Equal(t, 1, attempts, "client error is not retried")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "requests of client error")
+
+	atomic.StoreInt32(&status, http.StatusOK)
+	_, err = sender.send(ctx, endpoint, response)
+	assert.NoError(t, err, "send")
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer slow.Close()
+	defer close(unblock)
+	slowEndpoint := &ClientEndpoint{URL: slow.URL, Auth: CallbackAuthJWT}
+	slowKey := endpointKey(slow.URL)
+	sender = newCallbackSender(slow.Client(), token, CallbackPolicy{
+		Attempts: 1, Backoff: time.Millisecond, FailureThreshold: 1, OpenTimeout: time.Millisecond,
+	}, nil)
+	sender.breakers.report(slowKey, false)
+	time.Sleep(2 * time.Millisecond)
+	cancelCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	attempts, err = sender.send(cancelCtx, slowEndpoint, response)
+	cancel()
+	assert.Error(t, err, "cancelled trial")
+	assert.Equal(t, 0, attempts, "cancelled trial is not counted")
+	assert.Equal(t, circuitHalfOpen, sender.breakers.state(slowKey), "cancelled trial keeps half-open")
+	assert.True(t, sender.breakers.allow(slowKey), "next trial after cancel")
+}
@@ -0,0 +1,295 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/pkg/webhook"
+)
+
+const (
+	// CallbackAuthJWT authenticates the callbacks by a JWT (Authorization: Bearer)
+	CallbackAuthJWT = "jwt"
+	// CallbackAuthHMAC authenticates the callbacks by an HMAC-SHA256 signature (see package webhook)
+	CallbackAuthHMAC = "hmac"
+)
+
+// ErrCircuitOpen is returned, if the callback is not sent, because the circuit of the endpoint is open
+var ErrCircuitOpen = errors.New("circuit is open") // nolint:gochecknoglobals
+
+// callbackStatusError is a failed callback by the HTTP status of the response
+type callbackStatusError int
+
+func (status callbackStatusError) Error() string {
+	return fmt.Sprintf("callback status %d", int(status))
+}
+
+// isPermanentCallbackError tells, if the callback was rejected by the endpoint (4xx, except 429),
+// so sending it again would fail again
+func isPermanentCallbackError(err error) bool {
+	status, is := err.(callbackStatusError)
+
+	return is && status >= http.StatusBadRequest && status < http.StatusInternalServerError &&
+		status != http.StatusTooManyRequests
+}
+
+// ClientEndpoint is a callback endpoint of the client with its authentication
+type ClientEndpoint struct {
+	URL string
+	// Auth is CallbackAuthJWT or CallbackAuthHMAC
+	Auth string
+	// Secret is the shared HMAC key of CallbackAuthHMAC
+	Secret []byte
+}
+
+// ParseCallbackAuth checks the callback authentication mode
+func ParseCallbackAuth(auth string) (string, error) {
+	switch auth {
+	case CallbackAuthJWT, CallbackAuthHMAC:
+		return auth, nil
+	default:
+		return "", fmt.Errorf("invalid callback authentication: %s", auth)
+	}
+}
+
+// Validate checks the URL and the authentication of the endpoint
+func (endpoint *ClientEndpoint) Validate() error {
+	if endpoint.URL == "" {
+		return errors.New("missing endpoint URL")
+	}
+
+	if _, err := ParseCallbackAuth(endpoint.Auth); err != nil {
+		return err
+	}
+
+	if endpoint.Auth == CallbackAuthHMAC && len(endpoint.Secret) == 0 {
+		return errors.New("missing HMAC secret")
+	}
+
+	return nil
+}
+
+// CallbackRouter selects the endpoint of the responses by the client (tenant) of the request
+// The routes are read from Routes (see db.CallbackRoute) and cached for CacheTTL.
+// The responses of unknown clients (and of the requests without client) are sent to Default.
+type CallbackRouter struct {
+	Routes  db.RouteStore
+	Default *ClientEndpoint
+	// CacheTTL is the max age of a cached route, 0 disables the cache
+	CacheTTL time.Duration
+
+	cache map[string]cachedEndpoint
+	mx    sync.Mutex
+}
+
+type cachedEndpoint struct {
+	endpoint  *ClientEndpoint
+	expiresAt time.Time
+}
+
+// Endpoint returns the endpoint of the client
+// If the route cannot be read, an error is returned instead of Default, so the responses are not sent
+// to an endpoint of an other client.
+func (router *CallbackRouter) Endpoint(ctx context.Context, client string) (*ClientEndpoint, error) {
+	if client == "" {
+		return router.Default, nil
+	}
+
+	now := time.Now()
+	router.mx.Lock()
+	cached, has := router.cache[client]
+	router.mx.Unlock()
+	if has && now.Before(cached.expiresAt) {
+		return cached.endpoint, nil
+	}
+
+	endpoint := router.Default
+	route, err := router.Routes.GetCallbackRouteContext(ctx, client)
+	if err == nil {
+		endpoint = &ClientEndpoint{URL: route.URL, Auth: route.Auth, Secret: []byte(route.Secret)}
+	} else if err != db.ErrCallbackRouteNotFound {
+		return nil, err
+	}
+
+	if router.CacheTTL > 0 {
+		router.mx.Lock()
+		if router.cache == nil {
+			router.cache = map[string]cachedEndpoint{}
+		}
+		router.cache[client] = cachedEndpoint{endpoint: endpoint, expiresAt: now.Add(router.CacheTTL)}
+		router.mx.Unlock()
+	}
+
+	return endpoint, nil
+}
+
+// newCallbackRequest makes the signed POST request of the response
+func newCallbackRequest(ctx context.Context, endpoint *ClientEndpoint, token *AutorefreshToken,
+	response api.ResponseMessage,
+) (*http.Request, error) {
+	reqBody, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	if endpoint.Auth == CallbackAuthHMAC {
+		webhook.SignRequest(req, endpoint.Secret, time.Now(), reqBody)
+
+		return req, nil
+	}
+
+	tokenString, err := token.TokenFor(response.To, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make token, %s", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", tokenString))
+
+	return req, nil
+}
+
+// CallbackPolicy is the delivery policy of the callbacks
+type CallbackPolicy struct {
+	// Attempts is the max number of sending a callback, at least 1
+	Attempts int
+	// Backoff is the delay before the first retry, doubled by each retry
+	Backoff time.Duration
+	// FailureThreshold is the number of consecutive failures of an endpoint, which opens its circuit,
+	// 0 disables the circuit breaker
+	FailureThreshold int
+	// OpenTimeout is the time of the open circuit, before a trial callback (half-open)
+	OpenTimeout time.Duration
+}
+
+// callbackSender sends the responses to the client endpoints
+// A failed callback (network error, 5xx or 429) is retried, until the circuit of the endpoint is closed.
+// The delivery status of the responses is recorded in deliveries, nil disables the tracking.
+type callbackSender struct {
+	httpClient *http.Client
+	token      *AutorefreshToken
+	policy     CallbackPolicy
+	breakers   *circuitBreakers
+	deliveries db.DeliveryStore
+}
+
+func newCallbackSender(httpClient *http.Client, token *AutorefreshToken, policy CallbackPolicy,
+	deliveries db.DeliveryStore,
+) *callbackSender {
+	return &callbackSender{
+		httpClient: httpClient,
+		token:      token,
+		policy:     policy,
+		breakers:   newCircuitBreakers(policy.FailureThreshold, policy.OpenTimeout),
+		deliveries: deliveries,
+	}
+}
+
+// callbackOutcome is the result of sending a callback once
+type callbackOutcome int
+
+const (
+	// callbackNotSent is a local error (for example, signing) or a cancellation, the endpoint is not blamed
+	callbackNotSent callbackOutcome = iota
+	// callbackSuccess is a 2xx or 3xx response
+	callbackSuccess
+	// callbackRejected is a 4xx response (except 429), the endpoint is healthy, but it's not retried
+	callbackRejected
+	// callbackFailure is a transport error, a 5xx or a 429 response, which is retried
+	callbackFailure
+)
+
+// send sends the response, the failed callbacks are retried by the policy
+// The number of the sent callback requests is returned, too.
+// Only the responses and the transport errors of the sent requests are reported to the circuit breaker.
+func (sender *callbackSender) send(ctx context.Context, endpoint *ClientEndpoint, response api.ResponseMessage,
+) (int, error) {
+	key := endpointKey(endpoint.URL)
+	backoff := sender.policy.Backoff
+
+	for attempt := 1; ; attempt++ {
+		if !sender.breakers.allow(key) {
+			callbackRequests.WithLabelValues(key, "circuit_open").Inc()
+
+			return attempt - 1, ErrCircuitOpen
+		}
+
+		outcome, err := sender.post(ctx, endpoint, key, response)
+		if outcome == callbackNotSent {
+			sender.breakers.release(key)
+
+			return attempt - 1, err
+		}
+		sender.breakers.report(key, outcome != callbackFailure)
+		if outcome != callbackFailure || attempt >= sender.policy.Attempts {
+			return attempt, err
+		}
+
+		logger.Get().Warningf("callback attempt %d failed, retry in %s, %s", attempt, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return attempt, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the response once
+func (sender *callbackSender) post(ctx context.Context, endpoint *ClientEndpoint, key string,
+	response api.ResponseMessage,
+) (callbackOutcome, error) {
+	req, err := newCallbackRequest(ctx, endpoint, sender.token, response)
+	if err != nil {
+		return callbackNotSent, err
+	}
+
+	startedAt := time.Now()
+	resp, err := sender.httpClient.Do(req)
+	callbackDuration.WithLabelValues(key).Observe(time.Since(startedAt).Seconds())
+	if err != nil {
+		if ctx.Err() != nil {
+			callbackRequests.WithLabelValues(key, "cancelled").Inc()
+
+			return callbackNotSent, err
+		}
+		callbackRequests.WithLabelValues(key, "failure").Inc()
+
+		return callbackFailure, err
+	}
+	io.Copy(ioutil.Discard, resp.Body) // nolint:errcheck,gosec
+	resp.Body.Close()                  // nolint:errcheck,gosec
+
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests:
+		callbackRequests.WithLabelValues(key, "failure").Inc()
+
+		return callbackFailure, callbackStatusError(resp.StatusCode)
+	case resp.StatusCode >= http.StatusBadRequest:
+		callbackRequests.WithLabelValues(key, "client_error").Inc()
+
+		return callbackRejected, callbackStatusError(resp.StatusCode)
+	default:
+		callbackRequests.WithLabelValues(key, "success").Inc()
+
+		return callbackSuccess, nil
+	}
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// deliveryTimeout is the deadline of recording a delivery status (or marking an outbox message done)
+// The status is recorded after cancelling the sending, too.
+const deliveryTimeout = 5 * time.Second
+
+// setDeliveryStatus records the status of the response, the failures are only logged
+func (sender *callbackSender) setDeliveryStatus(response api.ResponseMessage, event db.DeliveryEvent) {
+	if sender.deliveries == nil || response.ID == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	_, err := sender.deliveries.UpdateDeliveryContext(ctx, response.ID, event)
+	switch {
+	case err == nil:
+	case err == db.ErrDeliveryStatus:
+		// the client acknowledged the response, before the sending was recorded
+		logger.Get().Debugf("delivery %s is not changed to %s", response.ID, event.Status)
+	default:
+		logger.Get().Warningf("cannot set delivery %s to %s, %s", response.ID, event.Status, err)
+	}
+}
+
+// failDelivery records the outbox message as failed
+func (sender *callbackSender) failDelivery(message *db.OutboxMessage, reason string) {
+	sender.setDeliveryStatus(api.ResponseMessage{ID: message.MessageID, To: message.Recipient}, db.DeliveryEvent{
+		Status: db.DeliveryFailed, At: time.Now(), Error: reason,
+	})
+}
@@ -0,0 +1,106 @@
+package engine
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+const (
+	// lockRetryInterval is the min delay of trying to take a held user lock again, a random jitter is added
+	lockRetryInterval = 20 * time.Millisecond
+	// unlockTimeout is the deadline of releasing a user lock
+	// The lock is released after the deadline of the message, too.
+	unlockTimeout = 5 * time.Second
+)
+
+// nolint:gochecknoglobals
+var (
+	userLockRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat_bot",
+		Subsystem: "user_lock",
+		Name:      "requests_total",
+		Help:      "Number of user lock requests by result (acquired, contended, timeout, error, lost)",
+	}, []string{"result"})
+	userLockWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "chat_bot",
+		Subsystem: "user_lock",
+		Name:      "wait_seconds",
+		Help:      "Time of waiting for the user locks",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(userLockRequests, userLockWait)
+}
+
+// lockUser takes the lock of the user, waiting until it's released by the other engines or ctx is done
+// The lock requests are counted as acquired (at first try), contended (after waiting), timeout or error.
+func lockUser(ctx context.Context, locker queue.Locker, uid string) (queue.Lease, error) {
+	startedAt := time.Now()
+	result := "acquired"
+	defer func() {
+		userLockRequests.WithLabelValues(result).Inc()
+		userLockWait.Observe(time.Since(startedAt).Seconds())
+	}()
+
+	for {
+		lease, locked, err := locker.TryLock(ctx, uid)
+		if err != nil {
+			result = "error"
+			if ctx.Err() != nil {
+				result = "timeout"
+			}
+
+			return queue.Lease{}, err
+		}
+		if locked {
+			return lease, nil
+		}
+
+		result = "contended"
+		timer := time.NewTimer(lockRetryInterval + time.Duration(rand.Int63n(int64(lockRetryInterval))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			result = "timeout"
+
+			return queue.Lease{}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// lockContext limits waiting for the user lock to the half of the remaining time of ctx,
+// so the message is processed (fenced by the DB) after a lock timeout, too
+func lockContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, has := ctx.Deadline()
+	if !has {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Until(deadline)/2)
+}
+
+// unlockUser releases the lock of the user, the failure is only logged
+// If the lease expired before, it's counted as lost.
+func unlockUser(locker queue.Locker, lease queue.Lease) {
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	err := locker.Unlock(ctx, lease)
+	switch {
+	case err == nil:
+	case err == queue.ErrLockLost:
+		userLockRequests.WithLabelValues("lost").Inc()
+		logger.Get().Warningf("lock of %s expired before releasing it", lease.Key)
+	default:
+		logger.Get().Warningf("cannot release lock of %s, %s", lease.Key, err)
+	}
+}
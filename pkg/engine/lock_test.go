@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+// TestMakeResponsesLock checks, that the replicas, which receive the same request, process it once
+func TestMakeResponsesLock(t *testing.T) {
+	uid := "014"
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	store := &queue.FakeLockStore{}
+	lockers := []queue.Locker{}
+	for r := 0; r < 3; r++ {
+		locker := &queue.FakeLocker{Store: store, TTL: time.Second}
+		if !assert.NoError(t, locker.Connect(context.Background()), "Connect locker") {
+			return
+		}
+		defer locker.Close()
+		lockers = append(lockers, locker)
+	}
+
+	requestBody, _ := json.Marshal(api.Envelope{ // nolint:errcheck
+		Version: api.EnvelopeVersion, ID: "id-1", Attempt: 1,
+		Payload: api.RequestMessage{From: uid, Text: "Hello"},
+	})
+
+	results := make([][]api.ResponseWithDelay, len(lockers))
+	wg := sync.WaitGroup{}
+	for r := range lockers {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			_, results[r] = makeResponses(context.Background(), dbHandler, lockers[r], redis.Message{Data: requestBody})
+		}(r)
+	}
+	wg.Wait()
+
+	processed := 0
+	for r := range results {
+		if len(results[r]) > 0 {
+			processed++
+		}
+	}
+	assert.Equal(t, 1, processed, "processed by one replica")
+
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser") {
+		assert.NotZero(t, user.FenceToken, "FenceToken")
+	}
+
+	messages, err := dbHandler.DoneOutboxContext(context.Background(), "id-1", math.MaxInt32, time.Now())
+	if assert.NoError(t, err, "DoneOutboxContext") {
+		assert.Len(t, messages, 2, "outbox")
+	}
+}
+
+// TestMakeResponsesLockTimeout checks, that the message is processed without lock (fenced by the DB),
+// if the user is locked too long, but it's dropped at shutdown
+func TestMakeResponsesLockTimeout(t *testing.T) {
+	uid := "015"
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	store := &queue.FakeLockStore{}
+	holder := &queue.FakeLocker{Store: store, TTL: time.Minute}
+	locker := &queue.FakeLocker{Store: store, TTL: time.Minute}
+	for _, l := range []queue.Locker{holder, locker} {
+		if !assert.NoError(t, l.Connect(context.Background()), "Connect locker") {
+			return
+		}
+		defer l.Close()
+	}
+
+	lease, locked, err := holder.TryLock(context.Background(), uid)
+	if !assert.NoError(t, err, "TryLock") || !assert.True(t, locked, "TryLock") {
+		return
+	}
+
+	timeoutsBefore := testutil.ToFloat64(userLockRequests.WithLabelValues("timeout"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// a version 0 message without ID
+	requestBody, _ := json.Marshal(api.RequestMessage{From: uid, Text: "Hello"}) // nolint:errcheck
+	_, responses := makeResponses(ctx, dbHandler, locker, redis.Message{Data: requestBody})
+
+	assert.Len(t, responses, 2, "Responses without lock")
+	assert.Equal(t, timeoutsBefore+1, testutil.ToFloat64(userLockRequests.WithLabelValues("timeout")), "timeouts")
+
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, shutdown)
+	nameBody, _ := json.Marshal(api.RequestMessage{From: uid, Text: "My name is Jane Doe"}) // nolint:errcheck
+	_, responses = makeResponses(shutdownCtx, dbHandler, locker, redis.Message{Data: nameBody})
+	assert.Len(t, responses, 0, "Responses at shutdown")
+
+	assert.NoError(t, holder.Unlock(context.Background(), lease), "Unlock")
+	_, responses = makeResponses(context.Background(), dbHandler, locker, redis.Message{Data: requestBody})
+	assert.Len(t, responses, 0, "Responses of the same message after Unlock")
+	_, responses = makeResponses(context.Background(), dbHandler, locker, redis.Message{Data: nameBody})
+	assert.Len(t, responses, 1, "Responses after Unlock")
+}
+
+// TestMakeResponsesLockFanOut checks, that a replica, which receives a request late (after an other replica
+// processed it and the next request of the user), doesn't process it again
+func TestMakeResponsesLockFanOut(t *testing.T) {
+	uid := "016"
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	store := &queue.FakeLockStore{}
+	fast := &queue.FakeLocker{Store: store, TTL: time.Second}
+	slow := &queue.FakeLocker{Store: store, TTL: time.Second}
+	for _, l := range []queue.Locker{fast, slow} {
+		if !assert.NoError(t, l.Connect(context.Background()), "Connect locker") {
+			return
+		}
+		defer l.Close()
+	}
+
+	// without idempotency key, the request is identified by its ID
+	hello, _ := json.Marshal(api.Envelope{ // nolint:errcheck
+		Version: api.EnvelopeVersion, ID: "fan-out-1", Attempt: 1,
+		Payload: api.RequestMessage{From: uid, Text: "Hello"},
+	})
+	name, _ := json.Marshal(api.Envelope{ // nolint:errcheck
+		Version: api.EnvelopeVersion, ID: "fan-out-2", Attempt: 1,
+		Payload: api.RequestMessage{From: uid, Text: "My name is Jane Doe"},
+	})
+
+	_, responses := makeResponses(context.Background(), dbHandler, fast, redis.Message{Data: hello})
+	assert.Len(t, responses, 2, "Hello")
+	_, responses = makeResponses(context.Background(), dbHandler, fast, redis.Message{Data: name})
+	assert.Len(t, responses, 1, "Name")
+
+	_, responses = makeResponses(context.Background(), dbHandler, slow, redis.Message{Data: hello})
+	assert.Len(t, responses, 0, "late Hello")
+
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser") {
+		assert.Equal(t, "Jane Doe", user.Name, "Name")
+		assert.Equal(t, "fan-out-2", user.LastRequestKey, "LastRequestKey")
+	}
+
+	messages, err := dbHandler.DoneOutboxContext(context.Background(), "fan-out-1", math.MaxInt32, time.Now())
+	if assert.NoError(t, err, "DoneOutboxContext") {
+		assert.Len(t, messages, 2, "outbox of Hello")
+	}
+}
@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// OutboxPolicy configures the relay, which sends the responses from the outbox
+type OutboxPolicy struct {
+	// PollInterval is the period of claiming the due messages
+	PollInterval time.Duration
+	// Lease is the max time of sending a message, an other relay may claim (and send) it again after it,
+	// so it should be longer than all callback attempts of a message
+	Lease time.Duration
+	// Concurrency is the max number of messages, which are sent at the same time, at least 1
+	Concurrency int
+	// MaxAge is the max age of a message (since OutboxMessage.CreatedAt), until the temporary failures
+	// (open circuit, network error, 5xx or 429) are retried, 0 retries them without limit
+	MaxAge time.Duration
+}
+
+// newOutboxMessages sets the IDs of the responses and makes their outbox messages
+// A message is due after the delays of the previous responses and its own delay, counted from now.
+// The requests without ID (earlier envelope versions) get a new ID, which groups the responses.
+func newOutboxMessages(envelope *api.Envelope, responses []api.ResponseWithDelay, now time.Time,
+) ([]db.OutboxMessage, error) {
+	requestID := envelope.ID
+	if requestID == "" {
+		id, err := api.NewMessageID()
+		if err != nil {
+			return nil, err
+		}
+		requestID = id
+	}
+
+	messages := make([]db.OutboxMessage, 0, len(responses))
+	sendAt := now
+	for r := range responses {
+		id, err := api.NewMessageID()
+		if err != nil {
+			return nil, err
+		}
+		responses[r].Response.ID = id
+		sendAt = sendAt.Add(responses[r].Delay)
+
+		messages = append(messages, db.OutboxMessage{
+			MessageID: id,
+			RequestID: requestID,
+			Sequence:  r,
+			Client:    envelope.Client,
+			Recipient: responses[r].Response.To,
+			Text:      responses[r].Response.Text,
+			SendAt:    sendAt,
+		})
+	}
+
+	return messages, nil
+}
+
+// storeResponses stores the responses in the outbox, without changing the user (for example, error replies)
+// The failure is only logged, the responses are not sent then.
+func storeResponses(ctx context.Context, outbox db.OutboxStore, envelope *api.Envelope,
+	responses []api.ResponseWithDelay,
+) []api.ResponseWithDelay {
+	messages, err := newOutboxMessages(envelope, responses, time.Now())
+	if err == nil {
+		err = outbox.UpdateWithOutboxContext(ctx, nil, messages)
+	}
+	if err != nil {
+		logger.Get().Warning("cannot store responses, ", err)
+	}
+
+	return responses
+}
+
+// RelayOutbox sends the due outbox messages to the client endpoints, until idleConnsClosed is closed
+// The responses of a request are sent in order, the next one is claimed after the previous one is done.
+// If sending a message fails temporarily (see OutboxPolicy.MaxAge), it's kept pending and claimed again
+// after the open circuit timeout (or the backoff) of the callback policy. If a message is rejected
+// by the endpoint or it's too old, the next messages of the request are dropped. If the sending is interrupted
+// (shutdown or the route cannot be read), the message is sent again after its lease expired,
+// so a response may be delivered more than once; the clients can deduplicate them by ID.
+// The delivery statuses of the responses are recorded in deliveries, nil disables the tracking.
+func RelayOutbox(idleConnsClosed chan struct{}, outbox db.OutboxStore, deliveries db.DeliveryStore,
+	httpClient *http.Client, signingKeys *jwks.SigningKeys, tokenOptions TokenOptions,
+	router *CallbackRouter, callbackPolicy CallbackPolicy, policy OutboxPolicy,
+) {
+	sender := newCallbackSender(httpClient, makeAutorefreshToken(signingKeys, tokenOptions), callbackPolicy, deliveries)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-idleConnsClosed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(policy.PollInterval)
+	defer ticker.Stop()
+
+	slots := make(chan struct{}, policy.Concurrency)
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Get().Info("Closing, no more outbox messages")
+			return
+		case <-ticker.C:
+		}
+
+		free := cap(slots) - len(slots)
+		if free == 0 {
+			continue
+		}
+
+		now := time.Now()
+		messages, err := outbox.ClaimOutboxContext(ctx, now, now.Add(policy.Lease), free)
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Get().Warning("cannot claim outbox messages, ", err)
+			}
+
+			continue
+		}
+
+		for m := range messages {
+			slots <- struct{}{}
+			wg.Add(1)
+
+			go func(message db.OutboxMessage) { // nolint:gocritic
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+
+				sender.relay(ctx, outbox, router, &message, policy.MaxAge)
+			}(messages[m])
+		}
+	}
+}
+
+// relay sends the claimed message and marks it done
+// A temporary failure of a message, which is younger than maxAge, is retried later.
+func (sender *callbackSender) relay(ctx context.Context, outbox db.OutboxStore, router *CallbackRouter,
+	message *db.OutboxMessage, maxAge time.Duration,
+) {
+	response := api.ResponseMessage{ID: message.MessageID, To: message.Recipient, Text: message.Text}
+
+	endpoint, err := router.Endpoint(ctx, message.Client)
+	if err != nil {
+		logger.Get().Warningf("cannot route the responses of client %s, %s", message.Client, err)
+
+		return
+	}
+	logger.Get().Infof("SEND %s", response)
+
+	attempts, err := sender.send(ctx, endpoint, response)
+	if ctx.Err() != nil {
+		logger.Get().Warningf("sending %s is cancelled, %s", message.MessageID, ctx.Err())
+
+		return
+	}
+
+	if err != nil && !isPermanentCallbackError(err) && (maxAge <= 0 || time.Since(message.CreatedAt) < maxAge) {
+		retryAt := time.Now().Add(sender.retryDelay())
+		logger.Get().Warningf("cannot send %s, retry at %s, %s", message.MessageID, retryAt, err)
+		retryOutbox(outbox, message.MessageID, retryAt)
+
+		return
+	}
+
+	if err != nil {
+		logger.Get().Warning("cannot send POST to client, ", err)
+		sender.setDeliveryStatus(response, db.DeliveryEvent{
+			Status: db.DeliveryFailed, At: time.Now(), Attempts: attempts, Error: err.Error(),
+		})
+
+		dropped := doneOutbox(outbox, message.RequestID, math.MaxInt32)
+		for d := range dropped {
+			if dropped[d].MessageID != message.MessageID {
+				sender.failDelivery(&dropped[d], "dropped, a previous response failed")
+			}
+		}
+
+		return
+	}
+
+	sender.setDeliveryStatus(response, db.DeliveryEvent{
+		Status: db.DeliverySent, At: time.Now(), Attempts: attempts,
+	})
+	doneOutbox(outbox, message.RequestID, message.Sequence)
+}
+
+// retryDelay is the delay of sending a failed message again: the open circuit timeout or the backoff
+func (sender *callbackSender) retryDelay() time.Duration {
+	if sender.policy.OpenTimeout > 0 {
+		return sender.policy.OpenTimeout
+	}
+
+	return sender.policy.Backoff
+}
+
+// retryOutbox keeps the message pending until retryAt, the failure is only logged
+// If it fails, the message is claimed again after its lease.
+func retryOutbox(outbox db.OutboxStore, messageID string, retryAt time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	if err := outbox.RetryOutboxContext(ctx, messageID, retryAt); err != nil {
+		logger.Get().Warningf("cannot retry the outbox message %s, %s", messageID, err)
+	}
+}
+
+// doneOutbox marks the messages of the request done, up to lastSequence, the failure is only logged
+// The message is marked after cancelling the sending, too.
+func doneOutbox(outbox db.OutboxStore, requestID string, lastSequence int) []db.OutboxMessage {
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	done, err := outbox.DoneOutboxContext(ctx, requestID, lastSequence, time.Now())
+	if err != nil {
+		logger.Get().Warningf("cannot mark the outbox messages of %s done, %s", requestID, err)
+	}
+
+	return done
+}
@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
+)
+
+func TestRelayOutbox(t *testing.T) {
+	signingKeys := &jwks.SigningKeys{Path: "../../" + config.DefaultRsaKey}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+	dbHandler := &db.FakeDbHandler{}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	received := make(chan api.ResponseMessage, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := api.ResponseMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			t.Error(err)
+		}
+		received <- response
+		if response.Text == "rejected" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	envelope := &api.Envelope{ID: "request", Client: "acme"}
+	ctx := context.Background()
+
+	responses := storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+		newResponseWithDelay("001", "Hi", 0),
+		newResponseWithDelay("001", "rejected", 0),
+		newResponseWithDelay("001", "dropped", 0),
+	})
+	for _, response := range responses {
+		if !assert.NotEmpty(t, response.Response.ID, "ID") {
+			return
+		}
+		delivery, err := dbHandler.GetDeliveryContext(ctx, response.Response.ID)
+		if assert.NoError(t, err, "GetDeliveryContext") {
+			assert.Equal(t, db.DeliveryQueued, delivery.Status, "queued")
+			assert.Equal(t, "request", delivery.RequestID, "RequestID")
+			assert.Equal(t, "acme", delivery.Client, "Client")
+			assert.Equal(t, "001", delivery.Recipient, "Recipient")
+		}
+	}
+
+	idleConnsClosed := make(chan struct{})
+	relayDone := make(chan struct{})
+	go func() {
+		RelayOutbox(idleConnsClosed, dbHandler, dbHandler, server.Client(), signingKeys, TokenOptions{},
+			&CallbackRouter{Routes: dbHandler, Default: &ClientEndpoint{URL: server.URL, Auth: CallbackAuthJWT}},
+			CallbackPolicy{Attempts: 1},
+			OutboxPolicy{PollInterval: 10 * time.Millisecond, Lease: time.Minute, Concurrency: 4})
+		close(relayDone)
+	}()
+	defer func() {
+		close(idleConnsClosed)
+		<-relayDone
+	}()
+
+	for r := 0; r < 2; r++ {
+		select {
+		case response := <-received:
+			assert.Equal(t, responses[r].Response.ID, response.ID, "sent ID")
+		case <-time.After(5 * time.Second):
+			t.Fatal("response is not sent")
+		}
+	}
+
+	expected := []string{db.DeliverySent, db.DeliveryFailed, db.DeliveryFailed}
+	for r, response := range responses {
+		delivery := db.Delivery{}
+		for wait := 0; wait < 50; wait++ {
+			delivery, _ = dbHandler.GetDeliveryContext(ctx, response.Response.ID) // nolint:errcheck
+			if delivery.Status != db.DeliveryQueued {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.Equal(t, expected[r], delivery.Status, "Status of "+response.Response.Text)
+	}
+
+	delivery, err := dbHandler.GetDeliveryContext(ctx, responses[1].Response.ID)
+	if assert.NoError(t, err, "GetDeliveryContext rejected") {
+		assert.Equal(t, 1, delivery.Attempts, "Attempts")
+		assert.Equal(t, "callback status 400", delivery.LastError, "LastError")
+	}
+	delivery, err = dbHandler.GetDeliveryContext(ctx, responses[2].Response.ID)
+	if assert.NoError(t, err, "GetDeliveryContext dropped") {
+		assert.Equal(t, 0, delivery.Attempts, "Attempts")
+		assert.Contains(t, delivery.LastError, "dropped", "LastError")
+	}
+
+	// all messages of the request are done
+	now := time.Now().Add(time.Hour)
+	pending, err := dbHandler.ClaimOutboxContext(ctx, now, now.Add(time.Minute), 10)
+	if assert.NoError(t, err, "ClaimOutboxContext") {
+		assert.Len(t, pending, 0, "pending")
+	}
+	assert.Len(t, received, 0, "dropped is not sent")
+}
+
+func TestRelayOutboxRetry(t *testing.T) {
+	signingKeys := &jwks.SigningKeys{Path: "../../" + config.DefaultRsaKey}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+	dbHandler := &db.FakeDbHandler{}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	failures := int32(2)
+	received := make(chan api.ResponseMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		response := api.ResponseMessage{}
+		if err := json.NewDecoder(r.Body).Decode(&response); err != nil {
+			t.Error(err)
+		}
+		if response.Text == "expired" || atomic.AddInt32(&failures, -1) >= 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+
+			return
+		}
+		received <- response
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	responses := storeResponses(ctx, dbHandler, &api.Envelope{ID: "request"}, []api.ResponseWithDelay{
+		newResponseWithDelay("001", "Hi", 0),
+		newResponseWithDelay("001", "What's your name?", 0),
+	})
+
+	idleConnsClosed := make(chan struct{})
+	relayDone := make(chan struct{})
+	relay := func(maxAge time.Duration) {
+		RelayOutbox(idleConnsClosed, dbHandler, dbHandler, server.Client(), signingKeys, TokenOptions{},
+			&CallbackRouter{Routes: dbHandler, Default: &ClientEndpoint{URL: server.URL, Auth: CallbackAuthJWT}},
+			CallbackPolicy{Attempts: 1, Backoff: 10 * time.Millisecond, FailureThreshold: 1, OpenTimeout: 20 * time.Millisecond},
+			OutboxPolicy{PollInterval: 5 * time.Millisecond, Lease: time.Minute, Concurrency: 4, MaxAge: maxAge})
+		relayDone <- struct{}{}
+	}
+	go relay(time.Hour)
+
+	// the temporary failures and the open circuit don't drop the responses
+	for r := range responses {
+		select {
+		case response := <-received:
+			assert.Equal(t, responses[r].Response.ID, response.ID, "sent ID")
+		case <-time.After(5 * time.Second):
+			t.Fatal("response is not sent")
+		}
+	}
+
+	for _, response := range responses {
+		delivery := db.Delivery{}
+		for wait := 0; wait < 50; wait++ {
+			delivery, _ = dbHandler.GetDeliveryContext(ctx, response.Response.ID) // nolint:errcheck
+			if delivery.Status != db.DeliveryQueued {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		assert.Equal(t, db.DeliverySent, delivery.Status, "Status of "+response.Response.Text)
+	}
+	close(idleConnsClosed)
+	<-relayDone
+
+	// a too old response fails
+	expired := storeResponses(ctx, dbHandler, &api.Envelope{ID: "expired"}, []api.ResponseWithDelay{
+		newResponseWithDelay("001", "expired", 0),
+	})
+	idleConnsClosed = make(chan struct{})
+	go relay(50 * time.Millisecond)
+	delivery := db.Delivery{}
+	for wait := 0; wait < 100; wait++ {
+		delivery, _ = dbHandler.GetDeliveryContext(ctx, expired[0].Response.ID) // nolint:errcheck
+		if delivery.Status != db.DeliveryQueued {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	close(idleConnsClosed)
+	<-relayDone
+	assert.Equal(t, db.DeliveryFailed, delivery.Status, "Status of expired")
+}
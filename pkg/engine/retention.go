@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// RetentionPolicy configures the purging of old data
+type RetentionPolicy struct {
+	// UserInactivity is the max inactivity of a user (since User.UpdatedAt), 0 disables purging
+	UserInactivity time.Duration
+	// DeliveryAge is the max age of a delivery status (since Delivery.CreatedAt), 0 disables purging
+	DeliveryAge time.Duration
+	// OutboxAge is the max age of a done outbox message (since OutboxMessage.DoneAt), 0 disables purging
+	OutboxAge time.Duration
+	// ProcessedRequestAge is the max age of a processed request key (since ProcessedRequest.CreatedAt),
+	// 0 disables purging
+	ProcessedRequestAge time.Duration
+	// TranscriptAge is the max age of a transcript entry (since TranscriptEntry.CreatedAt), 0 disables purging
+	TranscriptAge time.Duration
+	// Interval is the period of purging, it must be positive, if purging is enabled
+	Interval time.Duration
+	// DryRun only reports, what would be purged
+	DryRun bool
+}
+
+// nolint:gochecknoglobals
+var purgedRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "chat_bot",
+	Subsystem: "retention",
+	Name:      "purged_rows_total",
+	Help:      "Number of rows purged by the retention policy (would be purged, if dry_run is true)",
+}, []string{"table", "dry_run"})
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(purgedRows)
+}
+
+// RetentionStore is the DB of RetentionJob, the stores of the purged tables
+type RetentionStore interface {
+	db.UserStore
+	db.DeliveryStore
+	db.OutboxStore
+	db.TranscriptStore
+}
+
+// RetentionJob purges the inactive users, the old delivery statuses, outbox messages, processed request keys
+// and transcript entries regularly, until idleConnsClosed is closed
+func RetentionJob(idleConnsClosed chan struct{}, dbHandler RetentionStore, policy RetentionPolicy) {
+	if policy.UserInactivity <= 0 && policy.DeliveryAge <= 0 && policy.OutboxAge <= 0 &&
+		policy.ProcessedRequestAge <= 0 && policy.TranscriptAge <= 0 {
+		logger.Get().Info("Retention is disabled")
+		return
+	}
+	if policy.Interval <= 0 {
+		logger.Get().Warningf("Retention is disabled, invalid interval: %s", policy.Interval)
+		return
+	}
+
+	ticker := time.NewTicker(policy.Interval)
+	defer ticker.Stop()
+
+	for {
+		if policy.UserInactivity > 0 {
+			purgeUsers(dbHandler, policy)
+		}
+		if policy.DeliveryAge > 0 {
+			purgeDeliveries(dbHandler, policy)
+		}
+		if policy.OutboxAge > 0 {
+			purgeOutbox(dbHandler, policy)
+		}
+		if policy.ProcessedRequestAge > 0 {
+			purgeProcessedRequests(dbHandler, policy)
+		}
+		if policy.TranscriptAge > 0 {
+			purgeTranscripts(dbHandler, policy)
+		}
+
+		select {
+		case <-idleConnsClosed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeUsers(users db.UserStore, policy RetentionPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Interval)
+	defer cancel()
+
+	inactiveSince := time.Now().Add(-policy.UserInactivity)
+
+	purged, err := users.PurgeUsersContext(ctx, inactiveSince, policy.DryRun)
+	if err != nil {
+		logger.Get().Warning("cannot purge users, ", err)
+		return
+	}
+
+	purgedRows.WithLabelValues("user", strconv.FormatBool(policy.DryRun)).Add(float64(purged))
+
+	if policy.DryRun {
+		logger.Get().Infof("RETENTION dry run, users would be purged: %d (inactive since %s)", purged, inactiveSince)
+	} else {
+		logger.Get().Infof("RETENTION users purged: %d (inactive since %s)", purged, inactiveSince)
+	}
+}
+
+func purgeDeliveries(deliveries db.DeliveryStore, policy RetentionPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Interval)
+	defer cancel()
+
+	createdBefore := time.Now().Add(-policy.DeliveryAge)
+
+	purged, err := deliveries.PurgeDeliveriesContext(ctx, createdBefore, policy.DryRun)
+	if err != nil {
+		logger.Get().Warning("cannot purge deliveries, ", err)
+		return
+	}
+
+	purgedRows.WithLabelValues("delivery", strconv.FormatBool(policy.DryRun)).Add(float64(purged))
+
+	if policy.DryRun {
+		logger.Get().Infof("RETENTION dry run, deliveries would be purged: %d (created before %s)", purged, createdBefore)
+	} else {
+		logger.Get().Infof("RETENTION deliveries purged: %d (created before %s)", purged, createdBefore)
+	}
+}
+
+func purgeOutbox(outbox db.OutboxStore, policy RetentionPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Interval)
+	defer cancel()
+
+	doneBefore := time.Now().Add(-policy.OutboxAge)
+
+	purged, err := outbox.PurgeOutboxContext(ctx, doneBefore, policy.DryRun)
+	if err != nil {
+		logger.Get().Warning("cannot purge outbox, ", err)
+		return
+	}
+
+	purgedRows.WithLabelValues("outbox", strconv.FormatBool(policy.DryRun)).Add(float64(purged))
+
+	if policy.DryRun {
+		logger.Get().Infof("RETENTION dry run, outbox messages would be purged: %d (done before %s)", purged, doneBefore)
+	} else {
+		logger.Get().Infof("RETENTION outbox messages purged: %d (done before %s)", purged, doneBefore)
+	}
+}
+
+func purgeProcessedRequests(users db.UserStore, policy RetentionPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Interval)
+	defer cancel()
+
+	createdBefore := time.Now().Add(-policy.ProcessedRequestAge)
+
+	purged, err := users.PurgeProcessedRequestsContext(ctx, createdBefore, policy.DryRun)
+	if err != nil {
+		logger.Get().Warning("cannot purge processed requests, ", err)
+		return
+	}
+
+	purgedRows.WithLabelValues("processed_request", strconv.FormatBool(policy.DryRun)).Add(float64(purged))
+
+	if policy.DryRun {
+		logger.Get().Infof("RETENTION dry run, processed request keys would be purged: %d (created before %s)",
+			purged, createdBefore)
+	} else {
+		logger.Get().Infof("RETENTION processed request keys purged: %d (created before %s)", purged, createdBefore)
+	}
+}
+
+func purgeTranscripts(transcripts db.TranscriptStore, policy RetentionPolicy) {
+	ctx, cancel := context.WithTimeout(context.Background(), policy.Interval)
+	defer cancel()
+
+	createdBefore := time.Now().Add(-policy.TranscriptAge)
+
+	purged, err := transcripts.PurgeTranscriptsContext(ctx, createdBefore, policy.DryRun)
+	if err != nil {
+		logger.Get().Warning("cannot purge transcripts, ", err)
+		return
+	}
+
+	purgedRows.WithLabelValues("transcript", strconv.FormatBool(policy.DryRun)).Add(float64(purged))
+
+	if policy.DryRun {
+		logger.Get().Infof("RETENTION dry run, transcript entries would be purged: %d (created before %s)",
+			purged, createdBefore)
+	} else {
+		logger.Get().Infof("RETENTION transcript entries purged: %d (created before %s)", purged, createdBefore)
+	}
+}
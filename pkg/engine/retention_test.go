@@ -0,0 +1,201 @@
+package engine
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/db"
+)
+
+func TestPurgeUsers(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	if _, err := dbHandler.GetOrCreateUser("006"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	policy := RetentionPolicy{UserInactivity: 5 * time.Millisecond, Interval: time.Second, DryRun: true}
+	dryRunBefore := testutil.ToFloat64(purgedRows.WithLabelValues("user", "true"))
+	purgedBefore := testutil.ToFloat64(purgedRows.WithLabelValues("user", "false"))
+
+	purgeUsers(dbHandler, policy)
+
+	assert.Equal(t, dryRunBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("user", "true")), "dry run")
+	users, _ := dbHandler.ListUsersContext(context.Background(), 0, 10) // nolint:errcheck
+	assert.Equal(t, 1, len(users), "kept by dry run")
+
+	policy.DryRun = false
+	purgeUsers(dbHandler, policy)
+
+	assert.Equal(t, purgedBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("user", "false")), "purged")
+	users, _ = dbHandler.ListUsersContext(context.Background(), 0, 10) // nolint:errcheck
+	assert.Equal(t, 0, len(users), "purged")
+}
+
+func TestPurgeDeliveries(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	if err := dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{{MessageID: "m1", SendAt: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	policy := RetentionPolicy{DeliveryAge: 5 * time.Millisecond, Interval: time.Second, DryRun: true}
+	dryRunBefore := testutil.ToFloat64(purgedRows.WithLabelValues("delivery", "true"))
+	purgedBefore := testutil.ToFloat64(purgedRows.WithLabelValues("delivery", "false"))
+
+	purgeDeliveries(dbHandler, policy)
+
+	assert.Equal(t, dryRunBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("delivery", "true")), "dry run")
+	_, err := dbHandler.GetDeliveryContext(ctx, "m1")
+	assert.NoError(t, err, "kept by dry run")
+
+	policy.DryRun = false
+	purgeDeliveries(dbHandler, policy)
+
+	assert.Equal(t, purgedBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("delivery", "false")), "purged")
+	_, err = dbHandler.GetDeliveryContext(ctx, "m1")
+	assert.Equal(t, db.ErrDeliveryNotFound, err, "purged")
+}
+
+func TestPurgeOutbox(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	err := dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{
+		{MessageID: "m1", RequestID: "r1", SendAt: time.Now()},
+		{MessageID: "m2", RequestID: "r2", SendAt: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dbHandler.DoneOutboxContext(ctx, "r1", 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	policy := RetentionPolicy{OutboxAge: 5 * time.Millisecond, Interval: time.Second, DryRun: true}
+	dryRunBefore := testutil.ToFloat64(purgedRows.WithLabelValues("outbox", "true"))
+	purgedBefore := testutil.ToFloat64(purgedRows.WithLabelValues("outbox", "false"))
+
+	purgeOutbox(dbHandler, policy)
+
+	assert.Equal(t, dryRunBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("outbox", "true")), "dry run")
+
+	policy.DryRun = false
+	purgeOutbox(dbHandler, policy)
+
+	// the pending message is kept
+	assert.Equal(t, purgedBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("outbox", "false")), "purged")
+}
+
+func TestPurgeProcessedRequests(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	user, err := dbHandler.GetOrCreateUser("008")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.LastRequestKey = "k1"
+	if err = dbHandler.Update(user); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	policy := RetentionPolicy{ProcessedRequestAge: 5 * time.Millisecond, Interval: time.Second, DryRun: true}
+	dryRunBefore := testutil.ToFloat64(purgedRows.WithLabelValues("processed_request", "true"))
+	purgedBefore := testutil.ToFloat64(purgedRows.WithLabelValues("processed_request", "false"))
+
+	purgeProcessedRequests(dbHandler, policy)
+
+	assert.Equal(t, dryRunBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("processed_request", "true")),
+		"dry run")
+	processed, _ := dbHandler.IsRequestProcessedContext(ctx, "008", "k1") // nolint:errcheck
+	assert.True(t, processed, "kept by dry run")
+
+	policy.DryRun = false
+	purgeProcessedRequests(dbHandler, policy)
+
+	assert.Equal(t, purgedBefore+1, testutil.ToFloat64(purgedRows.WithLabelValues("processed_request", "false")),
+		"purged")
+	processed, _ = dbHandler.IsRequestProcessedContext(ctx, "008", "k1") // nolint:errcheck
+	assert.False(t, processed, "purged")
+}
+
+func TestPurgeTranscripts(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	entries := newTranscript(&api.Envelope{ID: "r1", Payload: api.RequestMessage{From: "007", Text: "Hello"}},
+		[]api.ResponseWithDelay{newResponseWithDelay("007", "Hi", 0)})
+	if err := dbHandler.AppendTranscriptContext(ctx, entries); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	policy := RetentionPolicy{TranscriptAge: 5 * time.Millisecond, Interval: time.Second, DryRun: true}
+	dryRunBefore := testutil.ToFloat64(purgedRows.WithLabelValues("transcript", "true"))
+	purgedBefore := testutil.ToFloat64(purgedRows.WithLabelValues("transcript", "false"))
+
+	purgeTranscripts(dbHandler, policy)
+
+	assert.Equal(t, dryRunBefore+2, testutil.ToFloat64(purgedRows.WithLabelValues("transcript", "true")), "dry run")
+	kept, _ := dbHandler.ListTranscriptContext(ctx, "007") // nolint:errcheck
+	assert.Len(t, kept, 2, "kept by dry run")
+
+	policy.DryRun = false
+	purgeTranscripts(dbHandler, policy)
+
+	assert.Equal(t, purgedBefore+2, testutil.ToFloat64(purgedRows.WithLabelValues("transcript", "false")), "purged")
+	kept, _ = dbHandler.ListTranscriptContext(ctx, "007") // nolint:errcheck
+	assert.Len(t, kept, 0, "purged")
+}
+
+// TestRetentionJobInvalidInterval checks, that a non-positive interval disables the job (instead of panicking)
+func TestRetentionJobInvalidInterval(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		RetentionJob(make(chan struct{}), dbHandler, RetentionPolicy{UserInactivity: time.Hour})
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("RetentionJob is running")
+	}
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/jwks"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+const (
+	// DefaultTokenLifetime is the expiration of the tokens, if TokenOptions.Lifetime is not set
+	DefaultTokenLifetime = 2 * time.Hour
+
+	// TokenTypeShared is the TokenType of the token, which is sent in every callback
+	TokenTypeShared = "level1"
+	// TokenTypeRequest is the TokenType of the per-request token
+	TokenTypeRequest = "request"
+)
+
+// SimpleClaim is a simple JWT claim
+type SimpleClaim struct {
+	*jwt.StandardClaims
+	TokenType string
+	// To is the UID of the recipient, only in per-request tokens
+	To string `json:"to,omitempty"`
+	// BodySHA256 is the base64url SHA-256 hash of the request body, only in per-request tokens
+	BodySHA256 string `json:"body_sha256,omitempty"`
+}
+
+// TokenOptions are the claims and the lifetime of the tokens, signed by the engine
+// The algorithm is selected by the signing key (see jwks.SigningKeys).
+type TokenOptions struct {
+	// Issuer is the iss claim, omitted if empty
+	Issuer string
+	// Audience is the aud claim, omitted if empty
+	Audience string
+	// Lifetime is the expiration of the tokens, DefaultTokenLifetime if not set
+	Lifetime time.Duration
+	// PerRequest signs a token for each callback, bound to the recipient (to), the body hash
+	// and a unique ID (jti), so the client can detect tampering and replays
+	PerRequest bool
+}
+
+func (options *TokenOptions) lifetime() time.Duration {
+	if options.Lifetime <= 0 {
+		return DefaultTokenLifetime
+	}
+
+	return options.Lifetime
+}
+
+// AutorefreshToken provides token, refreshed regularly
+// The token is signed by the active key of signingKeys, and it's refreshed at key rotation, too.
+type AutorefreshToken struct {
+	signingKeys *jwks.SigningKeys
+	options     TokenOptions
+	keyID       string
+	token       string
+
+	mx *sync.Mutex
+}
+
+func makeAutorefreshToken(signingKeys *jwks.SigningKeys, options TokenOptions) *AutorefreshToken {
+	autoToken := &AutorefreshToken{
+		signingKeys: signingKeys,
+		options:     options,
+		mx:          &sync.Mutex{},
+	}
+
+	autoToken.mx.Lock()
+	autoToken.refresh(signingKeys.Active())
+	autoToken.mx.Unlock()
+
+	go func() {
+		ticker := time.Tick(options.lifetime() / 2) // nolint:staticcheck
+		for range ticker {
+			autoToken.mx.Lock()
+			autoToken.refresh(signingKeys.Active())
+			autoToken.mx.Unlock()
+		}
+	}()
+
+	return autoToken
+}
+
+// refresh makes a new token, mx must be locked
+func (autoToken *AutorefreshToken) refresh(signingKey *jwks.SigningKey) {
+	token, err := createToken(signingKey, &autoToken.options, &SimpleClaim{TokenType: TokenTypeShared})
+	if err != nil {
+		logger.Get().Panic("cannot make token, ", err)
+	}
+
+	autoToken.keyID = signingKey.ID
+	autoToken.token = token
+	logger.Get().Debugf("New JWT token (kid %s): %s", signingKey.ID, token)
+}
+
+// GetToken returns a JWT token
+// token is refreshed regularly, and if the active key is changed
+func (autoToken *AutorefreshToken) GetToken() string {
+	autoToken.mx.Lock()
+	defer autoToken.mx.Unlock()
+
+	if signingKey := autoToken.signingKeys.Active(); signingKey.ID != autoToken.keyID {
+		autoToken.refresh(signingKey)
+	}
+
+	return autoToken.token
+}
+
+// TokenFor returns the token of a callback to the recipient
+// If PerRequest is set, a new token is signed for the body, else the shared token is returned.
+func (autoToken *AutorefreshToken) TokenFor(to string, body []byte) (string, error) {
+	if !autoToken.options.PerRequest {
+		return autoToken.GetToken(), nil
+	}
+
+	jti, err := api.NewMessageID()
+	if err != nil {
+		return "", err
+	}
+	bodyHash := sha256.Sum256(body)
+
+	return createToken(autoToken.signingKeys.Active(), &autoToken.options, &SimpleClaim{
+		StandardClaims: &jwt.StandardClaims{Id: jti},
+		TokenType:      TokenTypeRequest,
+		To:             to,
+		BodySHA256:     base64.RawURLEncoding.EncodeToString(bodyHash[:]),
+	})
+}
+
+// createToken fills the standard claims of claims by options and signs it
+func createToken(signingKey *jwks.SigningKey, options *TokenOptions, claims *SimpleClaim) (string, error) {
+	t := jwt.New(signingKey.Method)
+	t.Header["kid"] = signingKey.ID
+
+	if claims.StandardClaims == nil {
+		claims.StandardClaims = &jwt.StandardClaims{}
+	}
+	now := time.Now()
+	claims.Subject = "chat-bot"
+	claims.Issuer = options.Issuer
+	claims.Audience = options.Audience
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(options.lifetime()).Unix()
+	t.Claims = claims
+
+	return t.SignedString(signingKey.Key)
+}
@@ -0,0 +1,41 @@
+package engine
+
+import (
+	"context"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+// newTranscript returns the transcript entries of the request and its responses
+// The duplicate requests are not processed (no responses), so they are not recorded again.
+func newTranscript(envelope *api.Envelope, responses []api.ResponseWithDelay) []db.TranscriptEntry {
+	uid := envelope.Payload.From
+	entries := make([]db.TranscriptEntry, 0, len(responses)+1)
+	entries = append(entries, db.TranscriptEntry{
+		UID: uid, RequestID: envelope.ID, Direction: db.TranscriptRequest, Text: envelope.Payload.Text,
+	})
+
+	for r := range responses {
+		entries = append(entries, db.TranscriptEntry{
+			UID: uid, RequestID: envelope.ID, Direction: db.TranscriptResponse, Text: responses[r].Response.Text,
+		})
+	}
+
+	return entries
+}
+
+// appendTranscript stores the request and its responses in the transcript of the user, the failure is only logged
+// The responses are already in the outbox, so a missing transcript entry does not affect the conversation.
+func appendTranscript(ctx context.Context, transcripts db.TranscriptStore, envelope *api.Envelope,
+	responses []api.ResponseWithDelay,
+) {
+	if envelope.Payload.From == "" {
+		return
+	}
+
+	if err := transcripts.AppendTranscriptContext(ctx, newTranscript(envelope, responses)); err != nil {
+		logger.Get().Warningf("cannot store the transcript of %s, %s", envelope.Payload.From, err)
+	}
+}
@@ -2,43 +2,50 @@
 package engine
 
 import (
-	"bytes"
-	"crypto/rsa"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"regexp"
 	"strings"
-	"sync"
 	"time"
 
-	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/garyburd/redigo/redis"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 
 	"github.com/pgillich/chat-bot/api"
 	"github.com/pgillich/chat-bot/config"
 	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
 	"github.com/pgillich/chat-bot/internal/logger"
 	"github.com/pgillich/chat-bot/internal/queue"
 )
 
-// SimpleClaim is a simple JWT claim
-type SimpleClaim struct {
-	*jwt.StandardClaims
-	TokenType string
-}
+// JWKSPath is the path of the public keys, which verify the tokens of the engine
+const JWKSPath = "/.well-known/jwks.json"
 
 // App is the service, called by automatic test, too
+// locker is optional (nil disables the user lock)
+// If transcripts is set, the requests and the responses are stored in the transcript of the user.
 func App(idleConnsClosed chan struct{},
-	subscriber queue.RedisSubscriber, dbHandler db.DbHandler,
-	httpClient *http.Client, rsaKeyPath string, clientEndpoint string,
-	logLevel string,
+	subscriber queue.RedisSubscriber, dbHandler db.DbHandler, locker queue.Locker,
+	httpClient *http.Client, signingKeys *jwks.SigningKeys, tokenOptions TokenOptions,
+	router *CallbackRouter, callbackPolicy CallbackPolicy, outboxPolicy OutboxPolicy,
+	messageTimeout time.Duration, transcripts bool, retention RetentionPolicy, logLevel string,
 ) *http.ServeMux {
 	logger.Init(logLevel)
 
+	if err := signingKeys.Load(); err != nil {
+		logger.Get().Panic("cannot load signing keys, ", err)
+	}
+	go func() {
+		if err := signingKeys.Watch(idleConnsClosed); err != nil {
+			logger.Get().Warning("cannot watch signing keys, ", err)
+		}
+	}()
+
 	if err := subscriber.Connect(); err != nil {
 		logger.Get().Panic("cannot connect to Redis", err)
 	}
@@ -47,197 +54,265 @@ func App(idleConnsClosed chan struct{},
 		logger.Get().Panic("cannot connect to DB", err)
 	}
 
-	go Worker(idleConnsClosed, subscriber, dbHandler, httpClient, rsaKeyPath, clientEndpoint)
+	if locker != nil {
+		if err := locker.Connect(context.Background()); err != nil {
+			logger.Get().Panic("cannot connect to user locker", err)
+		}
+	}
+
+	var transcriptStore db.TranscriptStore
+	if transcripts {
+		transcriptStore = dbHandler
+	}
+
+	go Worker(idleConnsClosed, subscriber, dbHandler, locker, messageTimeout, transcriptStore)
+	go RelayOutbox(idleConnsClosed, dbHandler, dbHandler, httpClient, signingKeys, tokenOptions,
+		router, callbackPolicy, outboxPolicy)
+	go RetentionJob(idleConnsClosed, dbHandler, retention)
 
 	serverMux := http.NewServeMux()
 
 	serverMux.Handle("/metrics", promhttp.Handler())
+	serverMux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		ReadyHandler(w, r, subscriber)
+	})
+	serverMux.HandleFunc(JWKSPath, func(w http.ResponseWriter, r *http.Request) {
+		JWKSHandler(w, r, signingKeys)
+	})
 
 	return serverMux
 }
 
-// Worker is the main func of the engine
-func Worker(idleConnsClosed chan struct{}, subscriber queue.RedisSubscriber,
-	dbHandler db.DbHandler, httpClient *http.Client,
-	rsaKeyPath string, clientEndpoint string,
-) {
-	defer subscriber.Close()
-
-	signBytes, err := ioutil.ReadFile(rsaKeyPath) // nolint:gosec
-	if err != nil {
-		logger.Get().Panic("cannot open private key, ", err)
-	}
+// ReadyHandler is the readiness probe
+// The engine is ready, if the subscriber is connected to the request channel
+// nolint:interfacer
+func ReadyHandler(w http.ResponseWriter, r *http.Request, subscriber queue.RedisSubscriber) {
+	if !subscriber.Connected() {
+		w.WriteHeader(http.StatusServiceUnavailable)
 
-	signKey, err := jwt.ParseRSAPrivateKeyFromPEM(signBytes)
-	if err != nil {
-		logger.Get().Panic("cannot parse private key, ", err)
+		return
 	}
 
-	token := makeAutorefreshToken(signKey)
-
-	for {
-		select {
-		case <-idleConnsClosed:
-			return
-		default:
-			switch msg := subscriber.Receive().(type) {
-			case redis.Message:
-				sendResponses(httpClient, clientEndpoint, token.GetToken(), makeResponses(dbHandler, msg))
-			case redis.Subscription:
-				// We don't need to listen to subscription messages,
-			case error:
-				if strings.Contains(msg.Error(), "use of closed network connection") {
-					logger.Get().Info("Closing connection, no more messages")
-					return
-				}
-
-				logger.Get().Warningf("cannot receive from request channel, %s", msg)
-			}
-		}
-	}
-}
-
-// AutorefreshToken provides token, refreshed regularly
-type AutorefreshToken struct {
-	signKey *rsa.PrivateKey
-	token   string
-
-	mx *sync.Mutex
+	w.WriteHeader(http.StatusOK)
 }
 
-func makeAutorefreshToken(signKey *rsa.PrivateKey) *AutorefreshToken {
-	token, err := createToken(signKey)
+// JWKSHandler publishes the public keys of the JWT signing keys
+// The clients verify the token by the key, selected by the kid header. The key set may be cached
+// for the MaxAge of signingKeys, a new key signs only after it.
+func JWKSHandler(w http.ResponseWriter, r *http.Request, signingKeys *jwks.SigningKeys) {
+	keySet, err := signingKeys.JSONWebKeySet()
 	if err != nil {
-		logger.Get().Panic("cannot make token, ", err)
-	}
+		logger.Get().Warning("cannot make JWKS, ", err)
+		w.WriteHeader(http.StatusInternalServerError)
 
-	autoToken := &AutorefreshToken{
-		signKey: signKey,
-		token:   token,
-		mx:      &sync.Mutex{},
+		return
 	}
 
-	logger.Get().Debugf("New JWT token: %s", token)
-
-	go func() {
-		ticker := time.Tick(config.TokenRefreshDuration) // nolint:staticcheck
-		for range ticker {
-			autoToken.mx.Lock()
-
-			var err error
-			autoToken.token, err = createToken(signKey)
-			if err != nil {
-				logger.Get().Panic("cannot make token, ", err)
-			}
-			logger.Get().Debugf("New JWT token: %s", token)
-
-			autoToken.mx.Unlock()
-		}
-	}()
-
-	return autoToken
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(signingKeys.MaxAge.Seconds())))
+	json.NewEncoder(w).Encode(keySet) // nolint:errcheck,gosec
 }
 
-// GetToken returns a JWT token
-// token is refreshed regularly
-func (autoToken *AutorefreshToken) GetToken() string {
-	autoToken.mx.Lock()
-	defer autoToken.mx.Unlock()
-
-	return autoToken.token
+// ResponseStore is the DB of Worker, it reads and updates the users, and stores the responses in the outbox
+type ResponseStore interface {
+	db.UserStore
+	db.OutboxStore
 }
 
-func createToken(signKey *rsa.PrivateKey) (string, error) {
-	t := jwt.New(jwt.GetSigningMethod("RS256"))
-
-	t.Claims = &SimpleClaim{
-		&jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(config.TokenExpirationDuration).Unix(),
-			Subject:   "chat-bot",
-		},
-		"level1",
+// Worker is the main func of the engine
+// The responses are stored in the outbox, together with the user update, and sent by RelayOutbox.
+// If locker is not nil, the messages of a user are processed by one engine at a time.
+// Closing idleConnsClosed cancels the waiting for messages and the in-flight processing
+// Each message must be processed within messageTimeout
+// If transcripts is not nil, the processed requests and their responses are stored in the transcript of the user.
+func Worker(idleConnsClosed chan struct{}, subscriber queue.RedisSubscriber, dbHandler ResponseStore,
+	locker queue.Locker, messageTimeout time.Duration, transcripts db.TranscriptStore,
+) {
+	defer subscriber.Close()
+	if locker != nil {
+		defer locker.Close()
 	}
 
-	return t.SignedString(signKey)
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-func sendResponses(httpClient *http.Client, clientEndpoint string, token string,
-	messages []api.ResponseWithDelay,
-) {
 	go func() {
-		for _, messageWithDelay := range messages {
-			time.Sleep(messageWithDelay.Delay)
-			logger.Get().Infof("SEND %s", messageWithDelay)
-
-			reqBody, _ := json.Marshal(messageWithDelay.Response) // nolint:errcheck
+		select {
+		case <-idleConnsClosed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-			req, err := http.NewRequest("POST", clientEndpoint, bytes.NewReader(reqBody))
-			if err != nil {
-				logger.Get().Warning("cannot create POST to client", err)
+	for {
+		switch msg := subscriber.ReceiveContext(ctx).(type) {
+		case redis.Message:
+			msgCtx, msgCancel := context.WithTimeout(ctx, messageTimeout)
+			envelope, responses := makeResponses(msgCtx, dbHandler, locker, msg)
+			if transcripts != nil && len(responses) > 0 {
+				appendTranscript(msgCtx, transcripts, &envelope, responses)
+			}
+			msgCancel()
+		case redis.Subscription:
+			// We don't need to listen to subscription messages,
+		case error:
+			if ctx.Err() != nil {
+				logger.Get().Info("Closing, no more messages")
 				return
 			}
-			req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
 
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				logger.Get().Warning("cannot send POST to client", err)
+			if msg == queue.ErrClosed || strings.Contains(msg.Error(), "use of closed network connection") {
+				logger.Get().Info("Closing connection, no more messages")
 				return
 			}
-			if resp.Body != nil {
-				defer resp.Body.Close() // nolint:errcheck
-			}
+
+			logger.Get().Warningf("cannot receive from request channel, %s", msg)
 		}
-	}()
+	}
 }
 
-func makeResponses(dbHandler db.DbHandler, request redis.Message) []api.ResponseWithDelay {
-	var requestMessage api.RequestMessage
-	if err := json.Unmarshal(request.Data, &requestMessage); err != nil {
-		return []api.ResponseWithDelay{
-			newResponseWithDelay(requestMessage.From, "invalid request format", config.DefaultDelay),
-		}
+// makeResponses processes the api.Envelope (or an earlier version) of the request
+// The responses are stored in the outbox, the envelope is returned, too.
+func makeResponses(ctx context.Context, dbHandler ResponseStore, locker queue.Locker, request redis.Message,
+) (api.Envelope, []api.ResponseWithDelay) {
+	envelope, err := api.ParseEnvelope(request.Data)
+	if err != nil {
+		logger.Get().Warning("cannot parse message, ", err)
+
+		return envelope, storeResponses(ctx, dbHandler, &envelope, []api.ResponseWithDelay{
+			newResponseWithDelay(envelope.Payload.From, "invalid request format", config.DefaultDelay),
+		})
 	}
 
-	logger.Get().Info("RECEIVED", requestMessage)
+	return envelope, makeEnvelopeResponses(ctx, dbHandler, locker, &envelope)
+}
+
+// makeEnvelopeResponses processes the request of the envelope
+// The user update and the responses are stored in one transaction, so a crash cannot lose the responses
+// of a committed state change (or send the responses of a rolled back one).
+// If locker is not nil, the user is locked from reading until storing it, the update is fenced by the lock.
+func makeEnvelopeResponses(ctx context.Context, dbHandler ResponseStore, locker queue.Locker, envelope *api.Envelope,
+) []api.ResponseWithDelay {
+	requestMessage := envelope.Payload
+
+	logger.Get().WithFields(log.Fields{
+		"ID": envelope.ID, "VERSION": envelope.Version, "ATTEMPT": envelope.Attempt,
+		"CLIENT": envelope.Client, "TRACEPARENT": envelope.TraceParent,
+	}).Info("RECEIVED", requestMessage)
+
+	// The frontend binds From to the verified user, a mismatch is not trusted
+	if envelope.Identity != nil && envelope.Identity.Subject != requestMessage.From {
+		logger.Get().Warningf("identity %s does not match %s", envelope.Identity.Subject, requestMessage.From)
+
+		return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+			newResponseWithDelay(requestMessage.From, "unverified user", config.DefaultDelay),
+		})
+	}
 
 	if len(requestMessage.From) == 0 {
-		return []api.ResponseWithDelay{
+		return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
 			newResponseWithDelay(requestMessage.From, "empty user name", config.DefaultDelay),
-		}
+		})
 	}
 
 	id := requestMessage.From
 	if len(id) == 0 {
-		return []api.ResponseWithDelay{
+		return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
 			newResponseWithDelay(requestMessage.From, "missing user ID", config.DefaultDelay),
-		}
+		})
 	}
 
-	user, err := dbHandler.GetOrCreateUser(id)
-	if err != nil {
-		return []api.ResponseWithDelay{
-			newResponseWithDelay(requestMessage.From, "cannot create user, "+err.Error(), config.DefaultDelay),
+	requestText := strings.TrimSpace(requestMessage.Text)
+	requestKey := envelope.RequestKey()
+
+	lease := queue.Lease{}
+	if locker != nil {
+		lockCtx, lockCancel := lockContext(ctx)
+		var err error
+		lease, err = lockUser(lockCtx, locker, id)
+		lockCancel()
+		switch {
+		case err != nil && ctx.Err() == context.Canceled:
+			// shutdown, like the messages, which are not received yet
+			logger.Get().Warningf("cannot lock user %s, closing, %s", id, err)
+
+			return []api.ResponseWithDelay{}
+		case err != nil:
+			// the concurrent updates are still detected by the DB
+			logger.Get().Warningf("cannot lock user %s, processing without lock, %s", id, err)
+		default:
+			defer unlockUser(locker, lease)
 		}
 	}
 
-	var responses []api.ResponseWithDelay
+	// The user is reloaded and the message is reprocessed, if the user was updated concurrently
+	for attempt := 1; ; attempt++ {
+		user, err := dbHandler.GetOrCreateUserContext(ctx, id)
+		if err != nil {
+			return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+				newResponseWithDelay(requestMessage.From, "cannot create user, "+err.Error(), config.DefaultDelay),
+			})
+		}
 
-	requestText := strings.TrimSpace(requestMessage.Text)
-	if requestText == "" {
-		return []api.ResponseWithDelay{
-			newResponseWithDelay(requestMessage.From, "Well...", config.DefaultDelay),
+		if requestText == "" {
+			return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+				newResponseWithDelay(requestMessage.From, "Well...", config.DefaultDelay),
+			})
+		}
+
+		// The state was updated by this request (maybe by other engine), the responses were stored
+		if requestKey != "" {
+			processed := user.LastRequestKey == requestKey
+			if !processed {
+				if processed, err = dbHandler.IsRequestProcessedContext(ctx, id, requestKey); err != nil {
+					return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+						newResponseWithDelay(requestMessage.From, "cannot check request, "+err.Error(), config.DefaultDelay),
+					})
+				}
+			}
+			if processed {
+				logger.Get().Infof("duplicate request %s of %s", requestKey, id)
+
+				return []api.ResponseWithDelay{}
+			}
 		}
-	}
 
-	user, responses = makeStatefulResponses(user, requestText)
+		if lease.Token > 0 {
+			if user.FenceToken > lease.Token {
+				logger.Get().Warningf("lock of %s expired, the user was updated by an other engine", id)
 
-	if err := dbHandler.Update(user); err != nil {
-		return []api.ResponseWithDelay{
-			newResponseWithDelay(requestMessage.From, "cannot update user, "+err.Error(), config.DefaultDelay),
+				return []api.ResponseWithDelay{}
+			}
+			user.FenceToken = lease.Token
 		}
-	}
 
-	return responses
+		var responses []api.ResponseWithDelay
+
+		user, responses = makeStatefulResponses(user, requestText)
+		user.LastRequestKey = requestKey
+
+		outbox, err := newOutboxMessages(envelope, responses, time.Now())
+		if err != nil {
+			logger.Get().Warning("cannot make outbox messages, ", err)
+
+			return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+				newResponseWithDelay(requestMessage.From, "cannot make responses, "+err.Error(), config.DefaultDelay),
+			})
+		}
+
+		err = dbHandler.UpdateWithOutboxContext(ctx, &user, outbox)
+		if err == nil {
+			return responses
+		}
+
+		if !db.IsConflict(err) || attempt >= config.UpdateConflictAttempts {
+			return storeResponses(ctx, dbHandler, envelope, []api.ResponseWithDelay{
+				newResponseWithDelay(requestMessage.From, "cannot update user, "+err.Error(), config.DefaultDelay),
+			})
+		}
+
+		logger.Get().Infof("reprocessing, attempt #%d, %s", attempt, err)
+	}
 }
 
 func newResponseWithDelay(to string, text string, delay time.Duration) api.ResponseWithDelay {
@@ -287,7 +362,7 @@ func makeStatefulResponses(user db.User, text string) (db.User, []api.ResponseWi
 	loggerUser := logger.Get().WithField("USER", user.UID)
 
 	if reFirstHi.MatchString(text) || reFirstHello.MatchString(text) { // First question
-		user = db.User{Model: user.Model, UID: user.UID}
+		user = db.User{Model: user.Model, UID: user.UID, Version: user.Version, FenceToken: user.FenceToken}
 		responses = []api.ResponseWithDelay{
 			newResponseWithDelay(to, "Hi", config.DefaultDelay),
 			newResponseWithDelay(to, "What's your name?", config.DefaultDelay),
@@ -1,16 +1,34 @@
 package engine
 
 import (
+	"context"
+	"crypto/ed25519"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/config"
 	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
 	"github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
 	"github.com/pgillich/chat-bot/internal/test"
+	"github.com/pgillich/chat-bot/pkg/webhook"
 )
 
 func TestMain(m *testing.M) {
@@ -82,3 +100,378 @@ func TestLocationJaneDoe(t *testing.T) {
 	text := "Salakszentmotoros."
 	assert.Equal(t, "Salakszentmotoros", extractLocation(text))
 }
+
+// conflictingDbHandler updates the user concurrently, before the first UpdateWithOutboxContext
+type conflictingDbHandler struct {
+	*db.FakeDbHandler
+
+	conflicts int
+}
+
+func (dbHandler *conflictingDbHandler) UpdateWithOutboxContext(ctx context.Context, user *db.User,
+	messages []db.OutboxMessage,
+) error {
+	if dbHandler.conflicts == 0 {
+		dbHandler.conflicts++
+
+		concurrent, _ := dbHandler.GetOrCreateUser(user.UID) // nolint:errcheck
+		concurrent.Name = "Concurrent Doe"
+		if err := dbHandler.FakeDbHandler.Update(concurrent); err != nil {
+			return err
+		}
+	}
+
+	return dbHandler.FakeDbHandler.UpdateWithOutboxContext(ctx, user, messages)
+}
+
+func TestMakeResponsesConflict(t *testing.T) {
+	uid := "003"
+	dbHandler := &conflictingDbHandler{FakeDbHandler: &db.FakeDbHandler{}}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	requestBody, _ := json.Marshal(api.RequestMessage{From: uid, Text: "1976.04.24."}) // nolint:errcheck
+	_, responses := makeResponses(context.Background(), dbHandler, nil, redis.Message{Data: requestBody})
+
+	assert.Equal(t, 1, dbHandler.conflicts, "conflicts")
+	if assert.Equal(t, 1, len(responses), "Responses") {
+		// the concurrently stored name is taken into account, so the born date is expected
+		assert.Equal(t, "Where were you born?", responses[0].Response.Text, "Text")
+	}
+
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser") {
+		assert.Equal(t, "Concurrent Doe", user.Name, "Name")
+		assert.NotNil(t, user.BornOn, "BornOn")
+	}
+
+	// the responses of the conflicting update are not stored
+	now := time.Now().Add(time.Hour)
+	messages, err := dbHandler.ClaimOutboxContext(context.Background(), now, now.Add(time.Minute), 10)
+	if assert.NoError(t, err, "ClaimOutboxContext") && assert.Len(t, messages, 1, "outbox") {
+		assert.Equal(t, responses[0].Response.ID, messages[0].MessageID, "MessageID")
+		assert.Equal(t, "Where were you born?", messages[0].Text, "outbox Text")
+	}
+}
+
+func TestMakeResponsesTimeout(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	requestBody, _ := json.Marshal(api.RequestMessage{From: "004", Text: "Hello"}) // nolint:errcheck
+	_, responses := makeResponses(ctx, dbHandler, nil, redis.Message{Data: requestBody})
+
+	if assert.Equal(t, 1, len(responses), "Responses") {
+		assert.Contains(t, responses[0].Response.Text, context.Canceled.Error(), "Text")
+	}
+}
+
+func TestMakeResponsesIdentity(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	for from, expected := range map[string]string{"006": "Hi", "007": "unverified user"} {
+		requestBody, _ := json.Marshal(api.Envelope{ // nolint:errcheck
+			Version: api.EnvelopeVersion, ID: "id-" + from, Attempt: 1,
+			Identity: &api.Identity{Subject: "006", Method: "jwt"},
+			Payload:  api.RequestMessage{From: from, Text: "Hello"},
+		})
+		_, responses := makeResponses(context.Background(), dbHandler, nil, redis.Message{Data: requestBody})
+
+		if assert.NotEmpty(t, responses, "Responses of "+from) {
+			assert.Equal(t, expected, responses[0].Response.Text, "Text of "+from)
+		}
+	}
+}
+
+// TestMakeResponsesDuplicate checks, that a redelivered request does not advance the dialog again
+func TestMakeResponsesDuplicate(t *testing.T) {
+	uid := "013"
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	for n, expected := range []struct {
+		key       string
+		text      string
+		responses []string
+	}{
+		{"k1", "Hello", []string{"Hi", "What's your name?"}},
+		{"k2", "My name is Jane Doe", []string{"When were you born?"}},
+		{"k2", "My name is Jane Doe", []string{}},
+		{"k3", "1976.04.24.", []string{"Where were you born?"}},
+		// an earlier request is redelivered late
+		{"k1", "Hello", []string{}},
+	} {
+		requestBody, _ := json.Marshal(api.Envelope{ // nolint:errcheck
+			Version: api.EnvelopeVersion, ID: fmt.Sprintf("id-%d", n), Attempt: 1, IdempotencyKey: expected.key,
+			Payload: api.RequestMessage{From: uid, Text: expected.text},
+		})
+		_, responses := makeResponses(context.Background(), dbHandler, nil, redis.Message{Data: requestBody})
+
+		texts := []string{}
+		for _, response := range responses {
+			texts = append(texts, response.Response.Text)
+		}
+		assert.Equal(t, expected.responses, texts, fmt.Sprintf("Responses #%d", n))
+	}
+
+	user, err := dbHandler.GetOrCreateUser(uid)
+	if assert.NoError(t, err, "GetOrCreateUser") {
+		assert.Equal(t, "Jane Doe", user.Name, "Name")
+		assert.Equal(t, uint(3), user.Version, "Version")
+		assert.Equal(t, "k3", user.LastRequestKey, "LastRequestKey")
+	}
+}
+
+// TestMakeResponsesVersions checks the messages of the earlier frontends
+func TestMakeResponsesVersions(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if !assert.NoError(t, dbHandler.Connect(), "Connect") {
+		return
+	}
+	defer dbHandler.Close()
+
+	for name, expected := range map[string]struct {
+		message string
+		text    string
+	}{
+		"v0":          {`{"from":"008","text":"Hello"}`, "Hi"},
+		"v0 identity": {`{"from":"009","text":"Hello","identity":{"sub":"010","method":"jwt"}}`, "unverified user"},
+		"v1":          {`{"v":1,"id":"1","attempt":1,"payload":{"from":"011","text":"Hello"}}`, "Hi"},
+		"v2":          {`{"v":2,"id":"2","payload":{"from":"012","text":"Hello"}}`, "invalid request format"},
+		"invalid":     {`{`, "invalid request format"},
+	} {
+		_, responses := makeResponses(context.Background(), dbHandler, nil, redis.Message{Data: []byte(expected.message)})
+
+		if assert.NotEmpty(t, responses, "Responses of "+name) {
+			assert.Equal(t, expected.text, responses[0].Response.Text, "Text of "+name)
+		}
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	subscriber := &queue.FakeRedisSubscriber{Redis: &queue.FakeRedis{}}
+
+	ready := func() int {
+		recorder := httptest.NewRecorder()
+		ReadyHandler(recorder, httptest.NewRequest(http.MethodGet, "/ready", nil), subscriber)
+
+		return recorder.Code
+	}
+
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "before Connect")
+
+	if !assert.NoError(t, subscriber.Connect(), "Connect") {
+		return
+	}
+	assert.Equal(t, http.StatusOK, ready(), "connected")
+
+	subscriber.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, ready(), "after Close")
+}
+
+func TestJWKSHandler(t *testing.T) {
+	signingKeys := &jwks.SigningKeys{Path: "../../" + config.DefaultRsaKey, MaxAge: 5 * time.Minute}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+
+	recorder := httptest.NewRecorder()
+	JWKSHandler(recorder, httptest.NewRequest(http.MethodGet, JWKSPath, nil), signingKeys)
+	assert.Equal(t, http.StatusOK, recorder.Code, "status")
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "Content-Type")
+	assert.Equal(t, "public, max-age=300", recorder.Header().Get("Cache-Control"), "Cache-Control")
+
+	keySet, err := jwks.ParseKeySet(recorder.Body.Bytes())
+	if !assert.NoError(t, err, "ParseKeySet") {
+		return
+	}
+
+	tokenString := makeAutorefreshToken(signingKeys, TokenOptions{}).GetToken()
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string) // nolint:errcheck
+		assert.Equal(t, "chat_rsa", kid, "kid")
+
+		return keySet.Key(kid)
+	})
+	if assert.NoError(t, err, "Parse") {
+		assert.True(t, token.Valid, "Valid")
+	}
+}
+
+func TestTokenFor(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile, err := ioutil.TempFile("", "chat-bot-*.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name()) // nolint:errcheck
+	if err := pem.Encode(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		t.Fatal(err)
+	}
+	keyFile.Close() // nolint:errcheck,gosec
+
+	signingKeys := &jwks.SigningKeys{Path: keyFile.Name(), Algorithm: "EdDSA"}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+	options := TokenOptions{Issuer: "engine", Audience: "client", Lifetime: time.Minute, PerRequest: true}
+	token := makeAutorefreshToken(signingKeys, options)
+	body := []byte(`{"to":"001","text":"Hello"}`)
+
+	parse := func(tokenString string) *SimpleClaim {
+		claims := &SimpleClaim{}
+		_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			assert.Equal(t, "EdDSA", token.Method.Alg(), "alg")
+
+			return edKey.Public(), nil
+		})
+		assert.NoError(t, err, "ParseWithClaims")
+
+		return claims
+	}
+
+	first, err := token.TokenFor("001", body)
+	if !assert.NoError(t, err, "TokenFor") {
+		return
+	}
+	claims := parse(first)
+	bodyHash := sha256.Sum256(body)
+	assert.Equal(t, TokenTypeRequest, claims.TokenType, "TokenType")
+	assert.Equal(t, "001", claims.To, "to")
+	assert.Equal(t, base64.RawURLEncoding.EncodeToString(bodyHash[:]), claims.BodySHA256, "body_sha256")
+	assert.Equal(t, "engine", claims.Issuer, "iss")
+	assert.Equal(t, "client", claims.Audience, "aud")
+	assert.NotEmpty(t, claims.Id, "jti")
+	assert.InDelta(t, time.Now().Unix(), claims.IssuedAt, 5, "iat")
+	assert.Equal(t, claims.IssuedAt+60, claims.ExpiresAt, "exp")
+
+	second, err := token.TokenFor("001", body)
+	if assert.NoError(t, err, "TokenFor again") {
+		assert.NotEqual(t, claims.Id, parse(second).Id, "unique jti")
+	}
+
+	options.PerRequest = false
+	shared, err := makeAutorefreshToken(signingKeys, options).TokenFor("001", body)
+	if assert.NoError(t, err, "TokenFor shared") {
+		claims := parse(shared)
+		assert.Equal(t, TokenTypeShared, claims.TokenType, "shared TokenType")
+		assert.Empty(t, claims.To, "shared to")
+		assert.Empty(t, claims.BodySHA256, "shared body_sha256")
+	}
+}
+
+func TestCallbackRequest(t *testing.T) {
+	signingKeys := &jwks.SigningKeys{Path: "../../" + config.DefaultRsaKey}
+	if !assert.NoError(t, signingKeys.Load(), "Load") {
+		return
+	}
+	token := makeAutorefreshToken(signingKeys, TokenOptions{})
+	response := api.ResponseMessage{To: "001", Text: "Hello"}
+	ctx := context.Background()
+
+	endpoint := &ClientEndpoint{URL: "http://client/chat", Auth: CallbackAuthHMAC, Secret: []byte("secret")}
+	req, err := newCallbackRequest(ctx, endpoint, token, response)
+	if assert.NoError(t, err, "HMAC request") {
+		assert.Empty(t, req.Header.Get("Authorization"), "HMAC Authorization")
+		_, err = (&webhook.Verifier{Secret: endpoint.Secret}).VerifyRequest(req)
+		assert.NoError(t, err, "HMAC VerifyRequest")
+	}
+
+	endpoint = &ClientEndpoint{URL: "http://client/chat", Auth: CallbackAuthJWT}
+	req, err = newCallbackRequest(ctx, endpoint, token, response)
+	if assert.NoError(t, err, "JWT request") {
+		assert.Empty(t, req.Header.Get(webhook.SignatureHeader), "JWT signature")
+		assert.Equal(t, "Bearer "+token.GetToken(), req.Header.Get("Authorization"), "JWT Authorization")
+	}
+
+	for _, auth := range []string{CallbackAuthJWT, CallbackAuthHMAC} {
+		_, err := ParseCallbackAuth(auth)
+		assert.NoError(t, err, "ParseCallbackAuth "+auth)
+	}
+	_, err = ParseCallbackAuth("basic")
+	assert.Error(t, err, "ParseCallbackAuth basic")
+}
+
+func TestCallbackRouter(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := dbHandler.SetCallbackRouteContext(ctx, db.CallbackRoute{
+		Client: "acme", URL: "http://acme/chat", Auth: CallbackAuthHMAC, Secret: "secret",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	defaultEndpoint := &ClientEndpoint{URL: "http://default/chat", Auth: CallbackAuthJWT}
+	cachingRouter := &CallbackRouter{Routes: dbHandler, Default: defaultEndpoint, CacheTTL: time.Minute}
+	router := &CallbackRouter{Routes: dbHandler, Default: defaultEndpoint}
+
+	for _, router := range []*CallbackRouter{cachingRouter, router} {
+		endpoint, err := router.Endpoint(ctx, "acme")
+		if assert.NoError(t, err, "Endpoint acme") {
+			assert.Equal(t, &ClientEndpoint{URL: "http://acme/chat", Auth: CallbackAuthHMAC, Secret: []byte("secret")},
+				endpoint, "acme")
+		}
+
+		for _, client := range []string{"", "unknown"} {
+			endpoint, err := router.Endpoint(ctx, client)
+			if assert.NoError(t, err, "Endpoint "+client) {
+				assert.Equal(t, defaultEndpoint, endpoint, "default of "+client)
+			}
+		}
+	}
+
+	if err := dbHandler.DeleteCallbackRouteContext(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := cachingRouter.Endpoint(ctx, "acme")
+	if assert.NoError(t, err, "Endpoint cached") {
+		assert.Equal(t, "http://acme/chat", endpoint.URL, "cached")
+	}
+	endpoint, err = router.Endpoint(ctx, "acme")
+	if assert.NoError(t, err, "Endpoint deleted") {
+		assert.Equal(t, defaultEndpoint, endpoint, "deleted")
+	}
+
+	dbHandler.Close()
+	_, err = router.Endpoint(ctx, "acme")
+	assert.Error(t, err, "Endpoint of closed DB")
+
+	for name, expected := range map[string]struct {
+		endpoint ClientEndpoint
+		valid    bool
+	}{
+		"jwt":            {ClientEndpoint{URL: "http://acme/chat", Auth: CallbackAuthJWT}, true},
+		"hmac":           {ClientEndpoint{URL: "http://acme/chat", Auth: CallbackAuthHMAC, Secret: []byte("s")}, true},
+		"missing URL":    {ClientEndpoint{Auth: CallbackAuthJWT}, false},
+		"invalid auth":   {ClientEndpoint{URL: "http://acme/chat", Auth: "basic"}, false},
+		"missing secret": {ClientEndpoint{URL: "http://acme/chat", Auth: CallbackAuthHMAC}, false},
+	} {
+		err := expected.endpoint.Validate()
+		assert.Equal(t, expected.valid, err == nil, "Validate "+name)
+	}
+}
@@ -0,0 +1,145 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/apikey"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+const (
+	// DeliveryPath is the path prefix of the delivery status API:
+	// GET <DeliveryPath><message ID> returns the api.DeliveryStatus of the response,
+	// POST <DeliveryPath><message ID>/ack acknowledges it
+	DeliveryPath = "/deliveries/"
+
+	ackSuffix = "/ack"
+)
+
+// NewDeliveryStatus returns the API view of the delivery
+func NewDeliveryStatus(delivery *db.Delivery) api.DeliveryStatus {
+	return api.DeliveryStatus{
+		ID:        delivery.MessageID,
+		RequestID: delivery.RequestID,
+		To:        delivery.Recipient,
+		Status:    delivery.Status,
+		Attempts:  delivery.Attempts,
+		Error:     delivery.LastError,
+		CreatedAt: delivery.CreatedAt.UTC(),
+		SentAt:    delivery.SentAt,
+		AckedAt:   delivery.AckedAt,
+	}
+}
+
+// DeliveryHandler is the handler of the delivery status API
+// The caller must be authenticated by authenticator or userJWT (if both are nil, every request is answered
+// by 401). The API key must be allowed to speak for the recipient (To) of the response, and the subject
+// of the user JWT must be the recipient, else 403 is answered. The response must be of the client
+// of the API key (without API key, of a request without client), else it is not found (404).
+// Acknowledging a response again is not an error.
+// nolint:interfacer
+func DeliveryHandler(w http.ResponseWriter, r *http.Request,
+	deliveries db.DeliveryStore, requestTimeout time.Duration, authenticator *apikey.Authenticator, userJWT *UserJWT,
+) {
+	messageID := strings.TrimPrefix(r.URL.Path, DeliveryPath)
+	ack := strings.HasSuffix(messageID, ackSuffix)
+	messageID = strings.TrimSuffix(messageID, ackSuffix)
+
+	if messageID == "" || strings.Contains(messageID, "/") {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	if (ack && r.Method != http.MethodPost) || (!ack && r.Method != http.MethodGet) {
+		logger.Get().Warningf("%s method received on delivery API", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if authenticator == nil && userJWT == nil {
+		logger.Get().Warning("delivery API without authentication")
+		rejectedRequests.WithLabelValues("unauthorized").Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	delivery, err := deliveries.GetDeliveryContext(ctx, messageID)
+	if err == db.ErrDeliveryNotFound {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	} else if err != nil {
+		logger.Get().Warning("cannot get delivery, ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	if !authorizeDelivery(ctx, w, r, authenticator, userJWT, &delivery) {
+		return
+	}
+
+	if ack {
+		delivery, err = deliveries.UpdateDeliveryContext(ctx, messageID, db.DeliveryEvent{
+			Status: db.DeliveryAcked, At: time.Now(),
+		})
+		if err != nil {
+			logger.Get().Warning("cannot acknowledge delivery, ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+		logger.Get().Infof("ACK %s", messageID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(NewDeliveryStatus(&delivery)) // nolint:errcheck,gosec
+}
+
+// authorizeDelivery checks the caller of the delivery API, the response is written, if it's not allowed
+func authorizeDelivery(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	authenticator *apikey.Authenticator, userJWT *UserJWT, delivery *db.Delivery,
+) bool {
+	if userJWT != nil {
+		recipient := api.RequestMessage{From: delivery.Recipient}
+		if _, allowed := verifyUser(ctx, w, r, userJWT, &recipient); !allowed {
+			return false
+		}
+		if recipient.From != delivery.Recipient {
+			logger.Get().Warningf("user JWT subject %s is not the recipient of %s", recipient.From, delivery.MessageID)
+			rejectedRequests.WithLabelValues("forbidden").Inc()
+			w.WriteHeader(http.StatusForbidden)
+
+			return false
+		}
+	}
+
+	client := ""
+	if authenticator != nil {
+		var allowed bool
+		if client, allowed = authenticate(ctx, w, r, authenticator, delivery.Recipient); !allowed {
+			return false
+		}
+	}
+
+	if client != delivery.Client {
+		logger.Get().Warningf("delivery %s is not of client %s", delivery.MessageID, client)
+		w.WriteHeader(http.StatusNotFound)
+
+		return false
+	}
+
+	return true
+}
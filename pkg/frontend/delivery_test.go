@@ -0,0 +1,148 @@
+package frontend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/apikey"
+	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/test"
+)
+
+func TestDeliveryAPI(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	ctx := context.Background()
+	err := dbHandler.UpdateWithOutboxContext(ctx, nil, []db.OutboxMessage{
+		{MessageID: "m1", RequestID: "r1", Client: "acme", Recipient: "acme-001", SendAt: time.Now()},
+		{MessageID: "m2", RequestID: "r2", Client: "other", Recipient: "acme-001", SendAt: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := &apikey.Authenticator{Keys: dbHandler}
+	acmeKey, _, err := apikey.Create(ctx, dbHandler, "acme", "acme-*", apikey.ScopeChat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUserKey, _, err := apikey.Create(ctx, dbHandler, "acme", "acme-002", apikey.ScopeChat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n, expected := range []struct {
+		method string
+		path   string
+		key    string
+		status int
+		state  string
+	}{
+		{http.MethodGet, DeliveryPath + "m1", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, DeliveryPath + "m1", otherUserKey, http.StatusForbidden, ""},
+		{http.MethodGet, DeliveryPath + "m2", acmeKey, http.StatusNotFound, ""},
+		{http.MethodGet, DeliveryPath + "unknown", acmeKey, http.StatusNotFound, ""},
+		{http.MethodGet, DeliveryPath, acmeKey, http.StatusNotFound, ""},
+		{http.MethodPost, DeliveryPath + "m1", acmeKey, http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, DeliveryPath + "m1/ack", acmeKey, http.StatusMethodNotAllowed, ""},
+		{http.MethodGet, DeliveryPath + "m1", acmeKey, http.StatusOK, db.DeliveryQueued},
+		{http.MethodPost, DeliveryPath + "m1/ack", acmeKey, http.StatusOK, db.DeliveryAcked},
+		{http.MethodPost, DeliveryPath + "m1/ack", acmeKey, http.StatusOK, db.DeliveryAcked},
+		{http.MethodGet, DeliveryPath + "m1", acmeKey, http.StatusOK, db.DeliveryAcked},
+	} {
+		request := httptest.NewRequest(expected.method, expected.path, nil)
+		if expected.key != "" {
+			request.Header.Set(APIKeyHeader, expected.key)
+		}
+
+		recorder := httptest.NewRecorder()
+		DeliveryHandler(recorder, request, dbHandler, test.GetRequestTimeout(), authenticator, nil)
+
+		if !assert.Equal(t, expected.status, recorder.Code, fmt.Sprintf("Status #%d", n)) ||
+			expected.status != http.StatusOK {
+			continue
+		}
+
+		status := api.DeliveryStatus{}
+		if assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status), fmt.Sprintf("Body #%d", n)) {
+			assert.Equal(t, "m1", status.ID, fmt.Sprintf("ID #%d", n))
+			assert.Equal(t, "r1", status.RequestID, fmt.Sprintf("RequestID #%d", n))
+			assert.Equal(t, "acme-001", status.To, fmt.Sprintf("To #%d", n))
+			assert.Equal(t, expected.state, status.Status, fmt.Sprintf("Status #%d", n))
+			assert.Equal(t, expected.state == db.DeliveryAcked, status.AckedAt != nil, fmt.Sprintf("AckedAt #%d", n))
+		}
+	}
+
+	// without authentication, no delivery can be read
+	request := httptest.NewRequest(http.MethodGet, DeliveryPath+"m1", nil)
+	recorder := httptest.NewRecorder()
+	DeliveryHandler(recorder, request, dbHandler, test.GetRequestTimeout(), nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code, "Status without authentication")
+}
+
+func TestDeliveryAPIUserJWT(t *testing.T) {
+	dbHandler := &db.FakeDbHandler{}
+	if err := dbHandler.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer dbHandler.Close()
+
+	err := dbHandler.UpdateWithOutboxContext(context.Background(), nil, []db.OutboxMessage{
+		{MessageID: "m1", RequestID: "r1", Recipient: "001", SendAt: time.Now()},
+		{MessageID: "m2", RequestID: "r2", Client: "acme", Recipient: "001", SendAt: time.Now()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "chat-bot-jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	verifier, sign := makeUserJWT(t, dir)
+
+	for n, expected := range []struct {
+		mode    string
+		path    string
+		subject string
+		status  int
+	}{
+		{UserJWTModeFill, DeliveryPath + "m1", "", http.StatusUnauthorized},
+		{UserJWTModeFill, DeliveryPath + "m1", "002", http.StatusForbidden},
+		{UserJWTModeMatch, DeliveryPath + "m1", "002", http.StatusForbidden},
+		{UserJWTModeFill, DeliveryPath + "m2", "001", http.StatusNotFound},
+		{UserJWTModeFill, DeliveryPath + "m1", "001", http.StatusOK},
+		{UserJWTModeMatch, DeliveryPath + "m1/ack", "001", http.StatusOK},
+	} {
+		method := http.MethodGet
+		if strings.HasSuffix(expected.path, ackSuffix) {
+			method = http.MethodPost
+		}
+		request := httptest.NewRequest(method, expected.path, nil)
+		if expected.subject != "" {
+			request.Header.Set("Authorization", "Bearer "+sign(expected.subject))
+		}
+
+		recorder := httptest.NewRecorder()
+		DeliveryHandler(recorder, request, dbHandler, test.GetRequestTimeout(), nil,
+			&UserJWT{Verifier: verifier, Mode: expected.mode})
+		assert.Equal(t, expected.status, recorder.Code, fmt.Sprintf("Status #%d", n))
+	}
+}
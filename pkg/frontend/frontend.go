@@ -2,19 +2,70 @@
 package frontend
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/apikey"
+	"github.com/pgillich/chat-bot/internal/db"
 	"github.com/pgillich/chat-bot/internal/logger"
 	"github.com/pgillich/chat-bot/internal/queue"
 )
 
+const (
+	// APIKeyHeader is the HTTP header of the API key
+	APIKeyHeader = "X-API-Key"
+	// IdempotencyKeyHeader is the HTTP header of the idempotency key, RequestMessage.ID is used, if it's missing
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// ReplayedHeader is set in the response of a duplicated request
+	ReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+)
+
+// nolint:gochecknoglobals
+var rejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "chat_bot",
+	Subsystem: "frontend",
+	Name:      "rejected_requests_total",
+	Help:      "Number of requests, rejected by authentication, rate limits, backpressure (queue_full, no_consumer) or timeout",
+}, []string{"reason"})
+
+// nolint:gochecknoglobals
+var duplicateRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "chat_bot",
+	Subsystem: "frontend",
+	Name:      "duplicate_requests_total",
+	Help:      "Number of requests with already published idempotency key, which were not published again",
+})
+
+func init() { // nolint:gochecknoinits
+	prometheus.MustRegister(rejectedRequests, duplicateRequests)
+}
+
 // App is the service, called by automatic test, too
+// retryAfter is sent to the client, if the request is rejected by backpressure
+// rateLimits, authenticator, userJWT, deduplicator and deliveries are optional (nil)
+// The delivery status API (DeliveryPath) is served, if deliveries is not nil.
 func App(idleConnsClosed chan struct{},
 	publisher queue.RedisPublisher,
 	chatPath string,
+	requestTimeout time.Duration,
+	retryAfter time.Duration,
+	rateLimits *RateLimits,
+	authenticator *apikey.Authenticator,
+	userJWT *UserJWT,
+	deduplicator queue.Deduplicator,
+	deliveries db.DeliveryStore,
 	logLevel string,
 ) *http.ServeMux {
 	logger.Init(logLevel)
@@ -23,20 +74,59 @@ func App(idleConnsClosed chan struct{},
 		logger.Get().Panic("cannot connect to Redis", err)
 	}
 
+	if rateLimits != nil {
+		if err := rateLimits.Limiter.Connect(context.Background()); err != nil {
+			logger.Get().Panic("cannot connect to rate limiter", err)
+		}
+	}
+
+	if userJWT != nil {
+		if err := userJWT.Verifier.Keys.Load(context.Background()); err != nil {
+			logger.Get().Warning("cannot load JWKS, ", err)
+		}
+	}
+
+	if deduplicator != nil {
+		if err := deduplicator.Connect(context.Background()); err != nil {
+			logger.Get().Panic("cannot connect to deduplicator", err)
+		}
+	}
+
+	if deliveries != nil && authenticator == nil && userJWT == nil {
+		logger.Get().Panic("the delivery API requires API keys or user JWT")
+	}
+
 	serverMux := http.NewServeMux()
 
 	serverMux.Handle("/metrics", promhttp.Handler())
 	serverMux.HandleFunc(chatPath, func(w http.ResponseWriter, r *http.Request) {
-		Handler(w, r, publisher)
+		Handler(w, r, publisher, requestTimeout, retryAfter, rateLimits, authenticator, userJWT, deduplicator)
 	})
+	if deliveries != nil {
+		serverMux.HandleFunc(DeliveryPath, func(w http.ResponseWriter, r *http.Request) {
+			DeliveryHandler(w, r, deliveries, requestTimeout, authenticator, userJWT)
+		})
+	}
 
 	return serverMux
 }
 
 // Handler is the handler of chat bot service
+// The deadline of publishing is derived from the request
+// A full queue is answered by 429, a missing engine by 503, both with Retry-After
+// Exceeding the rate limits (if rateLimits is not nil) is answered by 429
+// If authenticator is not nil, a missing or invalid API key is answered by 401,
+// a key without chat scope or speaking for an other user (From) by 403
+// If userJWT is not nil, a missing or invalid bearer token is answered by 401,
+// From is filled by the subject of the token or a mismatch is answered by 403
+// The message is published in an api.Envelope, with the verified identity
+// If deduplicator is not nil, a request with an already published idempotency key of the user
+// is answered by 200 with Idempotent-Replayed header, without publishing
 // nolint:interfacer
 func Handler(w http.ResponseWriter, r *http.Request,
-	publisher queue.RedisPublisher,
+	publisher queue.RedisPublisher, requestTimeout time.Duration, retryAfter time.Duration,
+	rateLimits *RateLimits, authenticator *apikey.Authenticator, userJWT *UserJWT,
+	deduplicator queue.Deduplicator,
 ) {
 	if r.Body == nil {
 		logger.Get().Warning("empty body received")
@@ -55,6 +145,8 @@ func Handler(w http.ResponseWriter, r *http.Request,
 		return
 	}
 
+	receivedAt := time.Now()
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		logger.Get().Warning("bad body received", err)
@@ -68,11 +160,211 @@ func Handler(w http.ResponseWriter, r *http.Request,
 	logger.Get().Tracef("REQ: %+v\nHEAD: %+v", r, r.Header)
 	logger.Get().Debugf("BODY: %s", string(body))
 
-	if err := publisher.Request(body); err != nil {
-		logger.Get().Warning("cannot publish", err)
-		// TODO error message to user
-		w.WriteHeader(http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+
+	requestMessage := api.RequestMessage{}
+	if err := json.Unmarshal(body, &requestMessage); err != nil {
+		logger.Get().Warning("bad request message received", err)
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	idempotencyKey := getIdempotencyKey(r, requestMessage)
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		logger.Get().Warning("too long idempotency key received")
+		w.WriteHeader(http.StatusBadRequest)
 
 		return
 	}
+
+	var identity *api.Identity
+	if userJWT != nil {
+		var allowed bool
+		if identity, allowed = verifyUser(ctx, w, r, userJWT, &requestMessage); !allowed {
+			return
+		}
+	}
+
+	client := ""
+	if authenticator != nil {
+		var allowed bool
+		if client, allowed = authenticate(ctx, w, r, authenticator, requestMessage.From); !allowed {
+			return
+		}
+	}
+
+	if rateLimits != nil {
+		if reason := rateLimits.Check(ctx, w, r, client, identity, requestMessage.From); reason != "" {
+			logger.Get().Warningf("rate limit exceeded, %s", reason)
+			rejectedRequests.WithLabelValues(reason).Inc()
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+	}
+
+	dedupKey, duplicate := claimRequest(ctx, deduplicator, requestMessage.From, idempotencyKey)
+	if duplicate {
+		w.Header().Set(ReplayedHeader, "true")
+		w.WriteHeader(http.StatusOK)
+
+		return
+	}
+
+	message, err := makeEnvelope(r, requestMessage, receivedAt, client, identity, idempotencyKey)
+	if err != nil {
+		logger.Get().Warning("cannot make envelope", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	// only a failed request can be retried by the same idempotency key
+	if (err != nil || !publish(ctx, w, publisher, message, retryAfter)) && dedupKey != "" {
+		releaseRequest(deduplicator, dedupKey)
+	}
+}
+
+// publish publishes the message, the response is written, if it fails
+// A full queue is answered by 429, a missing engine by 503, both with Retry-After
+func publish(ctx context.Context, w http.ResponseWriter,
+	publisher queue.RedisPublisher, message []byte, retryAfter time.Duration,
+) bool {
+	err := publisher.RequestContext(ctx, message)
+	if err == nil {
+		return true
+	}
+
+	logger.Get().Warning("cannot publish", err)
+	// TODO error message to user
+	switch {
+	case err == queue.ErrQueueFull:
+		rejectedRequests.WithLabelValues("queue_full").Inc()
+		setRetryAfter(w, retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+	case err == queue.ErrNoConsumer:
+		rejectedRequests.WithLabelValues("no_consumer").Inc()
+		setRetryAfter(w, retryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	case ctx.Err() != nil:
+		rejectedRequests.WithLabelValues("timeout").Inc()
+		w.WriteHeader(http.StatusGatewayTimeout)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	return false
+}
+
+// makeEnvelope wraps the request message into an api.Envelope
+func makeEnvelope(r *http.Request, requestMessage api.RequestMessage, receivedAt time.Time,
+	client string, identity *api.Identity, idempotencyKey string,
+) ([]byte, error) {
+	envelope, err := api.NewEnvelope(requestMessage, receivedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	envelope.Client = client
+	envelope.RemoteAddr = remoteIP(r)
+	envelope.TraceParent = r.Header.Get("traceparent")
+	envelope.Identity = identity
+	envelope.IdempotencyKey = idempotencyKey
+
+	return json.Marshal(envelope)
+}
+
+// getIdempotencyKey returns the Idempotency-Key header or the ID of the request message
+func getIdempotencyKey(r *http.Request, requestMessage api.RequestMessage) string {
+	if idempotencyKey := r.Header.Get(IdempotencyKeyHeader); idempotencyKey != "" {
+		return idempotencyKey
+	}
+
+	return requestMessage.ID
+}
+
+// claimRequest claims the idempotency key of the user, the claimed key is returned and true, if it's a duplicate
+// If the deduplicator fails, the request is not deduplicated here (the engine checks it again).
+func claimRequest(ctx context.Context, deduplicator queue.Deduplicator,
+	from string, idempotencyKey string,
+) (string, bool) {
+	if deduplicator == nil || idempotencyKey == "" {
+		return "", false
+	}
+
+	dedupKey := from + ":" + idempotencyKey
+
+	claimed, err := deduplicator.Claim(ctx, dedupKey)
+	if err != nil {
+		logger.Get().Warning("cannot check idempotency key, ", err)
+
+		return "", false
+	}
+	if !claimed {
+		logger.Get().Infof("duplicate request %s", dedupKey)
+		duplicateRequests.Inc()
+
+		return "", true
+	}
+
+	return dedupKey, false
+}
+
+// releaseRequest releases the idempotency key of a failed request, so the client can retry it
+func releaseRequest(deduplicator queue.Deduplicator, dedupKey string) {
+	ctx, cancel := context.WithTimeout(context.Background(), queue.DefaultPublishTimeout)
+	defer cancel()
+
+	if err := deduplicator.Release(ctx, dedupKey); err != nil {
+		logger.Get().Warning("cannot release idempotency key, ", err)
+	}
+}
+
+// remoteIP returns the IP of the remote address
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// authenticate checks the API key and the user (from), the client of the key is returned
+// The response is written, if the request is not allowed.
+func authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	authenticator *apikey.Authenticator, from string,
+) (string, bool) {
+	key, err := authenticator.Authenticate(ctx, r.Header.Get(APIKeyHeader), apikey.ScopeChat)
+	if err == nil && !key.CanSpeakFor(from) {
+		err = apikey.ErrForbidden
+	}
+
+	switch {
+	case err == nil:
+		return key.Client, true
+	case err == apikey.ErrUnauthorized:
+		logger.Get().Warning("invalid API key")
+		rejectedRequests.WithLabelValues("unauthorized").Inc()
+		w.WriteHeader(http.StatusUnauthorized)
+	case err == apikey.ErrForbidden:
+		logger.Get().Warningf("API key %s is not allowed for %s", key.KeyID, from)
+		rejectedRequests.WithLabelValues("forbidden").Inc()
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		logger.Get().Warning("cannot check API key, ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	return "", false
+}
+
+// setRetryAfter sets the Retry-After header in seconds, rounded up, at least 1
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
 }
@@ -2,32 +2,47 @@ package frontend
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/stretchr/testify/assert"
 
 	"github.com/pgillich/chat-bot/api"
 	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/apikey"
 	"github.com/pgillich/chat-bot/internal/db"
+	"github.com/pgillich/chat-bot/internal/jwks"
+	"github.com/pgillich/chat-bot/internal/logger"
 	"github.com/pgillich/chat-bot/internal/queue"
 	"github.com/pgillich/chat-bot/internal/test"
 	"github.com/pgillich/chat-bot/pkg/engine"
 )
 
+func TestMain(m *testing.M) {
+	logger.Init(test.GetLogLevel())
+
+	exitVal := m.Run()
+
+	os.Exit(exitVal)
+}
+
 func buildServerFrontend(idleConnsClosed chan struct{},
 	publisher queue.RedisPublisher,
 ) *httptest.Server {
 	return httptest.NewServer(App(idleConnsClosed,
 		publisher,
-		config.DefaultChatPath,
+		config.DefaultChatPath, test.GetRequestTimeout(), time.Second, nil, nil, nil, nil, nil,
 		test.GetLogLevel()))
 }
 
@@ -36,8 +51,16 @@ func buildServerEngine(idleConnsClosed chan struct{},
 	httpClient *http.Client,
 ) *httptest.Server {
 	return httptest.NewServer(engine.App(idleConnsClosed,
-		subscriber, dbHandler, httpClient,
-		"../../"+config.DefaultRsaKey, config.DefaultClientEndpoint,
+		subscriber, dbHandler, &queue.FakeLocker{Store: &queue.FakeLockStore{}}, httpClient,
+		&jwks.SigningKeys{Path: "../../" + config.DefaultRsaKey}, engine.TokenOptions{},
+		&engine.CallbackRouter{
+			Routes:  dbHandler,
+			Default: &engine.ClientEndpoint{URL: config.DefaultClientEndpoint, Auth: engine.CallbackAuthJWT},
+		},
+		engine.CallbackPolicy{Attempts: 1},
+		engine.OutboxPolicy{PollInterval: 20 * time.Millisecond, Lease: time.Minute, Concurrency: 4},
+		test.GetMessageTimeout(), true,
+		engine.RetentionPolicy{},
 		test.GetLogLevel()))
 }
 
@@ -100,10 +123,10 @@ func (fakeTansport *FakeTransport) ResetReqBodies() {
 
 func testE2E(t *testing.T, uid string, messagePairs []test.MessagePair) {
 	fakeRedis := &queue.FakeRedis{}
-	defer fakeRedis.Close()
-
-	publisher := fakeRedis
-	subscriber := fakeRedis
+	publisher := &queue.FakeRedisPublisher{Redis: fakeRedis}
+	defer publisher.Close()
+	subscriber := &queue.FakeRedisSubscriber{Redis: fakeRedis}
+	defer subscriber.Close()
 
 	dbHandler := &db.FakeDbHandler{}
 	defer dbHandler.Close()
@@ -155,8 +178,11 @@ func testE2E(t *testing.T, uid string, messagePairs []test.MessagePair) {
 		for r, expectedResponse := range messagePair.Responses {
 			assert.Equal(t, expectedResponse.Response.To, uid, fmt.Sprintf("To #%d/%d", m, r))
 
-			responseBytes, _ := json.Marshal(api.ResponseMessage{To: uid, Text: expectedResponse.Response.Text}) // nolint:errcheck
-			assert.Equal(t, string(responseBytes), reqBodies[r], fmt.Sprintf("Text #%d/%d", m, r))
+			response := api.ResponseMessage{}
+			assert.NoError(t, json.Unmarshal([]byte(reqBodies[r]), &response), fmt.Sprintf("Body #%d/%d", m, r))
+			assert.NotEmpty(t, response.ID, fmt.Sprintf("ID #%d/%d", m, r))
+			assert.Equal(t, uid, response.To, fmt.Sprintf("To #%d/%d", m, r))
+			assert.Equal(t, expectedResponse.Response.Text, response.Text, fmt.Sprintf("Text #%d/%d", m, r))
 		}
 	}
 }
@@ -176,3 +202,242 @@ func TestJaneDoeE2E(t *testing.T) {
 	testE2E(t, uid, messagePairs)
 	testE2E(t, uid, messagePairs)
 }
+
+func TestQueueFull(t *testing.T) {
+	publisher, subscriber := connectFakeRedis(t, 0)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	idleConnsClosed := make(chan struct{}, 1)
+	defer close(idleConnsClosed)
+
+	frontendServer := buildServerFrontend(idleConnsClosed, publisher)
+	defer frontendServer.Close()
+
+	requestBody, _ := json.Marshal(api.RequestMessage{From: "005", Text: "Hello"}) // nolint:errcheck
+
+	// Nobody receives, so the queue becomes full
+	statusCode, retryAfter := http.StatusOK, ""
+	for m := 0; m < 100 && statusCode == http.StatusOK; m++ {
+		resp, err := post(frontendServer, string(requestBody))
+		if !assert.NoError(t, err, "POST") {
+			return
+		}
+		resp.Body.Close() // nolint:errcheck,gosec
+
+		statusCode, retryAfter = resp.StatusCode, resp.Header.Get("Retry-After")
+	}
+
+	assert.Equal(t, http.StatusTooManyRequests, statusCode, "Status")
+	assert.Equal(t, "1", retryAfter, "Retry-After")
+}
+
+// connectFakeRedis connects a publisher and a subscriber on a new FakeRedis, they must be closed
+func connectFakeRedis(t *testing.T, maxDepth int) (*queue.FakeRedisPublisher, *queue.FakeRedisSubscriber) {
+	fakeRedis := &queue.FakeRedis{MaxDepth: maxDepth}
+	publisher := &queue.FakeRedisPublisher{Redis: fakeRedis}
+	subscriber := &queue.FakeRedisSubscriber{Redis: fakeRedis}
+
+	if err := subscriber.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.Connect(); err != nil {
+		subscriber.Close()
+		t.Fatal(err)
+	}
+
+	return publisher, subscriber
+}
+
+// connectNoConsumer connects a publisher without subscribers, it must be closed
+func connectNoConsumer(t *testing.T) *queue.FakeRedisPublisher {
+	publisher := &queue.FakeRedisPublisher{Redis: &queue.FakeRedis{}}
+	if err := publisher.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	return publisher
+}
+
+func TestNoConsumer(t *testing.T) {
+	publisher := connectNoConsumer(t)
+	defer publisher.Close()
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBufferString(`{}`))
+	Handler(recorder, request, publisher, test.GetRequestTimeout(), 1500*time.Millisecond, nil, nil, nil, nil)
+
+	assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "Status")
+	assert.Equal(t, "2", recorder.Header().Get("Retry-After"), "Retry-After")
+}
+
+func TestAPIKey(t *testing.T) {
+	publisher, subscriber := connectFakeRedis(t, 100)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	keys := &db.FakeDbHandler{}
+	if err := keys.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Close()
+
+	ctx := context.Background()
+	authenticator := &apikey.Authenticator{Keys: keys}
+	acmeKey, _, err := apikey.Create(ctx, keys, "acme", "acme-*", apikey.ScopeChat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminKey, _, err := apikey.Create(ctx, keys, "admin", "*", "admin", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := &queue.FakeRateLimiter{Store: &queue.FakeRateStore{}}
+	if err := limiter.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer limiter.Close()
+
+	// the client of the key is limited, not the header
+	rateLimits := &RateLimits{
+		Limiter:        limiter,
+		Tiers:          map[string]queue.Limit{DefaultTier: {Rate: 0.001, Burst: 2}},
+		ClientIDHeader: "X-Client-Id",
+	}
+
+	for n, expected := range []struct {
+		key    string
+		from   string
+		status int
+	}{
+		{"", "acme-001", http.StatusUnauthorized},
+		{"cb_unknown_secret", "acme-001", http.StatusUnauthorized},
+		{adminKey, "acme-001", http.StatusForbidden},
+		{acmeKey, "other-001", http.StatusForbidden},
+		{acmeKey, "", http.StatusForbidden},
+		{acmeKey, "acme-001", http.StatusOK},
+		{acmeKey, "acme-002", http.StatusOK},
+		{acmeKey, "acme-003", http.StatusTooManyRequests},
+	} {
+		requestBody, _ := json.Marshal(api.RequestMessage{From: expected.from, Text: "Hello"}) // nolint:errcheck
+		request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBuffer(requestBody))
+		if expected.key != "" {
+			request.Header.Set(APIKeyHeader, expected.key)
+		}
+		request.Header.Set("X-Client-Id", fmt.Sprintf("client-%d", n))
+
+		recorder := httptest.NewRecorder()
+		Handler(recorder, request, publisher, test.GetRequestTimeout(), 0, rateLimits, authenticator, nil, nil)
+
+		assert.Equal(t, expected.status, recorder.Code, fmt.Sprintf("Status #%d", n))
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	publisher, subscriber := connectFakeRedis(t, 100)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath,
+		bytes.NewBufferString(`{"from":"001","text":"Hello"}`))
+	request.Header.Set("traceparent", traceParent)
+
+	recorder := httptest.NewRecorder()
+	Handler(recorder, request, publisher, test.GetRequestTimeout(), 0, nil, nil, nil, nil)
+	assert.Equal(t, http.StatusOK, recorder.Code, "Status")
+
+	ctx, cancel := context.WithTimeout(context.Background(), test.GetRequestTimeout())
+	defer cancel()
+
+	if message, is := subscriber.ReceiveContext(ctx).(redis.Message); assert.True(t, is, "published") {
+		envelope, err := api.ParseEnvelope(message.Data)
+		if assert.NoError(t, err, "ParseEnvelope") {
+			assert.Equal(t, api.EnvelopeVersion, envelope.Version, "Version")
+			assert.Len(t, envelope.ID, 36, "ID")
+			assert.WithinDuration(t, time.Now(), envelope.ReceivedAt, time.Minute, "ReceivedAt")
+			assert.Equal(t, "192.0.2.1", envelope.RemoteAddr, "RemoteAddr")
+			assert.Equal(t, traceParent, envelope.TraceParent, "TraceParent")
+			assert.Equal(t, 1, envelope.Attempt, "Attempt")
+			assert.Equal(t, api.RequestMessage{From: "001", Text: "Hello"}, envelope.Payload, "Payload")
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBufferString(`{`)),
+		publisher, test.GetRequestTimeout(), 0, nil, nil, nil, nil)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code, "Status of invalid message")
+}
+
+func TestIdempotency(t *testing.T) {
+	publisher, subscriber := connectFakeRedis(t, 100)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	deduplicator := &queue.FakeDeduplicator{Store: &queue.FakeDedupStore{}}
+	if err := deduplicator.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer deduplicator.Close()
+
+	send := func(publisher queue.RedisPublisher, idempotencyKey string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBufferString(body))
+		if idempotencyKey != "" {
+			request.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+		}
+
+		recorder := httptest.NewRecorder()
+		Handler(recorder, request, publisher, test.GetRequestTimeout(), 0, nil, nil, nil, deduplicator)
+
+		return recorder
+	}
+
+	published := func() []string {
+		keys := []string{}
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			message, is := subscriber.ReceiveContext(ctx).(redis.Message)
+			cancel()
+			if !is {
+				return keys
+			}
+
+			envelope, err := api.ParseEnvelope(message.Data)
+			if assert.NoError(t, err, "ParseEnvelope") {
+				keys = append(keys, envelope.IdempotencyKey)
+			}
+		}
+	}
+
+	for n, expected := range []struct {
+		idempotencyKey string
+		body           string
+		replayed       string
+	}{
+		{"a", `{"from":"001","text":"Hello"}`, ""},
+		{"a", `{"from":"001","text":"Hello"}`, "true"},
+		{"", `{"id":"a","from":"001","text":"Hello"}`, "true"},
+		{"a", `{"from":"002","text":"Hello"}`, ""}, // other user
+		{"", `{"id":"b","from":"001","text":"Hello"}`, ""},
+		{"", `{"from":"001","text":"Hello"}`, ""},
+		{"", `{"from":"001","text":"Hello"}`, ""},
+	} {
+		recorder := send(publisher, expected.idempotencyKey, expected.body)
+		assert.Equal(t, http.StatusOK, recorder.Code, fmt.Sprintf("Status #%d", n))
+		assert.Equal(t, expected.replayed, recorder.Header().Get(ReplayedHeader), fmt.Sprintf("Replayed #%d", n))
+	}
+	assert.Equal(t, []string{"a", "a", "b", "", ""}, published(), "published")
+
+	// a failed request can be retried
+	noConsumer := connectNoConsumer(t)
+	defer noConsumer.Close()
+	assert.Equal(t, http.StatusServiceUnavailable,
+		send(noConsumer, "c", `{"from":"001","text":"Hello"}`).Code, "Status of failed")
+	assert.Equal(t, "", send(publisher, "c", `{"from":"001","text":"Hello"}`).Header().Get(ReplayedHeader),
+		"Replayed of retry")
+	assert.Equal(t, []string{"c"}, published(), "published retry")
+
+	assert.Equal(t, http.StatusBadRequest,
+		send(publisher, strings.Repeat("x", 256), `{"from":"001","text":"Hello"}`).Code, "Status of too long key")
+}
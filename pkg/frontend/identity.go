@@ -0,0 +1,90 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/jwks"
+	"github.com/pgillich/chat-bot/internal/logger"
+)
+
+const (
+	// UserJWTModeFill fills From by the subject of the token
+	UserJWTModeFill = "fill"
+	// UserJWTModeMatch rejects the request, if From differs from the subject of the token
+	UserJWTModeMatch = "match"
+)
+
+// UserJWT verifies the end-user JWT (Authorization: Bearer) and binds From to its subject
+type UserJWT struct {
+	Verifier *jwks.Verifier
+	// Mode is UserJWTModeFill or UserJWTModeMatch
+	Mode string
+}
+
+// ParseUserJWTMode checks the mode
+func ParseUserJWTMode(mode string) (string, error) {
+	switch mode {
+	case UserJWTModeFill, UserJWTModeMatch:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid user JWT mode: %s", mode)
+	}
+}
+
+// bearerToken returns the bearer token of the Authorization header
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(parts[1])
+}
+
+// verifyUser verifies the bearer token, binds From to the subject and returns the identity
+// The response is written, if the request is not allowed.
+func verifyUser(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	userJWT *UserJWT, requestMessage *api.RequestMessage,
+) (*api.Identity, bool) {
+	tokenString := bearerToken(r)
+	if tokenString == "" {
+		logger.Get().Warning("missing user JWT")
+		rejectedRequests.WithLabelValues("unauthorized").Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return nil, false
+	}
+
+	claims, err := userJWT.Verifier.Verify(ctx, tokenString)
+	if err != nil {
+		logger.Get().Warning("invalid user JWT, ", err)
+		rejectedRequests.WithLabelValues("unauthorized").Inc()
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+
+		return nil, false
+	}
+
+	if userJWT.Mode == UserJWTModeFill {
+		requestMessage.From = claims.Subject
+	} else if requestMessage.From != claims.Subject {
+		logger.Get().Warningf("user JWT subject %s does not match %s", claims.Subject, requestMessage.From)
+		rejectedRequests.WithLabelValues("forbidden").Inc()
+		w.WriteHeader(http.StatusForbidden)
+
+		return nil, false
+	}
+
+	return &api.Identity{
+		Subject:    claims.Subject,
+		Issuer:     claims.Issuer,
+		Method:     "jwt",
+		VerifiedAt: time.Now().UTC(),
+	}, true
+}
@@ -0,0 +1,143 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/jwks"
+	"github.com/pgillich/chat-bot/internal/test"
+)
+
+// makeUserJWT stores the JWKS of a new user key in dir, and returns its verifier and a token signer
+func makeUserJWT(t *testing.T, dir string) (*jwks.Verifier, func(subject string) string) {
+	signKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonKey, err := jwks.NewJSONWebKey("user-1", signKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keySet, _ := json.Marshal(jwks.JSONWebKeySet{Keys: []jwks.JSONWebKey{jsonKey}}) // nolint:errcheck
+
+	jwksPath := filepath.Join(dir, "jwks.json")
+	if err := ioutil.WriteFile(jwksPath, keySet, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(subject string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"sub": subject, "exp": time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "user-1"
+		tokenString, err := token.SignedString(signKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return tokenString
+	}
+
+	return &jwks.Verifier{Keys: &jwks.Source{Location: jwksPath}}, sign
+}
+
+func TestUserJWT(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chat-bot-jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint:errcheck
+
+	verifier, sign := makeUserJWT(t, dir)
+	tokenString := sign("001")
+
+	publisher, subscriber := connectFakeRedis(t, 100)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	for n, expected := range []struct {
+		mode          string
+		authorization string
+		from          string
+		status        int
+	}{
+		{UserJWTModeFill, "", "001", http.StatusUnauthorized},
+		{UserJWTModeFill, "Bearer invalid", "001", http.StatusUnauthorized},
+		{UserJWTModeFill, "Bearer " + tokenString, "002", http.StatusOK},
+		{UserJWTModeFill, "bearer " + tokenString, "", http.StatusOK},
+		{UserJWTModeMatch, "Bearer " + tokenString, "002", http.StatusForbidden},
+		{UserJWTModeMatch, "Bearer " + tokenString, "001", http.StatusOK},
+	} {
+		requestBody, _ := json.Marshal(api.RequestMessage{From: expected.from, Text: "Hello"}) // nolint:errcheck
+		request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBuffer(requestBody))
+		if expected.authorization != "" {
+			request.Header.Set("Authorization", expected.authorization)
+		}
+
+		recorder := httptest.NewRecorder()
+		Handler(recorder, request, publisher, test.GetRequestTimeout(), 0, nil, nil,
+			&UserJWT{Verifier: verifier, Mode: expected.mode}, nil)
+
+		if !assert.Equal(t, expected.status, recorder.Code, fmt.Sprintf("Status #%d", n)) ||
+			expected.status != http.StatusOK {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.GetRequestTimeout())
+		message, is := subscriber.ReceiveContext(ctx).(redis.Message)
+		cancel()
+		if !assert.True(t, is, fmt.Sprintf("published #%d", n)) {
+			continue
+		}
+
+		published, err := api.ParseEnvelope(message.Data)
+		if assert.NoError(t, err, fmt.Sprintf("ParseEnvelope #%d", n)) {
+			assert.Equal(t, "001", published.Payload.From, fmt.Sprintf("From #%d", n))
+			if assert.NotNil(t, published.Identity, fmt.Sprintf("Identity #%d", n)) {
+				assert.Equal(t, "001", published.Identity.Subject, fmt.Sprintf("Subject #%d", n))
+				assert.Equal(t, "jwt", published.Identity.Method, fmt.Sprintf("Method #%d", n))
+			}
+		}
+	}
+}
+
+func TestForgedIdentity(t *testing.T) {
+	publisher, subscriber := connectFakeRedis(t, 100)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	requestBody := `{"from":"001","text":"Hello","identity":{"sub":"001","method":"jwt"}}`
+	recorder := httptest.NewRecorder()
+	Handler(recorder, httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBufferString(requestBody)),
+		publisher, test.GetRequestTimeout(), 0, nil, nil, nil, nil)
+	assert.Equal(t, http.StatusOK, recorder.Code, "Status")
+
+	ctx, cancel := context.WithTimeout(context.Background(), test.GetRequestTimeout())
+	defer cancel()
+
+	if message, is := subscriber.ReceiveContext(ctx).(redis.Message); assert.True(t, is, "published") {
+		published, err := api.ParseEnvelope(message.Data)
+		if assert.NoError(t, err, "ParseEnvelope") {
+			assert.Equal(t, "001", published.Payload.From, "From")
+			assert.Nil(t, published.Identity, "Identity of the client is not trusted")
+		}
+	}
+}
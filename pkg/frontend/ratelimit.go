@@ -0,0 +1,191 @@
+package frontend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/internal/logger"
+	"github.com/pgillich/chat-bot/internal/queue"
+)
+
+// DefaultTier is the tier of the clients, which are not listed in RateLimits.ClientTiers
+const DefaultTier = "default"
+
+const (
+	reasonClientRateLimit = "client_rate_limit"
+	reasonUserRateLimit   = "user_rate_limit"
+)
+
+// RateLimits are the token bucket limits of the users (RequestMessage.From) and the clients
+type RateLimits struct {
+	Limiter queue.RateLimiter
+	// User is the limit of a user, disabled, if Rate is 0
+	User queue.Limit
+	// Tiers are the limits of the client tiers, a client is not limited, if its tier is not listed
+	Tiers map[string]queue.Limit
+	// ClientTiers are the tiers of the clients, DefaultTier, if a client is not listed
+	ClientTiers map[string]string
+	// ClientIDHeader is the header of the client ID, set by a trusted proxy, empty disables it
+	// It's used only for the requests without API key and user JWT.
+	ClientIDHeader string
+}
+
+// ParseLimit parses a limit in <rate per second>:<burst> format, empty or "0" disables the limit
+func ParseLimit(text string) (queue.Limit, error) {
+	if text == "" || text == "0" {
+		return queue.Limit{}, nil
+	}
+
+	parts := strings.Split(text, ":")
+	if len(parts) != 2 {
+		return queue.Limit{}, fmt.Errorf("invalid rate limit: %s", text)
+	}
+
+	rate, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || rate <= 0 {
+		return queue.Limit{}, fmt.Errorf("invalid rate of rate limit: %s", text)
+	}
+
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil || burst < 1 {
+		return queue.Limit{}, fmt.Errorf("invalid burst of rate limit: %s", text)
+	}
+
+	return queue.Limit{Rate: rate, Burst: burst}, nil
+}
+
+// ParseRateLimits parses the user limit (<rate>:<burst>), the tiers (<tier>=<rate>:<burst>, comma separated)
+// and the client tiers (<client ID>=<tier>, comma separated)
+// nil is returned, if no limit is set
+func ParseRateLimits(user string, tiers string, clientTiers string) (*RateLimits, error) {
+	rateLimits := &RateLimits{Tiers: map[string]queue.Limit{}, ClientTiers: map[string]string{}}
+
+	var err error
+	if rateLimits.User, err = ParseLimit(user); err != nil {
+		return nil, err
+	}
+
+	for name, text := range parsePairs(tiers) {
+		limit, err := ParseLimit(text)
+		if err != nil {
+			return nil, fmt.Errorf("tier %s: %s", name, err)
+		}
+		if limit.Rate > 0 {
+			rateLimits.Tiers[name] = limit
+		}
+	}
+
+	for client, tier := range parsePairs(clientTiers) {
+		if _, has := rateLimits.Tiers[tier]; !has {
+			return nil, fmt.Errorf("unknown tier of client %s: %s", client, tier)
+		}
+		rateLimits.ClientTiers[client] = tier
+	}
+
+	if rateLimits.User.Rate == 0 && len(rateLimits.Tiers) == 0 {
+		return nil, nil
+	}
+
+	return rateLimits, nil
+}
+
+// parsePairs parses comma separated <name>=<value> pairs
+func parsePairs(text string) map[string]string {
+	pairs := map[string]string{}
+	for _, pair := range strings.Split(text, ",") {
+		if parts := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(parts) == 2 {
+			pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	return pairs
+}
+
+// clientID returns the bucket key and the tier ID of the client
+// The client is identified by the authenticated client (API key), the verified user (JWT subject),
+// the client ID header (if it's enabled) or the remote IP, in this order. The remote IPs are in the default tier.
+func (rateLimits *RateLimits) clientID(r *http.Request, client string, identity *api.Identity) (string, string) {
+	if client != "" {
+		return "client:" + client, client
+	}
+
+	if identity != nil && identity.Subject != "" {
+		return "subject:" + identity.Subject, identity.Subject
+	}
+
+	if rateLimits.ClientIDHeader != "" {
+		if clientID := r.Header.Get(rateLimits.ClientIDHeader); clientID != "" {
+			return "client:" + clientID, clientID
+		}
+	}
+
+	return "ip:" + remoteIP(r), ""
+}
+
+// Check takes a token from the buckets of the client and the user (from)
+// client is the authenticated client (API key) and identity is the verified user (JWT), if they are set.
+// The rate limit headers are set by the most restrictive bucket.
+// The reason of the rejection is returned, or empty, if the request is allowed.
+// The request is allowed, if the limiter fails.
+func (rateLimits *RateLimits) Check(ctx context.Context, w http.ResponseWriter, r *http.Request,
+	client string, identity *api.Identity, from string,
+) string {
+	type bucket struct {
+		key    string
+		limit  queue.Limit
+		reason string
+	}
+
+	buckets := []bucket{}
+	clientKey, clientID := rateLimits.clientID(r, client, identity)
+	tier, has := rateLimits.ClientTiers[clientID]
+	if !has || clientID == "" {
+		tier = DefaultTier
+	}
+	if limit, has := rateLimits.Tiers[tier]; has {
+		buckets = append(buckets, bucket{key: clientKey, limit: limit, reason: reasonClientRateLimit})
+	}
+	if rateLimits.User.Rate > 0 && from != "" {
+		buckets = append(buckets, bucket{key: "user:" + from, limit: rateLimits.User, reason: reasonUserRateLimit})
+	}
+
+	var restrictive *queue.RateLimitResult
+	restrictiveLimit := queue.Limit{}
+	for _, b := range buckets {
+		result, err := rateLimits.Limiter.Allow(ctx, b.key, b.limit)
+		if err != nil {
+			logger.Get().Warning("cannot check rate limit, ", err)
+
+			continue
+		}
+
+		if restrictive == nil || result.Remaining < restrictive.Remaining {
+			restrictive, restrictiveLimit = &result, b.limit
+		}
+
+		if !result.Allowed {
+			setRateLimitHeaders(w, restrictiveLimit, *restrictive)
+			setRetryAfter(w, result.RetryAfter)
+
+			return b.reason
+		}
+	}
+
+	if restrictive != nil {
+		setRateLimitHeaders(w, restrictiveLimit, *restrictive)
+	}
+
+	return ""
+}
+
+// setRateLimitHeaders sets the RateLimit-* headers (IETF draft), Reset is in seconds, rounded up
+func setRateLimitHeaders(w http.ResponseWriter, limit queue.Limit, result queue.RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+}
@@ -0,0 +1,135 @@
+package frontend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/api"
+	"github.com/pgillich/chat-bot/config"
+	"github.com/pgillich/chat-bot/internal/queue"
+	"github.com/pgillich/chat-bot/internal/test"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	rateLimits, err := ParseRateLimits("0.5:2", "default=1:3, premium=10:50", "acme=premium")
+	if assert.NoError(t, err, "ParseRateLimits") {
+		assert.Equal(t, queue.Limit{Rate: 0.5, Burst: 2}, rateLimits.User, "User")
+		assert.Equal(t, map[string]queue.Limit{
+			"default": {Rate: 1, Burst: 3}, "premium": {Rate: 10, Burst: 50},
+		}, rateLimits.Tiers, "Tiers")
+		assert.Equal(t, map[string]string{"acme": "premium"}, rateLimits.ClientTiers, "ClientTiers")
+	}
+
+	rateLimits, err = ParseRateLimits("0", "", "")
+	assert.NoError(t, err, "ParseRateLimits disabled")
+	assert.Nil(t, rateLimits, "disabled")
+
+	for _, invalid := range [][]string{
+		{"1", "", ""}, {"x:1", "", ""}, {"1:0", "", ""}, {"", "default=1", ""}, {"", "default=1:1", "acme=premium"},
+	} {
+		_, err := ParseRateLimits(invalid[0], invalid[1], invalid[2])
+		assert.Error(t, err, fmt.Sprintf("ParseRateLimits %v", invalid))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	publisher, subscriber := connectFakeRedis(t, 100)
+	defer subscriber.Close()
+	defer publisher.Close()
+
+	limiter := &queue.FakeRateLimiter{Store: &queue.FakeRateStore{}}
+	if err := limiter.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer limiter.Close()
+
+	// the buckets are not refilled during the test
+	rateLimits := &RateLimits{
+		Limiter: limiter,
+		User:    queue.Limit{Rate: 0.001, Burst: 2},
+		Tiers: map[string]queue.Limit{
+			DefaultTier: {Rate: 0.001, Burst: 3},
+			"premium":   {Rate: 0.001, Burst: 5},
+		},
+		ClientTiers:    map[string]string{"acme": "premium"},
+		ClientIDHeader: "X-Client-Id",
+	}
+
+	send := func(clientID string, from string) *httptest.ResponseRecorder {
+		requestBody, _ := json.Marshal(api.RequestMessage{From: from, Text: "Hello"}) // nolint:errcheck
+		request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath, bytes.NewBuffer(requestBody))
+		if clientID != "" {
+			request.Header.Set("X-Client-Id", clientID)
+		}
+
+		recorder := httptest.NewRecorder()
+		Handler(recorder, request, publisher, test.GetRequestTimeout(), 0, rateLimits, nil, nil, nil)
+
+		return recorder
+	}
+
+	// the remote IP is the client of the default tier
+	for n, expected := range []struct {
+		from      string
+		status    int
+		remaining string
+	}{
+		{"001", http.StatusOK, "1"},
+		{"001", http.StatusOK, "0"},
+		{"001", http.StatusTooManyRequests, "0"}, // user limit
+		{"002", http.StatusTooManyRequests, "0"}, // client limit
+	} {
+		recorder := send("", expected.from)
+		assert.Equal(t, expected.status, recorder.Code, fmt.Sprintf("Status #%d", n))
+		assert.Equal(t, expected.remaining, recorder.Header().Get("RateLimit-Remaining"), fmt.Sprintf("Remaining #%d", n))
+		if expected.status == http.StatusTooManyRequests {
+			assert.NotEmpty(t, recorder.Header().Get("Retry-After"), fmt.Sprintf("Retry-After #%d", n))
+		}
+	}
+
+	// the premium client has bigger burst, the headers are set by the most restrictive bucket
+	for n := 0; n < 5; n++ {
+		recorder := send("acme", fmt.Sprintf("1%02d", n))
+		assert.Equal(t, http.StatusOK, recorder.Code, fmt.Sprintf("Status of premium #%d", n))
+
+		if n == 0 {
+			assert.Equal(t, "2", recorder.Header().Get("RateLimit-Limit"), "Limit of user")
+		} else if n == 4 {
+			assert.Equal(t, "5", recorder.Header().Get("RateLimit-Limit"), "Limit of premium")
+		}
+	}
+	assert.Equal(t, http.StatusTooManyRequests, send("acme", "200").Code, "Status of premium over burst")
+}
+
+// TestRateLimitClientID checks, that the client ID header is not trusted, if it's not enabled,
+// and the authenticated identities have own buckets
+func TestRateLimitClientID(t *testing.T) {
+	rateLimits := &RateLimits{ClientTiers: map[string]string{"acme": "premium"}}
+
+	request := httptest.NewRequest(http.MethodPost, config.DefaultChatPath, nil)
+	request.Header.Set("X-Client-Id", "acme")
+
+	key, clientID := rateLimits.clientID(request, "", nil)
+	assert.Equal(t, "ip:"+remoteIP(request), key, "key of spoofed header")
+	assert.Equal(t, "", clientID, "tier of spoofed header")
+
+	key, clientID = rateLimits.clientID(request, "", &api.Identity{Subject: "acme"})
+	assert.Equal(t, "subject:acme", key, "key of JWT subject")
+	assert.Equal(t, "acme", clientID, "tier of JWT subject")
+
+	key, clientID = rateLimits.clientID(request, "acme", &api.Identity{Subject: "001"})
+	assert.Equal(t, "client:acme", key, "key of API key")
+	assert.Equal(t, "acme", clientID, "tier of API key")
+
+	rateLimits.ClientIDHeader = "X-Client-Id"
+	key, clientID = rateLimits.clientID(request, "", nil)
+	assert.Equal(t, "client:acme", key, "key of enabled header")
+	assert.Equal(t, "acme", clientID, "tier of enabled header")
+}
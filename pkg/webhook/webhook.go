@@ -0,0 +1,157 @@
+// Package webhook signs and verifies the callbacks of the engine by HMAC-SHA256
+//
+// It's an alternative to the JWT authentication for the receivers, which cannot verify RSA or EC signatures.
+// The X-Signature header has the form of t=<Unix time>,v1=<hex HMAC-SHA256 of "<Unix time>.<body>">,
+// so the signature covers the body and the time of the signing. The receiver rejects the callback,
+// if the signature does not match, or the timestamp is out of the tolerance window (replay).
+//
+// A receiver can use Verifier:
+//
+//	verifier := &webhook.Verifier{Secret: []byte(secret)}
+//	body, err := verifier.VerifyRequest(r)
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SignatureHeader is the HTTP header of the signature
+	SignatureHeader = "X-Signature"
+	// DefaultTolerance is the max difference of the timestamp and the current time, if Verifier.Tolerance is not set
+	DefaultTolerance = 5 * time.Minute
+
+	signatureVersion = "v1"
+)
+
+var (
+	// ErrMissingSignature is returned, if the signature header is missing or it has no v1 signature
+	ErrMissingSignature = errors.New("missing signature") // nolint:gochecknoglobals
+	// ErrInvalidSignature is returned, if no signature matches
+	ErrInvalidSignature = errors.New("invalid signature") // nolint:gochecknoglobals
+	// ErrInvalidTimestamp is returned, if the timestamp is missing or out of the tolerance window
+	ErrInvalidTimestamp = errors.New("invalid timestamp") // nolint:gochecknoglobals
+)
+
+// Sign returns the signature header value of the body, signed at timestamp
+func Sign(secret []byte, timestamp time.Time, body []byte) string {
+	unix := strconv.FormatInt(timestamp.Unix(), 10)
+
+	return "t=" + unix + "," + signatureVersion + "=" + hex.EncodeToString(mac(secret, unix, body))
+}
+
+// SignRequest sets the signature header of the request
+func SignRequest(req *http.Request, secret []byte, timestamp time.Time, body []byte) {
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+}
+
+func mac(secret []byte, unix string, body []byte) []byte {
+	hash := hmac.New(sha256.New, secret)
+	hash.Write([]byte(unix + ".")) // nolint:errcheck,gosec
+	hash.Write(body)               // nolint:errcheck,gosec
+
+	return hash.Sum(nil)
+}
+
+// Verifier verifies the signatures by Secret
+type Verifier struct {
+	Secret []byte
+	// Tolerance is the max difference of the timestamp and the current time, DefaultTolerance if not set
+	Tolerance time.Duration
+	// Now returns the current time, time.Now if not set
+	Now func() time.Time
+}
+
+// Verify verifies the signature header value of the body
+// More v1 signatures are accepted, if one of them matches (for example, at secret rotation).
+func (verifier *Verifier) Verify(signature string, body []byte) error {
+	unix := ""
+	signatures := [][]byte{}
+
+	for _, item := range strings.Split(signature, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		switch parts[0] {
+		case "t":
+			unix = parts[1]
+		case signatureVersion:
+			if value, err := hex.DecodeString(parts[1]); err == nil {
+				signatures = append(signatures, value)
+			}
+		}
+	}
+
+	if len(signatures) == 0 {
+		return ErrMissingSignature
+	}
+
+	if err := verifier.checkTimestamp(unix); err != nil {
+		return err
+	}
+
+	expected := mac(verifier.Secret, unix, body)
+	for _, value := range signatures {
+		if hmac.Equal(value, expected) {
+			return nil
+		}
+	}
+
+	return ErrInvalidSignature
+}
+
+func (verifier *Verifier) checkTimestamp(unix string) error {
+	seconds, err := strconv.ParseInt(unix, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+
+	tolerance := verifier.Tolerance
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+
+	now := time.Now
+	if verifier.Now != nil {
+		now = verifier.Now
+	}
+
+	diff := now().Sub(time.Unix(seconds, 0))
+	if diff > tolerance || diff < -tolerance {
+		return ErrInvalidTimestamp
+	}
+
+	return nil
+}
+
+// VerifyRequest verifies the signature header of the request and returns the body
+// The body of the request is restored, so it can be read again.
+func (verifier *Verifier) VerifyRequest(r *http.Request) ([]byte, error) {
+	signature := r.Header.Get(SignatureHeader)
+	if signature == "" {
+		return nil, ErrMissingSignature
+	}
+
+	body := []byte{}
+	if r.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+		r.Body.Close() // nolint:errcheck,gosec
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, verifier.Verify(signature, body)
+}
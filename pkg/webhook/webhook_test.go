@@ -0,0 +1,66 @@
+package webhook_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/pgillich/chat-bot/pkg/webhook"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"to":"001","text":"Hello"}`)
+	now := time.Unix(1590000000, 0)
+	verifier := &webhook.Verifier{Secret: secret, Tolerance: time.Minute, Now: func() time.Time { return now }}
+
+	signature := webhook.Sign(secret, now, body)
+	assert.Regexp(t, `^t=1590000000,v1=[0-9a-f]{64}$`, signature, "Sign")
+	assert.NoError(t, verifier.Verify(signature, body), "Verify")
+	assert.NoError(t, verifier.Verify(webhook.Sign(secret, now.Add(-59*time.Second), body), body), "Verify in tolerance")
+	assert.NoError(t, verifier.Verify(webhook.Sign([]byte("old"), now, body)+
+		",v1="+signature[len("t=1590000000,v1="):], body), "Verify more signatures")
+
+	for name, expected := range map[string]struct {
+		signature string
+		body      []byte
+		err       error
+	}{
+		"tampered body": {signature, []byte(`{"to":"002","text":"Hello"}`), webhook.ErrInvalidSignature},
+		"other secret":  {webhook.Sign([]byte("other"), now, body), body, webhook.ErrInvalidSignature},
+		"old":           {webhook.Sign(secret, now.Add(-2*time.Minute), body), body, webhook.ErrInvalidTimestamp},
+		"future":        {webhook.Sign(secret, now.Add(2*time.Minute), body), body, webhook.ErrInvalidTimestamp},
+		"replaced time": {"t=1590000001" + signature[len("t=1590000000"):], body, webhook.ErrInvalidSignature},
+		"no timestamp":  {signature[len("t=1590000000,"):], body, webhook.ErrInvalidTimestamp},
+		"no signature":  {"t=1590000000", body, webhook.ErrMissingSignature},
+		"garbage":       {"garbage", body, webhook.ErrMissingSignature},
+	} {
+		assert.Equal(t, expected.err, verifier.Verify(expected.signature, expected.body), name)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"to":"001","text":"Hello"}`)
+	verifier := &webhook.Verifier{Secret: secret}
+
+	request := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	webhook.SignRequest(request, secret, time.Now(), body)
+
+	verified, err := verifier.VerifyRequest(request)
+	if assert.NoError(t, err, "VerifyRequest") {
+		assert.Equal(t, body, verified, "body")
+	}
+	again, err := ioutil.ReadAll(request.Body)
+	if assert.NoError(t, err, "ReadAll") {
+		assert.Equal(t, body, again, "restored body")
+	}
+
+	_, err = verifier.VerifyRequest(httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	assert.Equal(t, webhook.ErrMissingSignature, err, "unsigned")
+}